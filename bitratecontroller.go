@@ -0,0 +1,266 @@
+package main
+
+/*
+ * Bitrate controllers (listener side)
+ *
+ * a controller is fed with the RTCP feedback of a listener (REMB, receiver
+ * report loss & jitter, RTT) and decides the target bitrate of the encoder
+ * (MCU) or of the forwarded layers (SFU).
+ *
+ * every input carries its date, a controller never reads the clock, so a
+ * recorded feedback trace can be replayed offline (see bitratecontroller_test.go)
+ */
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// the matrix algorithm updates its decision every period
+	bitrateMatrixPeriod = 1 * time.Second
+	// rembs averaged by the matrix algorithm
+	bitrateMatrixAvgWindow  = 3 * time.Second
+	bitrateMatrixAvgHistory = 30
+	// receiver report loss thresholds
+	bitrateLossLow  = 0.02
+	bitrateLossHigh = 0.10
+)
+
+type BitrateController interface {
+	OnREMB(now time.Time, bps int)
+	// fractionLost is the RR fraction lost (loss rate * 256), jitter in
+	// timestamp units
+	OnReceiverReport(now time.Time, fractionLost uint8, jitter uint32)
+	OnRTT(now time.Time, rtt time.Duration)
+	// Target return the bitrate to apply, 0 until a decision is taken
+	Target(now time.Time) int
+}
+
+/*
+ * NewBitrateController return the controller of the algorithm name (env
+ * BITRATE_CONTROLLER): simple, matrix or loss, the loss correction of simple
+ */
+func NewBitrateController(name string, bitrate Bitrate) (controller BitrateController, err error) {
+	switch name {
+	case "simple":
+		controller = NewBitrateControllerSimple(bitrate)
+	case "matrix":
+		controller = NewBitrateControllerMatrix(bitrate)
+	case "loss":
+		controller = NewBitrateControllerLoss(NewBitrateControllerSimple(bitrate), bitrate)
+	default:
+		err = errors.New(fmt.Sprintf("unknown bitrate controller %s", name))
+	}
+	return
+}
+
+// stepBitrate round the bitrate to the step, inside [Min, Max]
+func stepBitrate(bps int, bitrate Bitrate) int {
+	if bitrate.Step > 0 {
+		bps = bps / bitrate.Step * bitrate.Step
+	}
+	if bps > bitrate.Max {
+		bps = bitrate.Max
+	} else if bps < bitrate.Min {
+		bps = bitrate.Min
+	}
+	return bps
+}
+
+/*
+ * Algorithm
+ * - the target is the last remb.
+ */
+type BitrateControllerSimple struct {
+	bitrate Bitrate
+	remb    int
+}
+
+func NewBitrateControllerSimple(bitrate Bitrate) *BitrateControllerSimple {
+	return &BitrateControllerSimple{bitrate: bitrate}
+}
+
+func (c *BitrateControllerSimple) OnREMB(now time.Time, bps int) {
+	c.remb = bps
+}
+
+func (c *BitrateControllerSimple) OnReceiverReport(now time.Time, fractionLost uint8, jitter uint32) {
+}
+
+func (c *BitrateControllerSimple) OnRTT(now time.Time, rtt time.Duration) {}
+
+func (c *BitrateControllerSimple) Target(now time.Time) int {
+	if c.remb == 0 {
+		return 0
+	}
+	return stepBitrate(c.remb, c.bitrate)
+}
+
+type bitrateSample struct {
+	date time.Time
+	bps  int
+}
+
+/*
+ * Algorithm:
+ * - every second, compute an average of last 3sec rembs, stack into an avg queue
+ * - if no remb found => stack in avg the lowest bitrate allowed
+ * - let avg queue be : [avg1, avg2, ... avg30]
+ *   we compute a matrix queue [ m1, m2, ... , m29]
+ *   with mN = 1 if avgN+1>avgN, -1 if avgN+1<avgN or 0.
+ *   we sum the matrix queue to obtain a matrix result.
+ *
+ * if the matrix result is positive and last avg is bigger than current bitrate
+ *   we go up slowly
+ * if the matrix result is positive and last avg is lower than current bitrate
+ *   we go down to last avg
+ * if the matrix result is negative and last avg is bigger than current bitrate
+ *   we go down
+ * if the matrix result is negative and last avg is lower than current bitrate
+ *   we go down to last avg
+ */
+type BitrateControllerMatrix struct {
+	bitrate    Bitrate
+	rembs      []bitrateSample
+	avgs       []float64
+	target     int
+	lastUpdate time.Time
+}
+
+func NewBitrateControllerMatrix(bitrate Bitrate) *BitrateControllerMatrix {
+	c := new(BitrateControllerMatrix)
+	c.bitrate = bitrate
+	c.target = bitrate.Start
+	return c
+}
+
+func (c *BitrateControllerMatrix) OnREMB(now time.Time, bps int) {
+	c.rembs = append(c.rembs, bitrateSample{date: now, bps: bps})
+}
+
+func (c *BitrateControllerMatrix) OnReceiverReport(now time.Time, fractionLost uint8, jitter uint32) {
+}
+
+func (c *BitrateControllerMatrix) OnRTT(now time.Time, rtt time.Duration) {}
+
+func (c *BitrateControllerMatrix) Target(now time.Time) int {
+	if len(c.rembs) == 0 && len(c.avgs) == 0 {
+		return 0
+	}
+	if now.Sub(c.lastUpdate) < bitrateMatrixPeriod {
+		return c.target
+	}
+	c.lastUpdate = now
+
+	avg := c.avg(now)
+	c.avgs = append(c.avgs, avg)
+	if len(c.avgs) > bitrateMatrixAvgHistory {
+		c.avgs = c.avgs[1:]
+	}
+	matrixResult := c.matrixResult()
+	step := c.bitrate.Step
+	switch {
+	case matrixResult > 0 && int(avg) > c.target+step*3:
+		// increase by 1/3
+		c.target = stepBitrate(int(float64(c.target)+(avg-float64(c.target))/3.), c.bitrate)
+	case matrixResult > 0 && int(avg) > c.target+step:
+		c.target = stepBitrate(c.target+step, c.bitrate)
+	case matrixResult > 0 && int(avg) < c.target:
+		c.target = stepBitrate(int(avg), c.bitrate)
+	case matrixResult < 0 && int(avg) >= c.target-step:
+		c.target = stepBitrate(c.target-step, c.bitrate)
+	case matrixResult < 0 && int(avg) < c.target-step:
+		c.target = stepBitrate(int(avg), c.bitrate)
+	}
+	return c.target
+}
+
+// avg of the rembs of the window, older rembs are forgotten
+func (c *BitrateControllerMatrix) avg(now time.Time) float64 {
+	from := now.Add(-bitrateMatrixAvgWindow)
+	for len(c.rembs) > 0 && c.rembs[0].date.Before(from) {
+		c.rembs = c.rembs[1:]
+	}
+	if len(c.rembs) == 0 {
+		// no remb found, lowest bitrate allowed
+		return float64(c.bitrate.Min)
+	}
+	var sum float64
+	for _, r := range c.rembs {
+		sum += float64(r.bps)
+	}
+	return sum / float64(len(c.rembs))
+}
+
+func (c *BitrateControllerMatrix) matrixResult() (result int) {
+	for i := 1; i < len(c.avgs); i++ {
+		if c.avgs[i-1] < c.avgs[i] {
+			result++
+		} else if c.avgs[i-1] > c.avgs[i] {
+			result--
+		}
+	}
+	return
+}
+
+/*
+ * Algorithm
+ * - the remb based target of the wrapped controller is corrected with the
+ *   loss rate of the last receiver report:
+ *   loss < 2%  => remb * 1.1
+ *   loss > 10% => remb * (1 - 0.5 * loss)
+ *   otherwise the target is kept
+ * - the target never exceeds the remb, out of [Min, Max] it is kept.
+ */
+type BitrateControllerLoss struct {
+	BitrateController
+	bitrate      Bitrate
+	fractionLost uint8
+	target       int
+}
+
+func NewBitrateControllerLoss(controller BitrateController, bitrate Bitrate) *BitrateControllerLoss {
+	c := new(BitrateControllerLoss)
+	c.BitrateController = controller
+	c.bitrate = bitrate
+	c.target = bitrate.Start
+	return c
+}
+
+func (c *BitrateControllerLoss) OnReceiverReport(now time.Time, fractionLost uint8, jitter uint32) {
+	c.fractionLost = fractionLost
+	c.BitrateController.OnReceiverReport(now, fractionLost, jitter)
+}
+
+func (c *BitrateControllerLoss) Target(now time.Time) int {
+	remb := c.BitrateController.Target(now)
+	if remb == 0 {
+		return 0
+	}
+	lossRate := c.LossRate()
+	target := c.target
+	if lossRate < bitrateLossLow {
+		target = int(float64(remb) * 1.1)
+	}
+	if lossRate > bitrateLossHigh {
+		target = int(float64(remb) * (1 - 0.5*lossRate))
+	}
+	if target > remb {
+		target = remb
+	}
+	if target >= c.bitrate.Min && target <= c.bitrate.Max {
+		c.target = target
+	}
+	return c.target
+}
+
+// LossRate 0.00 -> 1.00
+func (c *BitrateControllerLoss) LossRate() float64 {
+	return float64(c.fractionLost) / 256
+}
+
+func (c *BitrateControllerLoss) String() string {
+	return fmt.Sprintf("{target=%d,loss=%.3f}", c.target, c.LossRate())
+}
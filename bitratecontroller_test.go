@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBitrate = Bitrate{Start: 300000, Min: 100000, Max: 1000000, Step: 50000}
+
+/*
+ * replayBitrateTrace replay a recorded feedback trace through a controller,
+ * ticking it every second like RtcpContextRembs.
+ *
+ * one event per line, '#' comments:
+ *   <ms> remb <bps>
+ *   <ms> rr <fraction lost> <jitter>
+ *   <ms> rtt <ms>
+ *   <ms> expect <bps>    assert on the target
+ */
+func replayBitrateTrace(t *testing.T, path string, controller BitrateController) {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer file.Close()
+
+	epoch := time.Unix(1500000000, 0)
+	lastTick := epoch
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(text)
+		values := make([]int, len(fields))
+		for i := range fields {
+			if i == 1 {
+				continue
+			}
+			values[i], err = strconv.Atoi(fields[i])
+			if err != nil {
+				t.Fatalf("%s:%d invalid value %s", path, line, fields[i])
+			}
+		}
+		now := epoch.Add(time.Duration(values[0]) * time.Millisecond)
+		for lastTick.Add(time.Second).Before(now) || lastTick.Add(time.Second).Equal(now) {
+			lastTick = lastTick.Add(time.Second)
+			controller.Target(lastTick)
+		}
+		switch {
+		case fields[1] == "remb" && len(fields) == 3:
+			controller.OnREMB(now, values[2])
+		case fields[1] == "rr" && len(fields) == 4:
+			controller.OnReceiverReport(now, uint8(values[2]), uint32(values[3]))
+		case fields[1] == "rtt" && len(fields) == 3:
+			controller.OnRTT(now, time.Duration(values[2])*time.Millisecond)
+		case fields[1] == "expect" && len(fields) == 3:
+			if target := controller.Target(now); target != values[2] {
+				t.Errorf("%s:%d target is %d, expected %d", path, line, target, values[2])
+			}
+		default:
+			t.Fatalf("%s:%d invalid event %s", path, line, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+}
+
+func TestBitrateControllerSimple(t *testing.T) {
+	replayBitrateTrace(t, filepath.Join("testdata", "bitrate", "simple.txt"), NewBitrateControllerSimple(testBitrate))
+}
+
+func TestBitrateControllerMatrix(t *testing.T) {
+	replayBitrateTrace(t, filepath.Join("testdata", "bitrate", "matrix.txt"), NewBitrateControllerMatrix(testBitrate))
+}
+
+func TestBitrateControllerLoss(t *testing.T) {
+	replayBitrateTrace(t, filepath.Join("testdata", "bitrate", "loss.txt"), NewBitrateControllerLoss(NewBitrateControllerSimple(testBitrate), testBitrate))
+}
+
+func TestBitrateControllerNoRemb(t *testing.T) {
+	now := time.Now()
+	controllers := []BitrateController{
+		NewBitrateControllerSimple(testBitrate),
+		NewBitrateControllerMatrix(testBitrate),
+		NewBitrateControllerLoss(NewBitrateControllerSimple(testBitrate), testBitrate),
+	}
+	for _, controller := range controllers {
+		controller.OnReceiverReport(now, 0, 0)
+		if target := controller.Target(now.Add(time.Second)); target != 0 {
+			t.Errorf("%T: target is %d before any remb", controller, target)
+		}
+	}
+}
+
+func TestNewBitrateController(t *testing.T) {
+	tests := []struct {
+		name       string
+		controller BitrateController
+	}{
+		{"simple", NewBitrateControllerSimple(testBitrate)},
+		{"matrix", NewBitrateControllerMatrix(testBitrate)},
+		{"loss", NewBitrateControllerLoss(NewBitrateControllerSimple(testBitrate), testBitrate)},
+	}
+	for _, test := range tests {
+		controller, err := NewBitrateController(test.name, testBitrate)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(controller, test.controller) {
+			t.Errorf("%s: controller %#v, expected %#v", test.name, controller, test.controller)
+		}
+	}
+	for _, name := range []string{"", "Simple", "remb"} {
+		if _, err := NewBitrateController(name, testBitrate); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -47,6 +47,9 @@ type ListenerBuffer struct {
 	outRTP             chan *srtp.PacketRTP
 	outRTCP            chan *RtpUdpPacket
 	lastRtpTimestamp   uint64
+	// RED output, its retransmissions have their own payload type
+	ptRed    int
+	ptRedRtx int
 }
 
 type PacketRTPBuffer struct {
@@ -172,20 +175,11 @@ func (lb *ListenerBuffer) isH264KeyFrame(p *srtp.PacketRTP) bool {
 		lb.log.Warnf("could not retreive key frame info because the stream is not configured as video")
 		return false
 	}
-	d := p.GetData()
-	RTPHeaderBytes := 12 + d[0]&0x0F
-
-	//j.log.Warnf("BYTE IS %X", d[RTPHeaderBytes])
-	f := d[RTPHeaderBytes] >> 7 & 0x1
-	nri := d[RTPHeaderBytes] >> 5 & 0x03
-	nalType := d[RTPHeaderBytes] & 0x1F
-
-	lb.log.Warnf("F IS %d, NRI IS %d, TYPE IS %d", f, nri, nalType)
-	if nalType == 24 || nalType == 28 {
-		return true
+	headerSize := p.GetHeaderSize()
+	if headerSize >= p.GetSize() {
+		return false
 	}
-
-	return false
+	return isH264KeyFrameStart(p.GetData()[headerSize:])
 }
 
 func (lb *ListenerBuffer) isVP8KeyFrame(p *srtp.PacketRTP) bool {
@@ -202,6 +196,31 @@ func (lb *ListenerBuffer) isVP8KeyFrame(p *srtp.PacketRTP) bool {
 	return false
 }
 
+func (lb *ListenerBuffer) isVP9KeyFrame(p *srtp.PacketRTP) bool {
+	if lb.jst != JitterStreamVideo {
+		lb.log.Warnf("could not retreive key frame info because the stream is not configured as video")
+		return false
+	}
+	headerSize := p.GetHeaderSize()
+	if headerSize >= p.GetSize() {
+		return false
+	}
+	return isVP9KeyFrameStart(p.GetData()[headerSize:])
+}
+
+// mediaPacket return the media packet of a RED packet, nil for the FEC
+// packets
+func (lb *ListenerBuffer) mediaPacket(p *srtp.PacketRTP) *srtp.PacketRTP {
+	if lb.ptRed == 0 || p.GetPT() != lb.ptRed {
+		return p
+	}
+	primary, err := p.REDExtractPrimary()
+	if err != nil || primary.GetPT() != lb.pt {
+		return nil
+	}
+	return primary
+}
+
 func (lb *ListenerBuffer) inPackets() {
 	waitingKeyFrame := true
 	for {
@@ -212,7 +231,8 @@ func (lb *ListenerBuffer) inPackets() {
 		case p := <-lb.in:
 			if lb.jst == JitterStreamVideo && waitingKeyFrame == true {
 				lb.seqNumber = p.GetSeqNumberWithCycles()
-				if (lb.codecOption == CodecVP8 && lb.isVP8KeyFrame(p)) || (lb.codecOption == CodecH264 && lb.isH264KeyFrame(p)) {
+				keyFrame := lb.mediaPacket(p)
+				if keyFrame != nil && ((lb.codecOption == CodecVP8 && lb.isVP8KeyFrame(keyFrame)) || (lb.codecOption == CodecH264 && lb.isH264KeyFrame(keyFrame)) || (lb.codecOption == CodecVP9 && lb.isVP9KeyFrame(keyFrame))) {
 					lb.log.Infof("Found the keyframe, starting to send stream")
 					waitingKeyFrame = false
 				} else {
@@ -278,13 +298,17 @@ func (lb *ListenerBuffer) SendRTX(seqs []uint16, ssrc uint32) {
 		copy(data[14+originCC:], originData[12+originCC:])
 
 		// Changing Payload Type to RTX Payload Type
-		data[1] = originData[1]&0x80 | (byte(lb.ptRtx) & 0x7f)
+		ptRtx := lb.ptRtx
+		if lb.ptRed != 0 && originalPacketRTP.GetPT() == lb.ptRed {
+			ptRtx = lb.ptRedRtx
+		}
+		data[1] = originData[1]&0x80 | (byte(ptRtx) & 0x7f)
 		// Changing SequenceNumber to RTX Sequence Number
 		binary.BigEndian.PutUint16(data[2:4], lb.rtxSeqNumber)
 		// Changing SSRC to RTX SSRC
 		binary.BigEndian.PutUint32(data[8:12], lb.rtxSsrc)
 
-		lb.log.Infof("send RTX packet with ssrc %d / pt %d / seq %d / original seq %d / lb.seqNumber is %d", lb.rtxSsrc, byte(lb.ptRtx), lb.rtxSeqNumber, s, lb.seqNumber)
+		lb.log.Infof("send RTX packet with ssrc %d / pt %d / seq %d / original seq %d / lb.seqNumber is %d", lb.rtxSsrc, byte(ptRtx), lb.rtxSeqNumber, s, lb.seqNumber)
 		packetRTP := srtp.NewPacketRTP(packet.NewUDP())
 		packetRTP.SetData(data)
 		select {
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
 	"net"
+	"sync/atomic"
 	"time"
 
 	plogger "github.com/heytribe/go-plogger"
@@ -15,9 +15,6 @@ import (
 	"github.com/heytribe/live-webrtcsignaling/srtp"
 )
 
-// percent delta difference to manage bitrate up/down
-const percentDelta = 0.3
-
 // Max latency before lowering bitrate (in ms)
 const maxLatency = 800
 
@@ -28,6 +25,37 @@ type NackPliState struct {
 	pli      int
 }
 
+/*
+ * RtxStats count the NACKs & their retransmissions (RFC 4588), updated by
+ * the in & timeouts goroutines
+ */
+type RtxStats struct {
+	// NACKs sent
+	Nacks uint64 `json:"nacks"`
+	// retransmissions inserted as the original packet
+	Recovered uint64 `json:"recovered"`
+	// retransmissions of packets already received or skipped
+	Late uint64 `json:"late"`
+	// padding only retransmissions (bandwidth probing)
+	Padding uint64 `json:"padding"`
+	// losses the NACKs didn't recover: a key frame is requested & the
+	// buffered packets are dropped, counted once per request
+	KeyFrameRequests uint64 `json:"keyFrameRequests"`
+	// packets rebuilt from the ULPFEC packets
+	FecRecovered uint64 `json:"fecRecovered"`
+}
+
+func (s *RtxStats) Load() RtxStats {
+	return RtxStats{
+		Nacks:            atomic.LoadUint64(&s.Nacks),
+		Recovered:        atomic.LoadUint64(&s.Recovered),
+		Late:             atomic.LoadUint64(&s.Late),
+		Padding:          atomic.LoadUint64(&s.Padding),
+		KeyFrameRequests: atomic.LoadUint64(&s.KeyFrameRequests),
+		FecRecovered:     atomic.LoadUint64(&s.FecRecovered),
+	}
+}
+
 type ProtectedPacketNacked struct {
 	my.RWMutex
 	d map[uint16]NackPliState
@@ -164,6 +192,7 @@ type JitterBuffer struct {
 	fps                uint8
 	lastPictureId      uint16
 	codecOption        CodecOptions
+	mode               ModeOptions
 	discontinuity      uint16
 	baseInTime         BaseClock
 	cumulDelay         int64
@@ -181,12 +210,25 @@ type JitterBuffer struct {
 	firstSeqFound       bool
 	lastRtpOutTs        time.Time
 	lastInRtp						*srtp.PacketRTP
+	// simulcast: only the jitter buffer of the first layer sends REMBs, the
+	// others share its estimator
+	rembDisabled bool
+	// video: computes the REMB
+	estimator *BandwidthEstimator
+	rtxStats  RtxStats
+	// retransmitted or FEC rebuilt packets, already unwrapped
+	inRecovered chan jitterRecoveredPacket
+}
+
+type jitterRecoveredPacket struct {
+	packet *srtp.PacketRTP
+	fec    bool
 }
 
 // ch is a channel where jitterbuffer could push buffer packets
-func NewJitterBufferPublisher(ctx context.Context, codecOption CodecOptions, pt uint16, ptRtx uint16, freq uint32, ssrc uint32, rtxSsrc uint32, jst JitterStreamTypeOptions, bitrate Bitrate, rtt *int64, n *PipelineNodeJitterPublisher) (jitterBuffer *JitterBuffer, err error) {
+func NewJitterBufferPublisher(ctx context.Context, codecOption CodecOptions, mode ModeOptions, pt uint16, ptRtx uint16, freq uint32, ssrc uint32, rtxSsrc uint32, jst JitterStreamTypeOptions, bitrate Bitrate, rtt *int64, n *PipelineNodeJitterPublisher) (jitterBuffer *JitterBuffer, err error) {
 	var bufferTimeSize int
-	if config.Mode == ModeMCU {
+	if mode == ModeMCU {
 		bufferTimeSize = 100 * 1000000
 	} else {
 		bufferTimeSize = 0
@@ -204,6 +246,7 @@ func NewJitterBufferPublisher(ctx context.Context, codecOption CodecOptions, pt
 		seqNumber:       0,
 		packetCounter:   0,
 		in:              make(chan *srtp.PacketRTP, channelSize),
+		inRecovered:     make(chan jitterRecoveredPacket, channelSize),
 		buffer:          NewBufferPublisher(bufferUnsorted, freq, 0),
 		bufferUnsorted:  bufferUnsorted,
 		reorderMaxDelay: 100 * 1000000,
@@ -215,17 +258,22 @@ func NewJitterBufferPublisher(ctx context.Context, codecOption CodecOptions, pt
 		freq:            freq,
 		filled:          false,
 		ssrc:            ssrc,
+		rtxSsrc:         rtxSsrc,
 		videoBitrate:    config.Bitrates.Video.Start,
 		audioBitrate:    config.Bitrates.Audio.Start,
 		bitrate:         bitrate,
 		rtt:             rtt,
 		n:               n,
 		codecOption:     codecOption,
+		mode:            mode,
 		bufferTimeSize:  uint64(bufferTimeSize),
 		acceptDisorder:  acceptDisorder,
 	}
 	// emitting REMB/NACKS
 	jitterBuffer.outRTCP = make(chan *RtpUdpPacket, 128)
+	if jst == JitterStreamVideo {
+		jitterBuffer.estimator = NewBandwidthEstimator(freq, bitrate)
+	}
 
 	go jitterBuffer.inPackets()
 
@@ -247,6 +295,7 @@ func (j *JitterBuffer) GetArrivalTime(rtpTimestamp uint64) int64 {
 }
 
 func (j *JitterBuffer) managePli(seq uint64) {
+	atomic.AddUint64(&j.rtxStats.KeyFrameRequests, 1)
 	j.firstSeqFound = false
 	j.waitingKeyFrame = true
 	j.inSeqNumber = 0
@@ -285,7 +334,6 @@ func (j *JitterBuffer) nackPacket(seq uint64) {
 		sleepTime := (j.bufferTimeSize * 2) / 5
 		time.Sleep(time.Duration(sleepTime) * time.Nanosecond)
 		nackCount++
-		j.ChangeBitrate(-0.05)
 	}
 	if j.waitingKeyFrame == false && j.inSeqNumber <= seq {
 		j.managePli(seq)
@@ -297,7 +345,6 @@ func (j *JitterBuffer) nackPacket(seq uint64) {
 
 func (j *JitterBuffer) manageTimeouts() {
 	j.log.Warnf("start manageTimeouts() go routine")
-	ticker := time.NewTicker(1 * time.Second)
 	tickerRtt := time.NewTicker(1 * time.Second)
 	rttCount := uint64(0)
 	for {
@@ -305,18 +352,6 @@ func (j *JitterBuffer) manageTimeouts() {
 		case <-j.ctx.Done():
 			j.log.Infof("goroutine manageTimeouts exit")
 			return
-		case <-ticker.C:
-			j.log.Infof("j.cumulDelay is %d", j.cumulDelay)
-			cumulDelay := j.cumulDelay
-			j.lastCumulDelay = cumulDelay
-			if j.lastCumulDelay <= 0 && cumulDelay <= 0 && j.waitingKeyFrame == false && j.cumulDelayTime.Add(time.Duration(j.buffer.GetAvgIntervalTime()*2) * time.Nanosecond).After(time.Now()) {
-				j.log.Infof("cumulDelay is under 0 (%d) and j.lastCumulDelay is under 0 (%d) up bitrate by 5 percent", cumulDelay, j.lastCumulDelay)
-				j.ChangeBitrate(0.05)
-			} else if j.cumulDelay > 5000000 {
-				j.log.Infof("cumulDelay is over 10000000 (%d) down bitrate by 10 percent", j.cumulDelay)
-				j.ChangeBitrate(-0.1)
-			}
-			//j.cumulDelay = 0
 		case <-tickerRtt.C:
 			j.log.Infof("RTT is %d", *j.rtt)
 			if rttCount == 0 {
@@ -325,7 +360,8 @@ func (j *JitterBuffer) manageTimeouts() {
 				j.avgRtt = (j.avgRtt*float64(rttCount) + float64(*j.rtt)) / float64(rttCount+1)
 			}
 			rttCount++
-			if config.Mode == ModeMCU {
+			j.sendRtxStats()
+			if j.mode == ModeMCU {
 				newBufferTimeSize := uint64(j.avgRtt) + uint64(j.reorderMaxDelay)
 				delta := uint64(math.Abs(float64(int64(newBufferTimeSize) - int64(j.bufferTimeSize))))
 				if delta > (j.bufferTimeSize*5)/100 {
@@ -472,6 +508,7 @@ func (j *JitterBuffer) inPackets() {
 				j.setSeqAndTsWithCycles(p)
 				j.cycleDetector(p)
 				//j.correctingTimestamp(p)
+				j.estimateBandwidth(p)
 
 				j.log.Debugf("RECEIVED PACKET RTP SEQ %d", p.GetSeqNumberWithCycles())
 				if j.lastInRtp == nil || j.lastInRtp.GetSeqNumberWithCycles() < p.GetSeqNumberWithCycles() {
@@ -480,7 +517,7 @@ func (j *JitterBuffer) inPackets() {
 				// If we're waiting a new key frame, don't do anything before receiving this Key frame
 				if j.waitingKeyFrame == true {
 					j.inSeqNumber = p.GetSeqNumberWithCycles()
-					if (j.codecOption == CodecVP8 && j.isVP8KeyFrame(p)) || (j.codecOption == CodecH264 && j.isH264KeyFrame(p)) {
+					if (j.codecOption == CodecVP8 && j.isVP8KeyFrame(p)) || (j.codecOption == CodecH264 && j.isH264KeyFrame(p)) || (j.codecOption == CodecVP9 && j.isVP9KeyFrame(p)) {
 						j.log.Infof("Key Frame received @ seq %d/%d restart...", p.GetSeqNumber(), j.inSeqNumber)
 						if j.exitNewKeyFrame != nil {
 							j.exitNewKeyFrame <- struct{}{}
@@ -587,51 +624,96 @@ func (j *JitterBuffer) inPackets() {
 					j.inSeqNumber = j.buffer.GetLastPacketRTP().GetSeqNumberWithCycles()+1
 				}
 			case j.ptRtx:
-				j.log.Infof("[ RTX ] RTP Packet PT %d, considered as a retransmission packet", p.GetPT())
-				packetOriginRTP, originSeq := p.RTXExtractOriginal(j.ssrc)
-				if j.waitingKeyFrame == false && p.GetSeqNumberWithCycles() >= j.inSeqNumber {
-					// Set the correst SEQ and TS cycles
-					j.setSeqAndTsWithCycles(packetOriginRTP)
-					j.cycleDetector(packetOriginRTP)
-					j.log.Infof("REINSERT packet data SEQ %d/%d", packetOriginRTP.GetSeqNumber(), packetOriginRTP.GetSeqNumberWithCycles())
-					if packetOriginRTP.GetSeqNumberWithCycles() > j.inSeqNumber {
-						j.bufferUnsorted.Put(packetOriginRTP)
-					} else {
-						err := j.buffer.Push(j.log, packetOriginRTP, false, j.acceptDisorder)
-						if err != nil {
-							j.log.Warnf("RTX packet RTP seq %d could not be reinserted on the list: %s", originSeq, err.Error())
-						} else {
-							j.log.Infof("RTX packet RTP seq %d reinserted on the list: %#v", originSeq, packetOriginRTP.GetData())
-							j.inSeqNumber = j.buffer.GetLastPacketRTP().GetSeqNumberWithCycles() + 1
-						}
-					}
-				}
+				j.pushRtx(p)
 			default:
 				j.log.Warnf("unknown Payload Type (%d != %d or %d) received on this ssrc %d", p.GetPT(), j.pt, j.ptRtx, j.ssrc)
 			}
+		case r := <-j.inRecovered:
+			j.insertRecovered(r.packet, r.fec)
 		}
 	}
 }
 
+/*
+ * pushRtx unwrap a retransmission and insert it in the buffers as if it
+ * was the original packet
+ */
+func (j *JitterBuffer) pushRtx(p *srtp.PacketRTP) {
+	if j.rtxSsrc != 0 && p.GetSSRCid() != j.rtxSsrc {
+		j.log.Warnf("[ RTX ] dropping packet of ssrc %d, rtx ssrc is %d", p.GetSSRCid(), j.rtxSsrc)
+		return
+	}
+	packetOriginRTP, originSeq, err := p.RTXExtractOriginal(j.ssrc, j.pt)
+	if err != nil {
+		j.log.Debugf("[ RTX ] %s", err.Error())
+		atomic.AddUint64(&j.rtxStats.Padding, 1)
+		return
+	}
+	j.log.Debugf("[ RTX ] original seq %d", originSeq)
+	j.insertRecovered(packetOriginRTP, false)
+}
+
+/*
+ * insertRecovered insert a retransmitted or FEC rebuilt packet in the
+ * buffers, unless it was already received or skipped
+ */
+func (j *JitterBuffer) insertRecovered(p *srtp.PacketRTP, fec bool) {
+	origin := "RTX"
+	if fec {
+		origin = "FEC"
+	}
+	// Set the correct SEQ and TS cycles
+	j.setSeqAndTsWithCycles(p)
+	j.cycleDetector(p)
+	seq := p.GetSeqNumberWithCycles()
+	if j.waitingKeyFrame || seq < j.inSeqNumber || j.bufferUnsorted.IsExist(seq) {
+		j.log.Infof("[ %s ] packet seq %d/%d already received or skipped, j.inSeqNumber is %d", origin, p.GetSeqNumber(), seq, j.inSeqNumber)
+		if !fec {
+			atomic.AddUint64(&j.rtxStats.Late, 1)
+		}
+		return
+	}
+	if fec {
+		atomic.AddUint64(&j.rtxStats.FecRecovered, 1)
+	} else {
+		atomic.AddUint64(&j.rtxStats.Recovered, 1)
+	}
+	j.nacked.Del(p.GetSeqNumber())
+	j.log.Infof("[ %s ] REINSERT packet data SEQ %d/%d", origin, p.GetSeqNumber(), seq)
+	if seq > j.inSeqNumber {
+		j.bufferUnsorted.Put(p)
+		return
+	}
+	err := j.buffer.Push(j.log, p, false, j.acceptDisorder)
+	if err != nil {
+		j.log.Warnf("%s packet RTP seq %d could not be reinserted on the list: %s", origin, p.GetSeqNumber(), err.Error())
+		return
+	}
+	j.inSeqNumber = j.buffer.GetLastPacketRTP().GetSeqNumberWithCycles() + 1
+}
+
+func (j *JitterBuffer) sendRtxStats() {
+	stats := &PipelineMessageRtxStats{
+		SSRC:     j.ssrc,
+		RtxStats: j.rtxStats.Load(),
+	}
+	select {
+	case j.event <- stats:
+	default:
+		j.log.Warnf("j.event is full, dropping rtx stats")
+	}
+}
+
 func (j *JitterBuffer) isH264KeyFrame(p *srtp.PacketRTP) bool {
 	if j.jst != JitterStreamVideo {
 		j.log.Warnf("could not retreive key frame info because the stream is not configured as video")
 		return false
 	}
-	d := p.GetData()
-	RTPHeaderBytes := 12 + d[0]&0x0F
-
-	//j.log.Warnf("BYTE IS %X", d[RTPHeaderBytes])
-	//f := d[RTPHeaderBytes] >> 7 & 0x1
-	//nri := d[RTPHeaderBytes] >> 5 & 0x03
-	nalType := d[RTPHeaderBytes] & 0x1F
-
-	//j.log.Warnf("F IS %d, NRI IS %d, TYPE IS %d", f, nri, nalType)
-	if nalType == 24 {
-		return true
+	headerSize := p.GetHeaderSize()
+	if headerSize >= p.GetSize() {
+		return false
 	}
-
-	return false
+	return isH264KeyFrameStart(p.GetData()[headerSize:])
 }
 
 func (j *JitterBuffer) isVP8KeyFrame(p *srtp.PacketRTP) bool {
@@ -640,6 +722,9 @@ func (j *JitterBuffer) isVP8KeyFrame(p *srtp.PacketRTP) bool {
 		return false
 	}
 	d := p.GetData()
+	if int(d[0]&0x0f)*4+16 >= len(d) {
+		return false
+	}
 	rtpP := d[(d[0]&0x0f)*4+16] & 0x01
 	if rtpP == 0 {
 		return true
@@ -648,20 +733,29 @@ func (j *JitterBuffer) isVP8KeyFrame(p *srtp.PacketRTP) bool {
 	return false
 }
 
-func (j *JitterBuffer) getPictureId(p *srtp.PacketRTP) (pictureId uint16, err error) {
+func (j *JitterBuffer) isVP9KeyFrame(p *srtp.PacketRTP) bool {
+	if j.jst != JitterStreamVideo {
+		j.log.Warnf("could not retreive key frame info because the stream is not configured as video")
+		return false
+	}
+	headerSize := p.GetHeaderSize()
+	if headerSize >= p.GetSize() {
+		return false
+	}
+	return isVP9KeyFrameStart(p.GetData()[headerSize:])
+}
+
+func (j *JitterBuffer) getVP8Descriptor(p *srtp.PacketRTP) (d VP8PayloadDescriptor, err error) {
 	if j.jst != JitterStreamVideo {
 		err = errors.New("the stream is not configured as video")
 		return
 	}
-	d := p.GetData()
-	m := d[12+int(d[0]&0x0f)+2] & 0xf0
-	if m == 0 {
-		pictureId = uint16(d[12+int(d[0]&0x0f)+2] & 0x7f)
-	} else {
-		pictureId = binary.BigEndian.Uint16(d[12+int(d[0]&0x0f)+2:14+int(d[0]&0x0f)+2]) & 0x7fff
+	headerSize := p.GetHeaderSize()
+	if headerSize >= p.GetSize() {
+		err = errors.New("RTP packet without payload")
+		return
 	}
-
-	return
+	return ParseVP8PayloadDescriptor(p.GetData()[headerSize:])
 }
 
 func (j *JitterBuffer) getMarker(p *srtp.PacketRTP) (marker bool, err error) {
@@ -682,11 +776,15 @@ func (j *JitterBuffer) getMarker(p *srtp.PacketRTP) (marker bool, err error) {
 //    false -> not completed, shoud continue
 func (j *JitterBuffer) checkRtpVP8Pictures(p *srtp.PacketRTP) bool {
 	markerPicture, _ := j.getMarker(p)
-	pictureId, err := j.getPictureId(p)
+	d, err := j.getVP8Descriptor(p)
+	if err == nil && !d.HasPictureId {
+		err = errors.New("no picture id in the VP8 payload descriptor")
+	}
 	if err != nil {
 		j.log.Warnf("could not get picture ID: %s", err.Error())
 	} else {
-		j.log.Debugf("SEQ %d, MARKER %t, PictureId %d", p.GetSeqNumber(), markerPicture, pictureId)
+		pictureId := d.PictureId
+		j.log.Debugf("SEQ %d, MARKER %t, PictureId %d, TL0PICIDX %d, TID %d, Y %t", p.GetSeqNumber(), markerPicture, pictureId, d.TL0PicIdx, d.TID, d.LayerSync)
 		if markerPicture == false {
 			if j.pictureId == 0 {
 				j.pictureId = pictureId
@@ -804,6 +902,17 @@ func (j *JitterBuffer) sendVideoPacket(packetRTP *srtp.PacketRTP) {
 func (j *JitterBuffer) manageVideoPacket(packetRTP *srtp.PacketRTP) {
 	var completed bool
 
+	if isFecSeqPlaceholder(packetRTP) {
+		// sequence number of a FEC packet: the SFU forwarders need it to
+		// keep the sequence of the listeners continuous, in order
+		if len(j.outBufferedPackets) > 0 {
+			j.outBufferedPackets = append(j.outBufferedPackets, packetRTP)
+		} else {
+			j.sendVideoPacket(packetRTP)
+		}
+		return
+	}
+
 	switch j.codecOption {
 	case CodecVP8:
 		completed = j.checkRtpVP8Pictures(packetRTP)
@@ -834,7 +943,6 @@ var test int
 
 func (j *JitterBuffer) requestNewKeyFrame() {
 	test++
-	j.ChangeBitrate(-0.3)
 	j.log.Warnf("starting requestNewKeyFrame -- %d", test)
 	ticker := time.NewTicker(2 * time.Second)
 	for {
@@ -844,7 +952,6 @@ func (j *JitterBuffer) requestNewKeyFrame() {
 			return
 		case <-ticker.C:
 			j.log.Infof("key frame not received, sending PLI again and wait 1000 ms...")
-			j.ChangeBitrate(-0.3)
 			j.SendPLI()
 		case <-j.exitNewKeyFrame:
 			j.exitNewKeyFrame = nil
@@ -903,6 +1010,12 @@ func (j *JitterBuffer) PushPacket(packet *srtp.PacketRTP) {
 	j.in <- packet
 }
 
+// PushRecovered push a packet unwrapped from a retransmission or rebuilt
+// from FEC packets
+func (j *JitterBuffer) PushRecovered(packet *srtp.PacketRTP, fec bool) {
+	j.inRecovered <- jitterRecoveredPacket{packet: packet, fec: fec}
+}
+
 func (j *JitterBuffer) PullPacket() *srtp.PacketRTP {
 	return <-j.out
 }
@@ -919,6 +1032,16 @@ func (j *JitterBuffer) GetOutCh() chan *srtp.PacketRTP {
 	return j.out
 }
 
+// SetSSRC is used when the ssrc is learned from the stream (simulcast rid)
+func (j *JitterBuffer) SetSSRC(ssrc uint32) {
+	j.ssrc = ssrc
+}
+
+// SetRtxSSRC is used when the rtx ssrc is learned from the stream (simulcast rid)
+func (j *JitterBuffer) SetRtxSSRC(ssrc uint32) {
+	j.rtxSsrc = ssrc
+}
+
 func (j *JitterBuffer) GetSSRC() uint32 {
 	return j.ssrc
 }
@@ -940,6 +1063,7 @@ func (j *JitterBuffer) SendNACK(seq uint16) {
 	pNack.PacketRTPFB.SenderSSRC = 0
 	pNack.PacketRTPFB.MediaSSRC = j.ssrc
 	pNack.Lost(seq)
+	atomic.AddUint64(&j.rtxStats.Nacks, 1)
 	dataNack := pNack.Bytes()
 	rtcpPacketNack := &RtpUdpPacket{
 		RAddr: j.rAddr,
@@ -954,6 +1078,9 @@ func (j *JitterBuffer) SendNACK(seq uint16) {
 }
 
 func (j *JitterBuffer) SendREMB(bitrate int) {
+	if j.rembDisabled {
+		return
+	}
 	if j.rAddr == nil {
 		j.log.Warnf("could not send any packets j.rAddr is nil")
 		return
@@ -975,6 +1102,27 @@ func (j *JitterBuffer) SendREMB(bitrate int) {
 	j.n.Bus <- remb
 }
 
+// SendTransportWideFeedback send the arrivals recorded since the last feedback
+func (j *JitterBuffer) SendTransportWideFeedback(twcc *TransportWideCC) {
+	if j.rAddr == nil {
+		return
+	}
+	feedback := twcc.Feedback(0, j.ssrc)
+	if feedback == nil {
+		return
+	}
+	rtcpPacketTW := &RtpUdpPacket{
+		RAddr: j.rAddr,
+		Data:  feedback.Bytes(),
+	}
+	j.log.Debugf("send RTCP transport-cc %s", feedback.String())
+	select {
+	case j.outRTCP <- rtcpPacketTW:
+	default:
+		j.log.Warnf("outRTCP is full, dropping packet rtcpPacketTW")
+	}
+}
+
 func (j *JitterBuffer) SendPLI() {
 	if j.rAddr == nil {
 		j.log.Warnf("could not send any packets j.rAddr is nil")
@@ -1017,29 +1165,32 @@ func (j *JitterBuffer) SendFIR() {
 	}
 }
 
-func (j *JitterBuffer) ChangeBitrate(percentDelta float64) {
-	var newBitrate int
-	dontRemb := false
-	newBitrate = int(float64(j.videoBitrate) + (float64(j.videoBitrate) * percentDelta))
-
-	if newBitrate < j.bitrate.Min {
-		j.log.Infof("bitrate is now at the minimum (%d bits/s)", j.bitrate.Min)
-		newBitrate = j.bitrate.Min
-	} else {
-		if newBitrate > j.bitrate.Max {
-			j.log.Infof("bitrate is now at the maximum (%d bits/s)", j.bitrate.Max)
-			dontRemb = true
-		} else {
-			if newBitrate == j.bitrate.Min {
-				dontRemb = true
-			}
-		}
+/*
+ * estimateBandwidth feed the bandwidth estimator with a media packet, the
+ * REMB is sent periodically or when the estimate drops
+ */
+func (j *JitterBuffer) estimateBandwidth(p *srtp.PacketRTP) {
+	if j.estimator == nil {
+		return
 	}
-	if dontRemb == false {
-		j.log.Infof("bitrate change with REMB to %d kbits/s", newBitrate/1000)
-		j.SendREMB(newBitrate)
-		j.videoBitrate = newBitrate
+	if j.rembDisabled {
+		j.estimator.OnLayerPacket(p.GetCreatedAt(), p.GetSize())
+		return
+	}
+	bitrate, remb := j.estimator.OnPacket(p.GetCreatedAt(), p.GetSeqNumberWithCycles(), p.GetTimestampWithCycles(), p.GetSize())
+	if !remb {
+		return
+	}
+	if bitrate != j.videoBitrate {
+		j.log.Infof("bitrate change with REMB to %d kbits/s", bitrate/1000)
+	}
+	j.videoBitrate = bitrate
+	j.SendREMB(bitrate)
+	state := j.estimator.State()
+	j.log.Debugf("bandwidth estimator %s", state)
+	select {
+	case j.n.Bus <- state:
+	default:
+		j.log.Warnf("Bus is full, dropping event PipelineMessageBandwidthEstimate")
 	}
-
-	return
 }
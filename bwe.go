@@ -0,0 +1,446 @@
+package main
+
+/*
+ * Receive-side bandwidth estimation of a publisher (REMB)
+ *
+ * Google Congestion Control like (draft-ietf-rmcat-gcc-02):
+ *  - packets are grouped by frame (RTP timestamp), the variation of the
+ *    one-way delay between groups is smoothed by a trendline filter
+ *  - the overuse detector compares the trend with an adaptive threshold
+ *  - an AIMD rate controller increases the estimate while the network is
+ *    not overused, and drops it below the incoming bitrate when overused
+ *  - a loss-based controller caps the estimate when packets are lost
+ * the estimate is sent to the publisher in a REMB.
+ *
+ * simulcast: the delay & the losses are measured on the first layer, the
+ * incoming bitrate on every layer, the REMB is for the whole session.
+ */
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// trendline filter
+	bweTrendlineWindow    = 20
+	bweTrendlineSmoothing = 0.9
+	bweTrendlineGain      = 4.0
+	bweTrendlineMaxDeltas = 60
+	// overuse detector, threshold in ms
+	bweThresholdInitial = 12.5
+	bweThresholdMin     = 6.0
+	bweThresholdMax     = 600.0
+	bweThresholdKUp     = 0.0087
+	bweThresholdKDown   = 0.039
+	bweOveruseTime      = 10 * time.Millisecond
+	// rate controller
+	bweDecreaseFactor      = 0.85
+	bweIncreasePerSecond   = 1.08
+	bweIncomingRateWindow  = 500 * time.Millisecond
+	bweLossPeriod          = 1 * time.Second
+	bweLossLow             = 0.02
+	bweLossHigh            = 0.10
+	bweRembPeriod          = 1 * time.Second
+	bweRembDecreaseTrigger = 0.97
+)
+
+type BandwidthUsage int
+
+const (
+	BandwidthNormal BandwidthUsage = iota
+	BandwidthUnderusing
+	BandwidthOverusing
+)
+
+func (u BandwidthUsage) String() string {
+	switch u {
+	case BandwidthUnderusing:
+		return "underusing"
+	case BandwidthOverusing:
+		return "overusing"
+	}
+	return "normal"
+}
+
+type RateControlState int
+
+const (
+	RateControlHold RateControlState = iota
+	RateControlIncrease
+	RateControlDecrease
+)
+
+func (s RateControlState) String() string {
+	switch s {
+	case RateControlIncrease:
+		return "increase"
+	case RateControlDecrease:
+		return "decrease"
+	}
+	return "hold"
+}
+
+// packets sent at the same time, a frame
+type bwePacketGroup struct {
+	rtpTimestamp uint64
+	lastArrival  time.Time
+}
+
+type bweArrival struct {
+	at   time.Time
+	size int
+}
+
+type BandwidthEstimator struct {
+	// the jitter buffers of the simulcast layers share the estimator
+	sync.Mutex
+	freq uint32
+	min  int
+	max  int
+	// inter-arrival
+	current  *bwePacketGroup
+	previous *bwePacketGroup
+	// trendline
+	firstArrival      time.Time
+	accumulatedDelay  float64
+	smoothedDelay     float64
+	samples           [][2]float64
+	numDeltas         int
+	trend             float64
+	prevModifiedTrend float64
+	threshold         float64
+	lastThresholdAt   time.Time
+	timeOverUsing     float64
+	overuseCounter    int
+	usage             BandwidthUsage
+	prevTrend         float64
+	// incoming bitrate
+	arrivals      []bweArrival
+	arrivalsBytes int
+	incomingBps   int
+	incomingSince time.Time
+	// AIMD
+	state         RateControlState
+	delayEstimate float64
+	lastUpdateAt  time.Time
+	avgMaxBps     float64
+	varMaxBps     float64
+	// loss
+	lossPeriodAt   time.Time
+	lossBaseSeq    uint64
+	lossHighestSeq uint64
+	lossReceived   int
+	lossRate       float64
+	lossEstimate   float64
+	// REMB
+	estimate   int
+	lastRemb   int
+	lastRembAt time.Time
+}
+
+func NewBandwidthEstimator(freq uint32, bitrate Bitrate) *BandwidthEstimator {
+	e := new(BandwidthEstimator)
+	e.freq = freq
+	e.min = bitrate.Min
+	e.max = bitrate.Max
+	e.threshold = bweThresholdInitial
+	e.timeOverUsing = -1
+	e.delayEstimate = float64(bitrate.Start)
+	// no cap until packets are lost
+	e.lossEstimate = float64(bitrate.Max)
+	e.estimate = bitrate.Start
+	e.avgMaxBps = -1
+	return e
+}
+
+/*
+ * OnPacket update the estimate with a packet received at arrival, seq &
+ * rtpTimestamp unwrapped. Return the estimate & true when a REMB should be
+ * sent: periodically, or at once when the estimate drops.
+ */
+func (e *BandwidthEstimator) OnPacket(arrival time.Time, seq uint64, rtpTimestamp uint64, size int) (bps int, remb bool) {
+	e.Lock()
+	defer e.Unlock()
+	e.updateIncomingRate(arrival, size)
+	e.updateLoss(arrival, seq)
+	if e.updateGroups(arrival, rtpTimestamp) {
+		e.updateRate(arrival)
+	}
+
+	e.estimate = int(math.Min(e.delayEstimate, e.lossEstimate))
+	if e.estimate < e.min {
+		e.estimate = e.min
+	}
+	if e.estimate > e.max {
+		e.estimate = e.max
+	}
+	if arrival.Sub(e.lastRembAt) >= bweRembPeriod || float64(e.estimate) < float64(e.lastRemb)*bweRembDecreaseTrigger {
+		e.lastRemb = e.estimate
+		e.lastRembAt = arrival
+		return e.estimate, true
+	}
+	return e.estimate, false
+}
+
+// OnLayerPacket count a packet of a simulcast layer > 0 in the incoming
+// bitrate
+func (e *BandwidthEstimator) OnLayerPacket(arrival time.Time, size int) {
+	e.Lock()
+	defer e.Unlock()
+	e.updateIncomingRate(arrival, size)
+}
+
+func (e *BandwidthEstimator) updateIncomingRate(arrival time.Time, size int) {
+	if e.incomingSince.IsZero() {
+		e.incomingSince = arrival
+	}
+	e.arrivals = append(e.arrivals, bweArrival{at: arrival, size: size})
+	e.arrivalsBytes += size
+	i := 0
+	for ; i < len(e.arrivals) && arrival.Sub(e.arrivals[i].at) > bweIncomingRateWindow; i++ {
+		e.arrivalsBytes -= e.arrivals[i].size
+	}
+	e.arrivals = e.arrivals[i:]
+	e.incomingBps = int(float64(e.arrivalsBytes*8) / bweIncomingRateWindow.Seconds())
+}
+
+// updateLoss compute the loss rate every bweLossPeriod & the loss based estimate
+func (e *BandwidthEstimator) updateLoss(arrival time.Time, seq uint64) {
+	if e.lossPeriodAt.IsZero() {
+		e.lossPeriodAt = arrival
+		e.lossBaseSeq = seq
+		e.lossHighestSeq = seq
+	}
+	if seq > e.lossHighestSeq {
+		e.lossHighestSeq = seq
+	}
+	e.lossReceived++
+	if arrival.Sub(e.lossPeriodAt) < bweLossPeriod {
+		return
+	}
+	expected := int(e.lossHighestSeq-e.lossBaseSeq) + 1
+	e.lossRate = 0
+	if expected > e.lossReceived {
+		e.lossRate = float64(expected-e.lossReceived) / float64(expected)
+	}
+	switch {
+	case e.lossRate < bweLossLow:
+		e.lossEstimate = math.Min(e.lossEstimate*1.08+1000, float64(e.max))
+	case e.lossRate > bweLossHigh:
+		e.lossEstimate = math.Max(float64(e.incomingBps)*(1-0.5*e.lossRate), float64(e.min))
+	}
+	e.lossPeriodAt = arrival
+	e.lossBaseSeq = e.lossHighestSeq + 1
+	e.lossReceived = 0
+}
+
+/*
+ * updateGroups return true when a group is completed, the delay variation
+ * between the last two groups is then fed to the trendline filter
+ */
+func (e *BandwidthEstimator) updateGroups(arrival time.Time, rtpTimestamp uint64) bool {
+	if e.current == nil {
+		e.current = &bwePacketGroup{rtpTimestamp: rtpTimestamp, lastArrival: arrival}
+		return false
+	}
+	if rtpTimestamp < e.current.rtpTimestamp {
+		// reordered packet of a previous frame
+		return false
+	}
+	if rtpTimestamp == e.current.rtpTimestamp {
+		e.current.lastArrival = arrival
+		return false
+	}
+	completed := false
+	if e.previous != nil {
+		sendDelta := float64(e.current.rtpTimestamp-e.previous.rtpTimestamp) * 1000 / float64(e.freq)
+		arrivalDelta := float64(e.current.lastArrival.Sub(e.previous.lastArrival)) / float64(time.Millisecond)
+		e.updateTrendline(arrivalDelta-sendDelta, sendDelta, e.current.lastArrival)
+		completed = true
+	}
+	e.previous = e.current
+	e.current = &bwePacketGroup{rtpTimestamp: rtpTimestamp, lastArrival: arrival}
+	return completed
+}
+
+// updateTrendline estimate the slope of the smoothed delay (ms/ms)
+func (e *BandwidthEstimator) updateTrendline(delayDelta float64, sendDelta float64, arrival time.Time) {
+	if e.firstArrival.IsZero() {
+		e.firstArrival = arrival
+	}
+	if e.numDeltas < bweTrendlineMaxDeltas {
+		e.numDeltas++
+	}
+	e.accumulatedDelay += delayDelta
+	e.smoothedDelay = bweTrendlineSmoothing*e.smoothedDelay + (1-bweTrendlineSmoothing)*e.accumulatedDelay
+	x := float64(arrival.Sub(e.firstArrival)) / float64(time.Millisecond)
+	e.samples = append(e.samples, [2]float64{x, e.smoothedDelay})
+	if len(e.samples) > bweTrendlineWindow {
+		e.samples = e.samples[1:]
+	}
+	if len(e.samples) == bweTrendlineWindow {
+		e.trend = linearFitSlope(e.samples, e.trend)
+	}
+	e.detect(sendDelta, arrival)
+}
+
+// linearFitSlope return the least squares slope, previous if undefined
+func linearFitSlope(samples [][2]float64, previous float64) float64 {
+	var sumX, sumY float64
+	for _, s := range samples {
+		sumX += s[0]
+		sumY += s[1]
+	}
+	avgX := sumX / float64(len(samples))
+	avgY := sumY / float64(len(samples))
+	var num, den float64
+	for _, s := range samples {
+		num += (s[0] - avgX) * (s[1] - avgY)
+		den += (s[0] - avgX) * (s[0] - avgX)
+	}
+	if den == 0 {
+		return previous
+	}
+	return num / den
+}
+
+// detect compare the modified trend with the adaptive threshold
+func (e *BandwidthEstimator) detect(sendDelta float64, arrival time.Time) {
+	if e.numDeltas < 2 {
+		e.usage = BandwidthNormal
+		return
+	}
+	modifiedTrend := float64(e.numDeltas) * e.trend * bweTrendlineGain
+	e.prevModifiedTrend = modifiedTrend
+	switch {
+	case modifiedTrend > e.threshold:
+		if e.timeOverUsing == -1 {
+			// assume the overuse started half way between the samples
+			e.timeOverUsing = sendDelta / 2
+		} else {
+			e.timeOverUsing += sendDelta
+		}
+		e.overuseCounter++
+		if e.timeOverUsing > float64(bweOveruseTime/time.Millisecond) && e.overuseCounter > 1 && e.trend >= e.prevTrend {
+			e.timeOverUsing = 0
+			e.overuseCounter = 0
+			e.usage = BandwidthOverusing
+		}
+	case modifiedTrend < -e.threshold:
+		e.timeOverUsing = -1
+		e.overuseCounter = 0
+		e.usage = BandwidthUnderusing
+	default:
+		e.timeOverUsing = -1
+		e.overuseCounter = 0
+		e.usage = BandwidthNormal
+	}
+	e.prevTrend = e.trend
+	e.updateThreshold(modifiedTrend, arrival)
+}
+
+// updateThreshold make the threshold follow the trend slowly, so the
+// estimator is not starved by concurrent TCP flows
+func (e *BandwidthEstimator) updateThreshold(modifiedTrend float64, arrival time.Time) {
+	if e.lastThresholdAt.IsZero() {
+		e.lastThresholdAt = arrival
+	}
+	absTrend := math.Abs(modifiedTrend)
+	if absTrend > e.threshold+15 {
+		// spike, ignored
+		e.lastThresholdAt = arrival
+		return
+	}
+	k := bweThresholdKUp
+	if absTrend < e.threshold {
+		k = bweThresholdKDown
+	}
+	elapsed := math.Min(float64(arrival.Sub(e.lastThresholdAt))/float64(time.Millisecond), 100)
+	e.threshold += k * (absTrend - e.threshold) * elapsed
+	e.threshold = math.Max(bweThresholdMin, math.Min(e.threshold, bweThresholdMax))
+	e.lastThresholdAt = arrival
+}
+
+// updateRate AIMD on the delay based estimate
+func (e *BandwidthEstimator) updateRate(now time.Time) {
+	switch e.usage {
+	case BandwidthNormal:
+		if e.state == RateControlHold {
+			e.state = RateControlIncrease
+		}
+	case BandwidthOverusing:
+		e.state = RateControlDecrease
+	case BandwidthUnderusing:
+		e.state = RateControlHold
+	}
+	if e.lastUpdateAt.IsZero() {
+		e.lastUpdateAt = now
+	}
+	elapsed := math.Min(now.Sub(e.lastUpdateAt).Seconds(), 1)
+	e.lastUpdateAt = now
+	incoming := float64(e.incomingBps)
+
+	switch e.state {
+	case RateControlIncrease:
+		if e.avgMaxBps >= 0 && incoming > e.avgMaxBps+3*math.Sqrt(e.varMaxBps*e.avgMaxBps) {
+			// the link capacity changed
+			e.avgMaxBps = -1
+		}
+		if e.avgMaxBps >= 0 && incoming > e.avgMaxBps-3*math.Sqrt(e.varMaxBps*e.avgMaxBps) {
+			// close to the last congestion, additive increase: a packet per
+			// response time
+			e.delayEstimate += math.Max(1000, 1200*8*elapsed/0.2)
+		} else {
+			e.delayEstimate *= math.Pow(bweIncreasePerSecond, elapsed)
+		}
+		// not above what is actually received, once measured
+		if now.Sub(e.incomingSince) >= bweIncomingRateWindow {
+			e.delayEstimate = math.Min(e.delayEstimate, 1.5*incoming+10000)
+		}
+	case RateControlDecrease:
+		if incoming > 0 {
+			e.delayEstimate = bweDecreaseFactor * incoming
+			e.updateMaxBitrate(incoming)
+		}
+		e.state = RateControlHold
+	}
+	e.delayEstimate = math.Max(float64(e.min), math.Min(e.delayEstimate, float64(e.max)))
+}
+
+// updateMaxBitrate track the incoming bitrate at congestion, mean & variance
+func (e *BandwidthEstimator) updateMaxBitrate(incoming float64) {
+	const alpha = 0.05
+	if e.avgMaxBps < 0 {
+		e.avgMaxBps = incoming
+	} else {
+		e.avgMaxBps = (1-alpha)*e.avgMaxBps + alpha*incoming
+	}
+	norm := math.Max(e.avgMaxBps, 1)
+	e.varMaxBps = (1-alpha)*e.varMaxBps + alpha*(e.avgMaxBps-incoming)*(e.avgMaxBps-incoming)/norm
+	e.varMaxBps = math.Max(0.4, math.Min(e.varMaxBps, 2.5))
+}
+
+// State return the estimator internal state, published on the pipeline bus
+func (e *BandwidthEstimator) State() *PipelineMessageBandwidthEstimate {
+	e.Lock()
+	defer e.Unlock()
+	return &PipelineMessageBandwidthEstimate{
+		Bps:         uint64(e.estimate),
+		DelayBps:    uint64(e.delayEstimate),
+		LossBps:     uint64(e.lossEstimate),
+		IncomingBps: uint64(e.incomingBps),
+		Usage:       e.usage,
+		State:       e.state,
+		Trend:       e.prevModifiedTrend,
+		Threshold:   e.threshold,
+		LossRate:    e.lossRate,
+	}
+}
+
+func (m *PipelineMessageBandwidthEstimate) String() string {
+	return fmt.Sprintf("estimate=%d delay=%d loss=%d incoming=%d usage=%s state=%s trend=%.2f threshold=%.2f lossRate=%.3f",
+		m.Bps, m.DelayBps, m.LossBps, m.IncomingBps, m.Usage, m.State, m.Trend, m.Threshold, m.LossRate)
+}
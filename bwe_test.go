@@ -0,0 +1,200 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	bweTestFrameInterval = 33 * time.Millisecond
+	// 90kHz clock
+	bweTestFrameTicks   = 2970
+	bweTestFramePackets = 4
+	// 4 * 300 bytes at 30 fps, ~290 kbps
+	bweTestPacketSize = 300
+)
+
+type bweTestStream struct {
+	e     *BandwidthEstimator
+	start time.Time
+	seq   uint64
+	frame int
+	// last estimate & REMB returned
+	bps  int
+	remb bool
+}
+
+func newBweTestStream() *bweTestStream {
+	return &bweTestStream{
+		e:     NewBandwidthEstimator(90000, testBitrate),
+		start: time.Unix(1500000000, 0),
+	}
+}
+
+/*
+ * feed send frames of bweTestFramePackets packets, the arrival of a frame
+ * is delayed by delay(frame) & one packet of lossEvery is lost (0: none)
+ */
+func (s *bweTestStream) feed(frames int, delay func(frame int) time.Duration, lossEvery int) {
+	for i := 0; i < frames; i++ {
+		arrival := s.start.Add(time.Duration(s.frame)*bweTestFrameInterval + delay(s.frame))
+		for p := 0; p < bweTestFramePackets; p++ {
+			s.seq++
+			if lossEvery > 0 && s.seq%uint64(lossEvery) == 0 {
+				continue
+			}
+			bps, remb := s.e.OnPacket(arrival.Add(time.Duration(p)*time.Millisecond), s.seq, uint64(s.frame*bweTestFrameTicks), bweTestPacketSize)
+			s.bps = bps
+			s.remb = s.remb || remb
+		}
+		s.frame++
+	}
+}
+
+func bweNoDelay(frame int) time.Duration {
+	return 0
+}
+
+func TestBandwidthEstimatorUsage(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay func(frame int) time.Duration
+		usage BandwidthUsage
+	}{
+		{"constant delay", bweNoDelay, BandwidthNormal},
+		{"jitter", func(frame int) time.Duration {
+			return time.Duration(frame%2) * 3 * time.Millisecond
+		}, BandwidthNormal},
+		{"growing queue", func(frame int) time.Duration {
+			return time.Duration(frame) * 10 * time.Millisecond
+		}, BandwidthOverusing},
+		{"draining queue", func(frame int) time.Duration {
+			return time.Duration(100-frame) * 10 * time.Millisecond
+		}, BandwidthUnderusing},
+	}
+	for _, test := range tests {
+		s := newBweTestStream()
+		s.feed(60, test.delay, 0)
+		if s.e.usage != test.usage {
+			t.Errorf("%s: usage is %s, expected %s (trend %.2f, threshold %.2f)", test.name, s.e.usage, test.usage, s.e.prevModifiedTrend, s.e.threshold)
+		}
+	}
+}
+
+func TestBandwidthEstimatorThreshold(t *testing.T) {
+	s := newBweTestStream()
+	s.feed(60, bweNoDelay, 0)
+	if s.e.threshold != bweThresholdMin {
+		t.Errorf("threshold is %.2f without delay variation, expected %.2f", s.e.threshold, bweThresholdMin)
+	}
+}
+
+func TestBandwidthEstimatorRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay func(frame int) time.Duration
+		state RateControlState
+		// expected delay based estimate, relative to the incoming bitrate
+		minRatio float64
+		maxRatio float64
+	}{
+		// multiplicative increase, capped by the incoming bitrate
+		{"increase", bweNoDelay, RateControlIncrease, 1.1, 1.5},
+		// decrease below the incoming bitrate
+		{"decrease", func(frame int) time.Duration {
+			if frame < 150 {
+				return 0
+			}
+			return time.Duration(frame-150) * 10 * time.Millisecond
+		}, RateControlHold, 0.7, 0.9},
+	}
+	for _, test := range tests {
+		s := newBweTestStream()
+		s.feed(180, test.delay, 0)
+		state := s.e.State()
+		ratio := float64(state.DelayBps) / float64(state.IncomingBps)
+		if state.State != test.state || ratio < test.minRatio || ratio > test.maxRatio {
+			t.Errorf("%s: %s, expected state %s and a delay estimate between %.2f and %.2f of the incoming bitrate", test.name, state, test.state, test.minRatio, test.maxRatio)
+		}
+		if !s.remb {
+			t.Errorf("%s: no REMB sent", test.name)
+		}
+	}
+}
+
+func TestBandwidthEstimatorDecreaseSendsREMB(t *testing.T) {
+	s := newBweTestStream()
+	s.feed(150, bweNoDelay, 0)
+	before := s.bps
+	s.remb = false
+	s.feed(20, func(frame int) time.Duration {
+		return time.Duration(frame-150) * 10 * time.Millisecond
+	}, 0)
+	if s.bps >= before || !s.remb {
+		t.Errorf("estimate %d => %d, REMB %t: expected an immediate REMB with a lower estimate", before, s.bps, s.remb)
+	}
+}
+
+func TestBandwidthEstimatorLoss(t *testing.T) {
+	tests := []struct {
+		name      string
+		lossEvery int
+		// expected loss based estimate, relative to the incoming bitrate,
+		// 0: not capped
+		ratio float64
+	}{
+		{"no loss", 0, 0},
+		// 5%, between the thresholds: hold
+		{"moderate loss", 20, 0},
+		// 25%, capped to incoming * (1 - loss/2)
+		{"heavy loss", 4, 0.875},
+	}
+	for _, test := range tests {
+		s := newBweTestStream()
+		s.feed(45, bweNoDelay, test.lossEvery)
+		state := s.e.State()
+		if test.ratio == 0 {
+			if state.LossBps != uint64(testBitrate.Max) {
+				t.Errorf("%s: %s, expected the loss estimate to stay at %d", test.name, state, testBitrate.Max)
+			}
+			continue
+		}
+		expected := test.ratio * float64(state.IncomingBps)
+		if float64(state.LossBps) < expected*0.95 || float64(state.LossBps) > expected*1.05 {
+			t.Errorf("%s: %s, expected a loss estimate of %.0f", test.name, state, expected)
+		}
+		if state.Bps != state.LossBps {
+			t.Errorf("%s: estimate %d, expected the loss estimate %d", test.name, state.Bps, state.LossBps)
+		}
+	}
+}
+
+func TestBandwidthEstimatorLossRecovery(t *testing.T) {
+	s := newBweTestStream()
+	s.feed(45, bweNoDelay, 4)
+	capped := s.e.State().LossBps
+	s.feed(90, bweNoDelay, 0)
+	if recovered := s.e.State().LossBps; recovered <= capped {
+		t.Errorf("loss estimate %d => %d, expected an increase without loss", capped, recovered)
+	}
+}
+
+func TestBandwidthEstimatorSimulcastLayers(t *testing.T) {
+	s := newBweTestStream()
+	// a second layer 3 times bigger, counted by the estimator of the first
+	for i := 0; i < 180; i++ {
+		s.feed(1, bweNoDelay, 0)
+		arrival := s.start.Add(time.Duration(i) * bweTestFrameInterval)
+		for p := 0; p < 3*bweTestFramePackets; p++ {
+			s.e.OnLayerPacket(arrival, bweTestPacketSize)
+		}
+	}
+	state := s.e.State()
+	first := bweTestFramePackets * bweTestPacketSize * 8 * 30
+	if state.IncomingBps < uint64(first*3) {
+		t.Errorf("%s: incoming bitrate should include the layers (first layer %d bps)", state, first)
+	}
+	if state.DelayBps < uint64(first*3/2) {
+		t.Errorf("%s: the estimate is capped by the first layer bitrate %d", state, first)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+/*
+ * local candidates
+ *
+ * we are an ICE lite agent, we only have host candidates (RFC 8445 2.5).
+ * every advertised address is a host candidate on the session UDP port,
+ * by decreasing local preference:
+ *  - private addresses (config.Network.PrivateIPs), clients of the same network
+ *  - addresses of the local interfaces (config.Network.DiscoverInterfaces)
+ *  - public addresses (config.Network.PublicIPV4 & NAT1To1IPs), 1:1 NAT
+ *  - public IPv6 (config.Network.PublicIPV6), if listening dual-stack
+ * sessions listen on the wildcard address, so checks are received on any of
+ * them.
+ */
+
+import (
+	"context"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+var localAddressesOnce sync.Once
+var localAddressesList []net.IP
+
+// localAddresses return the advertised addresses, computed once
+func localAddresses(ctx context.Context) []net.IP {
+	localAddressesOnce.Do(func() {
+		localAddressesList = listLocalAddresses(ctx)
+	})
+	return localAddressesList
+}
+
+func listLocalAddresses(ctx context.Context) (addresses []net.IP) {
+	log := plogger.FromContextSafe(ctx).Prefix("CANDIDATES")
+	dualStack := config.Network.PublicIPV6 != ""
+
+	add := func(ip net.IP) {
+		if ip.To4() == nil && !dualStack {
+			return
+		}
+		for _, known := range addresses {
+			if known.Equal(ip) {
+				return
+			}
+		}
+		addresses = append(addresses, ip)
+	}
+	parse := func(env string, values ...string) {
+		for _, v := range values {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				log.Warnf("invalid ip address %s in %s, skipping", v, env)
+				continue
+			}
+			add(ip)
+		}
+	}
+
+	parse("PRIVATE_IPS", config.Network.PrivateIPs...)
+	if config.Network.DiscoverInterfaces {
+		interfaceAddrs, err := net.InterfaceAddrs()
+		if !log.OnError(err, "could not list the local interfaces addresses") {
+			for _, interfaceAddr := range interfaceAddrs {
+				ipNet, ok := interfaceAddr.(*net.IPNet)
+				if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+					continue
+				}
+				add(ipNet.IP)
+			}
+		}
+	}
+	if config.Network.PublicIPV4 != "" {
+		parse("PUBLIC_IPV4", config.Network.PublicIPV4)
+	}
+	parse("NAT_1TO1_IPS", config.Network.NAT1To1IPs...)
+	if config.Network.PublicIPV6 != "" {
+		parse("PUBLIC_IPV6", config.Network.PublicIPV6)
+	}
+	// IPv4 first, the private/public order is kept inside each family
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].To4() != nil && addresses[j].To4() == nil
+	})
+	log.Infof("advertised addresses %v", addresses)
+	return
+}
+
+// hostCandidates return the MCU IP:Port candidates, one foundation per
+// address (different bases) & a decreasing local preference
+func hostCandidates(ctx context.Context, listenPort int) (candidates []sdp.Candidate) {
+	for i, ip := range localAddresses(ctx) {
+		localPreference := 65535 - i
+		candidates = append(candidates, sdp.Candidate{
+			Foundation:  strconv.Itoa(i + 1),
+			ComponentId: 1,
+			Transport:   "udp",
+			Priority:    int64(math.Pow(2, 24)*126 + math.Pow(2, 8)*float64(localPreference) + math.Pow(2, 0)*256),
+			Address:     ip,
+			Port:        listenPort,
+			Typ:         "host",
+		})
+	}
+	return
+}
+
+// localAddressFor guess which advertised address a remote address is
+// reaching, the wildcard sockets don't tell the destination of a packet.
+// Same family, private with private & public with public if possible.
+func localAddressFor(ctx context.Context, rIP net.IP) (ip net.IP) {
+	for _, localIP := range localAddresses(ctx) {
+		if (localIP.To4() == nil) != (rIP.To4() == nil) {
+			continue
+		}
+		if isPrivateIP(localIP) == isPrivateIP(rIP) {
+			return localIP
+		}
+		if ip == nil {
+			ip = localIP
+		}
+	}
+	return
+}
+
+// isPrivateIP is true for the RFC 1918 & RFC 4193 (unique local) addresses
+func isPrivateIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
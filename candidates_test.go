@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"172.31.255.255", true},
+		{"172.32.0.1", false},
+		{"172.15.0.1", false},
+		{"192.168.1.1", true},
+		{"192.169.1.1", false},
+		{"8.8.8.8", false},
+		{"::ffff:192.168.1.1", true},
+		{"fd00::1", true},
+		{"fc00::1", true},
+		{"fe80::1", false},
+		{"2001:db8::1", false},
+	}
+	for _, test := range tests {
+		if private := isPrivateIP(net.ParseIP(test.ip)); private != test.private {
+			t.Errorf("%s: private %t, expected %t", test.ip, private, test.private)
+		}
+	}
+}
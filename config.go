@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/dtls"
 	"github.com/heytribe/live-webrtcsignaling/my"
 )
 
@@ -29,10 +33,31 @@ type Bitrate struct {
 type ModeOptions int
 
 const (
-	ModeSFU = iota
+	ModeSFU ModeOptions = iota
 	ModeMCU
 )
 
+func (m ModeOptions) String() string {
+	switch m {
+	case ModeSFU:
+		return "sfu"
+	case ModeMCU:
+		return "mcu"
+	}
+	return "unknown"
+}
+
+// parseModeOption read a mode as reported by String
+func parseModeOption(s string) (mode ModeOptions, ok bool) {
+	switch s {
+	case "sfu":
+		return ModeSFU, true
+	case "mcu":
+		return ModeMCU, true
+	}
+	return
+}
+
 type Config struct {
 	Env         int
 	Mode				ModeOptions
@@ -44,6 +69,16 @@ type Config struct {
 	Network struct {
 		PortNumber string // fixme
 		PublicIPV4 string
+		// optional, sessions listen dual-stack when set
+		PublicIPV6 string
+		// extra advertised addresses: public addresses mapped 1:1 to this
+		// host & private addresses for clients of the same network
+		NAT1To1IPs []string
+		PrivateIPs []string
+		// advertise the addresses of the local interfaces too
+		DiscoverInterfaces bool
+		// single UDP port shared by every sessions, 0 = one port per session
+		UdpMuxPort int
 		Ws         struct {
 			WriteWait        time.Duration
 			PongWait         time.Duration
@@ -57,8 +92,15 @@ type Config struct {
 		FullUnitName string
 	}
 	Cert struct {
+		// TLS of the websocket & of rabbitmq, not used by DTLS
 		FilePath    string
 		KeyFilePath string
+		// DTLS certificates are generated, rotated before they expire
+		DtlsRotationPeriod time.Duration
+	}
+	Dtls struct {
+		// OpenSSL names, colon separated, by order of preference
+		SrtpProfiles string
 	}
 	JWTSecret    string
 	GraphiteIPV4 string
@@ -73,6 +115,23 @@ type Config struct {
 	Bitrates struct {
 		Audio Bitrate
 		Video Bitrate
+		// algorithm of the video bitrates, see NewBitrateController
+		Controller string
+	}
+	Room struct {
+		// peers of a room
+		MaxSize int
+		// SFU: videos forwarded to a listener, the last active speakers.
+		// 0 = every publisher. Default of the rooms, a join token can
+		// change it
+		LastN int
+		// peers of a room with a last-N
+		LastNMaxSize int
+	}
+	Sfu struct {
+		// forward the publisher RTP video to the listeners instead of
+		// re-payloading the gstreamer output, keeps the VP8 temporal layers
+		ForwardRTP bool
 	}
 	CpuCores int
 	Vp8      struct {
@@ -92,12 +151,37 @@ func (c *Config) Init(ctx context.Context) (err error) {
 	ctx = plogger.NewContextAddPrefix(ctx, "Config")
 	log, _ := plogger.FromContext(ctx)
 
+	// default mode of the rooms, chosen per room afterwards
 	c.Mode = ModeSFU
 
 	staticPorts := os.Getenv("STATIC_PORTS")
 	if staticPorts == "1" {
 		c.StaticPorts = true
 	}
+	if os.Getenv("SFU_FORWARD_RTP") == "1" {
+		c.Sfu.ForwardRTP = true
+	}
+	c.Room.MaxSize = 8
+	if roomMaxSize := os.Getenv("ROOM_MAX_SIZE"); roomMaxSize != "" {
+		c.Room.MaxSize, err = strconv.Atoi(roomMaxSize)
+		if log.OnError(err, "invalid env ROOM_MAX_SIZE") {
+			return
+		}
+	}
+	c.Room.LastNMaxSize = 20
+	if roomMaxSize := os.Getenv("ROOM_LASTN_MAX_SIZE"); roomMaxSize != "" {
+		c.Room.LastNMaxSize, err = strconv.Atoi(roomMaxSize)
+		if log.OnError(err, "invalid env ROOM_LASTN_MAX_SIZE") {
+			return
+		}
+	}
+	c.Room.LastN = 3
+	if lastN := os.Getenv("LAST_N"); lastN != "" {
+		c.Room.LastN, err = strconv.Atoi(lastN)
+		if log.OnError(err, "invalid env LAST_N") {
+			return
+		}
+	}
 
 	// FIXME: use var MCU_ENV
 	c.Env = ENV_DEVELOPPEMENT
@@ -151,18 +235,51 @@ func (c *Config) Init(ctx context.Context) (err error) {
 	if log.OnError(err, "invalid env BITRATE_VIDEO_STEP") {
 		return
 	}
+	c.Bitrates.Controller = "loss"
+	if controller := os.Getenv("BITRATE_CONTROLLER"); controller != "" {
+		c.Bitrates.Controller = controller
+	}
+	_, err = NewBitrateController(c.Bitrates.Controller, c.Bitrates.Video)
+	if log.OnError(err, "invalid env BITRATE_CONTROLLER") {
+		return
+	}
 
 	/*
 	 * ENV
 	 */
 	c.Network.PortNumber = os.Getenv("PORT_NUMBER")
 	c.Network.PublicIPV4 = os.Getenv("PUBLIC_IPV4")
+	c.Network.PublicIPV6 = os.Getenv("PUBLIC_IPV6")
+	c.Network.NAT1To1IPs = splitEnvList("NAT_1TO1_IPS")
+	c.Network.PrivateIPs = splitEnvList("PRIVATE_IPS")
+	if os.Getenv("DISCOVER_INTERFACES") == "1" {
+		c.Network.DiscoverInterfaces = true
+	}
+	if udpMuxPort := os.Getenv("UDP_MUX_PORT"); udpMuxPort != "" {
+		c.Network.UdpMuxPort, err = strconv.Atoi(udpMuxPort)
+		if log.OnError(err, "invalid env UDP_MUX_PORT") {
+			return
+		}
+	}
 	//
 	c.Instance.Uuid = os.Getenv("INSTANCE_UUID")
 	c.Instance.FullUnitName = os.Getenv("FULL_UNIT_NAME")
 	//
 	c.Cert.FilePath = os.Getenv("CERT_FILE_PATH")
 	c.Cert.KeyFilePath = os.Getenv("KEY_FILE_PATH")
+	c.Cert.DtlsRotationPeriod = 7 * 24 * time.Hour
+	if dtlsRotationPeriod := os.Getenv("DTLS_CERT_ROTATION_PERIOD"); dtlsRotationPeriod != "" {
+		c.Cert.DtlsRotationPeriod, err = time.ParseDuration(dtlsRotationPeriod)
+		if log.OnError(err, "invalid env DTLS_CERT_ROTATION_PERIOD") {
+			return
+		}
+	}
+	if c.Cert.DtlsRotationPeriod <= 0 || c.Cert.DtlsRotationPeriod >= dtls.CertificateValidity {
+		err = errors.New(fmt.Sprintf("DTLS certificates valid %s must be rotated more often than every %s", dtls.CertificateValidity, c.Cert.DtlsRotationPeriod))
+		log.OnError(err, "invalid env DTLS_CERT_ROTATION_PERIOD")
+		return
+	}
+	c.Dtls.SrtpProfiles = os.Getenv("SRTP_PROFILES")
 	//
 	c.JWTSecret = os.Getenv("JWT_SECRET")
 	c.GraphiteIPV4 = os.Getenv("GRAPHITE_IPV4")
@@ -204,3 +321,13 @@ func (c *Config) Init(ctx context.Context) (err error) {
 
 	return
 }
+
+// splitEnvList return the comma separated values of an env var
+func splitEnvList(name string) (values []string) {
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return
+}
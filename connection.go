@@ -43,6 +43,10 @@ type connection struct {
 	udpConnListener			*ProtectedMap
 	sdpSession *SdpSession*/
 	webRTCSessionPublisher *WebRTCSession
+	// listener sessions offered when a publisher is up, see subscription.go
+	autoSubscribe bool
+	// quality of the subscriptions by publisher socketId
+	subscriptions *ProtectedMap
 }
 
 func NewConnection(wsId uint64, ws *websocket.Conn) *connection {
@@ -55,6 +59,8 @@ func NewConnection(wsId uint64, ws *websocket.Conn) *connection {
 	c.state = `creating`
 	c.exit = false
 	c.webRTCSessionListeners = NewWebRTCSessionMap()
+	c.autoSubscribe = true
+	c.subscriptions = NewProtectedMap()
 	// naming mutex
 	c.wsMutex.Init("connection.ws")
 	c.joinMutex.Init("connection.join")
@@ -166,6 +172,8 @@ func (c *connection) copy(cSrc *connection) {
 	c.maxVideoBitrate = cSrc.maxVideoBitrate
 	c.maxAudioBitrate = cSrc.maxAudioBitrate
 	c.wsDataToRetransmit = cSrc.wsDataToRetransmit
+	c.autoSubscribe = cSrc.autoSubscribe
+	c.subscriptions = cSrc.subscriptions
 }
 
 func (c *connection) manageTimeout(ctx context.Context, ttl time.Duration) {
@@ -187,6 +195,15 @@ func (c *connection) manageTimeout(ctx context.Context, ttl time.Duration) {
 	return
 }
 
+func (c *connection) closeWebRTCSessionListeners(ctx context.Context) {
+	c.webRTCSessionListeners.Lock()
+	for socketId, w := range c.webRTCSessionListeners.d {
+		w.(*WebRTCSession).Disconnect(ctx)
+		delete(c.webRTCSessionListeners.d, socketId)
+	}
+	c.webRTCSessionListeners.Unlock()
+}
+
 func (c *connection) getPublisherCodec(ctx context.Context) (codecOption CodecOptions, ok bool) {
 	if c.webRTCSessionPublisher == nil {
 		return -1, false
@@ -195,6 +212,31 @@ func (c *connection) getPublisherCodec(ctx context.Context) (codecOption CodecOp
 	return
 }
 
+// getPublisherH264ProfileLevelId return the profile-level-id answered to
+// the publisher, "" if it does not send H264
+func (c *connection) getPublisherH264ProfileLevelId() string {
+	if c.webRTCSessionPublisher == nil {
+		return ""
+	}
+	_, answer := c.webRTCSessionPublisher.sdpCtx.Negotiated()
+	if answer == nil {
+		return ""
+	}
+	return answer.GetVideoFmtp("H264", "profile-level-id")
+}
+
+// closeWebRTCSessions disconnect our publisher & listener sessions, the
+// client has to publish again
+func (c *connection) closeWebRTCSessions(ctx context.Context) {
+	c.closeWebRTCSessionListeners(ctx)
+	c.negoSdpMutex.Lock(ctx)
+	if c.webRTCSessionPublisher != nil {
+		c.webRTCSessionPublisher.Disconnect(ctx)
+		c.webRTCSessionPublisher = nil
+	}
+	c.negoSdpMutex.Unlock(ctx)
+}
+
 // JSON marshaling
 type jsonConnection struct {
 	SocketId               string            `json:"socketId"`
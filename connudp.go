@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 
 	plogger "github.com/heytribe/go-plogger"
@@ -26,7 +27,7 @@ const (
 
 type connectionUdp struct {
 	wsConn      *connection
-	conn        *net.UDPConn
+	conn        udpSessionConn
 	dtlsSession *dtls.DTLSSession
 	gstSession  *GstSession
 	exit        bool
@@ -38,10 +39,13 @@ type connectionUdp struct {
 	tieBreaker  []byte
 	srtpSession *srtp.SrtpSession
 	sdpCtx      *SdpContext
+	// selected remote address, media follows it on ICE restart
+	rAddr      *net.UDPAddr
+	rAddrMutex sync.RWMutex
 }
 
 // FIXME: refactor.
-func NewConnectionUdp(ctx context.Context, udpConn *net.UDPConn, wsConn *connection) *connectionUdp {
+func NewConnectionUdp(ctx context.Context, udpConn udpSessionConn, wsConn *connection) *connectionUdp {
 	c := new(connectionUdp)
 	c.send = make(chan *packet.UDP, 1000)
 	c.connMutex.Init("conn")
@@ -55,6 +59,23 @@ func NewConnectionUdp(ctx context.Context, udpConn *net.UDPConn, wsConn *connect
 	return c
 }
 
+func (c *connectionUdp) SetRAddr(rAddr *net.UDPAddr) {
+	c.rAddrMutex.Lock()
+	defer c.rAddrMutex.Unlock()
+	c.rAddr = rAddr
+}
+
+// mediaRAddr return the selected remote address if any, packets built
+// before an ICE restart still carry the previous one.
+func (c *connectionUdp) mediaRAddr(rAddr *net.UDPAddr) *net.UDPAddr {
+	c.rAddrMutex.RLock()
+	defer c.rAddrMutex.RUnlock()
+	if c.rAddr != nil {
+		return c.rAddr
+	}
+	return rAddr
+}
+
 // write writes a message with the given message type and payload.
 func (c *connectionUdp) writeTo(ctx context.Context, udpPacket *packet.UDP) (err error) {
 	if udpPacket.GetRAddr() == nil {
@@ -79,7 +100,8 @@ func (c *connectionUdp) writeSrtpTo(ctx context.Context, rtpPacket *srtp.PacketR
 		err = errors.New("could not push a nil RTP packet !!!")
 		return
 	}
-	if rtpPacket.GetRAddr() == nil {
+	rAddr := c.mediaRAddr(rtpPacket.GetRAddr())
+	if rAddr == nil {
 		err = errors.New("could not send packet remote address is not set")
 		return
 	}
@@ -103,7 +125,7 @@ func (c *connectionUdp) writeSrtpTo(ctx context.Context, rtpPacket *srtp.PacketR
 	}
 	c.connMutex.Lock(ctx)
 	defer c.connMutex.Unlock(ctx)
-	_, err = c.conn.WriteTo(d[:newSize], rtpPacket.GetRAddr())
+	_, err = c.conn.WriteTo(d[:newSize], rAddr)
 	if err != nil {
 		return
 	}
@@ -114,7 +136,8 @@ func (c *connectionUdp) writeSrtpTo(ctx context.Context, rtpPacket *srtp.PacketR
 // write writes a message with the given message type and payload.
 func (c *connectionUdp) writeSrtpRtcpTo(ctx context.Context, rtcpPacket *RtpUdpPacket) (err error) {
 	log, _ := plogger.FromContext(ctx)
-	if rtcpPacket.RAddr == nil {
+	rAddr := c.mediaRAddr(rtcpPacket.RAddr)
+	if rAddr == nil {
 		err = errors.New("could not send packet remote address is not set")
 		return
 	}
@@ -133,7 +156,7 @@ func (c *connectionUdp) writeSrtpRtcpTo(ctx context.Context, rtcpPacket *RtpUdpP
 		return nil // not really an error ?
 	}
 	//logger.Debugf("rtpPacket.data was len = %d, new Size is %d", l, newSize)
-	_, err = c.conn.WriteTo(d[:newSize], rtcpPacket.RAddr)
+	_, err = c.conn.WriteTo(d[:newSize], rAddr)
 	//_, err = c.conn.WriteTo(rtpPacket.Data, rtpPacket.RAddr)
 	if err != nil {
 		return
@@ -4,11 +4,23 @@ package dtls
 import "C"
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"math/big"
 	"runtime"
+	"time"
 	"unsafe"
 )
 
+// CertificateValidity is the validity of the generated certificates, Rotate
+// must be called more often
+const CertificateValidity = 30 * 24 * time.Hour
+
 type Certificate struct {
 	x      *C.X509
 	Issuer *Certificate
@@ -34,8 +46,16 @@ const (
 
 func getDigestFunction(digest EVP_MD) (md *C.EVP_MD) {
 	switch digest {
+	case EVP_SHA1:
+		md = C.X_EVP_sha1()
+	case EVP_SHA224:
+		md = C.X_EVP_sha224()
 	case EVP_SHA256:
 		md = C.X_EVP_sha256()
+	case EVP_SHA384:
+		md = C.X_EVP_sha384()
+	case EVP_SHA512:
+		md = C.X_EVP_sha512()
 	}
 	return md
 }
@@ -64,6 +84,9 @@ func LoadCertificateFromPEM(pem_block []byte) (*Certificate, error) {
 // X509Digest returns a digest of the DER representation of the public key
 func (c *Certificate) Digest(digest EVP_MD) ([]byte, error) {
 	var md *C.EVP_MD = getDigestFunction(digest)
+	if md == nil {
+		return nil, errors.New("unsupported digest function")
+	}
 	var fingerprint [C.EVP_MAX_MD_SIZE]byte
 	var len C.uint
 	if C.X509_digest(c.x, md, (*C.uchar)(unsafe.Pointer(&fingerprint[0])), &len) == 0 {
@@ -71,3 +94,43 @@ func (c *Certificate) Digest(digest EVP_MD) ([]byte, error) {
 	}
 	return fingerprint[:len], nil
 }
+
+// GenerateCertificate create a self-signed ECDSA P-256 certificate, the
+// identity of WebRTC peers is their fingerprint, not a certificate chain
+func GenerateCertificate() (cert *Certificate, key PrivateKey, err error) {
+	var ecKey *ecdsa.PrivateKey
+	var serial *big.Int
+	var certDer, keyDer []byte
+
+	ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "WebRTC"},
+		NotBefore:    now.Add(-24 * time.Hour),
+		NotAfter:     now.Add(CertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err = x509.CreateCertificate(rand.Reader, template, template, &ecKey.PublicKey, ecKey)
+	if err != nil {
+		return
+	}
+	cert, err = LoadCertificateFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}))
+	if err != nil {
+		return
+	}
+	keyDer, err = x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		return
+	}
+	key, err = LoadPrivateKeyFromPKCS8DER(keyDer)
+	return
+}
@@ -17,6 +17,8 @@ type Ctx struct {
 	key       PrivateKey
 	verify_cb VerifyCallback
 	sni_cb    TLSExtServernameCallback
+	// sha-256 of cert
+	fingerprint string
 }
 
 type VerifyCallback func(preverify_ok bool, store *CertificateStoreCtx) bool
@@ -84,7 +86,8 @@ func (c *Ctx) SetEllipticCurve(curve EllipticCurve) error {
 type SSLVersion int
 
 const (
-	DTLSv1 SSLVersion = 0x01
+	DTLSv1   SSLVersion = 0x01
+	DTLSv1_2 SSLVersion = 0x02
 )
 
 var (
@@ -148,11 +151,20 @@ func NewCtxWithVersion(version SSLVersion) (*Ctx, error) {
 	switch version {
 	case DTLSv1:
 		method = C.X_DTLS_method()
+	case DTLSv1_2:
+		method = C.X_DTLSv1_2_method()
 	}
 	if method == nil {
 		return nil, errors.New("unknown ssl/tls version")
 	}
-	return newCtx(method)
+	c, err := newCtx(method)
+	if err != nil {
+		return nil, err
+	}
+	if version == DTLSv1_2 && C.X_SSL_CTX_set_min_dtls1_2(c.ctx) != 1 {
+		return nil, errorFromErrorQueue()
+	}
+	return c, nil
 }
 
 func (c *Ctx) SetVerify(options VerifyOptions, verify_cb VerifyCallback) {
@@ -164,11 +176,16 @@ func (c *Ctx) SetVerify(options VerifyOptions, verify_cb VerifyCallback) {
 	}
 }
 
-func (c *Ctx) SetTLSExtUseSrtp(profiles string) {
+// SetTLSExtUseSrtp set the SRTP profiles offered/accepted, colon separated
+// OpenSSL names in order of preference
+func (c *Ctx) SetTLSExtUseSrtp(profiles string) error {
 	p := C.CString(profiles)
 	defer C.free(unsafe.Pointer(p))
 
-	C.X_SSL_CTX_set_tlsext_use_srtp(c.ctx, p)
+	if C.X_SSL_CTX_set_tlsext_use_srtp(c.ctx, p) != 0 {
+		return errorFromErrorQueue()
+	}
+	return nil
 }
 
 func (c *Ctx) SetCipherList(list string) error {
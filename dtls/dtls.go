@@ -7,10 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"runtime"
-	"strings"
+	"sync"
 	"unsafe"
 
 	"time"
@@ -25,8 +24,11 @@ const dtlsCiphers = "ALL:NULL:eNULL:aNULL"
 //const dtlsCiphers = "ALL:!ADH:!LOW:!EXP:!MD5:@STRENGTH"
 
 var (
-	localFingerprint   string
 	libraryInitialized bool
+	srtpProfiles       = DefaultSrtpProfiles
+	// context of the new sessions, replaced by Rotate
+	currentCtx      *Ctx
+	currentCtxMutex sync.RWMutex
 )
 
 var (
@@ -43,6 +45,9 @@ type DTLSSession struct {
 	isShutdown       bool
 	mutex            my.Mutex
 	want_read_future *Future
+	// announced in the remote SDP, checked by verifyPeer
+	fingerprints []Fingerprint
+	verifyErr    error
 }
 
 var log plogger.PLogger
@@ -55,10 +60,6 @@ func init() {
 	}
 }
 
-func GetLocalFingerprint() string {
-	return localFingerprint
-}
-
 func verifyCallback(preverifyOk bool, store *CertificateStoreCtx) bool {
 	log.Infof("preverifyOk is %v, store is %#v", preverifyOk, store)
 
@@ -111,80 +112,75 @@ func infoCallback(s *C.SSL, where int, ret int) {
 	return
 }
 
-func LoadKeys(ctx *Ctx, certFile string, keyFile string) (cert *Certificate, key PrivateKey, err error) {
-	var certBytes []byte
-
-	certBytes, err = ioutil.ReadFile(certFile)
-	if err != nil {
+// Init initialize the DTLS context with a generated certificate, see Rotate.
+// profiles are the OpenSSL SRTP profile names, DefaultSrtpProfiles if empty.
+func Init(profiles string) (ctx *Ctx, err error) {
+	if libraryInitialized == true {
+		err = errors.New("DTLS library is already initialized")
 		return
 	}
-
-	certs := SplitPEM(certBytes)
-	if len(certs) == 0 {
-		err = fmt.Errorf("No PEM certificate found in '%s'", certFile)
-		return
+	if profiles != "" {
+		srtpProfiles = profiles
 	}
 
-	first, certs := certs[0], certs[1:]
-	cert, err = LoadCertificateFromPEM(first)
+	ctx, err = Rotate()
 	if err != nil {
 		return
 	}
 
-	err = ctx.UseCertificate(cert)
-	if err != nil {
-		return
-	}
+	libraryInitialized = true
 
-	var c *Certificate
-	for _, pem := range certs {
-		c, err = LoadCertificateFromPEM(pem)
-		if err != nil {
-			return
-		}
-		err = ctx.AddChainCertificate(c)
-		if err != nil {
-			return
-		}
-	}
+	return
+}
 
-	var keyBytes []byte
-	keyBytes, err = ioutil.ReadFile(keyFile)
-	if err != nil {
-		return
-	}
+// Rotate generate a new certificate & make its context the current one,
+// the sessions created with the previous context keep their certificate
+func Rotate() (ctx *Ctx, err error) {
+	var cert *Certificate
+	var key PrivateKey
 
-	key, err = LoadPrivateKeyFromPEM(keyBytes)
+	cert, key, err = GenerateCertificate()
 	if err != nil {
 		return
 	}
-
-	err = ctx.UsePrivateKey(key)
+	ctx, err = newDTLSCtx(cert, key)
 	if err != nil {
 		return
 	}
+	currentCtxMutex.Lock()
+	currentCtx = ctx
+	currentCtxMutex.Unlock()
+	log.Infof("new local certificate, fingerprint is %s", ctx.GetLocalFingerprint())
 
 	return
 }
 
-func Init(certFilePath string, keyFilePath string) (ctx *Ctx, err error) {
-	if libraryInitialized == true {
-		err = errors.New("DTLS library is already initialized")
-		return
-	}
+// Current return the context new sessions should be created with
+func Current() *Ctx {
+	currentCtxMutex.RLock()
+	defer currentCtxMutex.RUnlock()
+	return currentCtx
+}
 
-	ctx, err = NewCtxWithVersion(DTLSv1)
+func newDTLSCtx(cert *Certificate, key PrivateKey) (ctx *Ctx, err error) {
+	ctx, err = NewCtxWithVersion(DTLSv1_2)
 	if err != nil {
-		err = errors.New("could not create new OpenSSL context with openssl.DTLS method")
+		err = errors.New("could not create new OpenSSL context with openssl.DTLS 1.2 method")
 		return
 	}
 
 	ctx.SetVerify(VerifyPeer|VerifyFailIfNoPeerCert, verifyCallback)
-	ctx.SetTLSExtUseSrtp("SRTP_AES128_CM_SHA1_80")
+	err = ctx.SetTLSExtUseSrtp(srtpProfiles)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid SRTP profiles %s: %s", srtpProfiles, err.Error()))
+		return
+	}
 
-	var certFile *Certificate
-	//var keyFile openssl.PrivateKey
-	certFile, _, err = LoadKeys(ctx, certFilePath, keyFilePath)
+	err = ctx.UseCertificate(cert)
+	if err != nil {
+		return
+	}
+	err = ctx.UsePrivateKey(key)
 	if err != nil {
 		return
 	}
@@ -193,17 +189,13 @@ func Init(certFilePath string, keyFilePath string) (ctx *Ctx, err error) {
 		return
 	}
 	var digest []byte
-	digest, err = certFile.Digest(EVP_SHA256)
+	digest, err = cert.Digest(EVP_SHA256)
 	if err != nil {
 		return
 	}
 	log.Infof("digest is %#v", digest)
 
-	strSlice := make([]string, len(digest))
-	for i, b := range digest {
-		strSlice[i] = fmt.Sprintf("%.2X", b)
-	}
-	localFingerprint = strings.Join(strSlice, ":")
+	ctx.fingerprint = formatDigest(digest)
 
 	// No auto mtu
 	ctx.SetOptions(OpNoQueryMtu)
@@ -212,11 +204,15 @@ func Init(certFilePath string, keyFilePath string) (ctx *Ctx, err error) {
 	ctx.SetOptions(OpSingleECDHUse)
 	ctx.SetEllipticCurve(Prime256v1)
 
-	libraryInitialized = true
-
 	return
 }
 
+// GetLocalFingerprint return the sha-256 fingerprint of the context
+// certificate, for the a=fingerprint of the sessions created with it
+func (ctx *Ctx) GetLocalFingerprint() string {
+	return ctx.fingerprint
+}
+
 func newSSL(ctx *C.SSL_CTX) (*C.SSL, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
@@ -246,7 +242,9 @@ const (
 	DtlsRoleServer DtlsRole = 1
 )
 
-func (ctx *Ctx) NewDTLS(ch chan *packet.UDP, rAddr *net.UDPAddr, dtlsRole DtlsRole) (*DTLSSession, error) {
+// NewDTLS create a session with the remote peer, the handshake fails if the
+// peer certificate doesn't match one of the fingerprints
+func (ctx *Ctx) NewDTLS(ch chan *packet.UDP, rAddr *net.UDPAddr, dtlsRole DtlsRole, fingerprints []Fingerprint) (*DTLSSession, error) {
 	ssl, err := newSSL(ctx.ctx)
 	if err != nil {
 		return nil, err
@@ -278,17 +276,18 @@ func (ctx *Ctx) NewDTLS(ch chan *packet.UDP, rAddr *net.UDPAddr, dtlsRole DtlsRo
 
 	s := &SSL{ssl: ssl}
 	C.SSL_set_ex_data(s.ssl, get_ssl_idx(), unsafe.Pointer(s))
-	s.SetVerifyCallback(verifyCallback)
 	s.SetInfoCallback(infoCallback)
 
 	dtlsSession := &DTLSSession{
-		SSL:      s,
-		ch:       ch,
-		rAddr:    rAddr,
-		ctx:      ctx,
-		intoOSSL: intoOSSL,
-		fromOSSL: fromOSSL,
+		SSL:          s,
+		ch:           ch,
+		rAddr:        rAddr,
+		ctx:          ctx,
+		intoOSSL:     intoOSSL,
+		fromOSSL:     fromOSSL,
+		fingerprints: fingerprints,
 	}
+	s.SetVerifyCallback(dtlsSession.verifyPeer)
 
 	runtime.SetFinalizer(dtlsSession, func(dtlsSession *DTLSSession) {
 		dtlsSession.intoOSSL.Disconnect(intoOSSLBio)
@@ -403,6 +402,9 @@ func (dtlsSession *DTLSSession) Handshake() (err error) {
 		}
 		err = dtlsSession.handleError(dtlsSession.handshake())
 	}
+	if err != nil && dtlsSession.verifyErr != nil {
+		err = dtlsSession.verifyErr
+	}
 	log.Infof("handshake done after %d iterations (%v)", i, time.Now().Sub(ts))
 
 	rc := 0
@@ -441,6 +443,10 @@ func (dtlsSession *DTLSSession) Accept() (err error) {
 	for err == tryAgain {
 		err = dtlsSession.handleError(dtlsSession.accept())
 	}
+	if dtlsSession.verifyErr != nil {
+		err = dtlsSession.verifyErr
+		return
+	}
 
 	rc := int(C.SSL_is_init_finished(dtlsSession.ssl))
 	if rc != 1 {
@@ -460,6 +466,13 @@ func (dtlsSession *DTLSSession) GetSrtpKeys() (srtpKeys *SrtpKeys, err error) {
 	return
 }
 
+// SetRAddr move the session to a new remote address (ICE restart)
+func (dtlsSession *DTLSSession) SetRAddr(rAddr *net.UDPAddr) {
+	dtlsSession.mutex.Lock()
+	defer dtlsSession.mutex.Unlock()
+	dtlsSession.rAddr = rAddr
+}
+
 func (dtlsSession *DTLSSession) flushOutputBuffer() error {
 	_, err := dtlsSession.fromOSSL.WriteTo(dtlsSession.ch, dtlsSession.rAddr)
 	return err
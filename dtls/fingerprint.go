@@ -0,0 +1,103 @@
+package dtls
+
+//#include "shim.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint is a certificate hash announced by a=fingerprint (RFC 8122)
+type Fingerprint struct {
+	Type string // ex: sha-256
+	Hash string // ex: 42:89:C5:C6(...)
+}
+
+func getDigestByName(hashType string) (digest EVP_MD, err error) {
+	switch strings.ToLower(hashType) {
+	case "sha-1":
+		digest = EVP_SHA1
+	case "sha-224":
+		digest = EVP_SHA224
+	case "sha-256":
+		digest = EVP_SHA256
+	case "sha-384":
+		digest = EVP_SHA384
+	case "sha-512":
+		digest = EVP_SHA512
+	default:
+		err = errors.New(fmt.Sprintf("unsupported fingerprint hash function %s", hashType))
+	}
+	return
+}
+
+func formatDigest(digest []byte) string {
+	strSlice := make([]string, len(digest))
+	for i, b := range digest {
+		strSlice[i] = fmt.Sprintf("%.2X", b)
+	}
+	return strings.Join(strSlice, ":")
+}
+
+// Match compare the fingerprint with the hash of the certificate
+func (f Fingerprint) Match(cert *Certificate) (ok bool, err error) {
+	var digest EVP_MD
+	var b []byte
+
+	digest, err = getDigestByName(f.Type)
+	if err != nil {
+		return
+	}
+	b, err = cert.Digest(digest)
+	if err != nil {
+		return
+	}
+	ok = strings.EqualFold(formatDigest(b), f.Hash)
+	return
+}
+
+// GetCurrentCert return the certificate being verified, owned by the store
+func (store *CertificateStoreCtx) GetCurrentCert() *Certificate {
+	x := C.X509_STORE_CTX_get_current_cert(store.ctx)
+	if x == nil {
+		return nil
+	}
+	return &Certificate{x: x}
+}
+
+// GetErrorDepth return the depth of the certificate being verified,
+// 0 is the peer certificate
+func (store *CertificateStoreCtx) GetErrorDepth() int {
+	return int(C.X509_STORE_CTX_get_error_depth(store.ctx))
+}
+
+// verifyPeer check the peer certificate against the fingerprints of the
+// remote SDP. WebRTC certificates are self-signed, the chain is not verified.
+func (dtlsSession *DTLSSession) verifyPeer(preverifyOk bool, store *CertificateStoreCtx) bool {
+	if store.GetErrorDepth() != 0 {
+		return true
+	}
+	cert := store.GetCurrentCert()
+	if cert == nil {
+		dtlsSession.verifyErr = errors.New("DTLS peer did not present a certificate")
+		return false
+	}
+	if len(dtlsSession.fingerprints) == 0 {
+		dtlsSession.verifyErr = errors.New("no fingerprint in the remote SDP, could not verify the DTLS peer certificate")
+		return false
+	}
+	for _, fingerprint := range dtlsSession.fingerprints {
+		ok, err := fingerprint.Match(cert)
+		if err != nil {
+			log.Warnf("could not check %s fingerprint: %s", fingerprint.Type, err.Error())
+			continue
+		}
+		if ok {
+			return true
+		}
+	}
+	dtlsSession.verifyErr = errors.New(fmt.Sprintf("DTLS peer certificate does not match the remote SDP fingerprints %v", dtlsSession.fingerprints))
+	return false
+}
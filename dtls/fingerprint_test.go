@@ -0,0 +1,105 @@
+package dtls_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heytribe/live-webrtcsignaling/dtls"
+)
+
+// newTestCertificate return a self-signed certificate & its DER encoding
+func newTestCertificate(t *testing.T) (*dtls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cert, err := dtls.LoadCertificateFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return cert, der
+}
+
+// formatTestDigest format a digest as the hash of a=fingerprint (RFC 8122 5)
+func formatTestDigest(digest []byte) string {
+	s := make([]string, len(digest))
+	for i, b := range digest {
+		s[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(s, ":")
+}
+
+func TestFingerprintMatch(t *testing.T) {
+	cert, der := newTestCertificate(t)
+	sha256Digest := sha256.Sum256(der)
+	sha1Digest := sha1.Sum(der)
+	other := sha256.Sum256(append(der, 0))
+	tests := []struct {
+		name        string
+		fingerprint dtls.Fingerprint
+		ok          bool
+	}{
+		{"sha-256", dtls.Fingerprint{Type: "sha-256", Hash: formatTestDigest(sha256Digest[:])}, true},
+		// the hash function & the hex digits are case insensitive
+		{"lower case hash", dtls.Fingerprint{Type: "sha-256", Hash: strings.ToLower(formatTestDigest(sha256Digest[:]))}, true},
+		{"upper case type", dtls.Fingerprint{Type: "SHA-256", Hash: formatTestDigest(sha256Digest[:])}, true},
+		{"sha-1", dtls.Fingerprint{Type: "sha-1", Hash: formatTestDigest(sha1Digest[:])}, true},
+		{"other certificate", dtls.Fingerprint{Type: "sha-256", Hash: formatTestDigest(other[:])}, false},
+		{"hash function mismatch", dtls.Fingerprint{Type: "sha-1", Hash: formatTestDigest(sha256Digest[:])}, false},
+		{"without colons", dtls.Fingerprint{Type: "sha-256", Hash: strings.Replace(formatTestDigest(sha256Digest[:]), ":", "", -1)}, false},
+		{"empty hash", dtls.Fingerprint{Type: "sha-256", Hash: ""}, false},
+	}
+	for _, test := range tests {
+		ok, err := test.fingerprint.Match(cert)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: match %t, expected %t", test.name, ok, test.ok)
+		}
+	}
+}
+
+func TestFingerprintMatchUnsupported(t *testing.T) {
+	cert, der := newTestCertificate(t)
+	digest := sha256.Sum256(der)
+	for _, hashType := range []string{"md5", "sha-3", ""} {
+		if _, err := (dtls.Fingerprint{Type: hashType, Hash: formatTestDigest(digest[:])}).Match(cert); err == nil {
+			t.Errorf("%s: no error", hashType)
+		}
+	}
+}
+
+func TestCertificateDigest(t *testing.T) {
+	cert, der := newTestCertificate(t)
+	expected := sha256.Sum256(der)
+	digest, err := cert.Digest(dtls.EVP_SHA256)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if formatTestDigest(digest) != formatTestDigest(expected[:]) {
+		t.Errorf("sha-256 digest %s, expected %s", formatTestDigest(digest), formatTestDigest(expected[:]))
+	}
+}
@@ -276,6 +276,31 @@ func LoadPrivateKeyFromDER(der_block []byte) (PrivateKey, error) {
 	return p, nil
 }
 
+// LoadPrivateKeyFromPKCS8DER loads a private key of any type (RSA, EC) from
+// a DER-encoded PKCS#8 block.
+func LoadPrivateKeyFromPKCS8DER(der_block []byte) (PrivateKey, error) {
+	if len(der_block) == 0 {
+		return nil, errors.New("empty der block")
+	}
+	bio := C.BIO_new_mem_buf(unsafe.Pointer(&der_block[0]),
+		C.int(len(der_block)))
+	if bio == nil {
+		return nil, errors.New("failed creating bio")
+	}
+	defer C.BIO_free(bio)
+
+	key := C.d2i_PrivateKey_bio(bio, nil)
+	if key == nil {
+		return nil, errors.New("failed reading pkcs8 key")
+	}
+
+	p := &pKey{key: key}
+	runtime.SetFinalizer(p, func(p *pKey) {
+		C.X_EVP_PKEY_free(p.key)
+	})
+	return p, nil
+}
+
 // LoadPrivateKeyFromPEMWidthPassword loads a private key from a PEM-encoded block.
 // Backwards-compatible with typo
 func LoadPrivateKeyFromPEMWidthPassword(pem_block []byte, password string) (
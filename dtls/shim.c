@@ -222,6 +222,34 @@ const EVP_MD *X_EVP_sha512() {
 	return EVP_sha512();
 }
 
+const EVP_MD *X_EVP_sha224() {
+	return EVP_sha224();
+}
+
+const EVP_MD *X_EVP_sha384() {
+	return EVP_sha384();
+}
+
+// DTLS 1.2 only, the minimum version is set by X_SSL_CTX_set_min_dtls1_2
+const SSL_METHOD *X_DTLSv1_2_method() {
+#if OPENSSL_VERSION_NUMBER >= 0x1010000fL
+  return DTLS_method();
+#elif OPENSSL_VERSION_NUMBER >= 0x10002000L
+  return DTLSv1_2_method();
+#else
+  return NULL;
+#endif
+}
+
+// refuse the DTLS 1.0 peers, DTLSv1_2_method is already 1.2 only
+int X_SSL_CTX_set_min_dtls1_2(SSL_CTX *ctx) {
+#if OPENSSL_VERSION_NUMBER >= 0x1010000fL
+  return SSL_CTX_set_min_proto_version(ctx, DTLS1_2_VERSION);
+#else
+  return 1;
+#endif
+}
+
 const SSL_METHOD *X_DTLS_method() {
 #if OPENSSL_VERSION_NUMBER >= 0x1010000fL
   return DTLS_method();
@@ -28,6 +28,8 @@ extern int X_EVP_VerifyInit(EVP_MD_CTX *ctx, const EVP_MD *type);
 extern int X_EVP_VerifyUpdate(EVP_MD_CTX *ctx, const void *d, unsigned int cnt);
 extern int X_EVP_VerifyFinal(EVP_MD_CTX *ctx, const unsigned char *sigbuf, unsigned int siglen, EVP_PKEY *pkey);
 extern const SSL_METHOD *X_DTLS_method();
+extern const SSL_METHOD *X_DTLSv1_2_method();
+extern int X_SSL_CTX_set_min_dtls1_2(SSL_CTX *ctx);
 extern long X_SSL_CTX_add_extra_chain_cert(SSL_CTX* ctx, X509 *cert);
 extern int X_SSL_CTX_new_index();
 extern long X_SSL_CTX_set_options(SSL_CTX* ctx, long options);
@@ -46,6 +48,8 @@ extern int X_BIO_read(BIO *b, void *buf, int len);
 extern int X_BIO_write(BIO *b, const void *buf, int len);
 extern const EVP_MD *X_EVP_sha1();
 extern const EVP_MD *X_EVP_sha512();
+extern const EVP_MD *X_EVP_sha224();
+extern const EVP_MD *X_EVP_sha384();
 extern int X_SSL_new_index();
 extern int X_SSL_verify_cb(int preverify_ok, X509_STORE_CTX* store);
 extern void X_SSL_info_cb(SSL *s, int where, int ret);
@@ -5,7 +5,9 @@ import "C"
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"unsafe"
 )
 
@@ -18,12 +20,60 @@ const (
 	SSLTLSEXTErrNoAck        SSLTLSExtErr = C.SSL_TLSEXT_ERR_NOACK
 )
 
+// SrtpProfile is a DTLS-SRTP protection profile id (RFC 5764 & RFC 7714)
+type SrtpProfile uint16
+
 const (
-	SSLSrtpMasterKeyLength  int = 16
-	SSLSrtpMasterSaltLength int = 14
-	SSLSrtpMasterLength     int = SSLSrtpMasterKeyLength + SSLSrtpMasterSaltLength
+	SrtpAes128CmSha1_80 SrtpProfile = 0x0001
+	SrtpAes128CmSha1_32 SrtpProfile = 0x0002
+	SrtpAeadAes128Gcm   SrtpProfile = 0x0007
+	SrtpAeadAes256Gcm   SrtpProfile = 0x0008
 )
 
+// OpenSSL names, in our order of preference
+const DefaultSrtpProfiles = "SRTP_AEAD_AES_128_GCM:SRTP_AEAD_AES_256_GCM:SRTP_AES128_CM_SHA1_80:SRTP_AES128_CM_SHA1_32"
+
+// OpenSSL names of the profiles
+var srtpProfileNames = map[string]SrtpProfile{
+	"SRTP_AES128_CM_SHA1_80": SrtpAes128CmSha1_80,
+	"SRTP_AES128_CM_SHA1_32": SrtpAes128CmSha1_32,
+	"SRTP_AEAD_AES_128_GCM":  SrtpAeadAes128Gcm,
+	"SRTP_AEAD_AES_256_GCM":  SrtpAeadAes256Gcm,
+}
+
+/*
+ * FilterSrtpProfiles remove the profiles the SRTP library can't create
+ * sessions for from the OpenSSL names (DefaultSrtpProfiles if empty),
+ * unknown names are kept for SetTLSExtUseSrtp to reject them
+ */
+func FilterSrtpProfiles(profiles string, supported func(SrtpProfile) bool) (filtered string, err error) {
+	if profiles == "" {
+		profiles = DefaultSrtpProfiles
+	}
+	var kept []string
+	for _, name := range strings.Split(profiles, ":") {
+		if profile, ok := srtpProfileNames[name]; ok && !supported(profile) {
+			log.Warnf("SRTP profile %s is not supported by the SRTP library, ignored", name)
+			continue
+		}
+		kept = append(kept, name)
+	}
+	if len(kept) == 0 {
+		err = errors.New(fmt.Sprintf("none of the SRTP profiles %s is supported by the SRTP library", profiles))
+		return
+	}
+	filtered = strings.Join(kept, ":")
+	return
+}
+
+// master key & master salt lengths of each profile
+var srtpProfileLengths = map[SrtpProfile][2]int{
+	SrtpAes128CmSha1_80: {16, 14},
+	SrtpAes128CmSha1_32: {16, 14},
+	SrtpAeadAes128Gcm:   {16, 12},
+	SrtpAeadAes256Gcm:   {32, 12},
+}
+
 var (
 	ssl_idx = C.X_SSL_new_index()
 )
@@ -130,28 +180,54 @@ func (s *SSL) SetSSLCtx(ctx *Ctx) {
 }
 
 type SrtpKeys struct {
+	Profile    SrtpProfile
 	LocalKey   []byte
 	RemoteKey  []byte
 	LocalSalt  []byte
 	RemoteSalt []byte
 }
 
+// GetSelectedSrtpProfile return the profile negotiated by the use_srtp extension
+func (s *SSL) GetSelectedSrtpProfile() (profile SrtpProfile, err error) {
+	p := C.SSL_get_selected_srtp_profile(s.ssl)
+	if p == nil {
+		err = errors.New("no SRTP profile negotiated")
+		return
+	}
+	profile = SrtpProfile(p.id)
+	return
+}
+
 func (s *SSL) ExportKeyingMaterialSrtp() (srtpKeys *SrtpKeys, err error) {
+	var profile SrtpProfile
+
+	profile, err = s.GetSelectedSrtpProfile()
+	if err != nil {
+		return
+	}
+	lengths, ok := srtpProfileLengths[profile]
+	if !ok {
+		err = errors.New(fmt.Sprintf("unsupported SRTP profile 0x%04x", uint16(profile)))
+		return
+	}
+	keyLength, saltLength := lengths[0], lengths[1]
+
 	label := C.CString("EXTRACTOR-dtls_srtp")
 	defer C.free(unsafe.Pointer(label))
-	material := make([]byte, SSLSrtpMasterLength*2)
+	material := make([]byte, (keyLength+saltLength)*2)
 	if 1 != C.SSL_export_keying_material(s.ssl, (*C.uchar)(unsafe.Pointer(&material[0])), C.size_t(len(material)), label, C.size_t(19), nil, C.size_t(0), C.int(0)) {
 		err = errors.New("Could not get keying material")
 		return
 	}
 
-	log.Infof("material is %#v", material)
+	log.Infof("profile is 0x%04x, material is %#v", uint16(profile), material)
 
 	srtpKeys = &SrtpKeys{
-		LocalKey:   material[:SSLSrtpMasterKeyLength],
-		RemoteKey:  material[SSLSrtpMasterKeyLength : SSLSrtpMasterKeyLength*2],
-		LocalSalt:  material[SSLSrtpMasterKeyLength*2 : SSLSrtpMasterKeyLength*2+SSLSrtpMasterSaltLength],
-		RemoteSalt: material[SSLSrtpMasterKeyLength*2+SSLSrtpMasterSaltLength : SSLSrtpMasterKeyLength*2+SSLSrtpMasterSaltLength*2],
+		Profile:    profile,
+		LocalKey:   material[:keyLength],
+		RemoteKey:  material[keyLength : keyLength*2],
+		LocalSalt:  material[keyLength*2 : keyLength*2+saltLength],
+		RemoteSalt: material[keyLength*2+saltLength : keyLength*2+saltLength*2],
 	}
 
 	return
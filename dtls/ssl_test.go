@@ -0,0 +1,48 @@
+package dtls_test
+
+import (
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/dtls"
+)
+
+func TestFilterSrtpProfiles(t *testing.T) {
+	withoutGcm := func(profile dtls.SrtpProfile) bool {
+		return profile != dtls.SrtpAeadAes128Gcm && profile != dtls.SrtpAeadAes256Gcm
+	}
+	all := func(profile dtls.SrtpProfile) bool {
+		return true
+	}
+	tests := []struct {
+		name      string
+		profiles  string
+		supported func(dtls.SrtpProfile) bool
+		filtered  string
+	}{
+		{"default", "", all, dtls.DefaultSrtpProfiles},
+		{"default without gcm", "", withoutGcm, "SRTP_AES128_CM_SHA1_80:SRTP_AES128_CM_SHA1_32"},
+		{"configured", "SRTP_AEAD_AES_128_GCM:SRTP_AES128_CM_SHA1_80", withoutGcm, "SRTP_AES128_CM_SHA1_80"},
+		{"unknown name kept", "SRTP_FOO:SRTP_AES128_CM_SHA1_80", withoutGcm, "SRTP_FOO:SRTP_AES128_CM_SHA1_80"},
+	}
+	for _, test := range tests {
+		filtered, err := dtls.FilterSrtpProfiles(test.profiles, test.supported)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if filtered != test.filtered {
+			t.Errorf("%s: profiles %s, expected %s", test.name, filtered, test.filtered)
+		}
+	}
+	if _, err := dtls.FilterSrtpProfiles("SRTP_AEAD_AES_256_GCM", withoutGcm); err == nil {
+		t.Errorf("no error without supported profile")
+	}
+}
+
+func TestNewCtxWithVersion(t *testing.T) {
+	for _, version := range []dtls.SSLVersion{dtls.DTLSv1, dtls.DTLSv1_2} {
+		if _, err := dtls.NewCtxWithVersion(version); err != nil {
+			t.Errorf("version %d: %s", version, err.Error())
+		}
+	}
+}
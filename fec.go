@@ -0,0 +1,268 @@
+package main
+
+/*
+ * Forward error correction (publisher ingress)
+ *
+ * the video of the publisher can be sent in RED (RFC 2198) with ULPFEC
+ * (RFC 5109) packets in the same stream: the FEC packets carry the xor of
+ * a group of media packets, one lost packet of the group can be rebuilt
+ * without waiting for a retransmission.
+ *
+ * the FEC packets consume sequence numbers of the media stream, they are
+ * replaced by empty placeholders so the jitter buffer doesn't nack them.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+const (
+	// media packets kept to rebuild a lost packet
+	fecHistorySize = 256
+	// FEC packets waiting for a loss
+	fecPendingSize = 32
+	// payload types offered to the listeners
+	fecRedPayloadType    = 116
+	fecUlpfecPayloadType = 117
+	fecRedRtxPayloadType = 98
+	// ULPFEC packets sent, in % of the media packets
+	fecMaxPercentage = 50
+)
+
+/*
+ * FecOptions are the payload types of the redundancy negotiated on a
+ * stream, 0 if not negotiated
+ */
+type FecOptions struct {
+	redPayloadType    uint16
+	redRtxPayloadType uint16
+	ulpfecPayloadType uint16
+	// opus: discontinuous transmission (usedtx=1)
+	audioDtx bool
+}
+
+func (o FecOptions) Enabled() bool {
+	return o.redPayloadType != 0 && o.ulpfecPayloadType != 0
+}
+
+type ulpfecPacket struct {
+	ssrc uint32
+	// recovery fields of the FEC header
+	bits      [2]byte
+	seqBase   uint16
+	timestamp uint32
+	length    uint16
+	// level 0
+	mask    []byte
+	payload []byte
+	packet  *srtp.PacketRTP
+}
+
+// protected return the sequence numbers protected by the level 0 mask
+func (f *ulpfecPacket) protected() (seqs []uint16) {
+	for i, b := range f.mask {
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) != 0 {
+				seqs = append(seqs, f.seqBase+uint16(i*8+bit))
+			}
+		}
+	}
+	return
+}
+
+/*
+ * parseUlpfec parse the FEC header & the level 0 header (RFC 5109 7.3 &
+ * 7.4), the other levels are ignored.
+ */
+func parseUlpfec(p *srtp.PacketRTP) (f *ulpfecPacket, err error) {
+	data := p.GetData()
+	offset := p.GetHeaderSize()
+	if offset+10+4 > len(data) {
+		err = errors.New("ulpfec packet too short")
+		return
+	}
+	fec := data[offset:]
+	if fec[0]&0x80 != 0 {
+		err = errors.New("ulpfec extension flag is set")
+		return
+	}
+	f = &ulpfecPacket{
+		ssrc:      p.GetSSRCid(),
+		bits:      [2]byte{fec[0] & 0x3f, fec[1]},
+		seqBase:   binary.BigEndian.Uint16(fec[2:4]),
+		timestamp: binary.BigEndian.Uint32(fec[4:8]),
+		length:    binary.BigEndian.Uint16(fec[8:10]),
+		packet:    p,
+	}
+	maskSize := 2
+	if fec[0]&0x40 != 0 {
+		maskSize = 6
+	}
+	if 12+maskSize > len(fec) {
+		err = errors.New("ulpfec level 0 header truncated")
+		return
+	}
+	protectionLength := int(binary.BigEndian.Uint16(fec[10:12]))
+	f.mask = fec[12 : 12+maskSize]
+	f.payload = fec[12+maskSize:]
+	if protectionLength > len(f.payload) {
+		err = errors.New(fmt.Sprintf("ulpfec protection length %d exceeds the payload (%d)", protectionLength, len(f.payload)))
+		return
+	}
+	f.payload = f.payload[:protectionLength]
+	return
+}
+
+/*
+ * FecReceiver rebuild the lost media packets of a stream from its ULPFEC
+ * packets. Not thread safe, used by the jitter node goroutine.
+ */
+type FecReceiver struct {
+	mediaPt  int
+	redPt    int
+	redRtxPt int
+	ulpfecPt int
+	// media packets as received (header extension included), by seq
+	history     map[uint16][]byte
+	historySeqs []uint16
+	pending     []*ulpfecPacket
+}
+
+func NewFecReceiver(mediaPt uint16, options FecOptions) *FecReceiver {
+	return &FecReceiver{
+		mediaPt:  int(mediaPt),
+		redPt:    int(options.redPayloadType),
+		redRtxPt: int(options.redRtxPayloadType),
+		ulpfecPt: int(options.ulpfecPayloadType),
+		history:  make(map[uint16][]byte),
+	}
+}
+
+// Record save a copy of a media packet, the packet is modified afterwards
+func (r *FecReceiver) Record(p *srtp.PacketRTP) {
+	seq := p.GetSeqNumber()
+	if _, ok := r.history[seq]; ok {
+		return
+	}
+	data := make([]byte, p.GetSize())
+	copy(data, p.GetData())
+	r.history[seq] = data
+	r.historySeqs = append(r.historySeqs, seq)
+	if len(r.historySeqs) > fecHistorySize {
+		delete(r.history, r.historySeqs[0])
+		r.historySeqs = r.historySeqs[1:]
+	}
+}
+
+// PushUlpfec keep the FEC packet (RED primary block) until its group
+// is complete or a packet is missing
+func (r *FecReceiver) PushUlpfec(p *srtp.PacketRTP) error {
+	f, err := parseUlpfec(p)
+	if err != nil {
+		return err
+	}
+	r.pending = append(r.pending, f)
+	if len(r.pending) > fecPendingSize {
+		r.pending = r.pending[1:]
+	}
+	return nil
+}
+
+/*
+ * Recover rebuild the media packets which are the only missing packet of
+ * a FEC group. FEC packets of complete groups are forgotten.
+ */
+func (r *FecReceiver) Recover() (recovered []*srtp.PacketRTP) {
+	for found := true; found; {
+		found = false
+		pending := r.pending[:0]
+		for _, f := range r.pending {
+			var missing []uint16
+			for _, seq := range f.protected() {
+				if _, ok := r.history[seq]; !ok {
+					missing = append(missing, seq)
+				}
+			}
+			switch len(missing) {
+			case 0:
+				// nothing lost
+			case 1:
+				if p := r.rebuild(f, missing[0]); p != nil {
+					r.Record(p)
+					recovered = append(recovered, p)
+					found = true
+				}
+			default:
+				pending = append(pending, f)
+			}
+		}
+		r.pending = pending
+	}
+	return
+}
+
+/*
+ * rebuild xor the FEC packet with the received packets of its group
+ * (RFC 5109 10.4)
+ */
+func (r *FecReceiver) rebuild(f *ulpfecPacket, seq uint16) *srtp.PacketRTP {
+	bits := f.bits
+	timestamp := f.timestamp
+	length := f.length
+	payload := make([]byte, len(f.payload))
+	copy(payload, f.payload)
+	for _, s := range f.protected() {
+		if s == seq {
+			continue
+		}
+		data := r.history[s]
+		bits[0] ^= data[0] & 0x3f
+		bits[1] ^= data[1]
+		timestamp ^= binary.BigEndian.Uint32(data[4:8])
+		length ^= uint16(len(data) - 12)
+		for i := 12; i < len(data) && i-12 < len(payload); i++ {
+			payload[i-12] ^= data[i]
+		}
+	}
+	if int(length) > len(payload) {
+		return nil
+	}
+	data := make([]byte, 12+int(length))
+	data[0] = 0x80 | bits[0]
+	data[1] = bits[1]
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[4:8], timestamp)
+	binary.BigEndian.PutUint32(data[8:12], f.ssrc)
+	copy(data[12:], payload[:length])
+	p := srtp.NewPacketRTP(packet.NewUDPFromData(data, f.packet.GetRAddr()))
+	p.SetCreatedAt(f.packet.GetCreatedAt())
+	if p.GetPT() != r.mediaPt {
+		return nil
+	}
+	return p
+}
+
+/*
+ * fecSeqPlaceholder return an empty media packet with the sequence number
+ * of a FEC packet, it is not decoded, the SFU forwarders skip its sequence
+ * number.
+ */
+func fecSeqPlaceholder(p *srtp.PacketRTP, mediaPt int) *srtp.PacketRTP {
+	data := make([]byte, 12)
+	copy(data, p.GetData()[0:12])
+	// no padding, extension & csrcs
+	data[0] = 0x80
+	data[1] = data[1]&0x80 | byte(mediaPt)
+	placeholder := srtp.NewPacketRTP(packet.NewUDPFromData(data, p.GetRAddr()))
+	placeholder.SetCreatedAt(p.GetCreatedAt())
+	return placeholder
+}
+
+func isFecSeqPlaceholder(p *srtp.PacketRTP) bool {
+	return p.GetSize() <= 12
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+const (
+	fecTestMediaPt = 96
+	fecTestSSRC    = 0xAABBCCDD
+)
+
+// newFecTestMedia build a media packet without extension, marker on odd
+// sequence numbers
+func newFecTestMedia(seq uint16, timestamp uint32, payload []byte) []byte {
+	data := make([]byte, 12, 12+len(payload))
+	data[0] = 0x80
+	data[1] = fecTestMediaPt
+	if seq%2 == 1 {
+		data[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[4:8], timestamp)
+	binary.BigEndian.PutUint32(data[8:12], fecTestSSRC)
+	return append(data, payload...)
+}
+
+/*
+ * newFecTestUlpfec build the ULPFEC packet protecting media (RFC 5109 7.3 &
+ * 7.4): the recovery fields & payload are the xor of the media packets,
+ * the level 0 mask protects seqBase + i
+ */
+func newFecTestUlpfec(seq uint16, seqBase uint16, media [][]byte) *srtp.PacketRTP {
+	var bits [2]byte
+	var timestamp uint32
+	var length uint16
+	var payload []byte
+	var mask [2]byte
+	for _, data := range media {
+		bits[0] ^= data[0] & 0x3f
+		bits[1] ^= data[1]
+		timestamp ^= binary.BigEndian.Uint32(data[4:8])
+		length ^= uint16(len(data) - 12)
+		for len(payload) < len(data)-12 {
+			payload = append(payload, 0)
+		}
+		for i, b := range data[12:] {
+			payload[i] ^= b
+		}
+		offset := binary.BigEndian.Uint16(data[2:4]) - seqBase
+		mask[offset/8] |= 0x80 >> (offset % 8)
+	}
+	data := make([]byte, 12+10+4, 12+10+4+len(payload))
+	data[0] = 0x80
+	data[1] = fecUlpfecPayloadType
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[8:12], fecTestSSRC)
+	fec := data[12:]
+	fec[0] = bits[0]
+	fec[1] = bits[1]
+	binary.BigEndian.PutUint16(fec[2:4], seqBase)
+	binary.BigEndian.PutUint32(fec[4:8], timestamp)
+	binary.BigEndian.PutUint16(fec[8:10], length)
+	binary.BigEndian.PutUint16(fec[10:12], uint16(len(payload)))
+	copy(fec[12:14], mask[:])
+	data = append(data, payload...)
+	return srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+}
+
+// fecTestGroup is a group of 4 media packets of different sizes
+func fecTestGroup() [][]byte {
+	return [][]byte{
+		newFecTestMedia(100, 3000, []byte{0x01, 0x02, 0x03}),
+		newFecTestMedia(101, 3000, []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16}),
+		newFecTestMedia(102, 6000, []byte{0x21}),
+		newFecTestMedia(103, 6000, []byte{0x31, 0x32, 0x33, 0x34}),
+	}
+}
+
+func newFecTestReceiver() *FecReceiver {
+	return NewFecReceiver(fecTestMediaPt, FecOptions{
+		redPayloadType:    fecRedPayloadType,
+		ulpfecPayloadType: fecUlpfecPayloadType,
+	})
+}
+
+func TestParseUlpfec(t *testing.T) {
+	media := fecTestGroup()
+	f, err := parseUlpfec(newFecTestUlpfec(500, 100, media))
+	if err != nil {
+		t.Fatalf("parse failed: %s", err)
+	}
+	protected := f.protected()
+	expected := []uint16{100, 101, 102, 103}
+	if len(protected) != len(expected) {
+		t.Fatalf("protected %v, expected %v", protected, expected)
+	}
+	for i := range expected {
+		if protected[i] != expected[i] {
+			t.Errorf("protected %v, expected %v", protected, expected)
+			break
+		}
+	}
+	if f.ssrc != fecTestSSRC || f.seqBase != 100 || len(f.payload) != 6 {
+		t.Errorf("ssrc %x, seq base %d, payload size %d: expected %x, 100, 6", f.ssrc, f.seqBase, len(f.payload), fecTestSSRC)
+	}
+}
+
+func TestParseUlpfecInvalid(t *testing.T) {
+	valid := newFecTestUlpfec(500, 100, fecTestGroup()).GetData()
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+	}{
+		{"too short", func(data []byte) []byte {
+			return data[:12+10+3]
+		}},
+		{"extension flag", func(data []byte) []byte {
+			data[12] |= 0x80
+			return data
+		}},
+		{"long mask truncated", func(data []byte) []byte {
+			data[12] |= 0x40
+			return data[:12+10+4+3]
+		}},
+		{"protection length exceeds the payload", func(data []byte) []byte {
+			binary.BigEndian.PutUint16(data[12+10:12+12], 7)
+			return data
+		}},
+	}
+	for _, test := range tests {
+		data := test.modify(append([]byte{}, valid...))
+		p := srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+		if _, err := parseUlpfec(p); err == nil {
+			t.Errorf("%s: parsed without error", test.name)
+		}
+	}
+}
+
+func TestFecReceiverRecover(t *testing.T) {
+	media := fecTestGroup()
+	for lost := range media {
+		r := newFecTestReceiver()
+		for i, data := range media {
+			if i != lost {
+				r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(data, nil)))
+			}
+		}
+		if err := r.PushUlpfec(newFecTestUlpfec(500, 100, media)); err != nil {
+			t.Fatalf("push failed: %s", err)
+		}
+		recovered := r.Recover()
+		if len(recovered) != 1 {
+			t.Errorf("packet %d lost: %d packets recovered, expected 1", lost, len(recovered))
+			continue
+		}
+		if !bytes.Equal(recovered[0].GetData(), media[lost]) {
+			t.Errorf("packet %d lost: recovered %v, expected %v", lost, recovered[0].GetData(), media[lost])
+		}
+		if len(r.pending) != 0 {
+			t.Errorf("packet %d lost: %d FEC packets pending after the recovery", lost, len(r.pending))
+		}
+	}
+}
+
+func TestFecReceiverRecoverComplete(t *testing.T) {
+	media := fecTestGroup()
+	r := newFecTestReceiver()
+	for _, data := range media {
+		r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(data, nil)))
+	}
+	r.PushUlpfec(newFecTestUlpfec(500, 100, media))
+	if recovered := r.Recover(); len(recovered) != 0 {
+		t.Errorf("%d packets recovered from a complete group", len(recovered))
+	}
+	if len(r.pending) != 0 {
+		t.Errorf("the FEC packet of a complete group is pending")
+	}
+}
+
+func TestFecReceiverRecoverLater(t *testing.T) {
+	media := fecTestGroup()
+	r := newFecTestReceiver()
+	r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(media[0], nil)))
+	r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(media[3], nil)))
+	r.PushUlpfec(newFecTestUlpfec(500, 100, media))
+	// 2 packets missing: wait for one of them (retransmission)
+	if recovered := r.Recover(); len(recovered) != 0 {
+		t.Fatalf("%d packets recovered with 2 packets missing", len(recovered))
+	}
+	r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(media[2], nil)))
+	recovered := r.Recover()
+	if len(recovered) != 1 || !bytes.Equal(recovered[0].GetData(), media[1]) {
+		t.Errorf("recovered %d packets, expected packet 101", len(recovered))
+	}
+}
+
+func TestFecReceiverRecoverChained(t *testing.T) {
+	media := fecTestGroup()
+	r := newFecTestReceiver()
+	r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(media[0], nil)))
+	r.Record(srtp.NewPacketRTP(packet.NewUDPFromData(media[3], nil)))
+	// 102 rebuilt from the second packet, then 101 from the first
+	r.PushUlpfec(newFecTestUlpfec(500, 100, media))
+	r.PushUlpfec(newFecTestUlpfec(501, 102, media[2:]))
+	recovered := r.Recover()
+	if len(recovered) != 2 {
+		t.Fatalf("recovered %d packets, expected 2", len(recovered))
+	}
+	if !bytes.Equal(recovered[0].GetData(), media[2]) || !bytes.Equal(recovered[1].GetData(), media[1]) {
+		t.Errorf("recovered seqs %d & %d, expected 102 & 101", recovered[0].GetSeqNumber(), recovered[1].GetSeqNumber())
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+/*
+ * H264 (RFC 6184)
+ *
+ * profile-level-id negotiation: the profiles offered by the publisher are
+ * intersected with the ones the server handles, in MCU mode the ones
+ * decoded by openh264 (the VAAPI decoder is disabled), in SFU mode the
+ * stream is forwarded so the browser profiles are accepted.
+ *
+ * the SPS & PPS of the publisher are kept, a listener starting on an IDR
+ * sent without them receives them first.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+const (
+	h264NalIDR  = 5
+	h264NalSPS  = 7
+	h264NalPPS  = 8
+	h264NalStap = 24
+	h264NalFuA  = 28
+	// profile-level-id of the MCU encoders (openh264enc, vaapih264enc):
+	// constrained baseline 3.1
+	h264EncoderProfileLevelId = "42e01f"
+	// highest level decoded in MCU mode
+	h264DecoderMaxLevel = 0x1f
+)
+
+type H264Profile int
+
+const (
+	H264ProfileUnknown H264Profile = iota
+	H264ProfileConstrainedBaseline
+	H264ProfileBaseline
+	H264ProfileMain
+	H264ProfileConstrainedHigh
+	H264ProfileHigh
+)
+
+/*
+ * profile_idc & profile-iop patterns of the profiles (RFC 6184 8.1), the
+ * constraint flags not in the mask are ignored
+ */
+var h264ProfilePatterns = []struct {
+	profileIdc byte
+	iopMask    byte
+	iopValue   byte
+	profile    H264Profile
+}{
+	{0x42, 0x4f, 0x40, H264ProfileConstrainedBaseline},
+	{0x4d, 0x8f, 0x80, H264ProfileConstrainedBaseline},
+	{0x58, 0xcf, 0xc0, H264ProfileConstrainedBaseline},
+	{0x42, 0x4f, 0x00, H264ProfileBaseline},
+	{0x58, 0xcf, 0x80, H264ProfileBaseline},
+	{0x4d, 0xaf, 0x00, H264ProfileMain},
+	{0x64, 0xff, 0x00, H264ProfileHigh},
+	{0x64, 0xff, 0x0c, H264ProfileConstrainedHigh},
+}
+
+type H264ProfileLevelId struct {
+	Profile H264Profile
+	Level   byte
+	// the 3 bytes of the fmtp
+	profileIdc byte
+	profileIop byte
+}
+
+func ParseH264ProfileLevelId(s string) (p H264ProfileLevelId, err error) {
+	if len(s) != 6 {
+		err = errors.New(fmt.Sprintf("invalid profile-level-id %s", s))
+		return
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		err = errors.New(fmt.Sprintf("invalid profile-level-id %s", s))
+		return
+	}
+	p.profileIdc = byte(v >> 16)
+	p.profileIop = byte(v >> 8)
+	p.Level = byte(v)
+	for _, pattern := range h264ProfilePatterns {
+		if pattern.profileIdc == p.profileIdc && p.profileIop&pattern.iopMask == pattern.iopValue {
+			p.Profile = pattern.profile
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("unsupported profile in profile-level-id %s", s))
+	return
+}
+
+func (p H264ProfileLevelId) String() string {
+	return fmt.Sprintf("%02x%02x%02x", p.profileIdc, p.profileIop, p.Level)
+}
+
+// h264Profiles return the profiles handled by the server, by preference:
+// constrained baseline is decoded by every listener
+func h264Profiles(mode ModeOptions) []H264Profile {
+	if mode == ModeSFU {
+		return []H264Profile{
+			H264ProfileConstrainedBaseline,
+			H264ProfileBaseline,
+			H264ProfileMain,
+			H264ProfileConstrainedHigh,
+			H264ProfileHigh,
+		}
+	}
+	return []H264Profile{H264ProfileConstrainedBaseline, H264ProfileBaseline}
+}
+
+/*
+ * h264AnswerRtp choose the H264 format of an offer media: packetization
+ * mode 1 (the payloaders fragment with FU-A), the most preferred profile
+ * handled, the order of the offer breaks ties. The fmtp of the answer is
+ * the one of the format, the level is capped in MCU mode.
+ */
+func h264AnswerRtp(offerMedia sdp.Media, mode ModeOptions) (answerRtp sdp.Rtp, ok bool) {
+	best := -1
+	for _, pt := range offerMedia.PayloadTypes {
+		rtp, found := offerMedia.RtpMap[pt]
+		if !found || rtp.Codec != "H264" {
+			continue
+		}
+		fmtp := make(map[string]string)
+		for _, attribute := range rtp.Fmtp {
+			fmtp[attribute.K] = attribute.V
+		}
+		if fmtp["packetization-mode"] != "1" {
+			continue
+		}
+		// baseline 1.0 without profile-level-id
+		profileLevelIdString := fmtp["profile-level-id"]
+		if profileLevelIdString == "" {
+			profileLevelIdString = "42000a"
+		}
+		profileLevelId, err := ParseH264ProfileLevelId(profileLevelIdString)
+		if err != nil {
+			continue
+		}
+		for rank, profile := range h264Profiles(mode) {
+			if profile != profileLevelId.Profile || (best >= 0 && rank >= best) {
+				continue
+			}
+			if mode == ModeMCU && profileLevelId.Level > h264DecoderMaxLevel {
+				profileLevelId.Level = h264DecoderMaxLevel
+			}
+			best = rank
+			answerRtp = rtp
+			answerRtp.Fmtp = []sdp.Attribute{}
+			if fmtp["level-asymmetry-allowed"] == "1" {
+				answerRtp.Fmtp = append(answerRtp.Fmtp, sdp.Attribute{K: "level-asymmetry-allowed", V: "1"})
+			}
+			answerRtp.Fmtp = append(answerRtp.Fmtp,
+				sdp.Attribute{K: "packetization-mode", V: "1"},
+				sdp.Attribute{K: "profile-level-id", V: profileLevelId.String()},
+			)
+			ok = true
+		}
+	}
+	return
+}
+
+// h264NalTypes return the types of the NAL units starting in the payload:
+// single NAL, aggregated (STAP-A) or the first fragment (FU-A)
+func h264NalTypes(payload []byte) (nalTypes []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch nalType := payload[0] & 0x1f; nalType {
+	case h264NalStap:
+		for i := 1; i+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[i : i+2]))
+			nalTypes = append(nalTypes, payload[i+2]&0x1f)
+			i += 2 + size
+		}
+	case h264NalFuA:
+		// S bit of the FU header
+		if len(payload) > 1 && payload[1]&0x80 != 0 {
+			nalTypes = append(nalTypes, payload[1]&0x1f)
+		}
+	default:
+		nalTypes = append(nalTypes, nalType)
+	}
+	return
+}
+
+// an H264 key frame starts with an SPS or an IDR
+func isH264KeyFrameStart(payload []byte) bool {
+	for _, nalType := range h264NalTypes(payload) {
+		if nalType == h264NalIDR || nalType == h264NalSPS {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * H264ParameterSets keep the last SPS & PPS of a stream, sent as single NAL
+ * units or aggregated
+ */
+type H264ParameterSets struct {
+	sync.Mutex
+	sps []byte
+	pps []byte
+}
+
+func (h *H264ParameterSets) Observe(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch payload[0] & 0x1f {
+	case h264NalSPS, h264NalPPS:
+		h.set(payload)
+	case h264NalStap:
+		for i := 1; i+2 < len(payload); {
+			size := int(binary.BigEndian.Uint16(payload[i : i+2]))
+			if i+2+size > len(payload) {
+				return
+			}
+			h.set(payload[i+2 : i+2+size])
+			i += 2 + size
+		}
+	}
+}
+
+func (h *H264ParameterSets) set(nal []byte) {
+	if len(nal) < 1 {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	switch nal[0] & 0x1f {
+	case h264NalSPS:
+		h.sps = append(h.sps[:0], nal...)
+	case h264NalPPS:
+		h.pps = append(h.pps[:0], nal...)
+	}
+}
+
+/*
+ * Packet return a STAP-A packet with the SPS & PPS, to send before the IDR
+ * packet p (same header, no marker), nil if they are unknown
+ */
+func (h *H264ParameterSets) Packet(p *srtp.PacketRTP) *srtp.PacketRTP {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.sps) == 0 || len(h.pps) == 0 {
+		return nil
+	}
+	headerSize := p.GetHeaderSize()
+	if headerSize > p.GetSize() {
+		return nil
+	}
+	data := make([]byte, 0, headerSize+1+2+len(h.sps)+2+len(h.pps))
+	data = append(data, p.GetData()[:headerSize]...)
+	// no padding, no marker
+	data[0] &^= 0x20
+	data[1] &^= 0x80
+	// F & NRI of the SPS
+	data = append(data, h.sps[0]&0xe0|h264NalStap)
+	for _, nal := range [][]byte{h.sps, h.pps} {
+		data = append(data, byte(len(nal)>>8), byte(len(nal)))
+		data = append(data, nal...)
+	}
+	stap := srtp.NewPacketRTP(packet.NewUDPFromData(data, p.GetRAddr()))
+	stap.SetCreatedAt(p.GetCreatedAt())
+	return stap
+}
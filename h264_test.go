@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+func TestParseH264ProfileLevelId(t *testing.T) {
+	tests := []struct {
+		s       string
+		profile H264Profile
+		level   byte
+	}{
+		{"42e01f", H264ProfileConstrainedBaseline, 0x1f},
+		{"42c02a", H264ProfileConstrainedBaseline, 0x2a},
+		{"4d8015", H264ProfileConstrainedBaseline, 0x15},
+		{"58c00d", H264ProfileConstrainedBaseline, 0x0d},
+		{"42001f", H264ProfileBaseline, 0x1f},
+		{"42000a", H264ProfileBaseline, 0x0a},
+		{"588028", H264ProfileBaseline, 0x28},
+		{"4d001f", H264ProfileMain, 0x1f},
+		{"640c34", H264ProfileConstrainedHigh, 0x34},
+		{"64001f", H264ProfileHigh, 0x1f},
+	}
+	for _, test := range tests {
+		p, err := ParseH264ProfileLevelId(test.s)
+		if err != nil {
+			t.Errorf("%s: %s", test.s, err.Error())
+			continue
+		}
+		if p.Profile != test.profile || p.Level != test.level {
+			t.Errorf("%s: profile %d level %x, expected %d & %x", test.s, p.Profile, p.Level, test.profile, test.level)
+		}
+		if p.String() != test.s {
+			t.Errorf("%s: formatted as %s", test.s, p.String())
+		}
+	}
+}
+
+func TestParseH264ProfileLevelIdInvalid(t *testing.T) {
+	for _, s := range []string{"", "42e01", "42e01f0", "42g01f", "6e001f", "64081f"} {
+		if _, err := ParseH264ProfileLevelId(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+type h264TestFormat struct {
+	pt    sdp.PayloadType
+	codec string
+	// a=fmtp parameters
+	fmtp string
+}
+
+func newH264TestMedia(formats ...h264TestFormat) sdp.Media {
+	media := sdp.Media{Type: "video", RtpMap: make(map[sdp.PayloadType]sdp.Rtp)}
+	for order, format := range formats {
+		rtp := sdp.Rtp{Order: order, PayloadType: format.pt, Codec: format.codec, Rate: 90000}
+		if format.fmtp != "" {
+			for _, parameter := range strings.Split(format.fmtp, ";") {
+				kv := strings.SplitN(parameter, "=", 2)
+				rtp.Fmtp = append(rtp.Fmtp, sdp.Attribute{K: kv[0], V: kv[1]})
+			}
+		}
+		media.PayloadTypes = append(media.PayloadTypes, format.pt)
+		media.RtpMap[format.pt] = rtp
+	}
+	return media
+}
+
+func TestH264AnswerRtp(t *testing.T) {
+	// the H264 formats of a browser offer
+	browser := []h264TestFormat{
+		{96, "VP8", ""},
+		{102, "H264", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f"},
+		{104, "H264", "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f"},
+		{106, "H264", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{108, "H264", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=4d001f"},
+		{112, "H264", "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640c34"},
+	}
+	tests := []struct {
+		name    string
+		formats []h264TestFormat
+		mode    ModeOptions
+		ok      bool
+		pt      sdp.PayloadType
+		// a=fmtp parameters of the answer
+		fmtp string
+	}{
+		{"browser sfu", browser, ModeSFU, true, 106, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{"browser mcu", browser, ModeMCU, true, 106, "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f"},
+		{"high sfu", []h264TestFormat{
+			{112, "H264", "packetization-mode=1;profile-level-id=640c34"},
+			{108, "H264", "packetization-mode=1;profile-level-id=4d001f"},
+		}, ModeSFU, true, 108, "packetization-mode=1;profile-level-id=4d001f"},
+		{"high only sfu", []h264TestFormat{
+			{112, "H264", "packetization-mode=1;profile-level-id=640c34"},
+		}, ModeSFU, true, 112, "packetization-mode=1;profile-level-id=640c34"},
+		{"high only mcu", []h264TestFormat{
+			{112, "H264", "packetization-mode=1;profile-level-id=640c34"},
+		}, ModeMCU, false, 0, ""},
+		{"level capped in mcu", []h264TestFormat{
+			{102, "H264", "packetization-mode=1;profile-level-id=42e034"},
+		}, ModeMCU, true, 102, "packetization-mode=1;profile-level-id=42e01f"},
+		{"level kept in sfu", []h264TestFormat{
+			{102, "H264", "packetization-mode=1;profile-level-id=42e034"},
+		}, ModeSFU, true, 102, "packetization-mode=1;profile-level-id=42e034"},
+		{"no profile-level-id", []h264TestFormat{
+			{102, "H264", "packetization-mode=1"},
+		}, ModeMCU, true, 102, "packetization-mode=1;profile-level-id=42000a"},
+		{"offer order breaks ties", []h264TestFormat{
+			{110, "H264", "packetization-mode=1;profile-level-id=42c01f"},
+			{106, "H264", "packetization-mode=1;profile-level-id=42e01f"},
+		}, ModeSFU, true, 110, "packetization-mode=1;profile-level-id=42c01f"},
+		{"packetization mode 0", []h264TestFormat{
+			{104, "H264", "packetization-mode=0;profile-level-id=42e01f"},
+		}, ModeSFU, false, 0, ""},
+		{"invalid profile-level-id", []h264TestFormat{
+			{102, "H264", "packetization-mode=1;profile-level-id=zz"},
+		}, ModeSFU, false, 0, ""},
+		{"no H264", []h264TestFormat{
+			{96, "VP8", ""},
+		}, ModeSFU, false, 0, ""},
+	}
+	for _, test := range tests {
+		answerRtp, ok := h264AnswerRtp(newH264TestMedia(test.formats...), test.mode)
+		if ok != test.ok {
+			t.Errorf("%s: ok %t, expected %t", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		expected := newH264TestMedia(h264TestFormat{test.pt, "H264", test.fmtp}).RtpMap[test.pt].Fmtp
+		if answerRtp.PayloadType != test.pt || !reflect.DeepEqual(answerRtp.Fmtp, expected) {
+			t.Errorf("%s: answer %d %v, expected %d %v", test.name, answerRtp.PayloadType, answerRtp.Fmtp, test.pt, expected)
+		}
+	}
+}
+
+func TestH264NalTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		nalTypes []byte
+	}{
+		{"empty", []byte{}, nil},
+		{"IDR", []byte{0x65, 0x88, 0x84}, []byte{h264NalIDR}},
+		{"non IDR slice", []byte{0x41, 0x9a}, []byte{1}},
+		{"STAP-A", []byte{
+			0x78,
+			0x00, 0x02, 0x67, 0x42,
+			0x00, 0x02, 0x68, 0xce,
+			0x00, 0x03, 0x65, 0x88, 0x84,
+		}, []byte{h264NalSPS, h264NalPPS, h264NalIDR}},
+		{"STAP-A truncated size", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00}, []byte{h264NalSPS}},
+		{"FU-A start", []byte{0x7c, 0x85, 0x88}, []byte{h264NalIDR}},
+		{"FU-A middle", []byte{0x7c, 0x05, 0x88}, nil},
+		{"FU-A end", []byte{0x7c, 0x45, 0x88}, nil},
+		{"FU-A without header", []byte{0x7c}, nil},
+	}
+	for _, test := range tests {
+		if nalTypes := h264NalTypes(test.payload); !bytes.Equal(nalTypes, test.nalTypes) {
+			t.Errorf("%s: NAL types %v, expected %v", test.name, nalTypes, test.nalTypes)
+		}
+	}
+}
+
+func TestIsH264KeyFrameStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		keyFrame bool
+	}{
+		{"IDR", []byte{0x65, 0x88}, true},
+		{"SPS", []byte{0x67, 0x42}, true},
+		{"PPS", []byte{0x68, 0xce}, false},
+		{"non IDR slice", []byte{0x41, 0x9a}, false},
+		{"STAP-A SPS & PPS", []byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		{"FU-A IDR start", []byte{0x7c, 0x85, 0x88}, true},
+		{"FU-A IDR middle", []byte{0x7c, 0x05, 0x88}, false},
+	}
+	for _, test := range tests {
+		if keyFrame := isH264KeyFrameStart(test.payload); keyFrame != test.keyFrame {
+			t.Errorf("%s: key frame %t, expected %t", test.name, keyFrame, test.keyFrame)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"sync"
 )
 
 /*
  * Fully event based pipeline.
  */
 type Pipeline struct {
+	// nodes could be replaced while the pipeline is running
+	sync.RWMutex
 	Nodes   map[string]IPipelineNode
 	Bus     chan interface{}
 	Running bool
@@ -23,10 +26,14 @@ func NewPipeline() *Pipeline {
 func (p *Pipeline) Register(name string, node IPipelineNode) {
 	node.SetName(name)
 	node.SetBus(p.Bus)
+	p.Lock()
 	p.Nodes[name] = node
+	p.Unlock()
 }
 
 func (p *Pipeline) Get(name string) IPipelineNode {
+	p.RLock()
+	defer p.RUnlock()
 	return p.Nodes[name]
 }
 
@@ -34,8 +41,24 @@ func (p *Pipeline) Get(name string) IPipelineNode {
  * start every node & update self state
  */
 func (p *Pipeline) Run(ctx context.Context) {
+	p.Lock()
+	defer p.Unlock()
 	for _, node := range p.Nodes {
 		go node.Run(ctx)
 	}
 	p.Running = true
 }
+
+/*
+ * register & start a node in a running pipeline, replacing any node
+ * with the same name. The caller is responsible of stopping the previous
+ * node (by canceling the context it runs with).
+ */
+func (p *Pipeline) Replace(ctx context.Context, name string, node IPipelineNode) {
+	p.Register(name, node)
+	p.RLock()
+	defer p.RUnlock()
+	if p.Running {
+		go node.Run(ctx)
+	}
+}
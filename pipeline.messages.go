@@ -38,3 +38,33 @@ type PipelineMessageOutBps struct {
 	PipelineMessage
 	Bps uint64
 }
+
+// PipelineMessageBandwidthEstimate is the state of the publisher bandwidth
+// estimator, sent with each REMB
+type PipelineMessageBandwidthEstimate struct {
+	PipelineMessage
+	Bps         uint64
+	DelayBps    uint64
+	LossBps     uint64
+	IncomingBps uint64
+	Usage       BandwidthUsage
+	State       RateControlState
+	Trend       float64
+	Threshold   float64
+	LossRate    float64
+}
+
+// PipelineMessageAudioLevel is the average audio level (RFC 6464) of a
+// publisher, 0 is the silence, 127 the loudest
+type PipelineMessageAudioLevel struct {
+	PipelineMessage
+	Level uint8
+}
+
+// PipelineMessageRtxStats are the retransmission counters of a publisher
+// video stream, sent every second
+type PipelineMessageRtxStats struct {
+	PipelineMessage
+	SSRC uint32 `json:"ssrc"`
+	RtxStats
+}
@@ -37,6 +37,13 @@ func (n *PipelineNodeJitterListener) SendRTX(seqs []uint16, ssrc uint32) {
 	n.buffer.SendRTX(seqs, ssrc)
 }
 
+// SetRed is used when the encoder output is sent in RED, must be called
+// before Run
+func (n *PipelineNodeJitterListener) SetRed(fec FecOptions) {
+	n.buffer.ptRed = int(fec.redPayloadType)
+	n.buffer.ptRedRtx = int(fec.redRtxPayloadType)
+}
+
 func (n *PipelineNodeJitterListener) Run(ctx context.Context) {
 	n.Running = true
 	n.emitStart()
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"net"
+	"sync/atomic"
+	"time"
 
 	plogger "github.com/heytribe/go-plogger"
 	"github.com/heytribe/live-webrtcsignaling/srtp"
@@ -19,14 +21,24 @@ type PipelineNodeJitterPublisher struct {
 	OutRTCP chan *RtpUdpPacket
 	// private
 	buffer *JitterBuffer
+	// transport-cc, shared by the jitter buffers of the session
+	twcc            *TransportWideCC
+	twccExtensionId int
+	twccFeedback    bool
+	// red & ulpfec, nil if not negotiated
+	fec *FecReceiver
+	// audio level header extension, 0 if not negotiated
+	audioLevelExtensionId int
+	audioLevelSum         int
+	audioLevelCount       int
 }
 
-func NewPipelineNodeJitterPublisher(ctx context.Context, codecOption CodecOptions, pt uint16, ptRtx uint16,
+func NewPipelineNodeJitterPublisher(ctx context.Context, codecOption CodecOptions, mode ModeOptions, pt uint16, ptRtx uint16,
 	freq uint32, ssrc uint32, rtxSsrc uint32,
 	jst JitterStreamTypeOptions, bitrate Bitrate, rtt *int64) *PipelineNodeJitterPublisher {
 	n := new(PipelineNodeJitterPublisher)
 	// FIXME: check err
-	n.buffer, _ = NewJitterBufferPublisher(ctx, codecOption, pt, ptRtx, freq, ssrc, rtxSsrc, jst, bitrate, rtt, n)
+	n.buffer, _ = NewJitterBufferPublisher(ctx, codecOption, mode, pt, ptRtx, freq, ssrc, rtxSsrc, jst, bitrate, rtt, n)
 	n.In = make(chan *srtp.PacketRTP, 128)
 	n.Out = make(chan *srtp.PacketRTP, 128)
 	n.OutRTP = make(chan *srtp.PacketRTP, 128)
@@ -42,13 +54,54 @@ func (n *PipelineNodeJitterPublisher) Run(ctx context.Context) {
 	n.Running = true
 	n.emitStart()
 	log := plogger.FromContextSafe(ctx)
+	var twccFeedback <-chan time.Time
+	if n.twcc != nil && n.twccFeedback {
+		ticker := time.NewTicker(twccFeedbackPeriod)
+		defer ticker.Stop()
+		twccFeedback = ticker.C
+	}
+	var audioLevel <-chan time.Time
+	if n.audioLevelExtensionId != 0 {
+		ticker := time.NewTicker(audioLevelPeriod)
+		defer ticker.Stop()
+		audioLevel = ticker.C
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			n.onStop(ctx)
 			return
 		case packet := <-n.In:
-			n.buffer.PushPacket(packet)
+			if n.twcc != nil {
+				if seq, ok := getTransportWideSeq(packet.GetHeaderExtension(n.twccExtensionId)); ok {
+					n.twcc.Record(seq, packet.GetCreatedAt())
+				}
+			}
+			if n.audioLevelExtensionId != 0 {
+				if level, ok := getAudioLevel(packet.GetHeaderExtension(n.audioLevelExtensionId)); ok {
+					n.audioLevelSum += int(level)
+					n.audioLevelCount++
+				}
+			}
+			if n.fec != nil {
+				n.pushFec(ctx, packet)
+				break
+			}
+			n.pushPacket(packet)
+		case <-twccFeedback:
+			n.buffer.SendTransportWideFeedback(n.twcc)
+		case <-audioLevel:
+			if n.audioLevelCount == 0 {
+				break
+			}
+			msg := &PipelineMessageAudioLevel{Level: uint8(n.audioLevelSum / n.audioLevelCount)}
+			n.audioLevelSum = 0
+			n.audioLevelCount = 0
+			select {
+			case n.Bus <- msg:
+			default:
+				log.Warnf("Bus is full, dropping audio level")
+			}
 		case packet := <-n.buffer.out:
 			select {
 			case n.Out <- packet:
@@ -77,6 +130,108 @@ func (n *PipelineNodeJitterPublisher) Run(ctx context.Context) {
 	}
 }
 
+func (n *PipelineNodeJitterPublisher) pushPacket(packet *srtp.PacketRTP) {
+	if n.buffer.jst == JitterStreamVideo {
+		// the video jitter buffer expects the payload right after the csrcs
+		packet.StripHeaderExtension()
+	}
+	n.buffer.PushPacket(packet)
+}
+
+/*
+ * pushFec unwrap the RED packets (and their retransmissions), the media
+ * packets are recorded to rebuild the lost ones with the ULPFEC packets.
+ */
+func (n *PipelineNodeJitterPublisher) pushFec(ctx context.Context, packet *srtp.PacketRTP) {
+	log := plogger.FromContextSafe(ctx)
+	switch packet.GetPT() {
+	case n.fec.redPt:
+		n.pushRed(ctx, packet, false)
+	case n.fec.redRtxPt:
+		red, _, err := packet.RTXExtractOriginal(n.buffer.GetSSRC(), n.fec.redPt)
+		if err != nil {
+			log.Debugf("[ RTX ] %s", err.Error())
+			atomic.AddUint64(&n.buffer.rtxStats.Padding, 1)
+			return
+		}
+		n.pushRed(ctx, red, true)
+	default:
+		if packet.GetPT() == n.fec.mediaPt {
+			n.fec.Record(packet)
+		}
+		n.pushPacket(packet)
+	}
+	for _, recovered := range n.fec.Recover() {
+		log.Infof("[ FEC ] packet seq %d recovered", recovered.GetSeqNumber())
+		recovered.StripHeaderExtension()
+		n.buffer.PushRecovered(recovered, true)
+	}
+}
+
+func (n *PipelineNodeJitterPublisher) pushRed(ctx context.Context, packet *srtp.PacketRTP, rtx bool) {
+	log := plogger.FromContextSafe(ctx)
+	primary, err := packet.REDExtractPrimary()
+	if err != nil {
+		log.Warnf("[ RED ] dropping packet seq %d: %s", packet.GetSeqNumber(), err.Error())
+		return
+	}
+	if primary.GetPT() == n.fec.ulpfecPt {
+		err = n.fec.PushUlpfec(primary)
+		if err != nil {
+			log.Warnf("[ FEC ] %s", err.Error())
+		}
+		n.buffer.PushPacket(fecSeqPlaceholder(primary, n.fec.mediaPt))
+		return
+	}
+	n.fec.Record(primary)
+	if rtx {
+		primary.StripHeaderExtension()
+		n.buffer.PushRecovered(primary, false)
+		return
+	}
+	n.pushPacket(primary)
+}
+
+// SetFec enable the RED & ULPFEC decoding of the video. Must be called
+// before Run.
+func (n *PipelineNodeJitterPublisher) SetFec(options FecOptions) {
+	if !options.Enabled() {
+		return
+	}
+	n.fec = NewFecReceiver(uint16(n.buffer.pt), options)
+}
+
+// SetTransportWideCC record the transport-wide sequence numbers of the
+// packets received, feedback is sent by one jitter buffer of the session.
+// Must be called before Run.
+func (n *PipelineNodeJitterPublisher) SetTransportWideCC(twcc *TransportWideCC, extensionId int, feedback bool) {
+	n.twcc = twcc
+	n.twccExtensionId = extensionId
+	n.twccFeedback = feedback
+}
+
+// SetAudioLevel average the audio levels of the packets received, sent on
+// the bus. Must be called before Run.
+func (n *PipelineNodeJitterPublisher) SetAudioLevel(extensionId int) {
+	n.audioLevelExtensionId = extensionId
+}
+
+func (n *PipelineNodeJitterPublisher) SetSSRC(ssrc uint32) {
+	n.buffer.SetSSRC(ssrc)
+}
+
+func (n *PipelineNodeJitterPublisher) SetRtxSSRC(ssrc uint32) {
+	n.buffer.SetRtxSSRC(ssrc)
+}
+
+// SetSimulcastLayer is used for the simulcast layers > 0, the REMB is an
+// estimate for the whole session sent by the first layer jitter buffer: the
+// layer packets are counted in its incoming bitrate
+func (n *PipelineNodeJitterPublisher) SetSimulcastLayer(first *PipelineNodeJitterPublisher) {
+	n.buffer.rembDisabled = true
+	n.buffer.estimator = first.buffer.estimator
+}
+
 func (n *PipelineNodeJitterPublisher) SetJitterSize(size uint64) {
 	n.buffer.SetJitterSize(size)
 }
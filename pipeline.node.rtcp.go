@@ -15,6 +15,10 @@ type PipelineNodeRTCP struct {
 	// private
 	rtcpCtx    *RtcpContext
 	rtcpParser *rtcp.Parser
+	// bitrate controller of the rtcp context
+	controller     BitrateController
+	controllerSSRC uint32
+	rtt            *int64
 }
 
 func NewPipelineNodeRTCP() *PipelineNodeRTCP {
@@ -23,13 +27,20 @@ func NewPipelineNodeRTCP() *PipelineNodeRTCP {
 	return n
 }
 
+// SetBitrateController must be called before Run
+func (n *PipelineNodeRTCP) SetBitrateController(controller BitrateController, ssrc uint32, rtt *int64) {
+	n.controller = controller
+	n.controllerSSRC = ssrc
+	n.rtt = rtt
+}
+
 func (n *PipelineNodeRTCP) Run(ctx context.Context) {
 	n.Running = true
 	n.emitStart()
 	// log
 	log := plogger.FromContextSafe(ctx)
 	// init rtcp context & parser
-	n.rtcpCtx = NewRtcpContext(ctx)
+	n.rtcpCtx = NewRtcpContext(ctx, n.controller, n.controllerSSRC, n.rtt)
 	n.rtcpParser = rtcp.NewParser(rtcp.Dependencies{Logger: log.Prefix("IN").Tag("rtcp")})
 	for {
 		select {
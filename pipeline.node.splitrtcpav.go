@@ -15,6 +15,8 @@ type PipelineNodeSplitRTCPAV struct {
 	In                 chan *srtp.PacketRTCP
 	OutPacketRTCPAudio chan *srtp.PacketRTCP
 	OutPacketRTCPVideo chan *srtp.PacketRTCP
+	// video ssrcs learned while running (simulcast rid)
+	InVideoSSRC chan uint32
 	// private
 	audio []uint32
 	video []uint32
@@ -26,6 +28,7 @@ func NewPipelineNodeSplitRTCPAV(audio, video []uint32) *PipelineNodeSplitRTCPAV
 	n.In = make(chan *srtp.PacketRTCP, 128)
 	n.OutPacketRTCPAudio = make(chan *srtp.PacketRTCP, 128)
 	n.OutPacketRTCPVideo = make(chan *srtp.PacketRTCP, 128)
+	n.InVideoSSRC = make(chan uint32, 16)
 	//
 	n.audio = audio
 	n.video = video
@@ -63,6 +66,8 @@ func (n *PipelineNodeSplitRTCPAV) Run(ctx context.Context) {
 		case <-ctx.Done():
 			n.onStop(ctx)
 			return
+		case ssrcId := <-n.InVideoSSRC:
+			n.video = append(n.video, ssrcId)
 		case packetRTCP := <-n.In:
 			if packetRTCP.GetSize() < 12 {
 				log.Warnf("udp packet length should be > 12")
@@ -14,10 +14,17 @@ type PipelineNodeSplitRTPAV struct {
 	In                chan *srtp.PacketRTP
 	OutPacketRTPAudio chan *srtp.PacketRTP
 	OutPacketRTPVideo chan *srtp.PacketRTP
+	// simulcast: one output per layer, OutPacketRTPVideoLayers[0] is OutPacketRTPVideo
+	OutPacketRTPVideoLayers []chan *srtp.PacketRTP
+	// simulcast: ssrcs learned from the rid header extensions
+	OutLearnedSSRC chan SimulcastLayerSSRC
 	// private
-	audio []uint32
-	video []uint32
-	exit  chan struct{}
+	audio                  []uint32
+	video                  []uint32
+	layers                 []SimulcastLayer
+	ridExtensionId         int
+	repairedRidExtensionId int
+	exit                   chan struct{}
 }
 
 func NewPipelineNodeSplitRTPAV(audio, video []uint32) *PipelineNodeSplitRTPAV {
@@ -25,12 +32,69 @@ func NewPipelineNodeSplitRTPAV(audio, video []uint32) *PipelineNodeSplitRTPAV {
 	n.In = make(chan *srtp.PacketRTP, 128)
 	n.OutPacketRTPAudio = make(chan *srtp.PacketRTP, 128)
 	n.OutPacketRTPVideo = make(chan *srtp.PacketRTP, 128)
+	n.OutPacketRTPVideoLayers = []chan *srtp.PacketRTP{n.OutPacketRTPVideo}
+	n.OutLearnedSSRC = make(chan SimulcastLayerSSRC, 16)
 	//
 	n.audio = audio
 	n.video = video
 	return n
 }
 
+/*
+ * SetVideoLayers route the video of each simulcast layer to its own output.
+ * Layers without ssrc are identified by their rid, when the rid header
+ * extensions are negotiated (extension ids > 0).
+ * Must be called before Run.
+ */
+func (n *PipelineNodeSplitRTPAV) SetVideoLayers(layers []SimulcastLayer, ridExtensionId int, repairedRidExtensionId int) {
+	n.layers = append([]SimulcastLayer{}, layers...)
+	n.ridExtensionId = ridExtensionId
+	n.repairedRidExtensionId = repairedRidExtensionId
+	for i := 1; i < len(layers); i++ {
+		n.OutPacketRTPVideoLayers = append(n.OutPacketRTPVideoLayers, make(chan *srtp.PacketRTP, 128))
+	}
+}
+
+// getVideoLayer return the simulcast layer of a video packet, -1 if unknown
+func (n *PipelineNodeSplitRTPAV) getVideoLayer(ctx context.Context, packetRTP *srtp.PacketRTP) int {
+	ssrcId := packetRTP.GetSSRCid()
+	for i, layer := range n.layers {
+		if (layer.ssrcId != 0 && layer.ssrcId == ssrcId) || (layer.rtxSsrcId != 0 && layer.rtxSsrcId == ssrcId) {
+			return i
+		}
+	}
+	learn := func(extensionId int, rtx bool) int {
+		if extensionId == 0 {
+			return -1
+		}
+		rid := string(packetRTP.GetHeaderExtension(extensionId))
+		if rid == "" {
+			return -1
+		}
+		for i := range n.layers {
+			if n.layers[i].rid != rid {
+				continue
+			}
+			if rtx {
+				n.layers[i].rtxSsrcId = ssrcId
+			} else {
+				n.layers[i].ssrcId = ssrcId
+			}
+			select {
+			case n.OutLearnedSSRC <- SimulcastLayerSSRC{layer: i, ssrcId: ssrcId, rtx: rtx}:
+			default:
+				plogger.FromContextSafe(ctx).Warnf("OutLearnedSSRC is full, dropping ssrc %d of layer %d", ssrcId, i)
+			}
+			return i
+		}
+		return -1
+	}
+	if layer := learn(n.ridExtensionId, false); layer >= 0 {
+		return layer
+	}
+	return learn(n.repairedRidExtensionId, true)
+}
+
 func (n *PipelineNodeSplitRTPAV) IsAudio(ssrcId uint32) bool {
 	for i := 0; i < len(n.audio); i++ {
 		if n.audio[i] == ssrcId {
@@ -65,6 +129,10 @@ func (n *PipelineNodeSplitRTPAV) Run(ctx context.Context) {
 				continue
 			}
 			ssrcId := packetRTP.GetSSRCid()
+			layer := -1
+			if len(n.layers) > 1 && !n.IsAudio(ssrcId) && !n.IsVideo(ssrcId) {
+				layer = n.getVideoLayer(ctx, packetRTP)
+			}
 			switch {
 			case n.IsAudio(ssrcId):
 				select {
@@ -78,6 +146,12 @@ func (n *PipelineNodeSplitRTPAV) Run(ctx context.Context) {
 				default:
 					log.Warnf("OutPacketRTPAudio is full, dropping packet from In")
 				}
+			case layer >= 0:
+				select {
+				case n.OutPacketRTPVideoLayers[layer] <- packetRTP:
+				default:
+					log.Warnf("OutPacketRTPVideoLayers[%d] is full, dropping packet from In", layer)
+				}
 			default:
 				audiosIds := strings.Join(uint32sToStrings(n.audio), ",")
 				videosIds := strings.Join(uint32sToStrings(n.video), ",")
@@ -11,7 +11,6 @@ package main
 
 import (
 	"context"
-	"net"
 	"sync/atomic"
 	"time"
 
@@ -24,10 +23,10 @@ type PipelineNodeUDP struct {
 	// I/O
 	Out chan *packet.UDP
 	// privates
-	udpConn *net.UDPConn
+	udpConn udpSessionConn
 }
 
-func NewPipelineNodeUDP(udpConn *net.UDPConn) *PipelineNodeUDP {
+func NewPipelineNodeUDP(udpConn udpSessionConn) *PipelineNodeUDP {
 	n := new(PipelineNodeUDP)
 	n.udpConn = udpConn
 	n.Out = make(chan *packet.UDP, 1000)
@@ -11,12 +11,35 @@ import (
 
 var gRoomId uint64
 
+const (
+	// above this size the automatic mode is MCU
+	roomSfuMaxSize = 4
+	// a MCU room goes back to SFU this many peers below roomSfuMaxSize: a
+	// switch rebuilds every session of the room
+	roomSfuHysteresis = 1
+)
+
 type Room struct {
 	my.NamedRWMutex
 
 	dateCreation time.Time
 	id           uint64
 	connections  []*connection
+	// SFU or MCU, set by a join token (modeForced) or chosen automatically
+	mode       ModeOptions
+	modeForced bool
+	// socketId of the peer which forced the mode, automatic once it left
+	modeForcedBy string
+	// MCU only: composition & audio mixes of the publishers, created on
+	// first use
+	videoMixer *VideoMixer
+	audioMixer *AudioMixer
+	// levels of the publishers
+	speakers *ActiveSpeakers
+	// SFU: N of the last-N, 0 forwards every video
+	n int
+	// SFU: publishers whose video is forwarded, most recent speaker first
+	lastN []string
 }
 
 func NewRoom() *Room {
@@ -24,6 +47,9 @@ func NewRoom() *Room {
 	room.id = atomic.AddUint64(&gRoomId, 1)
 	room.dateCreation = time.Now()
 	room.connections = []*connection{}
+	room.speakers = NewActiveSpeakers()
+	room.mode = config.Mode
+	room.n = config.Room.LastN
 	room.NamedRWMutex.Init("room:%d", room.id)
 	return room
 }
@@ -47,6 +73,10 @@ func (room *Room) Remove(ctx context.Context, socketId string) *connection {
 		if c.socketId == socketId {
 			room.connections = append(room.connections[:i], room.connections[i+1:]...)
 			log.Infof("room: removing websocket %s, new room size", socketId, len(room.connections))
+			if room.modeForcedBy == socketId {
+				room.modeForced = false
+				room.modeForcedBy = ""
+			}
 			return c
 		}
 	}
@@ -61,10 +91,161 @@ func (room *Room) Range(ctx context.Context, f func(int, *connection)) {
 	}
 }
 
+func (room *Room) GetMode(ctx context.Context) ModeOptions {
+	room.RLock(ctx)
+	defer room.RUnlock(ctx)
+	return room.mode
+}
+
+/*
+ * chooseMode return the mode of the room for its current composition:
+ *  - the mode of the join token if one was given
+ *  - MCU if the publishers don't share a codec (the listeners receive the
+ *    codec they publish) or if a receiver cannot get a stream per peer
+ *  - SFU while the videos forwarded to a listener are few (last-N), MCU
+ *    above roomSfuMaxSize peers, back to SFU roomSfuHysteresis peers below
+ * offering is a publisher not answered yet, publishing offeringCodec.
+ * not thread safe
+ */
+func (room *Room) chooseMode(ctx context.Context, offering *connection, offeringCodec CodecOptions) ModeOptions {
+	if room.modeForced {
+		return room.mode
+	}
+	forwarded := lastNSize(room.n, len(room.connections))
+	sfuMaxSize := roomSfuMaxSize
+	if room.mode == ModeMCU {
+		sfuMaxSize -= roomSfuHysteresis
+	}
+	if forwarded+1 > sfuMaxSize {
+		return ModeMCU
+	}
+	codec := CodecNone
+	for _, c := range room.connections {
+		// forwarded streams are at least at the minimum video bitrate
+		if c.maxVideoBitrate < forwarded*config.Bitrates.Video.Min {
+			return ModeMCU
+		}
+		publisherCodec, ok := c.getPublisherCodec(ctx)
+		if c == offering {
+			publisherCodec, ok = offeringCodec, true
+		}
+		if !ok {
+			continue
+		}
+		if codec != CodecNone && publisherCodec != codec {
+			return ModeMCU
+		}
+		codec = publisherCodec
+	}
+	return ModeSFU
+}
+
+/*
+ * SetMode force the mode of the room (join token of socketId) until the
+ * peer leaves, switched is true if the sessions of the room must be rebuilt
+ */
+func (room *Room) SetMode(ctx context.Context, mode ModeOptions, socketId string) (switched bool) {
+	room.Lock(ctx)
+	defer room.Unlock(ctx)
+	room.modeForced = true
+	room.modeForcedBy = socketId
+	switched = room.mode != mode
+	room.mode = mode
+	return
+}
+
+/*
+ * UpdateMode choose the mode again after a change of the composition of the
+ * room, switched is true if the sessions of the room must be rebuilt
+ */
+func (room *Room) UpdateMode(ctx context.Context) (mode ModeOptions, switched bool) {
+	room.Lock(ctx)
+	defer room.Unlock(ctx)
+	mode = room.chooseMode(ctx, nil, CodecNone)
+	switched = room.mode != mode
+	room.mode = mode
+	return
+}
+
+/*
+ * UpdateModeForOffer choose the mode with the codec of a publisher offer,
+ * before it is answered: a switch after would close the new session
+ */
+func (room *Room) UpdateModeForOffer(ctx context.Context, c *connection, codecOption CodecOptions) (mode ModeOptions, switched bool) {
+	room.Lock(ctx)
+	defer room.Unlock(ctx)
+	mode = room.chooseMode(ctx, c, codecOption)
+	switched = room.mode != mode
+	room.mode = mode
+	return
+}
+
+/*
+ * switchMode close the sessions established in the previous mode, the
+ * peers are notified (eventRoomMode) and publish again: the sessions of
+ * the SFU (forwarding) and of the MCU (transcoding) pipelines can't be
+ * converted. offering is the publisher whose offer is answered in the new
+ * mode (nil if none): only its listeners are closed, it isn't notified.
+ */
+func (room *Room) switchMode(ctx context.Context, roomId RoomId, mode ModeOptions, offering *connection) {
+	log := plogger.FromContextSafe(ctx)
+	log.Infof("room %s switches to %s mode", roomId, mode)
+	room.RLock(ctx)
+	connections := append([]*connection{}, room.connections...)
+	room.RUnlock(ctx)
+	for _, c := range connections {
+		if c == offering {
+			c.closeWebRTCSessionListeners(ctx)
+			continue
+		}
+		c.closeWebRTCSessions(ctx)
+	}
+	room.closeMixers(ctx)
+	for _, c := range connections {
+		if c != offering {
+			eventRoomMode(ctx, c, roomId, mode)
+		}
+	}
+}
+
+// GetMixers return the composition & the audio mixes of the room, created
+// on first use
+func (room *Room) GetMixers(ctx context.Context) (videoMixer *VideoMixer, audioMixer *AudioMixer, err error) {
+	room.Lock(ctx)
+	defer room.Unlock(ctx)
+	if room.videoMixer == nil {
+		room.videoMixer, err = NewVideoMixer(ctx)
+		if err != nil {
+			room.videoMixer = nil
+			return
+		}
+		room.audioMixer = NewAudioMixer(ctx)
+	}
+	videoMixer = room.videoMixer
+	audioMixer = room.audioMixer
+	return
+}
+
+func (room *Room) closeMixers(ctx context.Context) {
+	room.Lock(ctx)
+	videoMixer := room.videoMixer
+	audioMixer := room.audioMixer
+	room.videoMixer = nil
+	room.audioMixer = nil
+	room.Unlock(ctx)
+	if videoMixer != nil {
+		videoMixer.Close()
+	}
+	if audioMixer != nil {
+		audioMixer.Close()
+	}
+}
+
 // JSON marshaling
 type jsonRoom struct {
 	Id           RoomId        `json:"id"`
 	DateCreation time.Time     `json:"dateCreation"`
+	Mode         string        `json:"mode"`
 	Connections  []*connection `json:"connections"`
 }
 
@@ -75,6 +256,7 @@ func newJsonRoom(id RoomId, room *Room) jsonRoom {
 	return jsonRoom{
 		id,
 		room.dateCreation,
+		room.mode.String(),
 		room.connections,
 	}
 }
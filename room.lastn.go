@@ -0,0 +1,199 @@
+package main
+
+/*
+ * Last-N (SFU)
+ *
+ * the video of the N most recent active speakers is forwarded to the
+ * listeners, the other publishers are only heard: their listener sessions
+ * stay connected, the video is paused & resumed on a key frame when they
+ * speak again. Until enough publishers spoke, the first ones of the room
+ * fill the list.
+ *
+ * N is set per room by the join tokens, LAST_N by default, 0 forwards every
+ * video. The rooms with a last-N accept up to ROOM_LASTN_MAX_SIZE peers.
+ */
+
+import (
+	"context"
+)
+
+// lastNSize return the number of videos forwarded to a listener of a room
+// of roomSize peers with a last-N of n
+func lastNSize(n int, roomSize int) int {
+	if roomSize < 1 {
+		return 0
+	}
+	if n > 0 && roomSize-1 > n {
+		return n
+	}
+	return roomSize - 1
+}
+
+// GetLastN return the N of the last-N of the room, 0 if every video is
+// forwarded
+func (room *Room) GetLastN(ctx context.Context) int {
+	room.RLock(ctx)
+	defer room.RUnlock(ctx)
+	return room.n
+}
+
+// SetLastN change the N of the room, applied at the next update
+func (room *Room) SetLastN(ctx context.Context, n int) {
+	room.Lock(ctx)
+	defer room.Unlock(ctx)
+	room.n = n
+}
+
+// MaxSize return the number of peers the room accepts
+func (room *Room) MaxSize(ctx context.Context) int {
+	room.RLock(ctx)
+	defer room.RUnlock(ctx)
+	if room.n > 0 {
+		return config.Room.LastNMaxSize
+	}
+	return config.Room.MaxSize
+}
+
+/*
+ * UpdateLastN choose the publishers forwarded after a change of the active
+ * speaker or of the room, the sessions & the peers are updated if it
+ * changed
+ */
+func (room *Room) UpdateLastN(ctx context.Context, roomId RoomId) (changed bool) {
+	active := room.speakers.Active()
+	room.Lock(ctx)
+	if room.n <= 0 || room.mode != ModeSFU {
+		// the sessions of a room switching to MCU are rebuilt
+		resume := room.lastN != nil && room.mode == ModeSFU
+		room.lastN = nil
+		connections := append([]*connection{}, room.connections...)
+		room.Unlock(ctx)
+		if resume {
+			// last-N disabled, every video is forwarded again
+			changed = true
+			setVideoForwarded(connections, nil)
+			eventLastN(ctx, roomId, publisherSources(connections), connections)
+		}
+		return
+	}
+	publishers := []string{}
+	for _, c := range room.connections {
+		if c.webRTCSessionPublisher != nil {
+			publishers = append(publishers, c.socketId)
+		}
+	}
+	lastN := chooseLastN(room.n, active, room.lastN, publishers)
+	changed = !sameLastN(room.lastN, lastN)
+	room.lastN = lastN
+	connections := append([]*connection{}, room.connections...)
+	room.Unlock(ctx)
+
+	if !changed {
+		return
+	}
+	setVideoForwarded(connections, lastN)
+	eventLastN(ctx, roomId, lastNSources(connections, lastN), connections)
+	return
+}
+
+/*
+ * chooseLastN return the n publishers forwarded: the active speaker, the
+ * previous ones (the most recent speakers first), then the publishers by
+ * arrival
+ */
+func chooseLastN(n int, active string, previous []string, publishers []string) []string {
+	lastN := []string{}
+	if active != "" && inLastN(publishers, active) {
+		lastN = append(lastN, active)
+	}
+	for _, socketId := range previous {
+		if socketId != active && inLastN(publishers, socketId) {
+			lastN = append(lastN, socketId)
+		}
+	}
+	for _, socketId := range publishers {
+		if !inLastN(lastN, socketId) {
+			lastN = append(lastN, socketId)
+		}
+	}
+	if len(lastN) > n {
+		lastN = lastN[:n]
+	}
+	return lastN
+}
+
+// setVideoForwarded pause the video of the publishers out of lastN, nil
+// forwards every video
+func setVideoForwarded(connections []*connection, lastN []string) {
+	for _, c := range connections {
+		c.webRTCSessionListeners.RLock()
+		for socketId, w := range c.webRTCSessionListeners.d {
+			w.(*WebRTCSession).SetVideoForwarded(lastN == nil || inLastN(lastN, socketId))
+		}
+		c.webRTCSessionListeners.RUnlock()
+	}
+}
+
+// SendLastN send the publishers forwarded to a peer, the list didn't change
+// when it joined
+func (room *Room) SendLastN(ctx context.Context, roomId RoomId, c *connection) {
+	room.RLock(ctx)
+	if room.n <= 0 || room.mode != ModeSFU {
+		room.RUnlock(ctx)
+		return
+	}
+	sources := lastNSources(room.connections, room.lastN)
+	room.RUnlock(ctx)
+	eventLastN(ctx, roomId, sources, []*connection{c})
+}
+
+func lastNSources(connections []*connection, lastN []string) (sources []Session) {
+	sources = []Session{}
+	for _, socketId := range lastN {
+		for _, c := range connections {
+			if c.socketId == socketId {
+				sources = append(sources, Session{SocketId: c.socketId, UserId: c.userId})
+			}
+		}
+	}
+	return
+}
+
+func publisherSources(connections []*connection) (sources []Session) {
+	sources = []Session{}
+	for _, c := range connections {
+		if c.webRTCSessionPublisher != nil {
+			sources = append(sources, Session{SocketId: c.socketId, UserId: c.userId})
+		}
+	}
+	return
+}
+
+// IsVideoForwarded return true if the video of a publisher is in the last-N
+func (room *Room) IsVideoForwarded(ctx context.Context, socketId string) bool {
+	room.RLock(ctx)
+	defer room.RUnlock(ctx)
+	return room.n <= 0 || room.mode != ModeSFU || inLastN(room.lastN, socketId)
+}
+
+func inLastN(lastN []string, socketId string) bool {
+	for _, s := range lastN {
+		if s == socketId {
+			return true
+		}
+	}
+	return false
+}
+
+// sameLastN compare the publishers, not their order
+func sameLastN(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, socketId := range a {
+		if !inLastN(b, socketId) {
+			return false
+		}
+	}
+	return true
+}
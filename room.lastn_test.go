@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLastNSize(t *testing.T) {
+	tests := []struct {
+		n        int
+		roomSize int
+		size     int
+	}{
+		{3, 0, 0},
+		{3, 1, 0},
+		{3, 4, 3},
+		// capped by N
+		{3, 5, 3},
+		{3, 20, 3},
+		// without last-N every other peer is forwarded
+		{0, 5, 4},
+		{0, 8, 7},
+	}
+	for _, test := range tests {
+		if size := lastNSize(test.n, test.roomSize); size != test.size {
+			t.Errorf("lastNSize(%d, %d) = %d, expected %d", test.n, test.roomSize, size, test.size)
+		}
+	}
+}
+
+func TestSameLastN(t *testing.T) {
+	tests := []struct {
+		a    []string
+		b    []string
+		same bool
+	}{
+		{nil, []string{}, true},
+		{[]string{"a", "b"}, []string{"a", "b"}, true},
+		// the order is ignored
+		{[]string{"a", "b"}, []string{"b", "a"}, true},
+		{[]string{"a", "b"}, []string{"a", "c"}, false},
+		{[]string{"a"}, []string{"a", "b"}, false},
+		{[]string{"a", "b"}, nil, false},
+	}
+	for _, test := range tests {
+		if same := sameLastN(test.a, test.b); same != test.same {
+			t.Errorf("sameLastN(%v, %v) = %t, expected %t", test.a, test.b, same, test.same)
+		}
+	}
+}
+
+func TestChooseLastN(t *testing.T) {
+	tests := []struct {
+		name       string
+		n          int
+		active     string
+		previous   []string
+		publishers []string
+		lastN      []string
+	}{
+		{"publishers by arrival", 2, "", nil, []string{"a", "b", "c"}, []string{"a", "b"}},
+		{"active speaker first", 2, "c", []string{"a", "b"}, []string{"a", "b", "c"}, []string{"c", "a"}},
+		{"most recent speakers kept", 3, "d", []string{"c", "a", "b"}, []string{"a", "b", "c", "d"}, []string{"d", "c", "a"}},
+		{"active speaker already forwarded", 2, "b", []string{"a", "b"}, []string{"a", "b", "c"}, []string{"b", "a"}},
+		{"active speaker not publishing", 2, "x", []string{"a"}, []string{"a", "b"}, []string{"a", "b"}},
+		{"publisher left", 2, "", []string{"a", "b"}, []string{"b", "c"}, []string{"b", "c"}},
+		{"fewer publishers than N", 3, "", nil, []string{"a"}, []string{"a"}},
+		{"no publisher", 3, "", []string{"a"}, nil, []string{}},
+	}
+	for _, test := range tests {
+		if lastN := chooseLastN(test.n, test.active, test.previous, test.publishers); !reflect.DeepEqual(lastN, test.lastN) {
+			t.Errorf("%s: %v, expected %v", test.name, lastN, test.lastN)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+const roomTestVideoMin = 100
+
+// newRoomTestConnection return a peer receiving maxVideoBitrate, publishing
+// codec (CodecNone: not published yet)
+func newRoomTestConnection(codec CodecOptions, maxVideoBitrate int) *connection {
+	c := &connection{maxVideoBitrate: maxVideoBitrate}
+	var format h264TestFormat
+	switch codec {
+	case CodecNone:
+		return c
+	case CodecVP8:
+		format = h264TestFormat{96, "VP8", ""}
+	case CodecVP9:
+		format = h264TestFormat{98, "VP9", ""}
+	case CodecH264:
+		format = h264TestFormat{102, "H264", "packetization-mode=1;profile-level-id=42e01f"}
+	}
+	answer := &sdp.SDP{Data: new(sdp.Data)}
+	answer.Data.Medias = []sdp.Media{newH264TestMedia(format)}
+	c.webRTCSessionPublisher = &WebRTCSession{sdpCtx: &SdpContext{answer: answer}}
+	return c
+}
+
+func newRoomTestConnections(codecs ...CodecOptions) []*connection {
+	connections := make([]*connection, len(codecs))
+	for i, codec := range codecs {
+		connections[i] = newRoomTestConnection(codec, 10*roomTestVideoMin)
+	}
+	return connections
+}
+
+func TestRoomChooseMode(t *testing.T) {
+	config = NewConfig()
+	config.Bitrates.Video.Min = roomTestVideoMin
+	features = NewFeatures()
+	offering := newRoomTestConnection(CodecNone, 10*roomTestVideoMin)
+	tests := []struct {
+		name        string
+		connections []*connection
+		// offering publishes offeringCodec if it is a connection of the room
+		offeringCodec CodecOptions
+		mode          ModeOptions
+		modeForced    bool
+		n             int
+		expected      ModeOptions
+	}{
+		{"empty", nil, CodecNone, ModeSFU, false, 0, ModeSFU},
+		{"same codec", newRoomTestConnections(CodecVP8, CodecVP8, CodecNone), CodecNone, ModeSFU, false, 0, ModeSFU},
+		{"codec mix", newRoomTestConnections(CodecVP8, CodecH264), CodecNone, ModeSFU, false, 0, ModeMCU},
+		{"offer same codec", append(newRoomTestConnections(CodecH264), offering), CodecH264, ModeSFU, false, 0, ModeSFU},
+		{"offer codec mix", append(newRoomTestConnections(CodecH264), offering), CodecVP9, ModeSFU, false, 0, ModeMCU},
+		{"low bitrate receiver", []*connection{
+			newRoomTestConnection(CodecVP8, 10*roomTestVideoMin),
+			newRoomTestConnection(CodecVP8, roomTestVideoMin),
+			newRoomTestConnection(CodecVP8, 10*roomTestVideoMin),
+		}, CodecNone, ModeSFU, false, 0, ModeMCU},
+		{"bitrate floor", []*connection{
+			newRoomTestConnection(CodecVP8, 10*roomTestVideoMin),
+			newRoomTestConnection(CodecVP8, roomTestVideoMin),
+			newRoomTestConnection(CodecVP8, 10*roomTestVideoMin),
+		}, CodecNone, ModeSFU, false, 1, ModeSFU},
+		{"max size", newRoomTestConnections(CodecVP8, CodecVP8, CodecVP8, CodecVP8), CodecNone, ModeSFU, false, 0, ModeSFU},
+		{"above max size", newRoomTestConnections(CodecVP8, CodecVP8, CodecVP8, CodecVP8, CodecVP8), CodecNone, ModeSFU, false, 0, ModeMCU},
+		// last-N: a listener receives n videos whatever the size of the room
+		{"last-N", newRoomTestConnections(CodecVP8, CodecVP8, CodecVP8, CodecVP8, CodecVP8, CodecVP8), CodecNone, ModeSFU, false, 2, ModeSFU},
+		{"hysteresis", newRoomTestConnections(CodecVP8, CodecVP8, CodecVP8, CodecVP8), CodecNone, ModeMCU, false, 0, ModeMCU},
+		{"below hysteresis", newRoomTestConnections(CodecVP8, CodecVP8, CodecVP8), CodecNone, ModeMCU, false, 0, ModeSFU},
+		{"forced sfu", newRoomTestConnections(CodecVP8, CodecH264), CodecNone, ModeSFU, true, 0, ModeSFU},
+		{"forced mcu", newRoomTestConnections(CodecVP8), CodecNone, ModeMCU, true, 0, ModeMCU},
+	}
+	for _, test := range tests {
+		room := &Room{connections: test.connections, mode: test.mode, modeForced: test.modeForced, n: test.n}
+		if mode := room.chooseMode(context.Background(), offering, test.offeringCodec); mode != test.expected {
+			t.Errorf("%s: mode %s, expected %s", test.name, mode, test.expected)
+		}
+	}
+}
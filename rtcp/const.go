@@ -73,6 +73,7 @@ const (
   2:    reserved (see note below)
   3:    Temporary Maximum Media Stream Bit Rate Request (TMMBR)
   4:    Temporary Maximum Media Stream Bit Rate Notification (TMMBN)
+  15:   Transport Wide Congestion Control (draft-holmer-rmcat-transport-wide-cc-extensions)
   31:   reserved for future expansion of the identifier number space
 */
 const (
@@ -86,7 +87,8 @@ const (
 	FMT_RTPFB_TLLEI
 	FMT_RTPFB_ECN
 	FMT_RTPFB_PS
-	FMT_RTPFB_EXT uint8 = 31
+	FMT_RTPFB_TWCC uint8 = 15 // Transport Wide Congestion Control, ex: transport-cc
+	FMT_RTPFB_EXT  uint8 = 31
 )
 
 /*
@@ -1,5 +1,14 @@
 package rtcp
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
 /*
 Application Layer FB Message
 Transport Wide Feedback
@@ -42,9 +51,171 @@ corresponding SDP negociation option :
   a=rtcp-fb:96 transport-cc
 */
 
-//
 type PacketALFBTW struct {
-	PacketPSFBAfb
+	PacketRTPFB
+	BaseSequenceNumber uint16
+	PacketStatusCount  uint16
+	// 24 bits signed, multiple of TW_REFERENCE_TIME_UNIT
+	ReferenceTime int32
+	FbPktCount    uint8
+	Packets       []RTPFBTWPacket
+	// private
+	size int
+}
+
+func NewPacketALFBTW() *PacketALFBTW {
+	return new(PacketALFBTW)
+}
+
+func (p *PacketALFBTW) ParsePacketRTPFB(packet PacketRTPFB) error {
+	// load packet
+	p.PacketRTPFB = packet
+	// setup offset
+	offset := packet.GetOffset()
+	data := p.GetData()
+	end := p.PacketRTCP.GetSize()
+	if end > len(data) || end < offset+8 {
+		return errors.New("tw size")
+	}
+	p.BaseSequenceNumber = binary.BigEndian.Uint16(data[offset : offset+2])
+	p.PacketStatusCount = binary.BigEndian.Uint16(data[offset+2 : offset+4])
+	p.ReferenceTime = int32(binary.BigEndian.Uint32(data[offset+4:offset+8])) >> 8
+	p.FbPktCount = data[offset+7]
+	offset += 8
+	statuses, size, err := parseTWChunks(data[offset:end], int(p.PacketStatusCount))
+	if err != nil {
+		return err
+	}
+	offset += size
+	p.Packets = make([]RTPFBTWPacket, len(statuses))
+	for i, status := range statuses {
+		p.Packets[i].SequenceNumber = p.BaseSequenceNumber + uint16(i)
+		p.Packets[i].Status = status
+		switch status {
+		case TW_STATUS_NOT_RECEIVED:
+		case TW_STATUS_SMALL_DELTA:
+			if end < offset+1 {
+				return errors.New("tw recv delta size")
+			}
+			p.Packets[i].RecvDelta = time.Duration(data[offset]) * TW_DELTA_UNIT
+			offset++
+		case TW_STATUS_LARGE_DELTA:
+			if end < offset+2 {
+				return errors.New("tw recv delta size")
+			}
+			p.Packets[i].RecvDelta = time.Duration(int16(binary.BigEndian.Uint16(data[offset:offset+2]))) * TW_DELTA_UNIT
+			offset += 2
+		default:
+			return errors.New(fmt.Sprintf("tw reserved status symbol for packet %d", p.Packets[i].SequenceNumber))
+		}
+	}
+	p.size = offset
+	return nil
+}
+
+/*
+ * SetArrivals fill the feedback of the packets following baseSequenceNumber,
+ * arrivals[i] is the arrival time of baseSequenceNumber+i, zero if lost.
+ * The reference time is counted from epoch.
+ */
+func (p *PacketALFBTW) SetArrivals(baseSequenceNumber uint16, arrivals []time.Time, epoch time.Time) {
+	var last time.Time
+
+	p.BaseSequenceNumber = baseSequenceNumber
+	p.PacketStatusCount = uint16(len(arrivals))
+	p.Packets = p.Packets[:0]
+	for i, arrival := range arrivals {
+		s := RTPFBTWPacket{SequenceNumber: baseSequenceNumber + uint16(i)}
+		if !arrival.IsZero() {
+			if last.IsZero() {
+				p.ReferenceTime = int32(arrival.Sub(epoch) / TW_REFERENCE_TIME_UNIT)
+				last = epoch.Add(time.Duration(p.ReferenceTime) * TW_REFERENCE_TIME_UNIT)
+			}
+			units := int64(arrival.Sub(last) / TW_DELTA_UNIT)
+			if units > math.MaxInt16 {
+				units = math.MaxInt16
+			} else if units < math.MinInt16 {
+				units = math.MinInt16
+			}
+			if units >= 0 && units <= 0xff {
+				s.Status = TW_STATUS_SMALL_DELTA
+			} else {
+				s.Status = TW_STATUS_LARGE_DELTA
+			}
+			s.RecvDelta = time.Duration(units) * TW_DELTA_UNIT
+			// deltas are summed by the receiver, rounding errors must not add up
+			last = last.Add(s.RecvDelta)
+		}
+		p.Packets = append(p.Packets, s)
+	}
 }
 
-// FIXME.
+// GetArrivals return the arrival time of each packet, zero if lost
+func (p *PacketALFBTW) GetArrivals(epoch time.Time) []time.Time {
+	arrivals := make([]time.Time, len(p.Packets))
+	last := epoch.Add(time.Duration(p.ReferenceTime) * TW_REFERENCE_TIME_UNIT)
+	for i, s := range p.Packets {
+		if s.Status == TW_STATUS_NOT_RECEIVED {
+			continue
+		}
+		last = last.Add(s.RecvDelta)
+		arrivals[i] = last
+	}
+	return arrivals
+}
+
+func (p *PacketALFBTW) Bytes() []byte {
+	var result []byte
+	var fci []byte
+
+	fci = append(fci, uint16ToBytes(p.BaseSequenceNumber)...)
+	fci = append(fci, uint16ToBytes(uint16(len(p.Packets)))...)
+	fci = append(fci, uint32ToBytes(uint32(p.ReferenceTime)<<8|uint32(p.FbPktCount))...)
+	statuses := make([]uint8, len(p.Packets))
+	for i, s := range p.Packets {
+		statuses[i] = s.Status
+	}
+	fci = append(fci, twChunksBytes(statuses)...)
+	for _, s := range p.Packets {
+		switch s.Status {
+		case TW_STATUS_SMALL_DELTA:
+			fci = append(fci, byte(s.RecvDelta/TW_DELTA_UNIT))
+		case TW_STATUS_LARGE_DELTA:
+			fci = append(fci, uint16ToBytes(uint16(int16(s.RecvDelta/TW_DELTA_UNIT)))...)
+		}
+	}
+	// zero padding, the status count tells where the deltas end
+	for len(fci)%4 != 0 {
+		fci = append(fci, 0)
+	}
+
+	p.PacketRTPFB.PacketRTCP.Header.Version = 2
+	p.PacketRTPFB.PacketRTCP.Header.Padding = false
+	// FMT is in RC field
+	p.PacketRTPFB.PacketRTCP.Header.ReceptionCount = FMT_RTPFB_TWCC
+	// PT
+	p.PacketRTPFB.PacketRTCP.Header.PacketType = PT_RTPFB
+	// length
+	p.PacketRTPFB.PacketRTCP.Header.Length = uint16(2 + len(fci)/4)
+
+	result = append(result, p.PacketRTPFB.Bytes()...)
+	result = append(result, fci...)
+	return result
+}
+
+func (p *PacketALFBTW) String() string {
+	var packets []string
+
+	for _, s := range p.Packets {
+		packets = append(packets, s.String())
+	}
+	return fmt.Sprintf(
+		"[RTCP-ALFB-TW %s BSN=%d PSC=%d RT=%d FPC=%d Pkts=(%s)]",
+		p.PacketRTPFB.String(),
+		p.BaseSequenceNumber,
+		p.PacketStatusCount,
+		p.ReferenceTime,
+		p.FbPktCount,
+		strings.Join(packets, ", "),
+	)
+}
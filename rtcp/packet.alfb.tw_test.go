@@ -0,0 +1,82 @@
+package rtcp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heytribe/live-webrtcsignaling/rtcp"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Debugf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+func (l testLogger) Infof(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Warnf(format string, args ...interface{})  { l.t.Logf(format, args...) }
+func (l testLogger) Errorf(format string, args ...interface{}) { l.t.Logf(format, args...) }
+func (l testLogger) Fatalf(format string, args ...interface{}) { l.t.Fatalf(format, args...) }
+
+func TestTWSerializeParse(t *testing.T) {
+	epoch := time.Now()
+	first := epoch.Add(10 * time.Second)
+	// small deltas, a lost run (run length chunk), a large & a negative delta
+	var arrivals []time.Time
+	for i := 0; i < 10; i++ {
+		arrivals = append(arrivals, first.Add(time.Duration(i)*5*time.Millisecond))
+	}
+	for i := 0; i < 20; i++ {
+		arrivals = append(arrivals, time.Time{})
+	}
+	arrivals = append(arrivals, first.Add(500*time.Millisecond))
+	arrivals = append(arrivals, first.Add(490*time.Millisecond))
+	arrivals = append(arrivals, first.Add(491*time.Millisecond))
+
+	p := rtcp.NewPacketALFBTW()
+	p.PacketRTPFB.SenderSSRC = 4242
+	p.PacketRTPFB.MediaSSRC = 4343
+	p.FbPktCount = 7
+	p.SetArrivals(65530, arrivals, epoch)
+	bytes := p.Bytes()
+	if len(bytes)%4 != 0 {
+		t.Fatalf("packet size %d is not a multiple of 4", len(bytes))
+	}
+
+	packet := rtcp.NewPacket()
+	packet.SetData(bytes)
+	packets, err := rtcp.NewParser(rtcp.Dependencies{Logger: testLogger{t}}).Parse(packet)
+	if err != nil {
+		t.Fatalf("parse error: %s", err.Error())
+	}
+	if len(packets) != 1 {
+		t.Fatalf("%d packets parsed, expected 1", len(packets))
+	}
+	parsed, ok := packets[0].(*rtcp.PacketALFBTW)
+	if !ok {
+		t.Fatalf("parsed %T, expected *rtcp.PacketALFBTW", packets[0])
+	}
+	if parsed.SenderSSRC != 4242 || parsed.MediaSSRC != 4343 || parsed.FbPktCount != 7 {
+		t.Errorf("header mismatch: %s", parsed)
+	}
+	if parsed.BaseSequenceNumber != 65530 || int(parsed.PacketStatusCount) != len(arrivals) {
+		t.Errorf("base sequence number %d / count %d", parsed.BaseSequenceNumber, parsed.PacketStatusCount)
+	}
+	if parsed.Packets[len(arrivals)-1].SequenceNumber != 65530+uint16(len(arrivals)-1) {
+		t.Errorf("sequence numbers should wrap, last is %d", parsed.Packets[len(arrivals)-1].SequenceNumber)
+	}
+	got := parsed.GetArrivals(epoch)
+	for i := range arrivals {
+		if arrivals[i].IsZero() != got[i].IsZero() {
+			t.Fatalf("packet %d: received %t, expected %t", i, !got[i].IsZero(), !arrivals[i].IsZero())
+		}
+		if arrivals[i].IsZero() {
+			continue
+		}
+		if diff := got[i].Sub(arrivals[i]); diff > rtcp.TW_DELTA_UNIT || diff < -rtcp.TW_DELTA_UNIT {
+			t.Errorf("packet %d: arrival off by %s", i, diff)
+		}
+	}
+	if parsed.Packets[31].Status != rtcp.TW_STATUS_LARGE_DELTA || parsed.Packets[31].RecvDelta != -10*time.Millisecond {
+		t.Errorf("negative delta: %s", parsed.Packets[31])
+	}
+}
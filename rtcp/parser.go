@@ -116,6 +116,14 @@ func (p *Parser) Parse(input IPacket) ([]interface{}, error) {
 				p.log.Warnf("ECN not yet implemented")
 			case FMT_RTPFB_PS:
 				p.log.Warnf("PS not yet implemented")
+			case FMT_RTPFB_TWCC:
+				packetALFBTW := NewPacketALFBTW()
+				if err = packetALFBTW.ParsePacketRTPFB(*packetRTPFB); err != nil {
+					p.log.Errorf("[RTCP]: packetALFBTW, err=%s", err.Error())
+					return packets, err
+				}
+				p.log.Debugf("%s", packetALFBTW)
+				packets = append(packets, packetALFBTW)
 			case FMT_RTPFB_EXT:
 				p.log.Warnf("EXT not yet implemented")
 			default:
@@ -0,0 +1,143 @@
+package rtcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+@see https://tools.ietf.org/html/draft-holmer-rmcat-transport-wide-cc-extensions-01#section-3.1.1
+
+packet status symbols
+  00 Packet not received
+  01 Packet received, small delta (1 byte, [0, 63.75] ms)
+  10 Packet received, large or negative delta (2 bytes, signed)
+  11 [Reserved]
+*/
+const (
+	TW_STATUS_NOT_RECEIVED uint8 = iota
+	TW_STATUS_SMALL_DELTA
+	TW_STATUS_LARGE_DELTA
+)
+
+const (
+	// recv deltas are multiples of 250us
+	TW_DELTA_UNIT = 250 * time.Microsecond
+	// reference time is a multiple of 64ms
+	TW_REFERENCE_TIME_UNIT = 64 * time.Millisecond
+)
+
+/*
+run length chunk
+
+	0                   1
+	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |T| S |       Run Length        |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+status vector chunk
+
+	0                   1
+	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |T|S|       symbol list         |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+T: 0 run length, 1 status vector
+S (vector): 0 14 symbols of 1 bit, 1 7 symbols of 2 bits
+*/
+const (
+	twRunLengthMax    = 0x1fff
+	twVectorOneBit    = 14
+	twVectorTwoBits   = 7
+	twChunkStatusMask = 0x03
+)
+
+// RTPFBTWPacket is the status of one packet of the feedback
+type RTPFBTWPacket struct {
+	SequenceNumber uint16
+	Status         uint8
+	// from the previous received packet, from the reference time for the
+	// first one
+	RecvDelta time.Duration
+}
+
+func (s RTPFBTWPacket) String() string {
+	if s.Status == TW_STATUS_NOT_RECEIVED {
+		return fmt.Sprintf("%d:lost", s.SequenceNumber)
+	}
+	return fmt.Sprintf("%d:%s", s.SequenceNumber, s.RecvDelta)
+}
+
+// parseTWChunks read the status of count packets, return the size read
+func parseTWChunks(data []byte, count int) (statuses []uint8, size int, err error) {
+	for len(statuses) < count {
+		if len(data) < size+2 {
+			err = errors.New("tw packet chunk size")
+			return
+		}
+		chunk := binary.BigEndian.Uint16(data[size : size+2])
+		size += 2
+		if chunk&0x8000 == 0 {
+			// run length
+			symbol := uint8(chunk>>13) & twChunkStatusMask
+			for i := 0; i < int(chunk&twRunLengthMax) && len(statuses) < count; i++ {
+				statuses = append(statuses, symbol)
+			}
+		} else if chunk&0x4000 == 0 {
+			for i := 0; i < twVectorOneBit && len(statuses) < count; i++ {
+				statuses = append(statuses, uint8(chunk>>uint(13-i))&0x01)
+			}
+		} else {
+			for i := 0; i < twVectorTwoBits && len(statuses) < count; i++ {
+				statuses = append(statuses, uint8(chunk>>uint(12-2*i))&twChunkStatusMask)
+			}
+		}
+	}
+	return
+}
+
+/*
+ * twChunksBytes encode the statuses, run length chunks for runs long enough
+ * to save a chunk, status vectors otherwise
+ */
+func twChunksBytes(statuses []uint8) []byte {
+	var result []byte
+
+	for i := 0; i < len(statuses); {
+		run := 1
+		for i+run < len(statuses) && statuses[i+run] == statuses[i] && run < twRunLengthMax {
+			run++
+		}
+		if run >= twVectorOneBit {
+			result = append(result, uint16ToBytes(uint16(statuses[i])<<13|uint16(run))...)
+			i += run
+			continue
+		}
+		// one bit symbols if no large delta in the next 14 packets
+		oneBit := true
+		for j := i; j < i+twVectorOneBit && j < len(statuses); j++ {
+			if statuses[j] > TW_STATUS_SMALL_DELTA {
+				oneBit = false
+			}
+		}
+		chunk := uint16(0x8000)
+		if oneBit {
+			for j := 0; j < twVectorOneBit && i < len(statuses); j++ {
+				chunk |= uint16(statuses[i]) << uint(13-j)
+				i++
+			}
+		} else {
+			chunk |= 0x4000
+			for j := 0; j < twVectorTwoBits && i < len(statuses); j++ {
+				chunk |= uint16(statuses[i]) << uint(12-2*j)
+				i++
+			}
+		}
+		result = append(result, uint16ToBytes(chunk)...)
+	}
+	return result
+}
@@ -14,12 +14,19 @@ type RtcpContext struct {
 	ChInfos chan interface{}
 }
 
-func NewRtcpContext(ctx context.Context) *RtcpContext {
+/*
+ * the controller decides the bitrate from the rembs & the receiver reports
+ * blocks of ssrc, rtt is the stun rtt of the session (optional)
+ */
+func NewRtcpContext(ctx context.Context, controller BitrateController, ssrc uint32, rtt *int64) *RtcpContext {
 	c := new(RtcpContext)
 	// export info
 	c.ChInfos = make(chan interface{}, 128)
 	// dependency with config.
-	c.Rembs = NewRtcpContextRembs(ctx, c.ChInfos, RTCP_REMB_ALGORITHM_SIMPLE)
+	if controller == nil {
+		controller = NewBitrateControllerSimple(config.Bitrates.Video)
+	}
+	c.Rembs = NewRtcpContextRembs(ctx, c.ChInfos, controller, ssrc, rtt)
 	return c
 }
 
@@ -53,6 +60,7 @@ func (c *RtcpContext) Push(ctx context.Context, untypedPacket interface{}) {
 		}
 	case *rtcp.PacketRR:
 		 log.Infof("received a RR packet")
+		 c.Rembs.PushRR(packet)
 		 select {
 		 case c.ChInfos <- packet:
 		 default:
@@ -4,9 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"math"
 	"net"
 	"strconv"
+	"sync"
 
 	"encoding/json"
 	plogger "github.com/heytribe/go-plogger"
@@ -15,25 +15,84 @@ import (
 	"github.com/kr/pretty"
 )
 
+// local ICE ufrags route the connectivity checks of the shared UDP socket,
+// they must not collide nor be guessed
+const iceUfragLength = 16
+
 // besoin de ca pour la partie transcoding :
 // - session gstreamer rattachée a une WEBRTC session
 // - si un gars envoie un flux publisher
 //    pouvoir rattacher une autre conn websocket
 //    pouvoir rattacher l'e
 type SdpContext struct {
-	offer  *sdp.SDP
-	answer *sdp.SDP
+	// a renegotiation replaces offer, answer & iceUfragAnswered under
+	// negotiationMutex, see Negotiated
+	negotiationMutex sync.RWMutex
+	offer            *sdp.SDP
+	answer           *sdp.SDP
 	//
 	iceState         string
 	iceCandidatePort int
+	// remote ufrag of the offer we answered, a new one is an ICE restart
+	iceUfragAnswered string
+	// sha-256 of the session DTLS certificate
+	localFingerprint string
+	// listener offer: H264 profile-level-id of the publisher (SFU mode)
+	h264ProfileLevelId string
+	// mode of the room when the session was created
+	mode ModeOptions
+	// listener offer: composition & audio mix of the room (MCU)
+	mix bool
 }
 
-func NewSdpCtx() *SdpContext {
+func NewSdpCtx(mode ModeOptions) *SdpContext {
 	sdpContext := new(SdpContext)
+	sdpContext.mode = mode
 
 	return sdpContext
 }
 
+// Negotiated return the offer & the answer of the current exchange, read
+// together: a renegotiation replaces both
+func (s *SdpContext) Negotiated() (offer *sdp.SDP, answer *sdp.SDP) {
+	s.negotiationMutex.RLock()
+	defer s.negotiationMutex.RUnlock()
+	return s.offer, s.answer
+}
+
+// renegotiationCtx return a copy of the context to answer a new offer,
+// published by setNegotiated once accepted
+func (s *SdpContext) renegotiationCtx(offer *sdp.SDP) *SdpContext {
+	s.negotiationMutex.RLock()
+	defer s.negotiationMutex.RUnlock()
+	return &SdpContext{
+		offer:              offer,
+		answer:             s.answer,
+		iceUfragAnswered:   s.iceUfragAnswered,
+		localFingerprint:   s.localFingerprint,
+		h264ProfileLevelId: s.h264ProfileLevelId,
+		mode:               s.mode,
+		mix:                s.mix,
+	}
+}
+
+// setNegotiated replace the exchange by the one of a renegotiation context
+func (s *SdpContext) setNegotiated(next *SdpContext) {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+	s.offer = next.offer
+	s.answer = next.answer
+	s.iceUfragAnswered = next.iceUfragAnswered
+}
+
+// setAnswer set the answer to an offer of the server, the session may read
+// the exchange meanwhile
+func (s *SdpContext) setAnswer(answer *sdp.SDP) {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+	s.answer = answer
+}
+
 func parseSDP(ctx context.Context, offer string) (*sdp.SDP, error) {
 	log := plogger.FromContextSafe(ctx).Tag("sdp").Prefix("SDP")
 	log.Prefix("OFFER").Debugf(offer)
@@ -47,8 +106,103 @@ func parseSDP(ctx context.Context, offer string) (*sdp.SDP, error) {
 	return sdp, err
 }
 
+// publicAddress return the address of the o= & c= lines, IPv4 unless the
+// server only has a public IPv6
+func publicAddress() (addrType string, address string) {
+	if config.Network.PublicIPV4 == "" && config.Network.PublicIPV6 != "" {
+		return "IP6", config.Network.PublicIPV6
+	}
+	return "IP4", config.Network.PublicIPV4
+}
+
+// getFingerprints return the a=fingerprint of the session & of the medias,
+// the peer DTLS certificate must match one of them
+func getFingerprints(s *sdp.SDP) (fingerprints []dtls.Fingerprint) {
+	add := func(f sdp.Fingerprint) {
+		if f.Type == "" || f.Hash == "" {
+			return
+		}
+		for _, known := range fingerprints {
+			if known.Type == f.Type && known.Hash == f.Hash {
+				return
+			}
+		}
+		fingerprints = append(fingerprints, dtls.Fingerprint{Type: f.Type, Hash: f.Hash})
+	}
+	if s == nil {
+		return
+	}
+	add(s.Data.Fingerprint)
+	for _, media := range s.Data.Medias {
+		add(media.Fingerprint)
+	}
+	return
+}
+
+/*
+ * answerVideoRtp select the codec answered to a video media, the preferred
+ * one if offered, then H264, VP8 and VP9
+ */
+func answerVideoRtp(offerMedia sdp.Media, mode ModeOptions, preferredCodecOption CodecOptions) (answerRtp sdp.Rtp, codecOption CodecOptions, ok bool) {
+	var answerRtpVP8 sdp.Rtp
+	var answerRtpVP9 sdp.Rtp
+	var offerRtpVP8 bool
+	var offerRtpVP9 bool
+	for _, rtp := range offerMedia.RtpMap {
+		switch rtp.Codec {
+		case "VP8":
+			offerRtpVP8 = true
+			answerRtpVP8 = rtp
+		case "VP9":
+			// profile 0 (8 bits 4:2:0) is the only one decoded,
+			// it is the default without profile-id
+			profileId := "0"
+			for _, fmtp := range rtp.Fmtp {
+				if fmtp.K == "profile-id" {
+					profileId = fmtp.V
+				}
+			}
+			if profileId == "0" {
+				offerRtpVP9 = true
+				answerRtpVP9 = rtp
+			}
+		}
+	}
+
+	// profile & packetization mode intersected with ours
+	answerRtpH264, offerRtpH264 := h264AnswerRtp(offerMedia, mode)
+
+	// try to select the preferred codec if available
+	switch {
+	case preferredCodecOption == CodecH264 && offerRtpH264:
+		return answerRtpH264, CodecH264, true
+	case preferredCodecOption == CodecVP8 && offerRtpVP8:
+		return answerRtpVP8, CodecVP8, true
+	case preferredCodecOption == CodecVP9 && offerRtpVP9:
+		return answerRtpVP9, CodecVP9, true
+	case offerRtpH264:
+		return answerRtpH264, CodecH264, true
+	case offerRtpVP8:
+		return answerRtpVP8, CodecVP8, true
+	case offerRtpVP9:
+		return answerRtpVP9, CodecVP9, true
+	}
+	return
+}
+
+// offerVideoCodec return the codec a publisher offer would be answered with
+func offerVideoCodec(offer *sdp.SDP, mode ModeOptions, preferredCodecOption CodecOptions) (codecOption CodecOptions, ok bool) {
+	for _, offerMedia := range offer.Data.Medias {
+		if offerMedia.Type == "video" {
+			_, codecOption, ok = answerVideoRtp(offerMedia, mode, preferredCodecOption)
+			return
+		}
+	}
+	return
+}
+
 func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOptions, listenPort int) (answer string, err error) {
-	var address string = config.Network.PublicIPV4
+	addrType, address := publicAddress()
 
 	log := plogger.FromContextSafe(ctx).Tag("sdp").Prefix("SDP")
 	if s.offer == nil {
@@ -58,20 +212,34 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 
 	fmt.Printf("SDP OFFER RECEIVED %# v\n", pretty.Formatter(s.offer.Data))
 
+	iceUfrag := randString(iceUfragLength)
+	icePwd := randString(22)
+	sessionId := randInt64()
+	sessionVersion := int64(2)
+	// renegotiation: the ICE credentials & the session id of our previous
+	// answer must be kept, only the session version is incremented.
+	// On ICE restart (new remote ufrag) we need new credentials too.
+	if s.answer != nil && len(s.answer.Data.Medias) > 0 {
+		if len(s.offer.Data.Medias) > 0 && s.offer.Data.Medias[0].IceUfrag == s.iceUfragAnswered {
+			iceUfrag = s.answer.Data.Medias[0].IceUfrag
+			icePwd = s.answer.Data.Medias[0].IcePwd
+		}
+		sessionId = s.answer.Data.Origin.SessionId
+		sessionVersion = s.answer.Data.Origin.SessionVersion + 1
+	}
+	if len(s.offer.Data.Medias) > 0 {
+		s.iceUfragAnswered = s.offer.Data.Medias[0].IceUfrag
+	}
 	s.answer = sdp.NewSDP(sdp.Dependencies{Logger: sdp.Logger(log)})
 	s.answer.Data.Origin.Username = "-"
-	s.answer.Data.Origin.SessionId = randInt64()
-	s.answer.Data.Origin.SessionVersion = 2
+	s.answer.Data.Origin.SessionId = sessionId
+	s.answer.Data.Origin.SessionVersion = sessionVersion
 	s.answer.Data.Origin.Address = address // FIXME
 	s.answer.Data.Origin.NetType = "IN"
-	s.answer.Data.Origin.AddrType = "IP4"
+	s.answer.Data.Origin.AddrType = addrType
 	s.answer.Data.Name = "Tribe MCU"
 	s.answer.Data.Info = "Tribe MCU Server"
 
-	priority := int64(math.Pow(2, 24)*126 + math.Pow(2, 8)*65535 + math.Pow(2, 0)*256)
-	iceUfrag := randString(4)
-	icePwd := randString(22)
-
 	var midAttributeAudio string
 	var midAttributeVideo string
 
@@ -117,7 +285,7 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 				Fmt:      strconv.Itoa(int(answerRtpOpus.PayloadType)),
 				Connection: sdp.Connection{
 					Nettype:  "IN",
-					Addrtype: "IP4",
+					Addrtype: addrType,
 					Address:  net.ParseIP(address),
 				},
 				/*Bandwidth: sdp.Bandwidth{
@@ -128,24 +296,14 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 				IcePwd:   icePwd,
 				Fingerprint: sdp.Fingerprint{
 					Type: "sha-256",
-					Hash: dtls.GetLocalFingerprint(),
+					Hash: s.localFingerprint,
 				},
 				//
 				// This is the MCU IP:Port
 				// candidate typ is "host" (no NAT server side)
 				//
 				// (candidates types could be : "host", "srflx", "prflx", and "relay")
-				Candidates: []sdp.Candidate{
-					sdp.Candidate{
-						Foundation:  "1",
-						ComponentId: 1,
-						Transport:   "udp",
-						Priority:    priority,
-						Address:     net.ParseIP(address),
-						Port:        listenPort,
-						Typ:         "host",
-					},
-				},
+				Candidates: hostCandidates(ctx, listenPort),
 				Attributes: []sdp.Attribute{
 					sdp.Attribute{K: "recvonly", V: ""},
 					sdp.Attribute{K: "mid", V: midAttributeAudio},
@@ -161,6 +319,9 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 					//sdp.Attribute{K: "extmap", V: "1 urn:ietf:params:rtp-hdrext:ssrc-audio-level"},
 				},
 			}
+			// opus in-band FEC & discontinuous transmission
+			answerRtpOpus.Fmtp = setFmtp(answerRtpOpus.Fmtp, "useinbandfec", "1")
+			answerRtpOpus.Fmtp = setFmtp(answerRtpOpus.Fmtp, "usedtx", "1")
 			answerRtpOpus.RtcpFb = []string{}
 			// hydrating RtpMap
 			answerMediaAudio.RtpMap = make(map[sdp.PayloadType]sdp.Rtp)
@@ -172,67 +333,21 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 			answerMediaAudio.SsrcMap = make(map[uint32][]sdp.Attribute)
 			//
 			answerMediaAudio.PayloadTypes = append(answerMediaAudio.PayloadTypes, answerRtpOpus.PayloadType)
+			transportWideCCAnswerMedia(s.offer, &answerMediaAudio)
+			audioLevelAnswerMedia(s.offer, &answerMediaAudio)
 			// adding answerMediaAudio to output
 			s.answer.Data.Medias = append(s.answer.Data.Medias, answerMediaAudio)
 		}
 		if offerMedia.Type == "video" {
 			//
 			// foreach sdp offer media video, we output a sdp answer media video
-			//   IF the media contains a "VP8" codec.
+			//   IF the media contains a "VP8", "VP9" or "H264" codec.
 			//
-			var answerRtpH264 sdp.Rtp
-			var answerRtpVP8 sdp.Rtp
 			var answerRtpRtx sdp.Rtp
-			var offerRtpVP8 bool
-			var offerRtpH264 bool
 			var videoPayloadType sdp.PayloadType
-			for _, rtp := range offerMedia.RtpMap {
-				//fmt.Printf("CHECKING RTP PT %d NAME %s\n", rtp.PayloadType, rtp.Codec)
-				switch rtp.Codec {
-				case "H264":
-					// Checking profile
-					for _, fmtp := range rtp.Fmtp {
-						/*
-							Profile 42C02A :
-							@see https://stackoverflow.com/questions/23494168/h264-profile-iop-explained
-							@see https://tools.ietf.org/html/rfc6184#section-8.1
-
-							@see https://en.wikipedia.org/wiki/H.264/MPEG-4_AVC
-								0x42 => Baseline Profile
-								0xC0 => constrained
-								Primarily for low-cost applications, this profile is most typically used in videoconferencing and mobile applications. It corresponds to the subset of features that are in common between the Baseline, Main, and High Profiles
-						*/
-						if fmtp.K == "profile-level-id" &&
-							(fmtp.V == "42e01f" || fmtp.V == "42C02A") {
-							for _, fmtp2 := range rtp.Fmtp {
-								if fmtp2.K == "packetization-mode" && fmtp2.V == "1" {
-									offerRtpH264 = true
-									answerRtpH264 = rtp
-									/*answerRtpH264.Fmtp = []sdp.Attribute{
-										sdp.Attribute{K: "profile-level-id", V: "42e01f"},
-									}*/
-								}
-							}
-						}
-					}
-				case "VP8":
-					offerRtpVP8 = true
-					answerRtpVP8 = rtp
-				}
-			}
-
-			// try to select the preferred codec if available
-			var answerRtp sdp.Rtp
-			if preferredCodecOption == CodecH264 && offerRtpH264 {
-				answerRtp = answerRtpH264
-			} else if preferredCodecOption == CodecVP8 && offerRtpVP8 {
-				answerRtp = answerRtpVP8
-			} else if offerRtpH264 {
-				answerRtp = answerRtpH264
-			} else if offerRtpVP8 {
-				answerRtp = answerRtpVP8
-			} else {
-			// no suitable codec found
+			answerRtp, _, ok := answerVideoRtp(offerMedia, s.mode, preferredCodecOption)
+			if !ok {
+				// no suitable codec found
 				continue
 			}
 			videoPayloadType = answerRtp.PayloadType
@@ -254,6 +369,9 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 				answerRtpRtx.Order = 1
 			}
 
+			// RED & ULPFEC, with the retransmissions of the RED packets
+			answerRtpFec := fecAnswerRtps(offerMedia, 2)
+
 			// searching mid attribute in offer media
 			//  we need this because chrome is using mid:audio & ffox: mid:sdparta_...
 			//  @see https://groups.google.com/forum/#!topic/jssip/lPFjVp-_XZA
@@ -276,7 +394,7 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 				Fmt:      strconv.Itoa(int(answerRtp.PayloadType)),
 				Connection: sdp.Connection{
 					Nettype:  "IN",
-					Addrtype: "IP4",
+					Addrtype: addrType,
 					Address:  net.ParseIP(address),
 				},
 				/*Bandwidth: sdp.Bandwidth{
@@ -290,19 +408,9 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 					Hash string
 				}{
 					Type: "sha-256",
-					Hash: dtls.GetLocalFingerprint(),
-				},
-				Candidates: []sdp.Candidate{
-					sdp.Candidate{
-						Foundation:  "1",
-						ComponentId: 1,
-						Transport:   "udp",
-						Priority:    priority,
-						Address:     net.ParseIP(address),
-						Port:        listenPort,
-						Typ:         "host",
-					},
+					Hash: s.localFingerprint,
 				},
+				Candidates: hostCandidates(ctx, listenPort),
 				Attributes: []sdp.Attribute{
 					sdp.Attribute{K: "recvonly", V: ""},
 					sdp.Attribute{K: "mid", V: midAttributeVideo},
@@ -313,6 +421,10 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 					//sdp.Attribute{K: "extmap", V: "6 http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"},
 				},
 			}
+			// simulcast layers are forwarded to the listeners in SFU mode only
+			if s.mode == ModeSFU {
+				answerMediaVideo.Attributes = append(answerMediaVideo.Attributes, simulcastAnswerAttributes(s.offer)...)
+			}
 			// Check RtcpFb parameters and append all options supported
 			rtcpFbSupported := make(map[string]bool)
 			rtcpFbSupported["ccm fir"] = true
@@ -332,6 +444,9 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 			if foundRtx {
 				answerMediaVideo.RtpMap[answerRtpRtx.PayloadType] = answerRtpRtx
 			}
+			for _, rtp := range answerRtpFec {
+				answerMediaVideo.RtpMap[rtp.PayloadType] = rtp
+			}
 			// ssrc
 			answerMediaVideo.SsrcMap = make(map[uint32][]sdp.Attribute)
 			//
@@ -339,6 +454,10 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 			if foundRtx {
 				answerMediaVideo.PayloadTypes = append(answerMediaVideo.PayloadTypes, answerRtpRtx.PayloadType)
 			}
+			for _, rtp := range answerRtpFec {
+				answerMediaVideo.PayloadTypes = append(answerMediaVideo.PayloadTypes, rtp.PayloadType)
+			}
+			transportWideCCAnswerMedia(s.offer, &answerMediaVideo)
 			// adding answerMediaVideo to output
 			s.answer.Data.Medias = append(s.answer.Data.Medias, answerMediaVideo)
 		}
@@ -360,18 +479,39 @@ func (s *SdpContext) answerSDP(ctx context.Context, preferredCodecOption CodecOp
 	return
 }
 
+// reofferSDP return our current offer with an incremented session version,
+// used to renegotiate an established listener session. With iceRestart, new
+// ICE credentials are generated for every media.
+func (s *SdpContext) reofferSDP(ctx context.Context, iceRestart bool) (offer string, err error) {
+	if s.offer == nil {
+		err = errors.New("could not re-offer, no offer created on this SDP context")
+		return
+	}
+	if iceRestart {
+		iceUfrag := randString(iceUfragLength)
+		icePwd := randString(22)
+		for i := range s.offer.Data.Medias {
+			s.offer.Data.Medias[i].IceUfrag = iceUfrag
+			s.offer.Data.Medias[i].IcePwd = icePwd
+		}
+	}
+	s.offer.Data.Origin.SessionVersion++
+	offer = s.offer.Write(ctx)
+
+	return
+}
+
 func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOptions, listenPort int) {
-	var address string = config.Network.PublicIPV4
+	addrType, address := publicAddress()
 
 	log, _ := plogger.FromContext(ctx)
-	priority := int64(math.Pow(2, 24)*126 + math.Pow(2, 8)*65535 + math.Pow(2, 0)*256)
 	s.offer = sdp.NewSDP(sdp.Dependencies{Logger: sdp.Logger(log)})
 	s.offer.Data.Origin.Username = "-"
 	s.offer.Data.Origin.SessionId = randInt64()
 	s.offer.Data.Origin.SessionVersion = 1
 	s.offer.Data.Origin.Address = address // FIXME
 	s.offer.Data.Origin.NetType = "IN"
-	s.offer.Data.Origin.AddrType = "IP4"
+	s.offer.Data.Origin.AddrType = addrType
 	s.offer.Data.Name = "Tribe MCU"
 	s.offer.Data.Info = "Tribe MCU Server"
 	s.offer.Data.Attributes = append(s.offer.Data.Attributes, sdp.Attribute{
@@ -383,16 +523,17 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 		V: "WMS tribemcu",
 	})
 
-	iceUfrag := randString(4)
+	iceUfrag := randString(iceUfragLength)
 	icePwd := randString(22)
 
 	// Building audio SDP part
 	offerASsrcId := randUint32()
 	opusPayloadTypeId := sdp.PayloadType(111)
-	opusFmtp := []sdp.Attribute{}
-	//		sdp.Attribute{K: "minptime", V: "10"},
-	//sdp.Attribute{K: "useinbandfec", V: "1"},
-	//}
+	opusFmtp := []sdp.Attribute{
+		sdp.Attribute{K: "minptime", V: "10"},
+		sdp.Attribute{K: "useinbandfec", V: "1"},
+		sdp.Attribute{K: "usedtx", V: "1"},
+	}
 	opusRtcpFb := []string{}
 	opusRtp := sdp.Rtp{
 		Order:       0,
@@ -412,26 +553,16 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 		Fmt:      strconv.Itoa(int(opusRtp.PayloadType)),
 		Connection: sdp.Connection{
 			Nettype:  "IN",
-			Addrtype: "IP4",
+			Addrtype: addrType,
 			Address:  net.ParseIP(address),
 		},
 		IceUfrag: iceUfrag,
 		IcePwd:   icePwd,
 		Fingerprint: sdp.Fingerprint{
 			Type: "sha-256",
-			Hash: dtls.GetLocalFingerprint(),
-		},
-		Candidates: []sdp.Candidate{
-			sdp.Candidate{
-				Foundation:  "1",
-				ComponentId: 1,
-				Transport:   "udp",
-				Priority:    priority,
-				Address:     net.ParseIP(address),
-				Port:        listenPort,
-				Typ:         "host",
-			},
+			Hash: s.localFingerprint,
 		},
+		Candidates: hostCandidates(ctx, listenPort),
 		Attributes: []sdp.Attribute{
 			sdp.Attribute{K: "sendonly", V: ""},
 			sdp.Attribute{K: "mid", V: "audio"},
@@ -478,10 +609,23 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 		videoPayloadType = sdp.PayloadType(102)
 		videoPayloadTypeRtx = sdp.PayloadType(103)
 		codecName = "H264"
+		// the MCU sends its encoder output, the SFU the publisher stream
+		profileLevelId := h264EncoderProfileLevelId
+		if s.mode == ModeSFU && s.h264ProfileLevelId != "" {
+			profileLevelId = s.h264ProfileLevelId
+		}
 		videoFmtp = []sdp.Attribute{
 			sdp.Attribute{K: "level-asymmetry-allowed", V: "1"},
 			sdp.Attribute{K: "packetization-mode", V: "1"},
-			sdp.Attribute{K: "profile-level-id", V: "42e01f"},
+			sdp.Attribute{K: "profile-level-id", V: profileLevelId},
+		}
+	case CodecVP9:
+		// 98 is the retransmission of RED
+		videoPayloadType = sdp.PayloadType(100)
+		videoPayloadTypeRtx = sdp.PayloadType(101)
+		codecName = "VP9"
+		videoFmtp = []sdp.Attribute{
+			sdp.Attribute{K: "profile-id", V: "0"},
 		}
 	}
 
@@ -516,7 +660,7 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 		Fmt:      strconv.Itoa(int(videoRtp.PayloadType)),
 		Connection: sdp.Connection{
 			Nettype:  "IN",
-			Addrtype: "IP4",
+			Addrtype: addrType,
 			Address:  net.ParseIP(address),
 		},
 		IceUfrag: iceUfrag,
@@ -526,19 +670,9 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 			Hash string
 		}{
 			Type: "sha-256",
-			Hash: dtls.GetLocalFingerprint(),
-		},
-		Candidates: []sdp.Candidate{
-			sdp.Candidate{
-				Foundation:  "1",
-				ComponentId: 1,
-				Transport:   "udp",
-				Priority:    priority,
-				Address:     net.ParseIP(address),
-				Port:        listenPort,
-				Typ:         "host",
-			},
+			Hash: s.localFingerprint,
 		},
+		Candidates: hostCandidates(ctx, listenPort),
 		Attributes: []sdp.Attribute{
 			sdp.Attribute{K: "sendonly", V: ""},
 			sdp.Attribute{K: "mid", V: "video"},
@@ -575,11 +709,111 @@ func (s *SdpContext) createSdpOffer(ctx context.Context, codecOption CodecOption
 	//
 	offerMediaVideo.PayloadTypes = append(offerMediaVideo.PayloadTypes, videoPayloadType)
 	offerMediaVideo.PayloadTypes = append(offerMediaVideo.PayloadTypes, videoPayloadTypeRtx)
+	// the MCU encoder protects the video with ULPFEC, the composition is
+	// encoded for several listeners without
+	if s.mode == ModeMCU && !s.mix {
+		for _, rtp := range fecOfferRtps(2) {
+			offerMediaVideo.RtpMap[rtp.PayloadType] = rtp
+			offerMediaVideo.PayloadTypes = append(offerMediaVideo.PayloadTypes, rtp.PayloadType)
+		}
+	}
 	s.offer.Data.Medias = append(s.offer.Data.Medias, offerMediaVideo)
 
 	return
 }
 
+// setFmtp set the value of a format parameter, added if absent
+func setFmtp(fmtp []sdp.Attribute, k string, v string) []sdp.Attribute {
+	for i := range fmtp {
+		if fmtp[i].K == k {
+			fmtp[i].V = v
+			return fmtp
+		}
+	}
+	return append(fmtp, sdp.Attribute{K: k, V: v})
+}
+
+/*
+ * fecAnswerRtps return the RED, ULPFEC & RED RTX codecs of an offer media,
+ * none if RED & ULPFEC are not both offered
+ */
+func fecAnswerRtps(offerMedia sdp.Media, order int) (rtps []sdp.Rtp) {
+	var red, ulpfec, redRtx *sdp.Rtp
+	for _, rtp := range offerMedia.RtpMap {
+		rtp := rtp
+		switch rtp.Codec {
+		case "red":
+			red = &rtp
+		case "ulpfec":
+			ulpfec = &rtp
+		}
+	}
+	if red == nil || ulpfec == nil {
+		return
+	}
+	for _, rtp := range offerMedia.RtpMap {
+		rtp := rtp
+		if rtp.Codec == "rtx" && len(rtp.Fmtp) > 0 &&
+			rtp.Fmtp[0].K == "apt" && rtp.Fmtp[0].V == fmt.Sprintf("%d", red.PayloadType) {
+			redRtx = &rtp
+		}
+	}
+	for _, rtp := range []*sdp.Rtp{red, ulpfec, redRtx} {
+		if rtp == nil {
+			continue
+		}
+		rtp.Order = order
+		rtp.RtcpFb = []string{}
+		rtps = append(rtps, *rtp)
+		order++
+	}
+	return
+}
+
+// fecOfferRtps return the RED, ULPFEC & RED RTX codecs offered to a listener
+func fecOfferRtps(order int) []sdp.Rtp {
+	return []sdp.Rtp{
+		sdp.Rtp{
+			Order:       order,
+			PayloadType: sdp.PayloadType(fecRedPayloadType),
+			Codec:       "red",
+			Rate:        90000,
+			Fmtp:        []sdp.Attribute{},
+			RtcpFb:      []string{},
+		},
+		sdp.Rtp{
+			Order:       order + 1,
+			PayloadType: sdp.PayloadType(fecUlpfecPayloadType),
+			Codec:       "ulpfec",
+			Rate:        90000,
+			Fmtp:        []sdp.Attribute{},
+			RtcpFb:      []string{},
+		},
+		sdp.Rtp{
+			Order:       order + 2,
+			PayloadType: sdp.PayloadType(fecRedRtxPayloadType),
+			Codec:       "rtx",
+			Rate:        90000,
+			Fmtp: []sdp.Attribute{
+				sdp.Attribute{K: "apt", V: fmt.Sprintf("%d", fecRedPayloadType)},
+			},
+			RtcpFb: []string{},
+		},
+	}
+}
+
+// getFecOptions return the redundancy negotiated in an answer, our answer
+// to a publisher or the answer of a listener
+func getFecOptions(answer *sdp.SDP) (options FecOptions) {
+	options.redPayloadType = answer.GetVideoPayloadType("red")
+	options.ulpfecPayloadType = answer.GetVideoPayloadType("ulpfec")
+	if options.redPayloadType != 0 {
+		options.redRtxPayloadType = answer.GetRtxPayloadType("red")
+	}
+	options.audioDtx = answer.GetAudioFmtp("opus", "usedtx") == "1"
+	return
+}
+
 // JSON marshaling
 type jsonSdpContext struct {
 	Offer            string `json:"offer"`
@@ -675,7 +675,9 @@ func parseAttributesMediaAttribute(p *parser) error {
 		ssrc = append(ssrc, ssrcAttr)
 		media.SsrcMap[ssrcId] = ssrc
 	case "ssrc-group":
-		media.SsrcGroup.Typ, err = parseWord(p)
+		var group SsrcGroup
+
+		group.Typ, err = parseWord(p)
 		if err != nil {
 			return errors.New("ssrc-group typ")
 		}
@@ -690,7 +692,12 @@ func parseAttributesMediaAttribute(p *parser) error {
 				}
 				return err
 			}
-			media.SsrcGroup.SsrcIdList = append(media.SsrcGroup.SsrcIdList, i)
+			group.SsrcIdList = append(group.SsrcIdList, i)
+		}
+		media.SsrcGroups = append(media.SsrcGroups, group)
+		// SsrcGroup is the first FID group (simulcast: FID of the first layer)
+		if media.SsrcGroup.Typ != "FID" {
+			media.SsrcGroup = group
 		}
 	default:
 		value, err := parseString(p)
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -103,6 +105,7 @@ type Media struct {
 	Attributes []Attribute
 	SsrcMap    map[uint32][]Attribute
 	SsrcGroup  SsrcGroup
+	SsrcGroups []SsrcGroup // every a=ssrc-group, ex: SIM + FID per layer
 }
 
 // get dynamic payload type number used for retransmission
@@ -209,6 +212,9 @@ func (sdp *SDP) GetVideoSSRC() uint32 {
 			if media.SsrcGroup.Typ == "FID" && len(media.SsrcGroup.SsrcIdList) > 1 {
 				return media.SsrcGroup.SsrcIdList[0]
 			}
+			if media.SsrcGroup.Typ == "SIM" && len(media.SsrcGroup.SsrcIdList) > 0 {
+				return media.SsrcGroup.SsrcIdList[0]
+			}
 			// return the first one (random) in the map
 			for ssrcId, _ := range media.SsrcMap {
 				return ssrcId
@@ -244,6 +250,27 @@ func (sdp *SDP) GetVideoClockRate(codec string) uint32 {
 	return 0
 }
 
+/*
+ * GetVideoFmtp return the value of a format parameter of the first video
+ * codec found, "" if absent
+ */
+func (sdp *SDP) GetVideoFmtp(codec string, key string) string {
+	for _, media := range sdp.Data.Medias {
+		if media.Type == "video" {
+			for _, m := range media.RtpMap {
+				if m.Codec == codec {
+					for _, fmtp := range m.Fmtp {
+						if fmtp.K == key {
+							return fmtp.V
+						}
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
 /*
  * GetAudioSSRC return first media video first ssrcId
  */
@@ -285,6 +312,27 @@ func (sdp *SDP) GetAudioClockRate(codec string) uint32 {
 	return 0
 }
 
+/*
+ * GetAudioFmtp return the value of a format parameter of the first audio
+ * codec found, "" if absent
+ */
+func (sdp *SDP) GetAudioFmtp(codec string, key string) string {
+	for _, media := range sdp.Data.Medias {
+		if media.Type == "audio" {
+			for _, m := range media.RtpMap {
+				if m.Codec == codec {
+					for _, fmtp := range m.Fmtp {
+						if fmtp.K == key {
+							return fmtp.V
+						}
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
 func (sdp *SDP) GetRtxPayloadType(codec string) uint16 {
 	videoPayloadType := sdp.GetVideoPayloadType(codec)
 	for _, media := range sdp.Data.Medias {
@@ -315,6 +363,115 @@ func (sdp *SDP) GetRtxSSRC() uint32 {
 	return 0
 }
 
+/*
+ * GetVideoSimulcastSSRCList return the layers ssrcIds of the first media
+ * video a=ssrc-group:SIM, lowest resolution first
+ */
+func (sdp *SDP) GetVideoSimulcastSSRCList() []uint32 {
+	for _, media := range sdp.Data.Medias {
+		if media.Type == "video" {
+			for _, group := range media.SsrcGroups {
+				if group.Typ == "SIM" {
+					return group.SsrcIdList
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+/*
+ * GetVideoRtxSSRCOf return the replay ssrcId paired with ssrcId by a
+ * a=ssrc-group:FID in the first media video
+ */
+func (sdp *SDP) GetVideoRtxSSRCOf(ssrcId uint32) uint32 {
+	for _, media := range sdp.Data.Medias {
+		if media.Type == "video" {
+			for _, group := range media.SsrcGroups {
+				if group.Typ == "FID" && len(group.SsrcIdList) > 1 && group.SsrcIdList[0] == ssrcId {
+					return group.SsrcIdList[1]
+				}
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+/*
+ * GetVideoSimulcastRids return the rids sent by the first media video,
+ * in the a=simulcast:send order (RFC 8853), or in the a=rid order if there
+ * is no a=simulcast. Paused rids (~) are returned, alternatives are not.
+ *
+ * a=simulcast:send q;h;f
+ * a=simulcast: send rid=q;h;f (draft syntax)
+ */
+func (sdp *SDP) GetVideoSimulcastRids() (rids []string) {
+	for _, media := range sdp.Data.Medias {
+		if media.Type != "video" {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.K != "simulcast" {
+				continue
+			}
+			fields := strings.Fields(attribute.V)
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fields[i] != "send" {
+					continue
+				}
+				for _, stream := range strings.Split(strings.TrimPrefix(fields[i+1], "rid="), ";") {
+					rid := strings.TrimPrefix(strings.Split(stream, ",")[0], "~")
+					if rid != "" {
+						rids = append(rids, rid)
+					}
+				}
+			}
+			return
+		}
+		for _, attribute := range media.Attributes {
+			fields := strings.Fields(attribute.V)
+			if attribute.K == "rid" && len(fields) > 1 && fields[1] == "send" {
+				rids = append(rids, fields[0])
+			}
+		}
+		return
+	}
+	return
+}
+
+/*
+ * GetExtmapId return the id negotiated for the header extension uri
+ * in the first media of this type, 0 if absent
+ *
+ * a=extmap:<id>[/<direction>] <uri>
+ */
+func (sdp *SDP) GetExtmapId(mediaType string, uri string) int {
+	for _, media := range sdp.Data.Medias {
+		if media.Type != mediaType {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			fields := strings.Fields(attribute.V)
+			if attribute.K != "extmap" || len(fields) < 2 || fields[1] != uri {
+				continue
+			}
+			id, err := strconv.Atoi(strings.Split(fields[0], "/")[0])
+			if err != nil {
+				return 0
+			}
+			return id
+		}
+		return 0
+	}
+	return 0
+}
+
+func (sdp *SDP) GetVideoExtmapId(uri string) int {
+	return sdp.GetExtmapId("video", uri)
+}
+
 func (sdp *SDP) LoadString(s string) error {
 	sdp.Data, sdp.err = sdp.Parse(s)
 	return sdp.err
@@ -337,6 +494,34 @@ func (sdp *SDP) Parse(input string) (*Data, error) {
 	return p.run()
 }
 
+// ParseCandidate parse a single trickled ICE candidate, as sent by the
+// browser in RTCIceCandidate.candidate ("candidate:..."), "a=" is optional
+func (sdp *SDP) ParseCandidate(input string) (candidate Candidate, err error) {
+	input = strings.TrimPrefix(strings.TrimSpace(input), "a=")
+	if !strings.HasPrefix(input, "candidate:") {
+		err = errors.New("not a candidate attribute")
+		return
+	}
+	p := &parser{
+		input:   "a=" + input + "\r\n",
+		line:    1,
+		data:    new(Data),
+		log:     sdp.log,
+		section: sectionMedia,
+	}
+	p.addMedia()
+	data, err := p.run()
+	if err != nil {
+		return
+	}
+	if len(data.Medias[0].Candidates) != 1 {
+		err = errors.New("malformed candidate attribute")
+		return
+	}
+	candidate = data.Medias[0].Candidates[0]
+	return
+}
+
 func (sdp *SDP) Write(ctx context.Context) string {
 	if sdp == nil || sdp.Data == nil {
 		return ""
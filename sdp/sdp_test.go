@@ -494,3 +494,166 @@ a=ssrc:4197005919 label:ViewControllerVIDEO
 		t.Fatal(err)
 	}
 }
+
+func TestParseCandidate(t *testing.T) {
+	s := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	candidate, err := s.ParseCandidate("candidate:1321500371 1 udp 1685987071 78.201.204.97 35188 typ srflx raddr 192.168.0.22 rport 35188 generation 0 ufrag fhni network-id 2 network-cost 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if candidate.Foundation != "1321500371" || candidate.ComponentId != 1 ||
+		candidate.Transport != "udp" || candidate.Priority != 1685987071 ||
+		candidate.Address.String() != "78.201.204.97" || candidate.Port != 35188 ||
+		candidate.Typ != "srflx" {
+		t.Fatalf("unexpected candidate %#v", candidate)
+	}
+	if _, err = s.ParseCandidate("a=ice-ufrag:fhni"); err == nil {
+		t.Fatal("expecting an error on a non candidate attribute")
+	}
+}
+
+func TestParseCandidateIPv6(t *testing.T) {
+	s := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	candidate, err := s.ParseCandidate("candidate:842163049 1 udp 2122262783 2001:db8::1 51004 typ host generation 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if candidate.Address.String() != "2001:db8::1" || candidate.IPv4 || candidate.Port != 51004 {
+		t.Fatalf("unexpected candidate %#v", candidate)
+	}
+}
+
+func TestSimulcastSsrcGroupSIM(t *testing.T) {
+	var s string = "v=0\r\n" +
+		"o=- 9143854556127760863 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 VP8/90000\r\n" +
+		"a=rtpmap:97 rtx/90000\r\n" +
+		"a=fmtp:97 apt=96\r\n" +
+		"a=ssrc-group:SIM 1000 2000 3000\r\n" +
+		"a=ssrc-group:FID 1000 1001\r\n" +
+		"a=ssrc-group:FID 2000 2001\r\n" +
+		"a=ssrc-group:FID 3000 3001\r\n" +
+		"a=ssrc:1000 cname:a\r\n" +
+		"a=ssrc:1001 cname:a\r\n" +
+		"a=ssrc:2000 cname:a\r\n" +
+		"a=ssrc:2001 cname:a\r\n" +
+		"a=ssrc:3000 cname:a\r\n" +
+		"a=ssrc:3001 cname:a\r\n"
+
+	sdp := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	if err := sdp.LoadBytes([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	layers := sdp.GetVideoSimulcastSSRCList()
+	if len(layers) != 3 || layers[0] != 1000 || layers[1] != 2000 || layers[2] != 3000 {
+		t.Fatalf("unexpected simulcast ssrcs %v", layers)
+	}
+	if sdp.GetVideoSSRC() != 1000 || sdp.GetRtxSSRC() != 1001 {
+		t.Fatalf("unexpected video ssrc %d / rtx ssrc %d", sdp.GetVideoSSRC(), sdp.GetRtxSSRC())
+	}
+	if sdp.GetVideoRtxSSRCOf(3000) != 3001 || sdp.GetVideoRtxSSRCOf(42) != 0 {
+		t.Fatalf("unexpected rtx ssrc %d for layer 3000", sdp.GetVideoRtxSSRCOf(3000))
+	}
+}
+
+func TestSimulcastRid(t *testing.T) {
+	var s string = "v=0\r\n" +
+		"o=- 9143854556127760863 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 VP8/90000\r\n" +
+		"a=extmap:4 urn:ietf:params:rtp-hdrext:sdes:mid\r\n" +
+		"a=extmap:10/sendonly urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id\r\n" +
+		"a=rid:q send\r\n" +
+		"a=rid:h send\r\n" +
+		"a=rid:f send\r\n" +
+		"a=simulcast:send q;h;~f\r\n"
+
+	sdp := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	if err := sdp.LoadBytes([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	rids := sdp.GetVideoSimulcastRids()
+	if len(rids) != 3 || rids[0] != "q" || rids[1] != "h" || rids[2] != "f" {
+		t.Fatalf("unexpected rids %v", rids)
+	}
+	if id := sdp.GetVideoExtmapId("urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"); id != 10 {
+		t.Fatalf("unexpected rtp-stream-id extmap id %d", id)
+	}
+	if id := sdp.GetVideoExtmapId("urn:ietf:params:rtp-hdrext:toffset"); id != 0 {
+		t.Fatalf("unexpected toffset extmap id %d", id)
+	}
+}
+
+func TestFecPayloadTypes(t *testing.T) {
+	var s string = "v=0\r\n" +
+		"o=- 9143854556127760863 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:111 opus/48000/2\r\n" +
+		"a=fmtp:111 minptime=10;useinbandfec=1;usedtx=1\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97 116 117 98\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 VP8/90000\r\n" +
+		"a=rtpmap:97 rtx/90000\r\n" +
+		"a=fmtp:97 apt=96\r\n" +
+		"a=rtpmap:116 red/90000\r\n" +
+		"a=rtpmap:117 ulpfec/90000\r\n" +
+		"a=rtpmap:98 rtx/90000\r\n" +
+		"a=fmtp:98 apt=116\r\n"
+
+	sdp := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	if err := sdp.LoadBytes([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if pt := sdp.GetVideoPayloadType("red"); pt != 116 {
+		t.Fatalf("unexpected red payload type %d", pt)
+	}
+	if pt := sdp.GetVideoPayloadType("ulpfec"); pt != 117 {
+		t.Fatalf("unexpected ulpfec payload type %d", pt)
+	}
+	if pt := sdp.GetRtxPayloadType("red"); pt != 98 {
+		t.Fatalf("unexpected red rtx payload type %d", pt)
+	}
+	if v := sdp.GetAudioFmtp("opus", "usedtx"); v != "1" {
+		t.Fatalf("unexpected opus usedtx %q", v)
+	}
+	if v := sdp.GetAudioFmtp("opus", "stereo"); v != "" {
+		t.Fatalf("unexpected opus stereo %q", v)
+	}
+}
+
+func TestVideoFmtp(t *testing.T) {
+	var s string = "v=0\r\n" +
+		"o=- 9143854556127760863 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96 97\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640c1f\r\n" +
+		"a=rtpmap:97 rtx/90000\r\n" +
+		"a=fmtp:97 apt=96\r\n"
+
+	sdp := sdp.NewSDP(sdp.Dependencies{Logger: new(testLogger)})
+	if err := sdp.LoadBytes([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if v := sdp.GetVideoFmtp("H264", "profile-level-id"); v != "640c1f" {
+		t.Fatalf("unexpected profile-level-id %q", v)
+	}
+	if v := sdp.GetVideoFmtp("H264", "packetization-mode"); v != "1" {
+		t.Fatalf("unexpected packetization-mode %q", v)
+	}
+	if v := sdp.GetVideoFmtp("VP8", "profile-level-id"); v != "" {
+		t.Fatalf("unexpected VP8 profile-level-id %q", v)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/dtls"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+const (
+	sdpTestHash      = "42:89:C5:C6:55:9D:6E:C8:E8:83:55:2A:39:F9:B6:EB:E9:A3:A9:E7:F2:8F:B3:10:A0:36:C6:3C:1A:D9:38:5A"
+	sdpTestOtherHash = "D2:FA:0E:C3:22:59:5E:14:95:69:92:3D:13:B4:84:24:2C:C2:8F:1E:23:B1:F6:7C:96:2F:D0:2E:61:0C:4E:12"
+)
+
+func newSdpTestFingerprints(session sdp.Fingerprint, medias ...sdp.Fingerprint) *sdp.SDP {
+	s := &sdp.SDP{Data: new(sdp.Data)}
+	s.Data.Fingerprint.Type = session.Type
+	s.Data.Fingerprint.Hash = session.Hash
+	for _, fingerprint := range medias {
+		s.Data.Medias = append(s.Data.Medias, sdp.Media{Fingerprint: fingerprint})
+	}
+	return s
+}
+
+func TestGetFingerprints(t *testing.T) {
+	fingerprint := sdp.Fingerprint{Type: "sha-256", Hash: sdpTestHash}
+	otherFingerprint := sdp.Fingerprint{Type: "sha-256", Hash: sdpTestOtherHash}
+	sha1Fingerprint := sdp.Fingerprint{Type: "sha-1", Hash: "4A:AD:B9:B1:3F:82:18:3B:54:02:12:DF:3E:5D:49:6B:19:E5:7C:AB"}
+	tests := []struct {
+		name         string
+		s            *sdp.SDP
+		fingerprints []dtls.Fingerprint
+	}{
+		{"no sdp", nil, nil},
+		{"no fingerprint", newSdpTestFingerprints(sdp.Fingerprint{}, sdp.Fingerprint{}), nil},
+		{"session level", newSdpTestFingerprints(fingerprint, sdp.Fingerprint{}, sdp.Fingerprint{}), []dtls.Fingerprint{
+			{Type: "sha-256", Hash: sdpTestHash},
+		}},
+		// bundled medias repeat the same fingerprint
+		{"media level", newSdpTestFingerprints(sdp.Fingerprint{}, fingerprint, fingerprint), []dtls.Fingerprint{
+			{Type: "sha-256", Hash: sdpTestHash},
+		}},
+		{"session & media level", newSdpTestFingerprints(fingerprint, fingerprint, otherFingerprint), []dtls.Fingerprint{
+			{Type: "sha-256", Hash: sdpTestHash},
+			{Type: "sha-256", Hash: sdpTestOtherHash},
+		}},
+		{"hash functions", newSdpTestFingerprints(sdp.Fingerprint{}, sha1Fingerprint, fingerprint), []dtls.Fingerprint{
+			{Type: "sha-1", Hash: sha1Fingerprint.Hash},
+			{Type: "sha-256", Hash: sdpTestHash},
+		}},
+		{"type without hash", newSdpTestFingerprints(sdp.Fingerprint{Type: "sha-256"}, fingerprint), []dtls.Fingerprint{
+			{Type: "sha-256", Hash: sdpTestHash},
+		}},
+	}
+	for _, test := range tests {
+		if fingerprints := getFingerprints(test.s); !reflect.DeepEqual(fingerprints, test.fingerprints) {
+			t.Errorf("%s: fingerprints %v, expected %v", test.name, fingerprints, test.fingerprints)
+		}
+	}
+}
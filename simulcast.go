@@ -0,0 +1,656 @@
+package main
+
+/*
+ * Simulcast (SFU mode)
+ *
+ * the publisher sends several encodings of its video, the layers, announced
+ * either by a=ssrc-group:SIM (ssrcs known from the SDP) or by a=rid &
+ * a=simulcast (ssrcs learned from the rtp-stream-id header extension,
+ * RFC 8852). Layers are ordered by increasing bitrate, the first layer is
+ * also the one decoded by gstreamer.
+ *
+ * every layer has its own jitter buffer, its output is pushed to the
+ * SimulcastForwarder of each listener. A forwarder sends a single layer,
+ * chosen with the REMB of its listener, and rewrites ssrc, payload type,
+ * sequence numbers & timestamps so the listener sees one continuous stream.
+ * Switching layer waits for a key frame of the new layer, an H264 key frame
+ * without SPS & PPS is preceded by the last ones of the layer.
+ */
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+const (
+	extmapSdesMid                = "urn:ietf:params:rtp-hdrext:sdes:mid"
+	extmapRtpStreamId            = "urn:ietf:params:rtp-hdrext:sdes:rtp-stream-id"
+	extmapRepairedRtpStreamId    = "urn:ietf:params:rtp-hdrext:sdes:repaired-rtp-stream-id"
+	simulcastKeyFrameRetryPeriod = 1 * time.Second
+)
+
+type SimulcastLayer struct {
+	rid       string
+	ssrcId    uint32
+	rtxSsrcId uint32
+}
+
+// SimulcastLayerSSRC is an ssrc learned from the rid header extensions
+type SimulcastLayerSSRC struct {
+	layer  int
+	ssrcId uint32
+	rtx    bool
+}
+
+/*
+ * getSimulcastLayers return the layers announced by the offer, nil if the
+ * publisher does not send simulcast
+ */
+func getSimulcastLayers(offer *sdp.SDP) (layers []SimulcastLayer) {
+	ssrcIds := offer.GetVideoSimulcastSSRCList()
+	if len(ssrcIds) > 1 {
+		for _, ssrcId := range ssrcIds {
+			layers = append(layers, SimulcastLayer{
+				ssrcId:    ssrcId,
+				rtxSsrcId: offer.GetVideoRtxSSRCOf(ssrcId),
+			})
+		}
+		return
+	}
+	rids := offer.GetVideoSimulcastRids()
+	if len(rids) < 2 || offer.GetVideoExtmapId(extmapRtpStreamId) == 0 {
+		return
+	}
+	for _, rid := range rids {
+		layers = append(layers, SimulcastLayer{rid: rid})
+	}
+	return
+}
+
+/*
+ * simulcastAnswerAttributes return the video attributes accepting the rid
+ * simulcast of the offer: the rid header extensions, a=rid:<rid> recv &
+ * a=simulcast:recv. Nothing is needed for a=ssrc-group:SIM.
+ */
+func simulcastAnswerAttributes(offer *sdp.SDP) (attributes []sdp.Attribute) {
+	layers := getSimulcastLayers(offer)
+	if len(layers) < 2 || layers[0].rid == "" {
+		return
+	}
+	for _, uri := range []string{extmapSdesMid, extmapRtpStreamId, extmapRepairedRtpStreamId} {
+		if id := offer.GetVideoExtmapId(uri); id != 0 {
+			attributes = append(attributes, sdp.Attribute{K: "extmap", V: fmt.Sprintf("%d %s", id, uri)})
+		}
+	}
+	rids := make([]string, len(layers))
+	for i, layer := range layers {
+		rids[i] = layer.rid
+		attributes = append(attributes, sdp.Attribute{K: "rid", V: layer.rid + " recv"})
+	}
+	attributes = append(attributes, sdp.Attribute{K: "simulcast", V: "recv " + strings.Join(rids, ";")})
+	return
+}
+
+// simulcastJitterName is the name of the layer jitter buffer in the publisher pipeline
+func simulcastJitterName(layer int) string {
+	if layer == 0 {
+		return "jittervideo"
+	}
+	return fmt.Sprintf("jittervideo%d", layer)
+}
+
+type simulcastLayerRate struct {
+	bytes int
+	since time.Time
+	bps   int
+}
+
+// add count the packet, the bitrate is computed every second
+func (rate *simulcastLayerRate) add(size int) {
+	rate.bytes += size
+	if elapsed := time.Since(rate.since); elapsed >= time.Second {
+		if elapsed < 2*time.Second {
+			rate.bps = int(float64(rate.bytes*8) / elapsed.Seconds())
+		}
+		rate.bytes = 0
+		rate.since = time.Now()
+	}
+}
+
+// get return the last bitrate, 0 if nothing was received recently
+func (rate *simulcastLayerRate) get() int {
+	if time.Since(rate.since) < 2*time.Second {
+		return rate.bps
+	}
+	return 0
+}
+
+/*
+ * SimulcastPublisher dispatch the layers of a publisher to the forwarders
+ * of its listeners & measure the bitrate of each layer
+ */
+type SimulcastPublisher struct {
+	sync.RWMutex
+	forwarders      []*SimulcastForwarder
+	codecOption     CodecOptions
+	ratesMutex      sync.Mutex
+	rates           []simulcastLayerRate
+	parameterSets   []*H264ParameterSets
+	requestKeyFrame func(layer int)
+}
+
+func NewSimulcastPublisher(codecOption CodecOptions, requestKeyFrame func(layer int)) *SimulcastPublisher {
+	s := new(SimulcastPublisher)
+	s.codecOption = codecOption
+	s.requestKeyFrame = requestKeyFrame
+	s.SetLayers(1)
+	return s
+}
+
+// SetLayers reset the layers, called when the publisher (re)negotiates
+func (s *SimulcastPublisher) SetLayers(count int) {
+	s.ratesMutex.Lock()
+	defer s.ratesMutex.Unlock()
+	s.rates = make([]simulcastLayerRate, count)
+	s.parameterSets = make([]*H264ParameterSets, count)
+	for i := range s.parameterSets {
+		s.parameterSets[i] = new(H264ParameterSets)
+	}
+}
+
+func (s *SimulcastPublisher) Enabled() bool {
+	s.ratesMutex.Lock()
+	defer s.ratesMutex.Unlock()
+	return len(s.rates) > 1
+}
+
+// LayerBitrates return the last measured bitrate of each layer, 0 if the
+// layer is not received
+func (s *SimulcastPublisher) LayerBitrates() []int {
+	s.ratesMutex.Lock()
+	defer s.ratesMutex.Unlock()
+	bitrates := make([]int, len(s.rates))
+	for i := range s.rates {
+		bitrates[i] = s.rates[i].get()
+	}
+	return bitrates
+}
+
+// H264ParameterSets return the SPS & PPS of a layer, nil if the publisher
+// does not send H264
+func (s *SimulcastPublisher) H264ParameterSets(layer int) *H264ParameterSets {
+	s.ratesMutex.Lock()
+	defer s.ratesMutex.Unlock()
+	if s.codecOption != CodecH264 || layer >= len(s.parameterSets) {
+		return nil
+	}
+	return s.parameterSets[layer]
+}
+
+func (s *SimulcastPublisher) RequestKeyFrame(layer int) {
+	if s.requestKeyFrame != nil {
+		s.requestKeyFrame(layer)
+	}
+}
+
+func (s *SimulcastPublisher) Subscribe(f *SimulcastForwarder) {
+	s.Lock()
+	defer s.Unlock()
+	f.publisher = s
+	s.forwarders = append(s.forwarders, f)
+}
+
+func (s *SimulcastPublisher) Unsubscribe(f *SimulcastForwarder) {
+	s.Lock()
+	defer s.Unlock()
+	for i, forwarder := range s.forwarders {
+		if forwarder == f {
+			s.forwarders = append(s.forwarders[:i], s.forwarders[i+1:]...)
+			return
+		}
+	}
+}
+
+// Forward push a packet of a layer, output of its jitter buffer, to the forwarders
+func (s *SimulcastPublisher) Forward(layer int, packetRTP *srtp.PacketRTP) {
+	s.ratesMutex.Lock()
+	if layer < len(s.rates) {
+		s.rates[layer].add(packetRTP.GetSize())
+		if s.codecOption == CodecH264 && packetRTP.GetHeaderSize() < packetRTP.GetSize() {
+			s.parameterSets[layer].Observe(packetRTP.GetData()[packetRTP.GetHeaderSize():])
+		}
+	}
+	s.ratesMutex.Unlock()
+
+	s.RLock()
+	defer s.RUnlock()
+	for _, f := range s.forwarders {
+		f.Push(layer, packetRTP)
+	}
+}
+
+/*
+ * SimulcastForwarder send one layer of the publisher to a listener
+ */
+type SimulcastForwarder struct {
+	sync.Mutex
+	Out chan *srtp.PacketRTP
+	// private
+	ctx         context.Context
+	publisher   *SimulcastPublisher
+	codecOption CodecOptions
+	ssrcId      uint32
+	payloadType uint16
+	clockRate   uint32
+	// layer sent, -1 until the first key frame
+	current int
+	// last-N: the publisher video isn't forwarded
+	paused bool
+	// layer wanted, switching on its next key frame
+	target int
+	// highest layer wanted by the listener (low quality), -1 for all
+	maxLayer        int
+	keyFrameAskedAt time.Time
+	seqOffset       uint16
+	tsOffset        uint32
+	lastSeq         uint16
+	lastTs          uint32
+	lastForwardedAt time.Time
+	// VP8 temporal layers of the current layer: highest TID sent & wanted
+	temporalLayer       uint8
+	targetTemporalLayer uint8
+	temporalRates       [vp8TemporalLayerAll + 1]simulcastLayerRate
+	// dropped frames are removed from the picture ids, TL0PICIDX continue
+	// across layer switches
+	pictureIdOffset uint16
+	tl0PicIdxOffset uint8
+	lastPictureId   uint16
+	lastTL0PicIdx   uint8
+	vp8Forwarded    bool
+}
+
+func NewSimulcastForwarder(ctx context.Context, codecOption CodecOptions, ssrcId uint32, payloadType uint16, clockRate uint32) *SimulcastForwarder {
+	f := new(SimulcastForwarder)
+	f.Out = make(chan *srtp.PacketRTP, 1000)
+	f.ctx = ctx
+	f.codecOption = codecOption
+	f.ssrcId = ssrcId
+	f.payloadType = payloadType
+	f.clockRate = clockRate
+	f.current = -1
+	f.maxLayer = -1
+	f.temporalLayer = vp8TemporalLayerAll
+	f.targetTemporalLayer = vp8TemporalLayerAll
+	return f
+}
+
+/*
+ * selectSimulcastLayer return the best layer fitting the estimated bitrate,
+ * going up needs a 15% margin to avoid oscillations. Layers not received
+ * are skipped, the first layer is the fallback.
+ */
+func selectSimulcastLayer(estimate int, current int, bitrates []int) (layer int) {
+	for i := 1; i < len(bitrates); i++ {
+		if bitrates[i] == 0 {
+			continue
+		}
+		required := bitrates[i]
+		if i > current {
+			required = required * 115 / 100
+		}
+		if required <= estimate {
+			layer = i
+		}
+	}
+	return
+}
+
+// SetEstimate choose the layer fitting the listener REMB
+func (f *SimulcastForwarder) SetEstimate(remb int) {
+	// the publisher locks its layers, not taken under our lock
+	f.Lock()
+	publisher := f.publisher
+	f.Unlock()
+	if publisher == nil {
+		return
+	}
+	bitrates := publisher.LayerBitrates()
+
+	f.Lock()
+	defer f.Unlock()
+	target := selectSimulcastLayer(remb, f.current, bitrates)
+	if f.maxLayer >= 0 && target > f.maxLayer {
+		target = f.maxLayer
+	}
+	if target == f.current {
+		f.setTargetTemporalLayer(remb)
+	} else {
+		f.targetTemporalLayer = vp8TemporalLayerAll
+	}
+	if target == f.target {
+		return
+	}
+	plogger.FromContextSafe(f.ctx).Infof("simulcast: remb %d, layer %d => %d (bitrates %v)", remb, f.current, target, bitrates)
+	f.target = target
+	if f.target != f.current {
+		f.askKeyFrame()
+	}
+}
+
+/*
+ * selectTemporalLayer return the highest temporal layer fitting the estimated
+ * bitrate, each temporal layer needs the lower ones. Going up needs a 15%
+ * margin, the base layer is the fallback.
+ */
+func selectTemporalLayer(estimate int, current uint8, bitrates []int) (temporalLayer uint8) {
+	required := 0
+	for i := range bitrates {
+		required += bitrates[i]
+		if bitrates[i] == 0 || i == 0 {
+			continue
+		}
+		r := required
+		if uint8(i) > current {
+			r = r * 115 / 100
+		}
+		if r > estimate {
+			break
+		}
+		temporalLayer = uint8(i)
+	}
+	return
+}
+
+// setTargetTemporalLayer drop VP8 temporal layers if the current layer does
+// not fit the listener REMB
+func (f *SimulcastForwarder) setTargetTemporalLayer(remb int) {
+	bitrates := make([]int, len(f.temporalRates))
+	received := 0
+	for i := range f.temporalRates {
+		bitrates[i] = f.temporalRates[i].get()
+		if bitrates[i] > 0 {
+			received++
+		}
+	}
+	if received < 2 {
+		// no temporal layers
+		f.targetTemporalLayer = vp8TemporalLayerAll
+		return
+	}
+	target := selectTemporalLayer(remb, f.temporalLayer, bitrates)
+	if target == f.highestTemporalLayer(bitrates) {
+		target = vp8TemporalLayerAll
+	}
+	if target != f.targetTemporalLayer {
+		plogger.FromContextSafe(f.ctx).Infof("simulcast: remb %d, temporal layer %d => %d (bitrates %v)", remb, f.temporalLayer, target, bitrates)
+		f.targetTemporalLayer = target
+	}
+}
+
+func (f *SimulcastForwarder) highestTemporalLayer(bitrates []int) (temporalLayer uint8) {
+	for i := range bitrates {
+		if bitrates[i] > 0 {
+			temporalLayer = uint8(i)
+		}
+	}
+	return
+}
+
+// SetMaxLayer limit the layers forwarded, -1 to remove the limit: the
+// layers above are reached again on the next REMB
+func (f *SimulcastForwarder) SetMaxLayer(layer int) {
+	f.Lock()
+	defer f.Unlock()
+	f.maxLayer = layer
+	if layer >= 0 && f.target > layer {
+		f.target = layer
+		f.askKeyFrame()
+	}
+}
+
+// Pause stop forwarding (last-N, audio only subscription), the stream continues on a key frame of
+// the target layer once resumed
+func (f *SimulcastForwarder) Pause() {
+	f.Lock()
+	defer f.Unlock()
+	f.paused = true
+	f.current = -1
+}
+
+func (f *SimulcastForwarder) Resume() {
+	f.Lock()
+	defer f.Unlock()
+	if !f.paused {
+		return
+	}
+	f.paused = false
+	f.askKeyFrame()
+}
+
+// RequestKeyFrame forward a listener PLI/FIR to the layer it will receive
+func (f *SimulcastForwarder) RequestKeyFrame() {
+	f.Lock()
+	defer f.Unlock()
+	f.askKeyFrame()
+}
+
+func (f *SimulcastForwarder) askKeyFrame() {
+	f.keyFrameAskedAt = time.Now()
+	if f.publisher != nil {
+		f.publisher.RequestKeyFrame(f.target)
+	}
+}
+
+// Push forward the packet if it belongs to the current layer, or switch to
+// the target layer on its key frame
+func (f *SimulcastForwarder) Push(layer int, packetRTP *srtp.PacketRTP) {
+	f.Lock()
+	defer f.Unlock()
+	if f.paused {
+		return
+	}
+	if isFecSeqPlaceholder(packetRTP) {
+		// FEC packet of the publisher, the receiver must not see a sequence gap
+		if layer == f.current {
+			f.seqOffset--
+		}
+		return
+	}
+	if layer != f.current {
+		if layer != f.target {
+			return
+		}
+		if !isKeyFrame(f.codecOption, packetRTP) {
+			// PLI might have been lost
+			if time.Since(f.keyFrameAskedAt) > simulcastKeyFrameRetryPeriod {
+				f.askKeyFrame()
+			}
+			return
+		}
+		// jitter buffers output in order, nothing older than the key frame follows
+		f.switchLayer(layer, packetRTP)
+		f.sendH264ParameterSets(layer, packetRTP)
+	}
+
+	var vp8 *VP8PayloadDescriptor
+	if f.codecOption == CodecVP8 && packetRTP.GetHeaderSize() < packetRTP.GetSize() {
+		d, err := ParseVP8PayloadDescriptor(packetRTP.GetData()[packetRTP.GetHeaderSize():])
+		if err == nil {
+			vp8 = &d
+		}
+	}
+	if vp8 != nil && f.dropTemporalLayer(vp8, packetRTP) {
+		// the receiver must not see a sequence gap
+		f.seqOffset--
+		return
+	}
+
+	select {
+	case f.Out <- f.rewrite(packetRTP, vp8):
+	default:
+		plogger.FromContextSafe(f.ctx).Warnf("simulcast: Out is full, dropping packet of layer %d", layer)
+	}
+}
+
+/*
+ * sendH264ParameterSets send the SPS & PPS of the layer before its first
+ * IDR, if the key frame doesn't start with them (the publisher may only
+ * send them with its first key frame)
+ */
+func (f *SimulcastForwarder) sendH264ParameterSets(layer int, packetRTP *srtp.PacketRTP) {
+	if f.codecOption != CodecH264 || f.publisher == nil {
+		return
+	}
+	nalTypes := h264NalTypes(packetRTP.GetData()[packetRTP.GetHeaderSize():])
+	if len(nalTypes) == 0 || nalTypes[0] != h264NalIDR {
+		return
+	}
+	parameterSets := f.publisher.H264ParameterSets(layer)
+	if parameterSets == nil {
+		return
+	}
+	stap := parameterSets.Packet(packetRTP)
+	if stap == nil {
+		plogger.FromContextSafe(f.ctx).Warnf("simulcast: no SPS/PPS known for layer %d", layer)
+		return
+	}
+	select {
+	case f.Out <- f.rewrite(stap, nil):
+		// the key frame follows the parameter sets
+		f.seqOffset++
+	default:
+		plogger.FromContextSafe(f.ctx).Warnf("simulcast: Out is full, dropping SPS/PPS of layer %d", layer)
+	}
+}
+
+/*
+ * switchLayer compute the offsets continuing the sequence numbers & the
+ * timestamps of the previous layer, with the wall clock time elapsed since
+ * the last packet sent
+ */
+func (f *SimulcastForwarder) switchLayer(layer int, packetRTP *srtp.PacketRTP) {
+	plogger.FromContextSafe(f.ctx).Infof("simulcast: switching from layer %d to layer %d", f.current, layer)
+	// continue the stream of the previous layer, or of the stream before a
+	// pause
+	if !f.lastForwardedAt.IsZero() {
+		delta := uint32(time.Since(f.lastForwardedAt).Seconds() * float64(f.clockRate))
+		if delta == 0 {
+			delta = 1
+		}
+		f.seqOffset = f.lastSeq + 1 - packetRTP.GetSeqNumber()
+		f.tsOffset = f.lastTs + delta - packetRTP.GetTimestamp()
+	}
+	if f.codecOption == CodecVP8 && f.vp8Forwarded {
+		d, err := ParseVP8PayloadDescriptor(packetRTP.GetData()[packetRTP.GetHeaderSize():])
+		if err == nil {
+			f.pictureIdOffset = f.lastPictureId + 1 - d.PictureId
+			f.tl0PicIdxOffset = f.lastTL0PicIdx + 1 - d.TL0PicIdx
+		}
+	}
+	// temporal layers are measured again on the new layer
+	for i := range f.temporalRates {
+		f.temporalRates[i] = simulcastLayerRate{}
+	}
+	f.temporalLayer = vp8TemporalLayerAll
+	f.targetTemporalLayer = vp8TemporalLayerAll
+	f.current = layer
+}
+
+/*
+ * dropTemporalLayer return true if the VP8 packet belongs to a temporal layer
+ * above the one sent. Going down is done on any frame, going up on a frame
+ * with the layer sync bit (it only depends on the base layer) or a key frame.
+ * Dropped frames are removed from the picture ids.
+ */
+func (f *SimulcastForwarder) dropTemporalLayer(d *VP8PayloadDescriptor, packetRTP *srtp.PacketRTP) bool {
+	if !d.HasTID {
+		return false
+	}
+	f.temporalRates[d.TID].add(packetRTP.GetSize())
+	if !d.IsFrameStart() {
+		return d.TID > f.temporalLayer
+	}
+	switch {
+	case f.targetTemporalLayer < f.temporalLayer:
+		plogger.FromContextSafe(f.ctx).Infof("simulcast: temporal layer %d => %d", f.temporalLayer, f.targetTemporalLayer)
+		f.temporalLayer = f.targetTemporalLayer
+	case f.targetTemporalLayer > f.temporalLayer && d.IsKeyFrameStart(packetRTP.GetData()[packetRTP.GetHeaderSize():]):
+		f.temporalLayer = f.targetTemporalLayer
+	case f.targetTemporalLayer > f.temporalLayer && d.TID > f.temporalLayer && d.TID <= f.targetTemporalLayer && d.LayerSync:
+		plogger.FromContextSafe(f.ctx).Infof("simulcast: temporal layer %d => %d", f.temporalLayer, d.TID)
+		f.temporalLayer = d.TID
+	}
+	if d.TID > f.temporalLayer {
+		if d.HasPictureId {
+			f.pictureIdOffset--
+		}
+		return true
+	}
+	return false
+}
+
+// rewrite copy the packet, it is shared by the forwarders of every listener
+func (f *SimulcastForwarder) rewrite(packetRTP *srtp.PacketRTP, vp8 *VP8PayloadDescriptor) *srtp.PacketRTP {
+	out := srtp.NewPacketRTP(packet.NewUDP())
+	out.SetData(append([]byte{}, packetRTP.GetData()...))
+	out.SetSSRC(f.ssrcId)
+	out.SetPT(int(f.payloadType))
+	out.SetSeqNumber(packetRTP.GetSeqNumber() + f.seqOffset)
+	out.SetTimestamp(packetRTP.GetTimestamp() + f.tsOffset)
+	if vp8 != nil {
+		payload := out.GetData()[out.GetHeaderSize():]
+		vp8.SetPictureId(payload, vp8.PictureId+f.pictureIdOffset)
+		vp8.SetTL0PicIdx(payload, vp8.TL0PicIdx+f.tl0PicIdxOffset)
+		f.lastPictureId = vp8.PictureId
+		f.lastTL0PicIdx = vp8.TL0PicIdx
+		f.vp8Forwarded = true
+	}
+
+	if int16(out.GetSeqNumber()-f.lastSeq) > 0 || f.lastForwardedAt.IsZero() {
+		f.lastSeq = out.GetSeqNumber()
+		f.lastTs = out.GetTimestamp()
+		f.lastForwardedAt = time.Now()
+	}
+	return out
+}
+
+// isKeyFrame check if the packet starts a key frame
+func isKeyFrame(codecOption CodecOptions, packetRTP *srtp.PacketRTP) bool {
+	headerSize := packetRTP.GetHeaderSize()
+	if headerSize >= packetRTP.GetSize() {
+		return false
+	}
+	payload := packetRTP.GetData()[headerSize:]
+	switch codecOption {
+	case CodecVP8:
+		return isVP8KeyFrameStart(payload)
+	case CodecH264:
+		return isH264KeyFrameStart(payload)
+	case CodecVP9:
+		return isVP9KeyFrameStart(payload)
+	case CodecNone:
+		// audio
+		return true
+	}
+	return false
+}
+
+// the key frame flag is in the payload header of the first partition
+func isVP8KeyFrameStart(payload []byte) bool {
+	d, err := ParseVP8PayloadDescriptor(payload)
+	return err == nil && d.IsKeyFrameStart(payload)
+}
+
+// a VP9 key frame is not inter predicted, it starts on the base spatial layer
+func isVP9KeyFrameStart(payload []byte) bool {
+	d, err := ParseVP9PayloadDescriptor(payload)
+	return err == nil && d.IsKeyFrameStart()
+}
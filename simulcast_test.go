@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+func TestSelectSimulcastLayer(t *testing.T) {
+	bitrates := []int{150000, 500000, 1500000}
+	tests := []struct {
+		name     string
+		estimate int
+		current  int
+		bitrates []int
+		layer    int
+	}{
+		{"below every layer", 100000, 0, bitrates, 0},
+		{"first layer", 300000, 0, bitrates, 0},
+		{"up with the margin", 600000, 0, bitrates, 1},
+		// 500000 * 1.15
+		{"up without the margin", 550000, 0, bitrates, 0},
+		{"kept without the margin", 550000, 1, bitrates, 1},
+		{"down", 450000, 1, bitrates, 0},
+		{"highest layer", 2000000, 1, bitrates, 2},
+		{"highest layer kept", 1500000, 2, bitrates, 2},
+		{"highest layer without the margin", 1600000, 1, bitrates, 1},
+		// the middle layer is not received
+		{"skip a missing layer", 600000, 0, []int{150000, 0, 1500000}, 0},
+		{"skip to the highest layer", 2000000, 0, []int{150000, 0, 1500000}, 2},
+		{"single layer", 2000000, 0, []int{150000}, 0},
+	}
+	for _, test := range tests {
+		if layer := selectSimulcastLayer(test.estimate, test.current, test.bitrates); layer != test.layer {
+			t.Errorf("%s: layer %d for %d bps from %d, expected %d", test.name, layer, test.estimate, test.current, test.layer)
+		}
+	}
+}
+
+func TestIsVP8KeyFrameStart(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		key     bool
+	}{
+		// S=1 PID=0, P=0
+		{"key frame", []byte{0x10, 0x00}, true},
+		{"inter frame", []byte{0x10, 0x01}, false},
+		// S=0
+		{"key frame continuation", []byte{0x00, 0x00}, false},
+		// S=1 PID=1
+		{"second partition", []byte{0x11, 0x00}, false},
+		// X, I with a 15 bits picture id, L, T & K
+		{"key frame with extensions", []byte{0x90, 0xF0, 0x80, 0x01, 0x05, 0x40, 0x00}, true},
+		{"inter frame with extensions", []byte{0x90, 0xF0, 0x80, 0x01, 0x05, 0x40, 0x01}, false},
+		{"descriptor without payload header", []byte{0x90, 0x80, 0x01}, false},
+		{"truncated descriptor", []byte{0x90, 0xF0, 0x80}, false},
+		{"empty", []byte{}, false},
+	}
+	for _, test := range tests {
+		if key := isVP8KeyFrameStart(test.payload); key != test.key {
+			t.Errorf("%s: key frame start %t, expected %t", test.name, key, test.key)
+		}
+	}
+}
+
+func TestSelectTemporalLayer(t *testing.T) {
+	// bitrate of each temporal layer, a layer needs the lower ones
+	bitrates := []int{200000, 100000, 100000}
+	tests := []struct {
+		name          string
+		estimate      int
+		current       uint8
+		bitrates      []int
+		temporalLayer uint8
+	}{
+		{"base layer fallback", 100000, 2, bitrates, 0},
+		{"base layer", 300000, 0, bitrates, 0},
+		// 300000 * 1.15
+		{"up with the margin", 350000, 0, bitrates, 1},
+		{"kept without the margin", 300000, 1, bitrates, 1},
+		{"every layer", 500000, 0, bitrates, 2},
+		{"down", 350000, 2, bitrates, 1},
+		{"missing layer", 500000, 0, []int{200000, 0, 100000}, 2},
+	}
+	for _, test := range tests {
+		if temporalLayer := selectTemporalLayer(test.estimate, test.current, test.bitrates); temporalLayer != test.temporalLayer {
+			t.Errorf("%s: temporal layer %d for %d bps from %d, expected %d", test.name, temporalLayer, test.estimate, test.current, test.temporalLayer)
+		}
+	}
+}
+
+// newVP8TestPacket build a VP8 packet starting a frame, with a 15 bits
+// picture id, TL0PICIDX & TID
+func newVP8TestPacket(seq uint16, pictureId uint16, tl0PicIdx uint8, tid uint8, key bool) *srtp.PacketRTP {
+	data := make([]byte, 12)
+	data[0] = 0x80
+	data[1] = 96
+	binary.BigEndian.PutUint16(data[2:4], seq)
+	binary.BigEndian.PutUint32(data[4:8], uint32(seq)*3000)
+	binary.BigEndian.PutUint32(data[8:12], 0x1234)
+	data = append(data, 0x90, 0xE0, byte(0x80|pictureId>>8), byte(pictureId), tl0PicIdx, tid<<6)
+	if key {
+		data = append(data, 0x00)
+	} else {
+		data = append(data, 0x01)
+	}
+	return srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+}
+
+func TestSimulcastForwarderVP8TemporalLayers(t *testing.T) {
+	f := NewSimulcastForwarder(context.Background(), CodecVP8, 0x5678, 100, 90000)
+	f.Push(0, newVP8TestPacket(1000, 10, 3, 0, true))
+	// the listener REMB only fits the base layer: TID 1 0 1 0, the frames
+	// of TID 1 are dropped
+	f.targetTemporalLayer = 0
+	packets := []*srtp.PacketRTP{
+		newVP8TestPacket(1001, 11, 3, 1, false),
+		newVP8TestPacket(1002, 12, 4, 0, false),
+		newVP8TestPacket(1003, 13, 4, 1, false),
+		newVP8TestPacket(1004, 14, 5, 0, false),
+	}
+	for _, p := range packets {
+		f.Push(0, p)
+	}
+	if len(f.Out) != 3 {
+		t.Fatalf("%d packets forwarded, expected 3", len(f.Out))
+	}
+	for i := 0; i < 3; i++ {
+		out := <-f.Out
+		d, err := ParseVP8PayloadDescriptor(out.GetData()[out.GetHeaderSize():])
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if out.GetSeqNumber() != uint16(1000+i) || d.PictureId != uint16(10+i) || d.TL0PicIdx != uint8(3+i) || d.TID != 0 {
+			t.Errorf("packet %d: seq %d, picture id %d, TL0PICIDX %d, TID %d: expected continuous sequence numbers & picture ids", i, out.GetSeqNumber(), d.PictureId, d.TL0PicIdx, d.TID)
+		}
+		if out.GetSSRCid() != 0x5678 || out.GetPT() != 100 {
+			t.Errorf("packet %d: ssrc %X, payload type %d, expected the ones of the listener", i, out.GetSSRCid(), out.GetPT())
+		}
+	}
+}
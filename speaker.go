@@ -0,0 +1,191 @@
+package main
+
+/*
+ * Active speaker detection
+ *
+ * the publishers send the level of their audio in the client-to-mixer audio
+ * level header extension (RFC 6464), in -dBov: 0 is the loudest, 127 the
+ * silence. The audio jitter buffer averages it on a short period, the room
+ * keeps a smoothed level of each publisher: the ranking of the speakers,
+ * the loudest one is the active speaker.
+ *
+ * the active speaker changes when another speaker is louder by a margin,
+ * and not more than once per activeSpeakerMinPeriod: a short noise or a
+ * laugh doesn't switch it.
+ *
+ * @see https://tools.ietf.org/html/rfc6464
+ */
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+const (
+	extmapAudioLevel = "urn:ietf:params:rtp-hdrext:ssrc-audio-level"
+	// levels received by a jitter buffer are averaged on this period
+	audioLevelPeriod = 100 * time.Millisecond
+	// weight of a new level in the smoothed level
+	speakerSmoothing = 0.3
+	// a publisher without level since this delay is silent (muted, left)
+	speakerTimeout = 1 * time.Second
+	// below -50 dBov nobody speaks
+	activeSpeakerMinLevel = 127 - 50
+	// margin of a speaker over the active one to replace it
+	activeSpeakerMargin    = 6
+	activeSpeakerMinPeriod = 1 * time.Second
+	// eventAudioLevels rate
+	audioLevelsEventPeriod = 500 * time.Millisecond
+)
+
+// getAudioLevel read the audio level header extension, returned as a
+// loudness: 0 is the silence, 127 the loudest
+func getAudioLevel(extension []byte) (level uint8, ok bool) {
+	if len(extension) < 1 {
+		return
+	}
+	return 127 - extension[0]&0x7f, true
+}
+
+// audioLevelAnswerMedia accept the audio level header extension if offered
+func audioLevelAnswerMedia(offer *sdp.SDP, media *sdp.Media) {
+	id := offer.GetExtmapId(media.Type, extmapAudioLevel)
+	if id == 0 {
+		return
+	}
+	media.Attributes = append(media.Attributes, sdp.Attribute{K: "extmap", V: fmt.Sprintf("%d %s", id, extmapAudioLevel)})
+}
+
+type SpeakerLevel struct {
+	SocketId string
+	UserId   string
+	// smoothed loudness, 0 to 127
+	Level int
+}
+
+type speaker struct {
+	userId    string
+	level     float64
+	updatedAt time.Time
+}
+
+/*
+ * ActiveSpeakers is the ranking of the speakers of a room
+ */
+type ActiveSpeakers struct {
+	sync.Mutex
+	// by socketId
+	speakers     map[string]*speaker
+	active       string
+	activeSince  time.Time
+	levelsSentAt time.Time
+}
+
+func NewActiveSpeakers() *ActiveSpeakers {
+	a := new(ActiveSpeakers)
+	a.speakers = make(map[string]*speaker)
+	return a
+}
+
+/*
+ * Observe save the level of a publisher received at now, return the new
+ * active speaker if it changed & the levels of the room when they are due
+ */
+func (a *ActiveSpeakers) Observe(socketId string, userId string, level uint8, now time.Time) (active *SpeakerLevel, levels []SpeakerLevel) {
+	a.Lock()
+	defer a.Unlock()
+	s := a.speakers[socketId]
+	if s == nil {
+		s = &speaker{userId: userId}
+		a.speakers[socketId] = s
+	}
+	if now.Sub(s.updatedAt) > speakerTimeout {
+		s.level = float64(level)
+	} else {
+		s.level += speakerSmoothing * (float64(level) - s.level)
+	}
+	s.updatedAt = now
+
+	if a.elect(now) {
+		active = &SpeakerLevel{SocketId: a.active, UserId: a.speakers[a.active].userId, Level: int(a.speakers[a.active].level)}
+	}
+	if now.Sub(a.levelsSentAt) >= audioLevelsEventPeriod {
+		a.levelsSentAt = now
+		levels = a.ranking(now)
+	}
+	return
+}
+
+// Remove forget a publisher, it left the room
+func (a *ActiveSpeakers) Remove(socketId string) {
+	a.Lock()
+	defer a.Unlock()
+	delete(a.speakers, socketId)
+	if a.active == socketId {
+		a.active = ""
+	}
+}
+
+// Active return the socketId of the active speaker, empty if nobody speaks
+func (a *ActiveSpeakers) Active() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.active
+}
+
+// Ranking return the levels of the publishers, the loudest first
+func (a *ActiveSpeakers) Ranking() []SpeakerLevel {
+	a.Lock()
+	defer a.Unlock()
+	return a.ranking(time.Now())
+}
+
+// not thread safe
+func (a *ActiveSpeakers) ranking(now time.Time) (levels []SpeakerLevel) {
+	for socketId, s := range a.speakers {
+		levels = append(levels, SpeakerLevel{SocketId: socketId, UserId: s.userId, Level: int(a.level(s, now))})
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		if levels[i].Level != levels[j].Level {
+			return levels[i].Level > levels[j].Level
+		}
+		return levels[i].SocketId < levels[j].SocketId
+	})
+	return
+}
+
+// level of a speaker, 0 once it timed out. not thread safe
+func (a *ActiveSpeakers) level(s *speaker, now time.Time) float64 {
+	if now.Sub(s.updatedAt) > speakerTimeout {
+		return 0
+	}
+	return s.level
+}
+
+// elect choose the active speaker, return true if it changed. not thread
+// safe
+func (a *ActiveSpeakers) elect(now time.Time) bool {
+	var loudest string
+	var loudestLevel float64
+	for socketId, s := range a.speakers {
+		if level := a.level(s, now); level > loudestLevel {
+			loudest = socketId
+			loudestLevel = level
+		}
+	}
+	if loudest == "" || loudest == a.active || loudestLevel < activeSpeakerMinLevel {
+		return false
+	}
+	if current := a.speakers[a.active]; current != nil {
+		if now.Sub(a.activeSince) < activeSpeakerMinPeriod || loudestLevel < a.level(current, now)+activeSpeakerMargin {
+			return false
+		}
+	}
+	a.active = loudest
+	a.activeSince = now
+	return true
+}
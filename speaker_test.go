@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetAudioLevel(t *testing.T) {
+	tests := []struct {
+		extension []byte
+		level     uint8
+		ok        bool
+	}{
+		{nil, 0, false},
+		// -0 dBov, the voice activity bit is ignored
+		{[]byte{0x00}, 127, true},
+		{[]byte{0x80}, 127, true},
+		// -30 dBov
+		{[]byte{30}, 97, true},
+		// silence
+		{[]byte{0x7f}, 0, true},
+		{[]byte{0xff}, 0, true},
+	}
+	for _, test := range tests {
+		level, ok := getAudioLevel(test.extension)
+		if level != test.level || ok != test.ok {
+			t.Errorf("getAudioLevel(%v) = %d, %t, expected %d, %t", test.extension, level, ok, test.level, test.ok)
+		}
+	}
+}
+
+// speakerTestStart is the time of the first level observed
+var speakerTestStart = time.Unix(1500000000, 0)
+
+func speakerTestAt(ms int) time.Time {
+	return speakerTestStart.Add(time.Duration(ms) * time.Millisecond)
+}
+
+func TestActiveSpeakersElection(t *testing.T) {
+	a := NewActiveSpeakers()
+	active, _ := a.Observe("a", "userA", 100, speakerTestAt(0))
+	if active == nil || active.SocketId != "a" || active.UserId != "userA" {
+		t.Fatalf("first speaker not elected: %+v", active)
+	}
+	// too quiet to speak
+	if active, _ := a.Observe("b", "userB", activeSpeakerMinLevel-1, speakerTestAt(10)); active != nil {
+		t.Errorf("silent speaker elected: %+v", active)
+	}
+	if a.Active() != "a" {
+		t.Errorf("active speaker is %s, expected a", a.Active())
+	}
+}
+
+func TestActiveSpeakersMinPeriod(t *testing.T) {
+	a := NewActiveSpeakers()
+	a.Observe("a", "userA", 90, speakerTestAt(0))
+	// b is louder by the margin, but a was just elected
+	for ms := 100; ms < 1000; ms += 100 {
+		if active, _ := a.Observe("b", "userB", 120, speakerTestAt(ms)); active != nil {
+			t.Fatalf("active speaker switched after %d ms", ms)
+		}
+		a.Observe("a", "userA", 90, speakerTestAt(ms))
+	}
+	active, _ := a.Observe("b", "userB", 120, speakerTestAt(1100))
+	if active == nil || active.SocketId != "b" {
+		t.Errorf("active speaker not switched after %s: %+v", activeSpeakerMinPeriod, active)
+	}
+}
+
+func TestActiveSpeakersMargin(t *testing.T) {
+	a := NewActiveSpeakers()
+	a.Observe("a", "userA", 100, speakerTestAt(0))
+	// louder, below the margin
+	for ms := 0; ms < 3000; ms += 100 {
+		a.Observe("a", "userA", 100, speakerTestAt(ms))
+		if active, _ := a.Observe("b", "userB", 100+activeSpeakerMargin-1, speakerTestAt(ms)); active != nil {
+			t.Fatalf("active speaker switched at %d ms without the margin", ms)
+		}
+	}
+}
+
+func TestActiveSpeakersSmoothing(t *testing.T) {
+	a := NewActiveSpeakers()
+	a.Observe("a", "userA", 100, speakerTestAt(0))
+	// a short noise of b doesn't reach the level of a
+	a.Observe("b", "userB", 10, speakerTestAt(2000))
+	a.Observe("a", "userA", 100, speakerTestAt(2000))
+	if active, _ := a.Observe("b", "userB", 127, speakerTestAt(2100)); active != nil {
+		t.Errorf("single loud level switched the active speaker: %+v", active)
+	}
+	// 10 + 0.3 * (127 - 10)
+	if level := a.ranking(speakerTestAt(2100))[1].Level; level != 45 {
+		t.Errorf("smoothed level is %d, expected 45", level)
+	}
+}
+
+func TestActiveSpeakersTimeout(t *testing.T) {
+	a := NewActiveSpeakers()
+	a.Observe("a", "userA", 120, speakerTestAt(0))
+	// a stopped sending levels (muted): b is elected without the margin
+	active, _ := a.Observe("b", "userB", 90, speakerTestAt(2000))
+	if active == nil || active.SocketId != "b" {
+		t.Errorf("timed out speaker kept active: %+v", active)
+	}
+	// a restarts from its new level, not the smoothed one
+	a.Observe("a", "userA", 80, speakerTestAt(4000))
+	if levels := a.ranking(speakerTestAt(4000)); len(levels) != 2 || levels[0].SocketId != "a" || levels[0].Level != 80 || levels[1].Level != 0 {
+		t.Errorf("ranking is %+v, expected a at 80 & b silent", levels)
+	}
+}
+
+func TestActiveSpeakersRemove(t *testing.T) {
+	a := NewActiveSpeakers()
+	a.Observe("a", "userA", 100, speakerTestAt(0))
+	a.Remove("a")
+	if a.Active() != "" {
+		t.Errorf("active speaker is %s after it left", a.Active())
+	}
+	active, _ := a.Observe("b", "userB", 90, speakerTestAt(100))
+	if active == nil || active.SocketId != "b" {
+		t.Errorf("next speaker not elected: %+v", active)
+	}
+}
+
+func TestActiveSpeakersLevelsPeriod(t *testing.T) {
+	a := NewActiveSpeakers()
+	events := 0
+	for ms := 0; ms < 2000; ms += 100 {
+		if _, levels := a.Observe("a", "userA", 100, speakerTestAt(ms)); levels != nil {
+			events++
+		}
+	}
+	if expected := int(2 * time.Second / audioLevelsEventPeriod); events != expected {
+		t.Errorf("%d levels events in 2s, expected %d", events, expected)
+	}
+}
@@ -2,6 +2,7 @@ package srtp
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/heytribe/live-webrtcsignaling/packet"
@@ -39,7 +40,6 @@ func (p *PacketRTP) GetPT() int {
 
 func (p *PacketRTP) SetPT(pt int) {
 	data := p.GetData()
-	fmt.Printf("SETTING PT %d", pt)
 	data[1] = data[1]&0x80 | byte(pt)
 	p.SetData(data)
 }
@@ -77,20 +77,172 @@ func (p *PacketRTP) SetSeqNumber(seq uint16) {
 	binary.BigEndian.PutUint16(data[2:4], seq)
 }
 
-func (p *PacketRTP) RTXExtractOriginal(ssrc uint32) (pOrigin *PacketRTP, osn uint16) {
+// GetHeaderSize return the size of the fixed header, the csrcs & the
+// header extension (RFC 3550 5.3.1)
+func (p *PacketRTP) GetHeaderSize() int {
 	data := p.GetData()
-	cc := (data[0] & 0x0f) << 2
-	headerSize := 12 + cc
+	headerSize := 12 + int(data[0]&0x0f)*4
+	if data[0]&0x10 != 0 && len(data) >= headerSize+4 {
+		headerSize += 4 + int(binary.BigEndian.Uint16(data[headerSize+2:headerSize+4]))*4
+	}
+	return headerSize
+}
+
+/*
+ * GetHeaderExtension return the value of the header extension element id,
+ * one-byte (0xBEDE) or two-byte (0x100X) header (RFC 8285), nil if absent
+ */
+func (p *PacketRTP) GetHeaderExtension(id int) []byte {
+	data := p.GetData()
+	offset := 12 + int(data[0]&0x0f)*4
+	if data[0]&0x10 == 0 || len(data) < offset+4 {
+		return nil
+	}
+	profile := binary.BigEndian.Uint16(data[offset : offset+2])
+	end := offset + 4 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))*4
+	if end > len(data) {
+		return nil
+	}
+	for i := offset + 4; i < end; {
+		var elementId, length int
+		switch {
+		case profile == 0xBEDE:
+			if data[i] == 0 {
+				// padding
+				i++
+				continue
+			}
+			elementId = int(data[i] >> 4)
+			length = int(data[i]&0x0f) + 1
+			if elementId == 15 {
+				return nil
+			}
+			i++
+		case profile&0xfff0 == 0x1000 && i+1 < end:
+			if data[i] == 0 {
+				i++
+				continue
+			}
+			elementId = int(data[i])
+			length = int(data[i+1])
+			i += 2
+		default:
+			return nil
+		}
+		if i+length > end {
+			return nil
+		}
+		if elementId == id {
+			return data[i : i+length]
+		}
+		i += length
+	}
+	return nil
+}
+
+// StripHeaderExtension remove the header extension, the payload is moved
+// right after the csrcs
+func (p *PacketRTP) StripHeaderExtension() {
+	data := p.GetData()
+	if data[0]&0x10 == 0 {
+		return
+	}
+	offset := 12 + int(data[0]&0x0f)*4
+	headerSize := p.GetHeaderSize()
+	if headerSize > len(data) {
+		return
+	}
+	data[0] &^= 0x10
+	p.SetData(append(data[:offset], data[headerSize:]...))
+}
+
+/*
+ * RTXExtractOriginal unwrap a retransmission packet (RFC 4588 4), the
+ * original sequence number is the first two bytes of the payload, the
+ * payload type & the ssrc are restored. The padding of the retransmission
+ * packet is removed, padding only packets (bandwidth probing) have no
+ * original packet.
+ */
+func (p *PacketRTP) RTXExtractOriginal(ssrc uint32, pt int) (pOrigin *PacketRTP, osn uint16, err error) {
+	data := p.GetData()
+	if len(data) < 12 {
+		err = errors.New("rtx packet too short")
+		return
+	}
+	headerSize := p.GetHeaderSize()
+	end := len(data)
+	if data[0]&0x20 != 0 && end > headerSize {
+		end -= int(data[end-1])
+	}
+	if end < headerSize+2 {
+		err = errors.New("rtx packet without original sequence number (padding only ?)")
+		return
+	}
 	osn = binary.BigEndian.Uint16(data[headerSize : headerSize+2])
-	originData := append(data[0:headerSize], data[headerSize+2:]...)
+	originData := make([]byte, 0, end-2)
+	originData = append(originData, data[0:headerSize]...)
+	originData = append(originData, data[headerSize+2:end]...)
+	// no padding
+	originData[0] &^= 0x20
 	// Restore origin Payload Type
-	originData[1] = originData[1]&0x80 | (originData[1]&0x7f - 1)
+	originData[1] = originData[1]&0x80 | byte(pt)
 	// Restore original Sequence Number
 	binary.BigEndian.PutUint16(originData[2:4], osn)
 	// Restore original SSRC
 	binary.BigEndian.PutUint32(originData[8:12], ssrc)
-	pOrigin = NewPacketRTP(packet.NewUDP())
-	pOrigin.SetData(originData)
+	pOrigin = NewPacketRTP(packet.NewUDPFromData(originData, p.GetRAddr()))
+	pOrigin.SetCreatedAt(p.GetCreatedAt())
+
+	return
+}
+
+/*
+ * REDExtractPrimary unwrap a redundant payload packet (RFC 2198 3), only the
+ * primary encoding is kept (the last block), the redundant blocks are
+ * skipped. The payload type is the block payload type, the header
+ * (extension included) is kept.
+ */
+func (p *PacketRTP) REDExtractPrimary() (pPrimary *PacketRTP, err error) {
+	data := p.GetData()
+	if len(data) < 12 {
+		err = errors.New("red packet too short")
+		return
+	}
+	headerSize := p.GetHeaderSize()
+	end := len(data)
+	if data[0]&0x20 != 0 && end > headerSize {
+		end -= int(data[end-1])
+	}
+	// block headers: F(1) PT(7) [timestamp offset(14) block length(10)]
+	offset := headerSize
+	redundantSize := 0
+	for offset < end && data[offset]&0x80 != 0 {
+		if offset+4 > end {
+			err = errors.New("red block header truncated")
+			return
+		}
+		redundantSize += int(binary.BigEndian.Uint16(data[offset+2:offset+4]) & 0x03ff)
+		offset += 4
+	}
+	if offset >= end {
+		err = errors.New("red packet without primary block")
+		return
+	}
+	pt := data[offset] & 0x7f
+	offset++
+	if offset+redundantSize > end {
+		err = errors.New(fmt.Sprintf("red redundant blocks size %d exceeds the payload", redundantSize))
+		return
+	}
+	offset += redundantSize
+	primaryData := make([]byte, 0, headerSize+end-offset)
+	primaryData = append(primaryData, data[0:headerSize]...)
+	primaryData = append(primaryData, data[offset:end]...)
+	// no padding
+	primaryData[0] &^= 0x20
+	primaryData[1] = primaryData[1]&0x80 | pt
+	pPrimary = NewPacketRTP(packet.NewUDPFromData(primaryData, p.GetRAddr()))
+	pPrimary.SetCreatedAt(p.GetCreatedAt())
 
 	return
 }
@@ -0,0 +1,311 @@
+package srtp_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+// rtpHeader is a RTP header without csrcs: version 2, PT 96, seq 0x1234,
+// timestamp 0x01020304, ssrc 0xAABBCCDD
+var rtpHeader = []byte{0x80, 0x60, 0x12, 0x34, 0x01, 0x02, 0x03, 0x04, 0xAA, 0xBB, 0xCC, 0xDD}
+
+var rtpPayload = []byte{0xDE, 0xAD, 0xBE, 0xEF}
+
+// newRTPWithExtension build a packet with the header extension profile &
+// elements, padded to a multiple of 4 bytes
+func newRTPWithExtension(profile uint16, elements []byte) *srtp.PacketRTP {
+	for len(elements)%4 != 0 {
+		elements = append(elements, 0)
+	}
+	data := append([]byte{}, rtpHeader...)
+	data[0] |= 0x10
+	words := len(elements) / 4
+	data = append(data, byte(profile>>8), byte(profile), byte(words>>8), byte(words))
+	data = append(data, elements...)
+	data = append(data, rtpPayload...)
+	return srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+}
+
+func TestGetHeaderExtensionOneByte(t *testing.T) {
+	// id 1 length 1, padding, id 3 length 3, id 2 length 2
+	p := newRTPWithExtension(0xBEDE, []byte{
+		0x10, 0xAA,
+		0x00,
+		0x32, 0x01, 0x02, 0x03,
+		0x21, 0x04, 0x05,
+	})
+	tests := []struct {
+		id    int
+		value []byte
+	}{
+		{1, []byte{0xAA}},
+		{2, []byte{0x04, 0x05}},
+		{3, []byte{0x01, 0x02, 0x03}},
+		{4, nil},
+	}
+	for _, test := range tests {
+		if value := p.GetHeaderExtension(test.id); !bytes.Equal(value, test.value) {
+			t.Errorf("one-byte extension %d = %v, expected %v", test.id, value, test.value)
+		}
+	}
+	if size := p.GetHeaderSize(); size != 12+4+12 {
+		t.Errorf("header size is %d, expected %d", size, 12+4+12)
+	}
+}
+
+func TestGetHeaderExtensionTwoByte(t *testing.T) {
+	// id 1 length 0, padding, id 20 length 3, id 2 length 1
+	p := newRTPWithExtension(0x1000, []byte{
+		0x01, 0x00,
+		0x00,
+		0x14, 0x03, 0x01, 0x02, 0x03,
+		0x02, 0x01, 0xAA,
+	})
+	tests := []struct {
+		id    int
+		value []byte
+	}{
+		{1, []byte{}},
+		{20, []byte{0x01, 0x02, 0x03}},
+		{2, []byte{0xAA}},
+		{3, nil},
+	}
+	for _, test := range tests {
+		value := p.GetHeaderExtension(test.id)
+		if !bytes.Equal(value, test.value) || (value == nil) != (test.value == nil) {
+			t.Errorf("two-byte extension %d = %v, expected %v", test.id, value, test.value)
+		}
+	}
+}
+
+func TestGetHeaderExtensionInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		p    *srtp.PacketRTP
+	}{
+		{"no extension", srtp.NewPacketRTP(packet.NewUDPFromData(append(append([]byte{}, rtpHeader...), rtpPayload...), nil))},
+		{"unknown profile", newRTPWithExtension(0x1234, []byte{0x10, 0xAA})},
+		// id 15 stops the parsing
+		{"reserved id", newRTPWithExtension(0xBEDE, []byte{0xF0, 0x00, 0x10, 0xAA})},
+		// length past the extension
+		{"truncated element", newRTPWithExtension(0xBEDE, []byte{0x00, 0x00, 0x00, 0x1F})},
+	}
+	for _, test := range tests {
+		if value := test.p.GetHeaderExtension(1); value != nil {
+			t.Errorf("%s: extension 1 = %v, expected none", test.name, value)
+		}
+	}
+}
+
+func TestStripHeaderExtension(t *testing.T) {
+	for _, profile := range []uint16{0xBEDE, 0x1000} {
+		p := newRTPWithExtension(profile, []byte{0x10, 0xAA, 0x21, 0x04, 0x05})
+		p.StripHeaderExtension()
+		expected := append(append([]byte{}, rtpHeader...), rtpPayload...)
+		if !bytes.Equal(p.GetData(), expected) {
+			t.Errorf("profile %X: stripped packet is %X, expected %X", profile, p.GetData(), expected)
+		}
+		if size := p.GetHeaderSize(); size != 12 {
+			t.Errorf("profile %X: header size is %d after strip, expected 12", profile, size)
+		}
+	}
+	// without extension the packet is unchanged
+	data := append(append([]byte{}, rtpHeader...), rtpPayload...)
+	p := srtp.NewPacketRTP(packet.NewUDPFromData(append([]byte{}, data...), nil))
+	p.StripHeaderExtension()
+	if !bytes.Equal(p.GetData(), data) {
+		t.Errorf("packet without extension changed: %X", p.GetData())
+	}
+}
+
+// newRTX build a retransmission of rtpHeader/rtpPayload: PT 97, seq 0x0001,
+// ssrc 0x11223344, the original sequence number before the payload
+func newRTX(marker bool, osn uint16, padding int) *srtp.PacketRTP {
+	data := append([]byte{}, rtpHeader...)
+	data[1] = 97
+	if marker {
+		data[1] |= 0x80
+	}
+	data[2], data[3] = 0x00, 0x01
+	data[8], data[9], data[10], data[11] = 0x11, 0x22, 0x33, 0x44
+	data = append(data, byte(osn>>8), byte(osn))
+	data = append(data, rtpPayload...)
+	if padding > 0 {
+		data[0] |= 0x20
+		for i := 1; i < padding; i++ {
+			data = append(data, 0)
+		}
+		data = append(data, byte(padding))
+	}
+	return srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+}
+
+func TestRTXExtractOriginal(t *testing.T) {
+	tests := []struct {
+		name    string
+		marker  bool
+		padding int
+	}{
+		{"plain", false, 0},
+		{"marker", true, 0},
+		{"padding", false, 3},
+	}
+	for _, test := range tests {
+		rtx := newRTX(test.marker, 0x1234, test.padding)
+		original, osn, err := rtx.RTXExtractOriginal(0xAABBCCDD, 96)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if osn != 0x1234 {
+			t.Errorf("%s: original sequence number %X, expected 1234", test.name, osn)
+		}
+		expected := append(append([]byte{}, rtpHeader...), rtpPayload...)
+		if test.marker {
+			expected[1] |= 0x80
+		}
+		if !bytes.Equal(original.GetData(), expected) {
+			t.Errorf("%s: original packet %X, expected %X", test.name, original.GetData(), expected)
+		}
+		if original.GetPT() != 96 || original.GetMarkerBit() != test.marker {
+			t.Errorf("%s: payload type %d marker %t, expected 96 & %t", test.name, original.GetPT(), original.GetMarkerBit(), test.marker)
+		}
+	}
+}
+
+func TestRTXExtractOriginalHeaderExtension(t *testing.T) {
+	// the header extension of the retransmission is kept
+	data := append([]byte{}, rtpHeader...)
+	data[0] |= 0x10
+	data[1] = 97
+	extension := []byte{0xBE, 0xDE, 0x00, 0x01, 0x10, 0xAA, 0x00, 0x00}
+	data = append(data, extension...)
+	data = append(data, 0x12, 0x34)
+	data = append(data, rtpPayload...)
+	rtx := srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+	original, osn, err := rtx.RTXExtractOriginal(0xAABBCCDD, 96)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if osn != 0x1234 || original.GetPT() != 96 {
+		t.Errorf("original sequence number %X, payload type %d", osn, original.GetPT())
+	}
+	if value := original.GetHeaderExtension(1); !bytes.Equal(value, []byte{0xAA}) {
+		t.Errorf("header extension 1 = %v, expected AA", value)
+	}
+	if payload := original.GetData()[original.GetHeaderSize():]; !bytes.Equal(payload, rtpPayload) {
+		t.Errorf("payload %X, expected %X", payload, rtpPayload)
+	}
+}
+
+func TestRTXExtractOriginalInvalid(t *testing.T) {
+	// bandwidth probing: the payload is the padding
+	paddingOnly := append(append([]byte{}, rtpHeader...), 0, 0, 0, 4)
+	paddingOnly[0] |= 0x20
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", append([]byte{}, rtpHeader[:8]...)},
+		{"no original sequence number", append([]byte{}, rtpHeader...)},
+		{"padding only", paddingOnly},
+	}
+	for _, test := range tests {
+		p := srtp.NewPacketRTP(packet.NewUDPFromData(test.data, nil))
+		if _, _, err := p.RTXExtractOriginal(0xAABBCCDD, 96); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+// newRED build a redundant payload packet of rtpHeader (PT 116): the
+// redundant blocks of PT 96, then the primary block rtpPayload of PT pt
+func newRED(pt byte, redundant [][]byte, padding int) *srtp.PacketRTP {
+	data := append([]byte{}, rtpHeader...)
+	data[1] = 116
+	for i, block := range redundant {
+		offset := uint16(3000 * (len(redundant) - i))
+		data = append(data, 0x80|96, byte(offset>>6), byte(offset<<2)|byte(len(block)>>8), byte(len(block)))
+	}
+	data = append(data, pt)
+	for _, block := range redundant {
+		data = append(data, block...)
+	}
+	data = append(data, rtpPayload...)
+	if padding > 0 {
+		data[0] |= 0x20
+		for i := 1; i < padding; i++ {
+			data = append(data, 0)
+		}
+		data = append(data, byte(padding))
+	}
+	return srtp.NewPacketRTP(packet.NewUDPFromData(data, nil))
+}
+
+func TestREDExtractPrimary(t *testing.T) {
+	tests := []struct {
+		name      string
+		pt        byte
+		redundant [][]byte
+		padding   int
+	}{
+		{"primary only", 96, nil, 0},
+		{"ulpfec primary", 117, nil, 0},
+		{"redundant block", 96, [][]byte{{0x01, 0x02, 0x03}}, 0},
+		{"redundant blocks", 96, [][]byte{{0x01}, {0x02, 0x03}}, 0},
+		{"padding", 96, [][]byte{{0x01, 0x02}}, 2},
+	}
+	for _, test := range tests {
+		red := newRED(test.pt, test.redundant, test.padding)
+		primary, err := red.REDExtractPrimary()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		expected := append(append([]byte{}, rtpHeader...), rtpPayload...)
+		expected[1] = test.pt
+		if !bytes.Equal(primary.GetData(), expected) {
+			t.Errorf("%s: primary packet %X, expected %X", test.name, primary.GetData(), expected)
+		}
+		if primary.GetPT() != int(test.pt) || primary.GetSeqNumber() != red.GetSeqNumber() {
+			t.Errorf("%s: payload type %d seq %d, expected %d & %d", test.name, primary.GetPT(), primary.GetSeqNumber(), test.pt, red.GetSeqNumber())
+		}
+	}
+}
+
+func TestREDExtractPrimaryMarker(t *testing.T) {
+	red := newRED(96, nil, 0)
+	red.GetData()[1] |= 0x80
+	primary, err := red.REDExtractPrimary()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !primary.GetMarkerBit() || primary.GetPT() != 96 {
+		t.Errorf("marker %t payload type %d, expected true & 96", primary.GetMarkerBit(), primary.GetPT())
+	}
+}
+
+func TestREDExtractPrimaryInvalid(t *testing.T) {
+	tooBig := newRED(96, [][]byte{{0x01, 0x02}}, 0).GetData()
+	// redundant block length 200
+	tooBig[12+3] = 200
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", append([]byte{}, rtpHeader[:8]...)},
+		{"no primary block", append([]byte{}, rtpHeader...)},
+		{"block header truncated", append(append([]byte{}, rtpHeader...), 0x80|96, 0x00)},
+		{"redundant only", append(append([]byte{}, rtpHeader...), 0x80|96, 0x00, 0x00, 0x00)},
+		{"redundant blocks exceed the payload", tooBig},
+	}
+	for _, test := range tests {
+		p := srtp.NewPacketRTP(packet.NewUDPFromData(test.data, nil))
+		if _, err := p.REDExtractPrimary(); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package srtp
+
+//#include "shim.h"
+import "C"
+
+// Profile is a DTLS-SRTP protection profile, values are the ids of
+// RFC 5764 & RFC 7714 (same as libsrtp srtp_profile_t)
+type Profile uint16
+
+const (
+	ProfileAes128CmSha1_80 Profile = 0x0001
+	ProfileAes128CmSha1_32 Profile = 0x0002
+	ProfileAeadAes128Gcm   Profile = 0x0007
+	ProfileAeadAes256Gcm   Profile = 0x0008
+)
+
+// MasterKeyLength return the length of the master key + master salt
+// expected by Create, 0 if the profile is not supported by libsrtp
+func (p Profile) MasterKeyLength() int {
+	keyLength := int(C.srtp_profile_get_master_key_length(C.srtp_profile_t(p)))
+	if keyLength == 0 {
+		return 0
+	}
+	return keyLength + int(C.srtp_profile_get_master_salt_length(C.srtp_profile_t(p)))
+}
+
+// Supported is true if libsrtp can create sessions of the profile
+func (p Profile) Supported() bool {
+	return C.X_SRTP_profile_supported(C.int(p)) == 1
+}
@@ -16,23 +16,63 @@ int X_SRTP_shim_init() {
   return 0;
 }
 
-srtp_policy_t *X_SRTP_set_remote_policy(unsigned char *remote_srtp_key) {
-  unsigned char *remote_srtp_key_copy;
+static srtp_policy_t *X_SRTP_new_policy(unsigned char *srtp_key, int srtp_key_len, int profile) {
+  srtp_policy_t *policy;
+
+  policy = (srtp_policy_t *)malloc(sizeof(srtp_policy_t));
+  memset(policy, 0x0, sizeof(srtp_policy_t));
+  if (srtp_crypto_policy_set_from_profile_for_rtp(&(policy->rtp), (srtp_profile_t)profile) != srtp_err_status_ok ||
+      srtp_crypto_policy_set_from_profile_for_rtcp(&(policy->rtcp), (srtp_profile_t)profile) != srtp_err_status_ok) {
+    free(policy);
+    return NULL;
+  }
+  policy->key = (unsigned char *)malloc(srtp_key_len);
+  bcopy(srtp_key, policy->key, srtp_key_len);
+  policy->window_size = 128;
+  policy->allow_repeat_tx = 0;
+  policy->next = NULL;
+
+  return policy;
+}
+
+/*
+ * X_SRTP_profile_supported create a session of the profile with a zero key,
+ * the GCM profiles need libsrtp built with OpenSSL (--enable-openssl)
+ */
+int X_SRTP_profile_supported(int profile) {
+  unsigned char key[64];
+  srtp_policy_t *policy;
+  srtp_t session;
+
+  memset(key, 0x0, sizeof(key));
+  policy = X_SRTP_new_policy(key, sizeof(key), profile);
+  if (policy == NULL) {
+    return 0;
+  }
+  policy->ssrc.type = ssrc_any_inbound;
+  if (srtp_create(&session, policy) != srtp_err_status_ok) {
+    free(policy->key);
+    free(policy);
+    return 0;
+  }
+  srtp_dealloc(session);
+  free(policy->key);
+  free(policy);
+
+  return 1;
+}
+
+srtp_policy_t *X_SRTP_set_remote_policy(unsigned char *remote_srtp_key, int remote_srtp_key_len, int profile) {
   srtp_policy_t *remote_policy;
 
-  remote_policy = (srtp_policy_t *)malloc(sizeof(srtp_policy_t));
-  memset(remote_policy, 0x0, sizeof(srtp_policy_t));
-  srtp_crypto_policy_set_rtp_default(&(remote_policy->rtp));
-  srtp_crypto_policy_set_rtcp_default(&(remote_policy->rtcp));
+  remote_policy = X_SRTP_new_policy(remote_srtp_key, remote_srtp_key_len, profile);
+  if (remote_policy == NULL) {
+    return NULL;
+  }
   remote_policy->ssrc.type = ssrc_any_inbound;
-  remote_policy->key = (unsigned char *)malloc(30);
-  bcopy(remote_srtp_key,  remote_policy->key, 30);
-  remote_policy->window_size = 128;
-  remote_policy->allow_repeat_tx = 0;
-  remote_policy->next = NULL;
   int i = 0;
   fprintf(stderr, "[ SRTP ] remote_policy->key is ");
-  for (i = 0; i < 30; i++) {
+  for (i = 0; i < remote_srtp_key_len; i++) {
     fprintf(stderr, "0x%.2x ",  remote_policy->key[i]);
   }
   fprintf(stderr, "\n");
@@ -40,24 +80,18 @@ srtp_policy_t *X_SRTP_set_remote_policy(unsigned char *remote_srtp_key) {
   return remote_policy;
 }
 
-srtp_policy_t *X_SRTP_set_local_policy(unsigned char *local_srtp_key) {
-  unsigned char *local_srtp_key_copy;
+srtp_policy_t *X_SRTP_set_local_policy(unsigned char *local_srtp_key, int local_srtp_key_len, int profile) {
   srtp_policy_t *local_policy;
 
-  local_policy = (srtp_policy_t *)malloc(sizeof(srtp_policy_t));
-  memset(local_policy, 0x0, sizeof(srtp_policy_t));
-  srtp_crypto_policy_set_rtp_default(&(local_policy->rtp));
-  srtp_crypto_policy_set_rtcp_default(&(local_policy->rtcp));
+  local_policy = X_SRTP_new_policy(local_srtp_key, local_srtp_key_len, profile);
+  if (local_policy == NULL) {
+    return NULL;
+  }
   local_policy->ssrc.type = ssrc_any_outbound;
-  local_policy->key = (unsigned char *)malloc(30);
-  bcopy(local_srtp_key, local_policy->key, 30);
-  local_policy->window_size = 128;
-  local_policy->allow_repeat_tx = 0;
-  local_policy->next = NULL;
 
   int i = 0;
   fprintf(stderr, "[ SRTP ] local_policy->key is ");
-  for (i = 0; i < 30; i++) {
+  for (i = 0; i < local_srtp_key_len; i++) {
     fprintf(stderr, "0x%.2x ", local_policy->key[i]);
   }
   fprintf(stderr, "\n");
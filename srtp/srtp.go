@@ -93,13 +93,29 @@ var srtpGlobalMutex sync.RWMutex
 	return
 }*/
 
-func Create(localSrtpKey []byte, remoteSrtpKey []byte) (srtpSession *SrtpSession, err error) {
+// Create the inbound & outbound sessions, keys are master key + master salt
+// with the lengths of the negotiated profile
+func Create(profile Profile, localSrtpKey []byte, remoteSrtpKey []byte) (srtpSession *SrtpSession, err error) {
 	srtpGlobalMutex.Lock()
 	defer srtpGlobalMutex.Unlock()
 
-	logString("[ SRTP ] localSrtpKey is %#v, remoteSrtpKey is %#v", localSrtpKey, remoteSrtpKey)
-	localPolicy := C.X_SRTP_set_local_policy((*C.uchar)(unsafe.Pointer(&localSrtpKey[0])))
-	remotePolicy := C.X_SRTP_set_remote_policy((*C.uchar)(unsafe.Pointer(&remoteSrtpKey[0])))
+	keyLength := profile.MasterKeyLength()
+	if keyLength == 0 {
+		err = errors.New(fmt.Sprintf("SRTP profile 0x%04x is not supported", uint16(profile)))
+		return
+	}
+	if len(localSrtpKey) != keyLength || len(remoteSrtpKey) != keyLength {
+		err = errors.New(fmt.Sprintf("SRTP profile 0x%04x expects %d bytes keys, got %d & %d", uint16(profile), keyLength, len(localSrtpKey), len(remoteSrtpKey)))
+		return
+	}
+
+	logString("[ SRTP ] profile is 0x%04x, localSrtpKey is %#v, remoteSrtpKey is %#v", uint16(profile), localSrtpKey, remoteSrtpKey)
+	localPolicy := C.X_SRTP_set_local_policy((*C.uchar)(unsafe.Pointer(&localSrtpKey[0])), C.int(keyLength), C.int(profile))
+	remotePolicy := C.X_SRTP_set_remote_policy((*C.uchar)(unsafe.Pointer(&remoteSrtpKey[0])), C.int(keyLength), C.int(profile))
+	if localPolicy == nil || remotePolicy == nil {
+		err = errors.New(fmt.Sprintf("could not create SRTP policies for profile 0x%04x", uint16(profile)))
+		return
+	}
 
 	logString("[ SRTP ] remotePolicy == %#v", remotePolicy)
 	var ret int
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 	"sync"
@@ -17,6 +18,7 @@ import (
 	plogger "github.com/heytribe/go-plogger"
 	"github.com/heytribe/live-webrtcsignaling/my"
 	"github.com/heytribe/live-webrtcsignaling/packet"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
 )
 
 const (
@@ -108,6 +110,10 @@ type StunRequest struct {
 	priority      uint32
 	mappedAddress string
 	ttl           time.Time
+	// request: MESSAGE-INTEGRITY was present & valid
+	integrity bool
+	// request sent: address checked, its response must come from it
+	rAddr *net.UDPAddr
 }
 
 var bin = binary.BigEndian
@@ -135,21 +141,30 @@ func (m *StunMessage) AddXorMappedAddress(rAddr *net.UDPAddr) (err error) {
 		err = errors.New("could not add a XOR-MAPPED-ADDRESS attribute if the packet is not initialized correctly (missing STUN header)")
 		return
 	}
-	if len(rAddr.IP) != 4 {
-		err = errors.New(fmt.Sprintf("remote ip address format %#v is not supported (IPv4 only)", rAddr.IP))
+	// dual-stack sockets report IPv4 clients with IPv4-mapped addresses
+	if ipv4 := rAddr.IP.To4(); ipv4 != nil {
+		b = make([]byte, 12)
+		sAttrHeader.length = 8
+		b[5] = 0x01 // IPv4
+		bin.PutUint32(b[8:12], bin.Uint32(ipv4)^0x2112a442)
+	} else if len(rAddr.IP) == net.IPv6len {
+		// IPv6 is XOR'ed with the magic cookie followed by the transaction id
+		b = make([]byte, 24)
+		sAttrHeader.length = 20
+		b[5] = 0x02 // IPv6
+		xor := m.b[4:20]
+		for i := 0; i < net.IPv6len; i++ {
+			b[8+i] = rAddr.IP[i] ^ xor[i]
+		}
+	} else {
+		err = errors.New(fmt.Sprintf("remote ip address format %#v is not supported", rAddr.IP))
 		return
 	}
-
-	rIpUint := bin.Uint32(rAddr.IP[:])
-	b = make([]byte, 12)
 	sAttrHeader.typ = 0x0020
-	sAttrHeader.length = 8
 	bin.PutUint16(b[0:2], sAttrHeader.typ)
 	bin.PutUint16(b[2:4], sAttrHeader.length)
 	b[4] = 0x00 // Reserved
-	b[5] = 0x01 // IPv4
 	bin.PutUint16(b[6:8], uint16(rAddr.Port)^0x2112)
-	bin.PutUint32(b[8:12], rIpUint^0x2112a442)
 
 	m.b = append(m.b, b...)
 
@@ -397,6 +412,7 @@ func (m *StunMessage) BuildBindingRequest(ctx context.Context, rAddr *net.UDPAdd
 
 	// Add stun request transaction Id / stunRequest infos to stunTransactions
 	key := fmt.Sprintf("%X", transactionId)
+	stunRequest.rAddr = rAddr
 	stunTransactions.Set(ctx, key, &stunRequest)
 
 	return
@@ -433,14 +449,41 @@ type StunState int
 const (
 	StunStateInit      StunState = 0
 	StunStateCompleted StunState = 1
+	// an ICE restart validated a new remote address, DTLS & SRTP are kept
+	StunStateRestarted StunState = 2
+	// consent freshness (RFC 7675) of a completed context
+	StunStateConnected    StunState = 3
+	StunStateDisconnected StunState = 4
+	StunStateFailed       StunState = 5
+)
+
+// consent freshness: the media path is disconnected, then failed, when
+// our binding requests stay unanswered for these durations
+const (
+	STUN_CONSENT_DISCONNECTED_SECS = 10
+	STUN_CONSENT_FAILED_SECS       = 30
 )
 
+// connectivity checks toward trickled candidates (offerer mode)
+const (
+	STUN_CHECK_INTERVAL_MS = 500
+	STUN_CHECK_MAX         = 20
+)
+
+type StunCandidatePair struct {
+	Local      string
+	Remote     string
+	RemoteType string
+}
+
 type StunContext struct {
 	sync.RWMutex
 	State              StunState
 	ChState            chan StunState
 	RAddr              *net.UDPAddr
 	sdpCtx             *SdpContext
+	iceUfragLocal      string
+	iceUfragRemote     string
 	icePwdLocal        string
 	icePwdRemote       string
 	mode               StunMode
@@ -449,6 +492,18 @@ type StunContext struct {
 	monitorStarted     bool
 	monitorStunRequest StunRequest
 	monitorRAddr       *net.UDPAddr
+	// trickle ICE
+	c                *connectionUdp
+	remoteCandidates []sdp.Candidate
+	endOfCandidates  bool
+	selectedPair     *StunCandidatePair
+	// ICE restart
+	restart bool
+	done    chan struct{}
+	// consent freshness: last binding response received & current state
+	// (connected, disconnected or failed)
+	lastConsent time.Time
+	consent     string
 }
 
 func NewStunCtx(ctx context.Context, key string, sdpCtx *SdpContext, mode StunMode) (stunCtx *StunContext) {
@@ -461,17 +516,260 @@ func NewStunCtx(ctx context.Context, key string, sdpCtx *SdpContext, mode StunMo
 	stunCtx.sdpCtx = sdpCtx
 	stunCtx.mode = mode
 	if stunCtx.mode == StunAnswererMode {
+		stunCtx.iceUfragLocal = sdpCtx.answer.Data.Medias[0].IceUfrag
+		stunCtx.iceUfragRemote = sdpCtx.offer.Data.Medias[0].IceUfrag
 		stunCtx.icePwdLocal = sdpCtx.answer.Data.Medias[0].IcePwd
 		stunCtx.icePwdRemote = sdpCtx.offer.Data.Medias[0].IcePwd
 	} else {
+		stunCtx.iceUfragLocal = sdpCtx.offer.Data.Medias[0].IceUfrag
+		stunCtx.iceUfragRemote = sdpCtx.answer.Data.Medias[0].IceUfrag
 		stunCtx.icePwdLocal = sdpCtx.offer.Data.Medias[0].IcePwd
 		stunCtx.icePwdRemote = sdpCtx.answer.Data.Medias[0].IcePwd
 	}
 	stunCtx.rtt = new(int64)
+	stunCtx.done = make(chan struct{})
 	log.Debugf("Local icePwd is %s, Remote icePwd is %s", stunCtx.icePwdLocal, stunCtx.icePwdRemote)
 	return
 }
 
+// NewStunCtxRestart create the stun context of an ICE restart, with the new
+// credentials of sdpCtx. The state channel & the rtt of the previous context
+// are kept, the session state managers are still reading them.
+func NewStunCtxRestart(ctx context.Context, key string, sdpCtx *SdpContext, previous *StunContext) (stunCtx *StunContext) {
+	stunCtx = NewStunCtx(ctx, key, sdpCtx, previous.mode)
+	stunCtx.ChState = previous.ChState
+	stunCtx.rtt = previous.rtt
+	stunCtx.restart = true
+	// the previous path is not probed anymore: the restart gets a full
+	// consent period to complete, the consent state is kept meanwhile
+	previous.RLock()
+	stunCtx.consent = previous.consent
+	previous.RUnlock()
+	stunCtx.lastConsent = time.Now()
+	return
+}
+
+// Close stop the goroutines of a replaced stun context
+func (stunCtx *StunContext) Close() {
+	stunCtx.Lock()
+	defer stunCtx.Unlock()
+	select {
+	case <-stunCtx.done:
+	default:
+		close(stunCtx.done)
+	}
+}
+
+// credentialsChanged return true if the current SDP exchange does not use
+// the ICE credentials of this context anymore
+func (stunCtx *StunContext) credentialsChanged(sdpCtx *SdpContext) bool {
+	offer, answer := sdpCtx.Negotiated()
+	if offer == nil || answer == nil {
+		return false
+	}
+	local, remote := answer, offer
+	if stunCtx.mode == StunOffererMode {
+		local, remote = offer, answer
+	}
+	return local.Data.Medias[0].IceUfrag != stunCtx.iceUfragLocal ||
+		remote.Data.Medias[0].IceUfrag != stunCtx.iceUfragRemote
+}
+
+// checking return true while this context should answer connectivity checks
+// with its own binding requests: before DTLS, or during an ICE restart
+func (stunCtx *StunContext) checking(c *connectionUdp) bool {
+	if c.dtlsState == DtlsStateNone {
+		return true
+	}
+	stunCtx.RLock()
+	defer stunCtx.RUnlock()
+	return stunCtx.restart && stunCtx.State != StunStateCompleted
+}
+
+// AddRemoteCandidate save a trickled candidate of the remote peer, in offerer
+// mode a connectivity check is sent right away if the udp connection is up
+func (stunCtx *StunContext) AddRemoteCandidate(ctx context.Context, candidate sdp.Candidate) (err error) {
+	log := plogger.FromContextSafe(ctx).Prefix("STUN").Tag("stun")
+	ctx = plogger.NewContext(ctx, log)
+
+	// we only listen on udp and use rtcp-mux
+	if strings.ToLower(candidate.Transport) != "udp" {
+		err = errors.New(fmt.Sprintf("candidate transport %s is not supported", candidate.Transport))
+		return
+	}
+	if candidate.ComponentId != 1 {
+		err = errors.New(fmt.Sprintf("candidate component-id %d is not supported (rtcp-mux only)", candidate.ComponentId))
+		return
+	}
+	if candidate.Address.To4() == nil && config.Network.PublicIPV6 == "" {
+		err = errors.New(fmt.Sprintf("candidate address %s is not supported (no public IPv6 configured)", candidate.Address))
+		return
+	}
+
+	stunCtx.Lock()
+	for _, c := range stunCtx.remoteCandidates {
+		if c.Address.Equal(candidate.Address) && c.Port == candidate.Port {
+			stunCtx.Unlock()
+			log.Debugf("candidate %s:%d already known, skipping", candidate.Address, candidate.Port)
+			return
+		}
+	}
+	stunCtx.remoteCandidates = append(stunCtx.remoteCandidates, candidate)
+	c := stunCtx.c
+	state := stunCtx.State
+	stunCtx.Unlock()
+	log.Infof("remote candidate %s %s:%d typ %s added", candidate.Foundation, candidate.Address, candidate.Port, candidate.Typ)
+
+	if stunCtx.mode == StunOffererMode && state != StunStateCompleted && c != nil {
+		stunCtx.checkCandidate(ctx, c, candidate)
+	}
+
+	return
+}
+
+// SetEndOfCandidates is called when the remote peer has gathered all its candidates
+func (stunCtx *StunContext) SetEndOfCandidates(ctx context.Context) {
+	log := plogger.FromContextSafe(ctx).Prefix("STUN").Tag("stun")
+	stunCtx.Lock()
+	defer stunCtx.Unlock()
+	stunCtx.endOfCandidates = true
+	log.Infof("end of candidates, %d remote candidate(s) received", len(stunCtx.remoteCandidates))
+}
+
+func (stunCtx *StunContext) getRemoteCandidates() []sdp.Candidate {
+	stunCtx.RLock()
+	defer stunCtx.RUnlock()
+	return append([]sdp.Candidate{}, stunCtx.remoteCandidates...)
+}
+
+func (stunCtx *StunContext) checkCandidate(ctx context.Context, c *connectionUdp, candidate sdp.Candidate) {
+	log, _ := plogger.FromContext(ctx)
+
+	rAddr := &net.UDPAddr{IP: candidate.Address, Port: candidate.Port}
+	username := stunCtx.iceUfragRemote
+	password := stunCtx.iceUfragLocal
+	stunRequest := StunRequest{
+		username: &username,
+		password: &password,
+	}
+	var m StunMessage
+	m.Init(c.tieBreaker)
+	err := m.BuildBindingRequest(ctx, rAddr, stunRequest, stunCtx.icePwdRemote, stunCtx.mode)
+	if log.OnError(err, "[ error ] could not build a STUN binding request to candidate %s", rAddr) {
+		return
+	}
+	stunCtx.Lock()
+	stunCtx.requestTs = time.Now()
+	stunCtx.Unlock()
+	log.Debugf("Sending a connectivity check to candidate %s", rAddr)
+	select {
+	case c.send <- packet.NewUDPFromData(m.b, rAddr):
+	default:
+		log.Warnf("c.send is full, dropping connectivity check to %s", rAddr)
+	}
+}
+
+// connectivityChecks send binding requests toward every remote candidates
+// until the stun context is completed (offerer mode only, the answerer is
+// ICE lite and waits for incoming checks)
+func (stunCtx *StunContext) connectivityChecks(ctx context.Context, c *connectionUdp) {
+	log := plogger.FromContextSafe(ctx).Prefix("STUN").Tag("stun")
+	ctx = plogger.NewContext(ctx, log)
+
+	stunCtx.Lock()
+	stunCtx.c = c
+	stunCtx.Unlock()
+	if stunCtx.mode != StunOffererMode {
+		return
+	}
+	ticker := time.NewTicker(STUN_CHECK_INTERVAL_MS * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; i < STUN_CHECK_MAX; i++ {
+		stunCtx.RLock()
+		state := stunCtx.State
+		stunCtx.RUnlock()
+		if state == StunStateCompleted {
+			return
+		}
+		for _, candidate := range stunCtx.getRemoteCandidates() {
+			stunCtx.checkCandidate(ctx, c, candidate)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-stunCtx.done:
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Warnf("no connectivity check succeeded after %d tries", STUN_CHECK_MAX)
+}
+
+func (stunCtx *StunContext) newCandidatePair(ctx context.Context, c *connectionUdp, rAddr *net.UDPAddr) *StunCandidatePair {
+	pair := &StunCandidatePair{
+		Remote:     rAddr.String(),
+		RemoteType: "prflx",
+	}
+	if localAddr, ok := c.conn.LocalAddr().(*net.UDPAddr); ok {
+		if localIP := localAddressFor(ctx, rAddr.IP); localIP != nil {
+			pair.Local = net.JoinHostPort(localIP.String(), strconv.Itoa(localAddr.Port))
+		}
+	}
+	for _, candidate := range stunCtx.remoteCandidates {
+		if candidate.Address.Equal(rAddr.IP) && candidate.Port == rAddr.Port {
+			pair.RemoteType = candidate.Typ
+			break
+		}
+	}
+	return pair
+}
+
+// checkConsent update the consent state from the last binding response
+// received and post its changes on ChState, it returns false once failed
+func (stunCtx *StunContext) checkConsent(ctx context.Context) bool {
+	log, _ := plogger.FromContext(ctx)
+
+	stunCtx.Lock()
+	if stunCtx.lastConsent.IsZero() {
+		stunCtx.Unlock()
+		return true
+	}
+	previous := stunCtx.consent
+	elapsed := time.Since(stunCtx.lastConsent)
+	switch {
+	case elapsed > STUN_CONSENT_FAILED_SECS*time.Second:
+		stunCtx.consent = "failed"
+	case elapsed > STUN_CONSENT_DISCONNECTED_SECS*time.Second:
+		stunCtx.consent = "disconnected"
+	case stunCtx.restart && stunCtx.State != StunStateCompleted:
+		// restart in progress, no response on the new path yet
+	default:
+		stunCtx.consent = "connected"
+	}
+	consent := stunCtx.consent
+	stunCtx.Unlock()
+	if consent == previous || (previous == "" && consent == "connected") {
+		return consent != "failed"
+	}
+
+	log.Infof("consent is now %s, last binding response %s ago", consent, elapsed)
+	stunCtx.sdpCtx.iceState = consent
+	var state StunState
+	switch consent {
+	case "failed":
+		state = StunStateFailed
+	case "disconnected":
+		state = StunStateDisconnected
+	default:
+		state = StunStateConnected
+	}
+	go func(ch chan StunState) {
+		ch <- state
+	}(stunCtx.ChState)
+
+	return consent != "failed"
+}
+
 func (stunCtx *StunContext) monitorRTT(ctx context.Context, c *connectionUdp) {
 	var err error
 	var udpPacket *packet.UDP
@@ -483,7 +781,14 @@ func (stunCtx *StunContext) monitorRTT(ctx context.Context, c *connectionUdp) {
 		case <-ctx.Done():
 			log.Infof("go func monitorRTT exiting")
 			return
+		case <-stunCtx.done:
+			log.Infof("stun context replaced, go func monitorRTT exiting")
+			return
 		default:
+			if stunCtx.checkConsent(ctx) == false {
+				log.Warnf("consent expired, go func monitorRTT exiting")
+				return
+			}
 			if stunCtx.RAddr != nil {
 				var m2 StunMessage
 				m2.Init(c.tieBreaker)
@@ -492,7 +797,9 @@ func (stunCtx *StunContext) monitorRTT(ctx context.Context, c *connectionUdp) {
 					log.Warnf("could not create a STUN binding request: %s", err.Error())
 				} else {
 					udpPacket = packet.NewUDPFromData(m2.b, stunCtx.monitorRAddr)
+					stunCtx.Lock()
 					stunCtx.requestTs = time.Now()
+					stunCtx.Unlock()
 					log.Debugf("Sending a binding request @ %d", time.Now().UnixNano())
 					c.send <- udpPacket
 				}
@@ -559,6 +866,14 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 		if log.OnError(err, "[ error ] could not decode stun message") {
 			return
 		}
+		if !stunRequest.integrity {
+			err = errors.New("invalid STUN binding request, MESSAGE-INTEGRITY is missing")
+			return
+		}
+		// shared socket: the address is routed to us once the check is validated
+		if mc, ok := c.conn.(*udpMuxConn); ok {
+			mc.LearnRAddr(rAddr)
+		}
 
 		// Stun packet is OK - changing state in sdpSessions
 		/*sessionKey := *stunRequest.username + ":" + *stunRequest.password
@@ -584,7 +899,7 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 		//sdpSessions.Set(sessionKey, sdpData)
 
 		// Now build the STUN request to the server
-		if c.dtlsState == DtlsStateNone {
+		if stunCtx.checking(c) {
 			username := stunRequest.username
 			stunCtx.monitorRAddr = rAddr
 			stunRequest.username = stunRequest.password
@@ -594,7 +909,9 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 			m2.Init(c.tieBreaker)
 			err = m2.BuildBindingRequest(ctx, rAddr, stunRequest, stunCtx.icePwdRemote, stunCtx.mode)
 			udpPacket = packet.NewUDPFromData(m2.b, rAddr)
+			stunCtx.Lock()
 			stunCtx.requestTs = time.Now()
+			stunCtx.Unlock()
 			log.Debugf("Sending a binding request @ %d", time.Now().UnixNano())
 			c.send <- udpPacket
 		}
@@ -622,6 +939,12 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 			return
 		}
 		stunTransactions.Delete(ctx, key)
+		// the pair checked is the one the request was sent to (RFC 8445
+		// 7.2.5.2.1), a response from another address fails the check
+		if origin := stunOriginRequest.rAddr; origin != nil && !(origin.IP.Equal(rAddr.IP) && origin.Port == rAddr.Port) {
+			err = errors.New(fmt.Sprintf("STUN binding response from %s to a check sent to %s", rAddr, origin))
+			return
+		}
 
 		// Stun packet is OK - changing state in sdpSessions
 		/*sessionKey := *stunOriginRequest.username + ":" + *stunOriginRequest.password
@@ -631,11 +954,15 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 			return
 		}*/
 
+		// consent refreshed
+		stunCtx.Lock()
 		*stunCtx.rtt = responseTs.UnixNano() - stunCtx.requestTs.UnixNano()
+		stunCtx.lastConsent = responseTs
+		stunCtx.Unlock()
 		log.Debugf("RTT is %f ms", float64(*stunCtx.rtt)/1000000)
 
 		// It's OK we could send the binding indication
-		if c.dtlsState == DtlsStateNone {
+		if stunCtx.checking(c) {
 			var m3 StunMessage
 			m3.Init(c.tieBreaker)
 			err = m3.BuildBindingIndication()
@@ -646,17 +973,23 @@ func (stunCtx *StunContext) handleStunMessage(ctx context.Context, c *connection
 			c.send <- udpPacket
 
 			log.Debugf("[ STUN ] Probably STUN is about to complete and create DTLS session")
-			log.Debugf("[ STUN ] rAddr.Port is %d and stunCtx.sdpCtx.iceCandidatePort is %d", rAddr.Port, stunCtx.sdpCtx.iceCandidatePort)
+			log.Debugf("[ STUN ] candidate pair with %s succeeded", rAddr)
 
-			stunCtx.RLock()
-			defer stunCtx.RUnlock()
-			if stunCtx.State != StunStateCompleted && ((stunCtx.sdpCtx.iceCandidatePort == 0) || (rAddr.Port == stunCtx.sdpCtx.iceCandidatePort)) {
+			stunCtx.Lock()
+			defer stunCtx.Unlock()
+			if stunCtx.State != StunStateCompleted {
 				stunCtx.sdpCtx.iceState = `completed`
 				stunCtx.RAddr = rAddr
 				stunCtx.State = StunStateCompleted
-				log.Debugf("posting to stunCtx.ChState -> state completed stunCtx.ChState is %p", stunCtx.ChState)
+				stunCtx.selectedPair = stunCtx.newCandidatePair(ctx, c, rAddr)
+				log.Infof("selected candidate pair %s <-> %s (%s)", stunCtx.selectedPair.Local, stunCtx.selectedPair.Remote, stunCtx.selectedPair.RemoteType)
+				state := StunStateCompleted
+				if stunCtx.restart {
+					state = StunStateRestarted
+				}
+				log.Debugf("posting to stunCtx.ChState -> state %d stunCtx.ChState is %p", state, stunCtx.ChState)
 				go func(ch chan StunState) {
-					ch <- StunStateCompleted
+					ch <- state
 				}(stunCtx.ChState)
 			}
 		}
@@ -761,6 +1094,7 @@ func (stunCtx *StunContext) decodeStun(ctx context.Context, buf []byte, request
 					return
 				}
 				err = stunCtx.checkMessageIntegrity(buf[:bufPos], &sAttrHeader, &stunRequest, stunCtx.icePwdLocal)
+				stunRequest.integrity = err == nil
 			} else {
 				err = stunCtx.checkMessageIntegrity(buf[:bufPos], &sAttrHeader, stunOriginRequest, stunCtx.icePwdRemote)
 			}
@@ -775,13 +1109,22 @@ func (stunCtx *StunContext) decodeStun(ctx context.Context, buf []byte, request
 			// NONCE
 		case 0x0020:
 			// XOR-MAPPED-ADDRESS
-			if sAttrHeader.length != 8 {
-				err = errors.New("invalid STUN attribute packet XOR-MAPPED-ADDRESS, length should be 8 bytes / IPv4 only")
+			port := bin.Uint16(sAttrHeader.value[2:4]) ^ 0x2112
+			switch {
+			case sAttrHeader.length == 8 && sAttrHeader.value[1] == 0x01:
+				ipv4 := bin.Uint32(sAttrHeader.value[4:8]) ^ 0x2112a442
+				stunRequest.mappedAddress = fmt.Sprintf("%d.%d.%d.%d:%d", (ipv4&0xff000000)>>24, (ipv4&0x00ff0000)>>16, (ipv4&0x0000ff00)>>8, ipv4&0x000000ff, port)
+			case sAttrHeader.length == 20 && sAttrHeader.value[1] == 0x02:
+				ipv6 := make(net.IP, net.IPv6len)
+				xor := buf[4:20]
+				for i := 0; i < net.IPv6len; i++ {
+					ipv6[i] = sAttrHeader.value[4+i] ^ xor[i]
+				}
+				stunRequest.mappedAddress = net.JoinHostPort(ipv6.String(), strconv.Itoa(int(port)))
+			default:
+				err = errors.New("invalid STUN attribute packet XOR-MAPPED-ADDRESS, length should be 8 bytes (IPv4) or 20 bytes (IPv6)")
 				return
 			}
-			ipv4 := bin.Uint32(sAttrHeader.value[4:8]) ^ 0x2112a442
-			port := bin.Uint16(sAttrHeader.value[2:4]) ^ 0x2112
-			stunRequest.mappedAddress = fmt.Sprintf("%d.%d.%d.%d:%d", (ipv4&0xff000000)>>24, (ipv4&0x00ff0000)>>16, (ipv4&0x0000ff00)>>8, ipv4&0x000000ff, port)
 		case 0x0024:
 			// PRIORITY
 			if len(sAttrHeader.value) != 4 {
@@ -815,10 +1158,21 @@ func (stunCtx *StunContext) decodeStun(ctx context.Context, buf []byte, request
 }
 
 // JSON marshaling
+type jsonStunCandidatePair struct {
+	Local      string `json:"local"`
+	Remote     string `json:"remote"`
+	RemoteType string `json:"remoteType"`
+}
+
 type jsonStunContext struct {
-	State string  `json:"state"`
-	Mode  string  `json:"mode"`
-	RTT   float64 `json:"rtt"`
+	State            string                 `json:"state"`
+	Mode             string                 `json:"mode"`
+	RTT              float64                `json:"rtt"`
+	RemoteCandidates []string               `json:"remoteCandidates"`
+	EndOfCandidates  bool                   `json:"endOfCandidates"`
+	SelectedPair     *jsonStunCandidatePair `json:"selectedPair"`
+	Restart          bool                   `json:"restart"`
+	Consent          string                 `json:"consent"`
 }
 
 func newJsonStunContext(stunCtx *StunContext) jsonStunContext {
@@ -832,10 +1186,30 @@ func newJsonStunContext(stunCtx *StunContext) jsonStunContext {
 		mode = "offered"
 	}
 
+	stunCtx.RLock()
+	defer stunCtx.RUnlock()
+	remoteCandidates := []string{}
+	for _, candidate := range stunCtx.remoteCandidates {
+		remoteCandidates = append(remoteCandidates, fmt.Sprintf("%s:%d typ %s", candidate.Address, candidate.Port, candidate.Typ))
+	}
+	var selectedPair *jsonStunCandidatePair
+	if stunCtx.selectedPair != nil {
+		selectedPair = &jsonStunCandidatePair{
+			stunCtx.selectedPair.Local,
+			stunCtx.selectedPair.Remote,
+			stunCtx.selectedPair.RemoteType,
+		}
+	}
+
 	return jsonStunContext{
 		state,
 		mode,
 		float64(*stunCtx.rtt) / 1000000,
+		remoteCandidates,
+		stunCtx.endOfCandidates,
+		selectedPair,
+		stunCtx.restart,
+		stunCtx.consent,
 	}
 }
 
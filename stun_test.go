@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+// stunTestHeader is the header of the RFC 5769 sample responses (2.2 & 2.3)
+var stunTestHeader = []byte{
+	0x01, 0x01, 0x00, 0x00,
+	0x21, 0x12, 0xa4, 0x42,
+	0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae,
+}
+
+func TestAddXorMappedAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		rAddr     *net.UDPAddr
+		attribute []byte
+	}{
+		{"ipv4", &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 32853}, []byte{
+			0x00, 0x20, 0x00, 0x08,
+			0x00, 0x01, 0xa1, 0x47,
+			0xe1, 0x12, 0xa6, 0x43,
+		}},
+		// dual-stack socket
+		{"ipv4-mapped ipv6", &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 32853}, []byte{
+			0x00, 0x20, 0x00, 0x08,
+			0x00, 0x01, 0xa1, 0x47,
+			0xe1, 0x12, 0xa6, 0x43,
+		}},
+		{"ipv6", &net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}, []byte{
+			0x00, 0x20, 0x00, 0x14,
+			0x00, 0x02, 0xa1, 0x47,
+			0x01, 0x13, 0xa9, 0xfa,
+			0xa5, 0xd3, 0xf1, 0x79,
+			0xbc, 0x25, 0xf4, 0xb5,
+			0xbe, 0xd2, 0xb9, 0xd9,
+		}},
+	}
+	for _, test := range tests {
+		m := StunMessage{b: append([]byte{}, stunTestHeader...)}
+		if err := m.AddXorMappedAddress(test.rAddr); err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if attribute := m.b[20:]; !bytes.Equal(attribute, test.attribute) {
+			t.Errorf("%s: attribute %X, expected %X", test.name, attribute, test.attribute)
+		}
+	}
+}
+
+func TestAddXorMappedAddressInvalid(t *testing.T) {
+	m := StunMessage{}
+	if err := m.AddXorMappedAddress(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}); err == nil {
+		t.Errorf("attribute added without STUN header")
+	}
+	m = StunMessage{b: append([]byte{}, stunTestHeader...)}
+	if err := m.AddXorMappedAddress(&net.UDPAddr{IP: net.IP{1, 2, 3}, Port: 1}); err == nil {
+		t.Errorf("attribute added with an invalid address")
+	}
+}
+
+func TestDecodeStunXorMappedAddress(t *testing.T) {
+	tests := []struct {
+		rAddr         *net.UDPAddr
+		mappedAddress string
+	}{
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 32853}, "192.0.2.1:32853"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8:1234:5678:11:2233:4455:6677"), Port: 32853}, "[2001:db8:1234:5678:11:2233:4455:6677]:32853"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 9}, "[fe80::1]:9"},
+	}
+	for _, test := range tests {
+		m := StunMessage{b: append([]byte{}, stunTestHeader...)}
+		m.AddXorMappedAddress(test.rAddr)
+		m.UpdateLength()
+		stunRequest, err := new(StunContext).decodeStun(context.Background(), m.b, true)
+		if err != nil {
+			t.Errorf("%s: %s", test.mappedAddress, err.Error())
+			continue
+		}
+		if stunRequest.mappedAddress != test.mappedAddress {
+			t.Errorf("mapped address %s, expected %s", stunRequest.mappedAddress, test.mappedAddress)
+		}
+	}
+}
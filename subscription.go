@@ -0,0 +1,62 @@
+package main
+
+/*
+ * Selective subscription (SFU)
+ *
+ * by default a peer receives every publisher of the room: a listener
+ * session is offered when a publisher is up. A peer joining with
+ * autoSubscribe false only receives the publishers it subscribes to, any
+ * peer can unsubscribe from a publisher (off-screen tile, picture in
+ * picture) and subscribe again.
+ *
+ * the quality hint of a subscription is applied by the forwarder of the
+ * listener session, without renegotiation: audio pauses the video, low
+ * keeps the lowest simulcast layer.
+ */
+
+type SubscriptionQuality int
+
+const (
+	// unsubscribed, no listener session
+	SubscriptionNone SubscriptionQuality = iota
+	SubscriptionAudio
+	SubscriptionLow
+	SubscriptionHigh
+)
+
+func (q SubscriptionQuality) String() string {
+	switch q {
+	case SubscriptionAudio:
+		return "audio"
+	case SubscriptionLow:
+		return "low"
+	case SubscriptionHigh:
+		return "high"
+	}
+	return "none"
+}
+
+// parseSubscriptionQuality read the quality hint of subscribe, high by
+// default
+func parseSubscriptionQuality(quality string) (q SubscriptionQuality, ok bool) {
+	switch quality {
+	case "", "high":
+		return SubscriptionHigh, true
+	case "low":
+		return SubscriptionLow, true
+	case "audio":
+		return SubscriptionAudio, true
+	}
+	return SubscriptionNone, false
+}
+
+// subscription return the quality of our subscription to a publisher
+func (c *connection) subscription(socketId string) SubscriptionQuality {
+	if q := c.subscriptions.Get(socketId); q != nil {
+		return q.(SubscriptionQuality)
+	}
+	if c.autoSubscribe {
+		return SubscriptionHigh
+	}
+	return SubscriptionNone
+}
@@ -52,13 +52,34 @@ func NewDecoderParse(ctx context.Context, codecOption CodecOptions, audioIn chan
 	return
 }
 
-func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srtp.PacketRTP, videoIn chan *srtp.PacketRTP, c *connectionUdp, rAddr *net.UDPAddr, vSsrcId uint32, vPayloadType uint16, aSsrcId uint32, aPayloadType uint16) (s *GstSession, err error) {
+func decoderVideoCaps(codecOption CodecOptions, vPayloadType uint16) (caps string, err error) {
+	switch codecOption {
+	case CodecVP8:
+		caps = fmt.Sprintf("application/x-rtp,media=(string)video,payload=(int)%d,clock-rate=(int)90000,encoding-name=(string)VP8", vPayloadType)
+	case CodecH264:
+		//caps = fmt.Sprintf("application/x-rtp, media=(string)video, payload=(int)%d, clock-rate=(int)90000, encoding-name=(string)H264, packetization-mode=(int)1, profile-level-id=(string)42e01f", vPayloadType)
+		caps = fmt.Sprintf("application/x-rtp,media=(string)video,payload=(int)%d,clock-rate=(int)90000,encoding-name=(string)H264", vPayloadType)
+	case CodecVP9:
+		caps = fmt.Sprintf("application/x-rtp,media=(string)video,payload=(int)%d,clock-rate=(int)90000,encoding-name=(string)VP9", vPayloadType)
+	default:
+		err = fmt.Errorf("Unknown codec option %d", codecOption)
+	}
+	return
+}
+
+func decoderAudioCaps(aPayloadType uint16) string {
+	return fmt.Sprintf("application/x-rtp,media=(string)audio,payload=(int)%d,clock-rate=(int)48000,encoding-name=(string)OPUS", aPayloadType)
+}
+
+func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srtp.PacketRTP, videoIn chan *srtp.PacketRTP, c *connectionUdp, rAddr *net.UDPAddr, vSsrcId uint32, vPayloadType uint16, aSsrcId uint32, aPayloadType uint16, mode ModeOptions) (s *GstSession, err error) {
 	var e *gst.GstElement
 
 	log := plogger.FromContextSafe(ctx).Prefix("GST:Decoder").Tag("gst")
 	ctx = plogger.NewContext(ctx, log)
 	s = NewGstSession(ctx, audioIn, videoIn, c, rAddr, vSsrcId, aSsrcId, codecOption, 0)
 	s.callbackCtx = gst.NewCallbackCtx()
+	// the controller name is checked by the config
+	s.bitrateController, _ = NewBitrateController(config.Bitrates.Controller, config.Bitrates.Video)
 
 	e, err = gst.PipelineNew("")
 	if log.OnError(err, "Could not create a new GStreamer pipeline") {
@@ -73,18 +94,11 @@ func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srt
 	gst.ObjectSet(ctx, e, "do-timestamp", true)
 	gst.ObjectSet(ctx, e, "is-live", true)
 	gst.ObjectSet(ctx, e, "format", 3)
-	var videoCaps *gst.GstCaps
-	switch codecOption {
-	case CodecVP8:
-		videoCaps = gst.CapsFromString(fmt.Sprintf("application/x-rtp,media=(string)video,payload=(int)%d,clock-rate=(int)90000,encoding-name=(string)VP8", vPayloadType))
-	case CodecH264:
-		//videoCaps = gst.CapsFromString(fmt.Sprintf("application/x-rtp, media=(string)video, payload=(int)%d, clock-rate=(int)90000, encoding-name=(string)H264, packetization-mode=(int)1, profile-level-id=(string)42e01f", vPayloadType))
-		videoCaps = gst.CapsFromString(fmt.Sprintf("application/x-rtp,media=(string)video,payload=(int)%d,clock-rate=(int)90000,encoding-name=(string)H264", vPayloadType))
-	default:
-		err = fmt.Errorf("Unknown codec option %d", codecOption)
+	videoCaps, err := decoderVideoCaps(codecOption, vPayloadType)
+	if err != nil {
 		return
 	}
-	gst.ObjectSet(ctx, e, "caps", videoCaps)
+	gst.ObjectSet(ctx, e, "caps", gst.CapsFromString(videoCaps))
 	//s.callbackCtx.SetNeedDataCallback(ctx, e, needDataCallback, id, 0)
 	s.elements.Set("appsrcrtpvideo", e)
 
@@ -95,8 +109,7 @@ func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srt
 	gst.ObjectSet(ctx, e, "do-timestamp", true)
 	gst.ObjectSet(ctx, e, "is-live", true)
 	gst.ObjectSet(ctx, e, "format", 3)
-	audioCaps := gst.CapsFromString(fmt.Sprintf("application/x-rtp,media=(string)audio,payload=(int)%d,clock-rate=(int)48000,encoding-name=(string)OPUS", aPayloadType))
-	gst.ObjectSet(ctx, e, "caps", audioCaps)
+	gst.ObjectSet(ctx, e, "caps", gst.CapsFromString(decoderAudioCaps(aPayloadType)))
 	//s.callbackCtx.SetNeedDataCallback(ctx, e, needDataCallback, id, 1)
 	s.elements.Set("appsrcrtpaudio", e)
 
@@ -108,7 +121,7 @@ func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srt
 		}
 		s.elements.Set("rtpVideoDepay", e)
 
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			e, err = gst.ElementFactoryMake("vaapivp8dec", "")
 			err = fmt.Errorf("Disabling VP8 HW")
 			if log.OnError(err, "No VP8 VAAPI hardware decoder available") {
@@ -147,7 +160,7 @@ func NewDecoder(ctx context.Context, codecOption CodecOptions, audioIn chan *srt
 			}
 			gst.ObjectSet(ctx, e, "config-interval", -1)
 			s.elements.Set("videoCodecParser", e)
-if config.Mode == ModeMCU {
+if mode == ModeMCU {
 			//e, err = gst.ElementFactoryMake("avdec_h264", "")
 			e, err = gst.ElementFactoryMake("vaapih264dec", "")
 			err = fmt.Errorf("Disabling H264 HW")
@@ -163,13 +176,29 @@ if config.Mode == ModeMCU {
 			}
 			s.elements.Set("videoCodec", e)
 		}
+	case CodecVP9:
+		e, err = gst.ElementFactoryMake("rtpvp9depay", "")
+		if log.OnError(err, "Could not create a GStreamer element factory") {
+			return
+		}
+		s.elements.Set("rtpVideoDepay", e)
+
+		if mode == ModeMCU {
+			e, err = gst.ElementFactoryMake("vp9dec", "")
+			if log.OnError(err, "Could not create a Gstreamer element factory") {
+				return
+			}
+			gst.ObjectSet(ctx, e, "threads", 8)
+			gst.ObjectSet(ctx, e, "post-processing", true)
+			s.elements.Set("videoCodec", e)
+		}
 	default:
 		err = fmt.Errorf("Unknown codec option %d", codecOption)
 		return
 	}
 
 	var qv5 *gst.GstElement
-	if features.IsActive(ctx, "facedetect") && config.Mode == ModeMCU {
+	if features.IsActive(ctx, "facedetect") && mode == ModeMCU {
 		// I420 -> to RGB
 		e, err = gst.ElementFactoryMake("videoconvert", "I420toRGB")
 		if log.OnError(err, "Could not create colorspace GStreamer element factory") {
@@ -203,7 +232,7 @@ if config.Mode == ModeMCU {
 		}
 	}
 
-	if config.Mode == ModeMCU {
+	if mode == ModeMCU {
 		e, err = gst.ElementFactoryMake("videorate", "")
 		if log.OnError(err, "Could not create a GStreamer element factory") {
 			return
@@ -234,7 +263,7 @@ if config.Mode == ModeMCU {
 	s.elements.Set("opusParse", e)
 
   var opusDec *gst.GstElement
-	//if config.Mode == ModeMCU {
+	//if mode == ModeMCU {
 		opusDec, err = gst.ElementFactoryMake("opusdec", "")
 		if log.OnError(err, "Could not create a GStreamer element factory") {
 			return
@@ -299,7 +328,7 @@ if config.Mode == ModeMCU {
 		videoCodecFilterAfterDepay = s.elements.Get("videoCodecFilterAfterDepay").(*gst.GstElement)
 	}
 
-	switch config.Mode {
+	switch mode {
 	case ModeMCU:
 		gst.BinAddMany(s.elements.Get("pdecoder").(*gst.GstElement),
 			s.elements.Get("appsrcrtpvideo").(*gst.GstElement),
@@ -332,7 +361,7 @@ if config.Mode == ModeMCU {
 			qv1, qv2, qv3, qv4, qv5, qa1, qa2, qa3,
 		)
 	default:
-		err = fmt.Errorf("Unknown mode %d", config.Mode)
+		err = fmt.Errorf("Unknown mode %d", mode)
 		return
 	}
 
@@ -354,18 +383,19 @@ if config.Mode == ModeMCU {
 	case CodecH264:
 			gstElementList = append(gstElementList, qv1)
 			gstElementList = append(gstElementList, videoCodecFilterAfterDepay)
-		if config.Mode == ModeMCU {
+			// SPS & PPS inserted before every IDR, for the late listeners
 			gstElementList = append(gstElementList, qv2)
 			gstElementList = append(gstElementList, videoCodecParser)
+		if mode == ModeMCU {
 			gstElementList = append(gstElementList, qv3)
 			gstElementList = append(gstElementList, s.elements.Get("videoCodec").(*gst.GstElement))
 			gstElementList = append(gstElementList, qv4)
 			gstElementList = append(gstElementList, s.elements.Get("videorate").(*gst.GstElement))
 			gstElementList = append(gstElementList, s.elements.Get("videoratecaps").(*gst.GstElement))
 		}
-	case CodecVP8:
+	case CodecVP8, CodecVP9:
 		gstElementList = append(gstElementList, qv1)
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			gstElementList = append(gstElementList, s.elements.Get("videoCodec").(*gst.GstElement))
 			gstElementList = append(gstElementList, qv2)
 			gstElementList = append(gstElementList, s.elements.Get("videorate").(*gst.GstElement))
@@ -386,7 +416,7 @@ if config.Mode == ModeMCU {
 		return
 	}
 
-	switch config.Mode {
+	switch mode {
 	case ModeMCU:
 		err = gst.ElementLinkMany(ctx,
 			s.elements.Get("appsrcrtpaudio").(*gst.GstElement),
@@ -409,7 +439,7 @@ if config.Mode == ModeMCU {
 			s.elements.Get("appsinkrawaudio").(*gst.GstElement),
 		)
 	default:
-		err = fmt.Errorf("Unknown mode %d", config.Mode)
+		err = fmt.Errorf("Unknown mode %d", mode)
 		return
 	}
 
@@ -430,6 +460,23 @@ if config.Mode == ModeMCU {
 	return
 }
 
+/*
+ * SetDecoderPayloadTypes update the appsrc caps after a renegotiation
+ * changed the publisher payload types (the codec stays the same)
+ */
+func (s *GstSession) SetDecoderPayloadTypes(ctx context.Context, vPayloadType uint16, aPayloadType uint16) (err error) {
+	log := plogger.FromContextSafe(ctx).Prefix("GST:Decoder").Tag("gst")
+	videoCaps, err := decoderVideoCaps(s.CodecOption, vPayloadType)
+	if log.OnError(err, "could not update decoder video caps") {
+		return
+	}
+	gst.ObjectSet(ctx, s.elements.Get("appsrcrtpvideo").(*gst.GstElement), "caps", gst.CapsFromString(videoCaps))
+	gst.ObjectSet(ctx, s.elements.Get("appsrcrtpaudio").(*gst.GstElement), "caps", gst.CapsFromString(decoderAudioCaps(aPayloadType)))
+	log.Infof("decoder payload types set to video %d, audio %d", vPayloadType, aPayloadType)
+
+	return
+}
+
 func (s *GstSession) checkAndSendWebrtcUp() {
 	if s.WebrtcUpSignalSent == false && s.videoReceived == true && s.audioReceived == true {
 		go func(ch chan bool) {
@@ -528,6 +575,9 @@ func (s *GstSession) handleAudioRawData(ctx context.Context) {
 			if gst.AppSinkIsEOS(e) == true {
 				log.Infof("goroutine handleAudioRawData exit EOS")
 				return
+			} else if ctx.Err() != nil {
+				log.Infof("goroutine handleAudioRawData exit")
+				return
 			} else {
 				log.Warnf("handleAudioRawData: could not get sample from appsinkrawaudio")
 				continue
@@ -535,10 +585,16 @@ func (s *GstSession) handleAudioRawData(ctx context.Context) {
 		}
 		log.Debugf("Send a raw audio buffer")
 		s.EncodersMutex.RLock()
-		for _, e := range s.Encoders {
-			e.RawAudioSampleList <- gst.SampleRef(gstSample)
+		audioMixer := s.audioMixer
+		if audioMixer == nil {
+			for _, e := range s.Encoders {
+				e.RawAudioSampleList <- gst.SampleRef(gstSample)
+			}
 		}
 		s.EncodersMutex.RUnlock()
+		if audioMixer != nil {
+			audioMixer.Push(s, gstSample)
+		}
 		gst.SampleUnref(gstSample)
 	}
 }
@@ -555,17 +611,26 @@ func (s *GstSession) handleVideoRawData(ctx context.Context) {
 			if gst.AppSinkIsEOS(e) == true {
 				log.Infof("goroutine handleVideoRawData exit EOS")
 				return
+			} else if ctx.Err() != nil {
+				log.Infof("goroutine handleVideoRawData exit")
+				return
 			} else {
 				log.Warnf("handleAudioRawData: could not get sample from appsinkrawvideo")
 				continue
 			}
 		}
 		s.EncodersMutex.RLock()
-		for _, e := range s.Encoders {
-			log.Debugf("Send a raw video buffer")
-			e.RawVideoSampleList <- gst.SampleRef(gstSample)
+		videoMixer := s.videoMixer
+		if videoMixer == nil {
+			for _, e := range s.Encoders {
+				log.Debugf("Send a raw video buffer")
+				e.RawVideoSampleList <- gst.SampleRef(gstSample)
+			}
 		}
 		s.EncodersMutex.RUnlock()
+		if videoMixer != nil {
+			videoMixer.Push(s, gstSample)
+		}
 		//log.Warnf("RAW DATA SAMPLE UNREF")
 		gst.SampleUnref(gstSample)
 	}
@@ -26,7 +26,7 @@ func (s *GstSession) FlushStop(element *gst.GstElement) (err error) {
 	return
 }
 
-func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionUdp, audioOut chan *srtp.PacketRTP, videoOut chan *srtp.PacketRTP, sDecoder *GstSession, rAddr *net.UDPAddr, vSsrcId uint32, aSsrcId uint32, maxVideoBitrate int) (s *GstSession, err error) {
+func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionUdp, audioOut chan *srtp.PacketRTP, videoOut chan *srtp.PacketRTP, sDecoder *GstSession, rAddr *net.UDPAddr, vSsrcId uint32, aSsrcId uint32, maxVideoBitrate int, fec FecOptions, mode ModeOptions) (s *GstSession, err error) {
 	var e *gst.GstElement
 
 	log := plogger.FromContextSafe(ctx).Prefix("GST:Encoder").Tag("gst")
@@ -92,7 +92,7 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 
 	switch codecOption {
 	case CodecVP8:
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			e, err = gst.ElementFactoryMake("vaapivp8enc", "")
 			err = fmt.Errorf("Disabling VP8 HW Encoder")
 			if log.OnError(err, "No VP8 VAAPI hardware encoder available") {
@@ -162,7 +162,7 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 		gst.ObjectSet(ctx, e, "perfect-rtptime", true)
 		s.elements.Set("rtpVideoPay", e)
 	case CodecH264:
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			var videoCaps *gst.GstElement
 			videoCaps, err = gst.ElementFactoryMake("capsfilter", "")
 			if log.OnError(err, "Could not create a Gstreamer element factory") {
@@ -242,14 +242,78 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 		gst.ObjectSet(ctx, e, "perfect-rtptime", true)
 		gst.ObjectSet(ctx, e, "config-interval", -1)
 		s.elements.Set("rtpVideoPay", e)
+	case CodecVP9:
+		if mode == ModeMCU {
+			// no VAAPI VP9 encoder, libvpx in realtime mode
+			e, err = gst.ElementFactoryMake("vp9enc", "")
+			if log.OnError(err, "Could not create a Gstreamer element factory") {
+				return
+			}
+			gst.ObjectSet(ctx, e, "target-bitrate", s.videoBitrate)
+			gst.ObjectSet(ctx, e, "min-quantizer", 2)
+			gst.ObjectSet(ctx, e, "max-quantizer", 56)
+			gst.ObjectSet(ctx, e, "keyframe-max-dist", 3000)
+			gst.ObjectSet(ctx, e, "threads", config.CpuCores)
+			gst.ObjectSet(ctx, e, "end-usage", config.Vp8.EndUsage)
+			gst.ObjectSet(ctx, e, "cpu-used", config.Vp8.CpuUsed)
+			gst.ObjectSet(ctx, e, "deadline", config.Vp8.Deadline)
+			gst.ObjectSet(ctx, e, "error-resilient", config.Vp8.ErrorResilient)
+			gst.ObjectSet(ctx, e, "tile-columns", 2)
+			gst.ObjectSet(ctx, e, "undershoot", 100)
+			gst.ObjectSet(ctx, e, "overshoot", 15)
+			gst.ObjectSet(ctx, e, "buffer-size", 1000)
+			gst.ObjectSet(ctx, e, "buffer-initial-size", 5000)
+			gst.ObjectSet(ctx, e, "buffer-optimal-size", 600)
+			gst.ObjectSet(ctx, e, "keyframe-mode", 0)
+			s.elements.Set("videoCodec", e)
+
+			e, err = gst.ElementFactoryMake("capsfilter", "")
+			if log.OnError(err, "Could not create a Gstreamer element factory") {
+				return
+			}
+			caps := gst.CapsFromString("video/x-vp9,profile=(string)0")
+			gst.ObjectSet(ctx, e, "caps", caps)
+			s.elements.Set("videoCodecCaps", e)
+		}
+
+		e, err = gst.ElementFactoryMake("rtpvp9pay", "")
+		if log.OnError(err, "Could not create a Gstreamer element factory") {
+			return
+		}
+		gst.ObjectSet(ctx, e, "ssrc", vSsrcId)
+		gst.ObjectSet(ctx, e, "pt", 100)
+		gst.ObjectSet(ctx, e, "mtu", 1200)
+		gst.ObjectSet(ctx, e, "perfect-rtptime", true)
+		s.elements.Set("rtpVideoPay", e)
 	default:
 		err = fmt.Errorf("Unknown codec option %d", codecOption)
 		return
 	}
 
+	// ULPFEC packets sent in RED, the percentage follows the listener losses
+	var ulpfecEnc *gst.GstElement
+	var redEnc *gst.GstElement
+	if mode == ModeMCU && fec.Enabled() {
+		ulpfecEnc, err = gst.ElementFactoryMake("rtpulpfecenc", "")
+		if log.OnError(err, "Could not create a Gstreamer element factory") {
+			return
+		}
+		gst.ObjectSet(ctx, ulpfecEnc, "pt", uint32(fec.ulpfecPayloadType))
+		gst.ObjectSet(ctx, ulpfecEnc, "percentage", uint32(0))
+		s.elements.Set("rtpUlpfecEnc", ulpfecEnc)
+
+		redEnc, err = gst.ElementFactoryMake("rtpredenc", "")
+		if log.OnError(err, "Could not create a Gstreamer element factory") {
+			return
+		}
+		gst.ObjectSet(ctx, redEnc, "pt", int(fec.redPayloadType))
+		gst.ObjectSet(ctx, redEnc, "allow-no-red-blocks", true)
+		s.elements.Set("rtpRedEnc", redEnc)
+	}
+
 	var opusEnc *gst.GstElement
 	var opusParse *gst.GstElement
-	//if config.Mode == ModeMCU {
+	//if mode == ModeMCU {
 		opusEnc, err = gst.ElementFactoryMake("opusenc", "")
 		if log.OnError(err, "Could not create a Gstreamer element factory") {
 			return
@@ -258,10 +322,12 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 		gst.ObjectSet(ctx, opusEnc, "bitrate", s.audioBitrate)
 		gst.ObjectSet(ctx, opusEnc, "audio-type", 2048)
 		gst.ObjectSet(ctx, opusEnc, "inband-fec", true)
+		gst.ObjectSet(ctx, opusEnc, "dtx", fec.audioDtx)
 		gst.ObjectSet(ctx, opusEnc, "frame-size", 20)
 		gst.ObjectSet(ctx, opusEnc, "bitrate-type", 1)
 		//gst.ObjectSet(ctx, opusEnc, "hard-resync", true)
 		gst.ObjectSet(ctx, opusEnc, "perfect-timestamp", true)
+		s.elements.Set("opusenc", opusEnc)
 
 		opusParse, err = gst.ElementFactoryMake("opusparse", "")
 		if logOnError(err, "Could not create a Gstreamer element factory") {
@@ -332,7 +398,7 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 		return
 	}
 
-	switch config.Mode {
+	switch mode {
 	case ModeMCU:
 		gst.BinAddMany(s.elements.Get("pencoder").(*gst.GstElement),
 			s.elements.Get("appsrcrawvideo").(*gst.GstElement), queueVideo,
@@ -362,16 +428,19 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 			appSinkEncodedRtpAudio,
 		)
 	default:
-		err = fmt.Errorf("Unknown mode %d", config.Mode)
+		err = fmt.Errorf("Unknown mode %d", mode)
 		return
 	}
+	if ulpfecEnc != nil {
+		gst.BinAddMany(s.elements.Get("pencoder").(*gst.GstElement), ulpfecEnc, redEnc)
+	}
 
 	var gstElementList []*gst.GstElement
 
 	switch codecOption {
 	case CodecH264:
 		gstElementList = append(gstElementList, s.elements.Get("appsrcrawvideo").(*gst.GstElement))
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			/*if s.HardwareCodecUsed == true {
 				gstElementList = append(gstElementList, s.elements.Get("vaapiPostProcessing").(*gst.GstElement))
 			}*/
@@ -383,10 +452,9 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 			}
 		}
 		gstElementList = append(gstElementList, s.elements.Get("rtpVideoPay").(*gst.GstElement))
-		gstElementList = append(gstElementList, appSinkEncodedRtpVideo)
-	case CodecVP8:
+	case CodecVP8, CodecVP9:
 		gstElementList = append(gstElementList, s.elements.Get("appsrcrawvideo").(*gst.GstElement))
-		if config.Mode == ModeMCU {
+		if mode == ModeMCU {
 			/*if s.HardwareCodecUsed == true {
 				gstElementList = append(gstElementList, s.elements.Get("vaapiPostProcessing").(*gst.GstElement))
 			}*/
@@ -398,15 +466,19 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 			}
 		}
 		gstElementList = append(gstElementList, s.elements.Get("rtpVideoPay").(*gst.GstElement))
-		gstElementList = append(gstElementList, appSinkEncodedRtpVideo)
 	}
 
+	if ulpfecEnc != nil {
+		gstElementList = append(gstElementList, ulpfecEnc, redEnc)
+	}
+	gstElementList = append(gstElementList, appSinkEncodedRtpVideo)
+
 	err = gst.ElementLinkMany(ctx, gstElementList...)
 	if log.OnError(err, "could not link video elements") {
 		return
 	}
 
-	switch config.Mode {
+	switch mode {
 	case ModeMCU:
 		err = gst.ElementLinkMany(ctx,
 			s.elements.Get("appsrcrawaudio").(*gst.GstElement),
@@ -427,7 +499,7 @@ func CreateEncoder(ctx context.Context, codecOption CodecOptions, c *connectionU
 			appSinkEncodedRtpAudio,
 		)
 	default:
-		err = fmt.Errorf("Unknown mode %d", config.Mode)
+		err = fmt.Errorf("Unknown mode %d", mode)
 		return
 	}
 
@@ -477,7 +549,7 @@ func (s *GstSession) dumpPipelineToDotFile() {
 func (s *GstSession) GetAndSetDecoderCaps(ctx context.Context) {
 	log := plogger.FromContextSafe(ctx)
 	element := s.elements.Get("appsrcrawvideo").(*gst.GstElement)
-	appSinkRawVideoPad := gst.ElementGetStaticPad(s.decoder.elements.Get("appsinkrawvideo").(*gst.GstElement), "sink")
+	appSinkRawVideoPad := gst.ElementGetStaticPad(s.getDecoder().elements.Get("appsinkrawvideo").(*gst.GstElement), "sink")
 	caps := gst.PadGetCurrentCaps(appSinkRawVideoPad)
 	log.Warnf("Set Encoder video caps to %s", gst.CapsToString(caps))
 	gst.ObjectSet(ctx, element, "caps", caps)
@@ -498,17 +570,25 @@ func (s *GstSession) handleRawVideoData(ctx context.Context, e *GstSession) {
 		select {
 		case <-ctx.Done():
 			log.Infof("goroutine handleRawVideoData exit")
-			s.decoder.EncodersMutex.Lock()
+			// the decoder can be replaced by a mixer rebuild until its
+			// encoders are locked
+			decoder := s.getDecoder()
+			decoder.EncodersMutex.Lock()
+			for decoder != s.getDecoder() {
+				decoder.EncodersMutex.Unlock()
+				decoder = s.getDecoder()
+				decoder.EncodersMutex.Lock()
+			}
 			// search index
-			for i := 0; i < len(s.decoder.Encoders); i++ {
-				if e == s.decoder.Encoders[i] {
+			for i := 0; i < len(decoder.Encoders); i++ {
+				if e == decoder.Encoders[i] {
 					log.Infof("found the encoder entry, delete it")
-					s.decoder.Encoders = append(s.decoder.Encoders[:i], s.decoder.Encoders[i+1:]...)
-					log.Infof("s.decoder.Encoders is now %#v", s.decoder.Encoders)
+					decoder.Encoders = append(decoder.Encoders[:i], decoder.Encoders[i+1:]...)
+					log.Infof("s.decoder.Encoders is now %#v", decoder.Encoders)
 					break
 				}
 			}
-			s.decoder.EncodersMutex.Unlock()
+			decoder.EncodersMutex.Unlock()
 			gst.ElementSetState(s.elements.Get("pencoder").(*gst.GstElement), gst.StateNull)
 			return
 		case gstSample = <-e.RawVideoSampleList:
@@ -525,7 +605,7 @@ func (s *GstSession) handleRawVideoData(ctx context.Context, e *GstSession) {
 				if gstSample.Height != 0 {
 					oldBufferHeight = gstSample.Height
 				}
-				appSinkRawVideoPad := gst.ElementGetStaticPad(s.decoder.elements.Get("appsinkrawvideo").(*gst.GstElement), "sink")
+				appSinkRawVideoPad := gst.ElementGetStaticPad(s.getDecoder().elements.Get("appsinkrawvideo").(*gst.GstElement), "sink")
 				caps := gst.PadGetCurrentCaps(appSinkRawVideoPad)
 				log.Warnf("Resolution change: %s %d %d", gst.CapsToString(caps), gstSample.Width, gstSample.Height)
 				//gst.ObjectSet(ctx, element, "caps", caps)
@@ -613,6 +693,9 @@ func (s *GstSession) handleRtpAudioEncodedData(ctx context.Context, rAddr *net.U
 			if gst.AppSinkIsEOS(e) == true {
 				log.Infof("goroutine handleRtpAudioEncodedData exit EOS")
 				return
+			} else if ctx.Err() != nil {
+				log.Infof("goroutine handleRtpAudioEncodedData exit")
+				return
 			} else {
 				log.Warnf("handleRtpAudioEncodedData: could not get sample from appSinkEncodedRtpAudio")
 				continue
@@ -659,7 +742,7 @@ func (s *GstSession) SetEncodingVideoBitrate(v int) error {
 		bitrate /= 1000
 	}
 	switch s.CodecOption {
-	case CodecVP8:
+	case CodecVP8, CodecVP9:
 		if s.HardwareCodecUsed == true {
 			gst.ObjectSet(s.ctx, e.(*gst.GstElement), "bitrate", bitrate)
 		} else {
@@ -720,6 +803,24 @@ func (s *GstSession) SetEncodingAudioBitrate(v int) error {
 	return nil
 }
 
+/*
+ * SetEncodingPacketLoss adapt the redundancy to the loss rates (0.00 -> 1.00)
+ * of the listener: ULPFEC percentage of the video, opus in-band FEC.
+ */
+func (s *GstSession) SetEncodingPacketLoss(videoLossRate float64, audioLossRate float64) {
+	if ulpfecEnc := s.elements.Get("rtpUlpfecEnc"); ulpfecEnc != nil {
+		// twice the losses: the loss bursts are not recovered by one FEC packet
+		percentage := uint32(videoLossRate * 200)
+		if percentage > fecMaxPercentage {
+			percentage = fecMaxPercentage
+		}
+		gst.ObjectSet(s.ctx, ulpfecEnc.(*gst.GstElement), "percentage", percentage)
+	}
+	if opusEnc := s.elements.Get("opusenc"); opusEnc != nil {
+		gst.ObjectSet(s.ctx, opusEnc.(*gst.GstElement), "packet-loss-percentage", int(audioLossRate*100))
+	}
+}
+
 func (s *GstSession) ForceKeyFrame() (err error) {
 	e := s.elements.Get("videoCodec").(*gst.GstElement)
 	if e == nil {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"time"
 
 	plogger "github.com/heytribe/go-plogger"
 	"github.com/heytribe/live-webrtcsignaling/gst"
@@ -34,7 +35,15 @@ type GstSession struct {
 	VideoRtcpBufferList   chan []byte
 	EncodersMutex         sync.RWMutex
 	Encoders              []*GstSession
+	// encoder only: changed by the MCU mixers when they are rebuilt
+	decoderMutex          sync.RWMutex
 	decoder               *GstSession
+	// decoder only: compositor of the room (MCU), receives the raw video
+	videoMixer            *VideoMixer
+	// decoder only: mixes of the room (MCU), receive the raw audio
+	audioMixer            *AudioMixer
+	// decoder only: limit of the encoders, fed with the publisher rembs
+	bitrateController     BitrateController
 	audioReceived         bool
 	videoReceived         bool
 	WebrtcUpCh            chan bool
@@ -95,6 +104,7 @@ const (
 	CodecNone CodecOptions = iota
 	CodecVP8
 	CodecH264
+	CodecVP9
 )
 
 func (s *GstSession) GetAudioBitrate() int {
@@ -105,8 +115,48 @@ func (s *GstSession) GetVideoBitrate() int {
 	return s.videoBitrate
 }
 
-func (s *GstSession) AdjustEncodersBitrate(ctx context.Context, bitrate uint32) {
+// getDecoder return the session the encoder reads the raw data from
+func (s *GstSession) getDecoder() *GstSession {
+	s.decoderMutex.RLock()
+	defer s.decoderMutex.RUnlock()
+	return s.decoder
+}
+
+/*
+ * moveEncoders move the encoders of the session to another decoder. Both
+ * encoders lists are locked: an encoder removing itself from its decoder
+ * finds it in one of them
+ */
+func (s *GstSession) moveEncoders(to *GstSession) {
+	s.EncodersMutex.Lock()
+	defer s.EncodersMutex.Unlock()
+	to.EncodersMutex.Lock()
+	defer to.EncodersMutex.Unlock()
+	for _, e := range s.Encoders {
+		e.decoderMutex.Lock()
+		e.decoder = to
+		e.decoderMutex.Unlock()
+		to.Encoders = append(to.Encoders, e)
+	}
+	s.Encoders = nil
+}
+
+/*
+ * AdjustEncodersBitrate limit the encoders of the decoder to the target of
+ * its bitrate controller, called by the bus manager of the publisher
+ */
+func (s *GstSession) AdjustEncodersBitrate(ctx context.Context, remb uint32) {
 	log := plogger.FromContextSafe(s.ctx)
+	if s.bitrateController == nil {
+		return
+	}
+	now := time.Now()
+	s.bitrateController.OnREMB(now, int(remb))
+	target := s.bitrateController.Target(now)
+	if target == 0 {
+		return
+	}
+	bitrate := uint32(target)
 	s.EncodersMutex.RLock()
 	defer s.EncodersMutex.RUnlock()
 	// search index
@@ -0,0 +1,359 @@
+package main
+
+/*
+ * MCU audio mixing
+ *
+ * the raw audio of the publishers decoders is mixed for each listener
+ * without its own voice (N-1), the mixes are keyed by the publisher they
+ * exclude: a mix is encoded once and shared by the listeners having the
+ * same contributors, in their "mix" listener session.
+ *
+ * like the video composition, the mixing pipelines are rebuilt when a
+ * publisher comes or goes and keep the clock & base time of the first one,
+ * the opus encoders are moved to the new pipelines.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/gst"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+// format of the mixed audio, opusdec output
+const audioMixerCaps = "audio/x-raw,format=S16LE,layout=interleaved,rate=48000,channels=2"
+
+type AudioMixer struct {
+	sync.Mutex
+	ctx context.Context
+	// decoders of the publishers
+	decoders []*GstSession
+	clock    *gst.GstClock
+	baseTime gst.GstClockTime
+	// mixes by excluded publisher decoder, nil: every publisher
+	mixes  map[*GstSession]*audioMix
+	closed bool
+}
+
+type audioMix struct {
+	exclude *GstSession
+	// mixing pipeline, named like a decoder
+	mixer       *GstSession
+	mixerCancel context.CancelFunc
+	// decoders mixed, by appsrc
+	contributors []*GstSession
+	encoder      *GstSession
+	// encoder & forwarding
+	cancel    context.CancelFunc
+	simulcast *SimulcastPublisher
+	listeners int
+}
+
+func NewAudioMixer(ctx context.Context) *AudioMixer {
+	log := plogger.FromContextSafe(ctx).Prefix("MIXER:Audio").Tag("gst")
+	m := new(AudioMixer)
+	// the mixer lives as long as the room, not the session creating it
+	m.ctx = plogger.NewContext(context.Background(), log)
+	m.mixes = make(map[*GstSession]*audioMix)
+	return m
+}
+
+// contributors return the decoders mixed for the listeners of a mix. not
+// thread safe
+func (m *AudioMixer) contributors(exclude *GstSession) (contributors []*GstSession) {
+	for _, d := range m.decoders {
+		if d != exclude {
+			contributors = append(contributors, d)
+		}
+	}
+	return
+}
+
+/*
+ * start play a pipeline of the mixer on the clock & base time of the first
+ * one: the samples keep their timestamps across the pipelines. not thread
+ * safe
+ */
+func (m *AudioMixer) start(e *gst.GstElement) {
+	log := plogger.FromContextSafe(m.ctx)
+	if m.clock != nil {
+		gst.PipelineUseClock(e, m.clock, m.baseTime)
+	}
+	stateReturn := gst.ElementSetState(e, gst.StatePlaying)
+	log.Debugf("State return of pipeline is %#v", stateReturn)
+	if m.clock == nil {
+		m.clock = gst.ElementGetClock(e)
+		m.baseTime = gst.ElementGetBaseTime(e)
+	}
+}
+
+/*
+ * newMixer build the pipeline mixing the contributors:
+ *
+ *  audiotestsrc (silence) ------------------------------------------\
+ *  appsrcrawaudioN ! audioconvert ! audioresample ! mix caps ! audiomixer
+ *  audiomixer ! mix caps ! appsink name=appsinkrawaudio
+ *
+ * the silence keeps the mix running without contributor. not thread safe
+ */
+func (m *AudioMixer) newMixer(contributors []*GstSession) (s *GstSession, cancel context.CancelFunc, err error) {
+	log := plogger.FromContextSafe(m.ctx)
+
+	var description bytes.Buffer
+	fmt.Fprintf(&description, `audiomixer name=audiomixer ! %s !
+		queue ! appsink name=appsinkrawaudio
+		audiotestsrc is-live=true wave=silence ! %s ! audiomixer.`,
+		audioMixerCaps, audioMixerCaps)
+	for i := range contributors {
+		fmt.Fprintf(&description, `
+		appsrc name=appsrcrawaudio%d is-live=true do-timestamp=true format=3 !
+		queue ! audioconvert ! audioresample ! %s ! audiomixer.`,
+			i, audioMixerCaps)
+	}
+
+	e, err := gst.ParseLaunchFull(description.String(), nil, gst.ParseFlagNone)
+	if log.OnError(err, "Could not create a new GStreamer audio mixer pipeline") {
+		return
+	}
+	s = NewGstSession(m.ctx, nil, nil, nil, nil, 0, 0, CodecNone, 0)
+	s.elements.Set("pdecoder", e)
+	s.elements.Set("appsinkrawaudio", gst.ElementGetByName(e, "appsinkrawaudio"))
+	for i := range contributors {
+		name := fmt.Sprintf("appsrcrawaudio%d", i)
+		s.elements.Set(name, gst.ElementGetByName(e, name))
+	}
+
+	m.start(e)
+	log.Infof("audio mixer pipeline started with %d contributors", len(contributors))
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(m.ctx)
+	go s.handleAudioRawData(ctx)
+
+	return
+}
+
+/*
+ * newEncoder build the opus encoder of a mix, it outlives the mixing
+ * pipelines. not thread safe
+ */
+func (m *AudioMixer) newEncoder(ctx context.Context, audioOut chan *srtp.PacketRTP) (s *GstSession, err error) {
+	log := plogger.FromContextSafe(m.ctx)
+
+	ssrcId := randUint32()
+	e, err := gst.ParseLaunchFull(fmt.Sprintf(`
+		appsrc name=appsrcrawaudio is-live=true format=3 !
+		queue ! audioconvert ! audioresample !
+		opusenc name=opusenc bitrate=%d audio-type=voice inband-fec=true frame-size=20 bitrate-type=vbr perfect-timestamp=true !
+		rtpopuspay pt=111 ssrc=%d mtu=1300 perfect-rtptime=true !
+		appsink name=appSinkEncodedRtpAudio sync=false`, config.Bitrates.Audio.Max, ssrcId), nil, gst.ParseFlagNone)
+	if log.OnError(err, "Could not create a new GStreamer audio mix encoder pipeline") {
+		return
+	}
+	s = NewGstSession(m.ctx, audioOut, nil, nil, nil, 0, ssrcId, CodecNone, 0)
+	s.elements.Set("pencoder", e)
+	s.elements.Set("appsrcrawaudio", gst.ElementGetByName(e, "appsrcrawaudio"))
+	s.elements.Set("opusenc", gst.ElementGetByName(e, "opusenc"))
+	s.elements.Set("appSinkEncodedRtpAudio", gst.ElementGetByName(e, "appSinkEncodedRtpAudio"))
+
+	m.start(e)
+
+	go s.handleRawAudioData(ctx, s)
+	go s.handleRtpAudioEncodedData(ctx, nil)
+
+	return
+}
+
+// newMix create the mix of every publisher but exclude. not thread safe
+func (m *AudioMixer) newMix(exclude *GstSession) (mix *audioMix, err error) {
+	mix = &audioMix{exclude: exclude}
+	mix.contributors = m.contributors(exclude)
+	mix.mixer, mix.mixerCancel, err = m.newMixer(mix.contributors)
+	if err != nil {
+		return
+	}
+	var ctx context.Context
+	ctx, mix.cancel = context.WithCancel(m.ctx)
+	audioOut := make(chan *srtp.PacketRTP, 1000)
+	mix.encoder, err = m.newEncoder(ctx, audioOut)
+	if err != nil {
+		mix.cancel()
+		mix.closeMixer()
+		return
+	}
+	mix.mixer.EncodersMutex.Lock()
+	mix.mixer.Encoders = append(mix.mixer.Encoders, mix.encoder)
+	mix.mixer.EncodersMutex.Unlock()
+	// every opus packet can start the stream
+	mix.simulcast = NewSimulcastPublisher(CodecNone, nil)
+	go mix.forward(ctx, audioOut)
+	return
+}
+
+/*
+ * rebuild replace the mixing pipelines after a change of the publishers,
+ * the encoders are moved to the new ones. not thread safe
+ */
+func (m *AudioMixer) rebuild() {
+	log := plogger.FromContextSafe(m.ctx)
+
+	for _, mix := range m.mixes {
+		contributors := m.contributors(mix.exclude)
+		mixer, mixerCancel, err := m.newMixer(contributors)
+		if log.OnError(err, "could not rebuild an audio mix, keeping the previous contributors") {
+			continue
+		}
+		previous := mix.mixer
+		previous.moveEncoders(mixer)
+
+		mix.closeMixer()
+		mix.mixer = mixer
+		mix.mixerCancel = mixerCancel
+		mix.contributors = contributors
+	}
+}
+
+// AddPublisher mix the audio of the decoder for the other listeners
+func (m *AudioMixer) AddPublisher(decoder *GstSession) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	for _, d := range m.decoders {
+		if d == decoder {
+			return
+		}
+	}
+	m.decoders = append(m.decoders, decoder)
+	m.rebuild()
+	decoder.EncodersMutex.Lock()
+	decoder.audioMixer = m
+	decoder.EncodersMutex.Unlock()
+}
+
+func (m *AudioMixer) RemovePublisher(decoder *GstSession) {
+	m.Lock()
+	defer m.Unlock()
+	decoder.EncodersMutex.Lock()
+	decoder.audioMixer = nil
+	decoder.EncodersMutex.Unlock()
+	if m.closed {
+		return
+	}
+	for i, d := range m.decoders {
+		if d == decoder {
+			m.decoders = append(m.decoders[:i], m.decoders[i+1:]...)
+			m.rebuild()
+			return
+		}
+	}
+}
+
+// Push send a raw audio buffer of a publisher decoder to the mixes it
+// contributes to
+func (m *AudioMixer) Push(decoder *GstSession, gstSample *gst.GstSample) {
+	log := plogger.FromContextSafe(m.ctx)
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	for _, mix := range m.mixes {
+		for i, d := range mix.contributors {
+			if d == decoder {
+				e := mix.mixer.elements.Get(fmt.Sprintf("appsrcrawaudio%d", i)).(*gst.GstElement)
+				err := gst.AppSrcPushSample(e, gstSample)
+				log.OnError(err, "Could not push raw audio data to the audio mixer")
+				break
+			}
+		}
+	}
+}
+
+/*
+ * Subscribe forward the mix of every publisher but exclude (the publisher
+ * of the listener, nil if it doesn't publish) to a listener
+ */
+func (m *AudioMixer) Subscribe(exclude *GstSession, f *SimulcastForwarder) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		err = fmt.Errorf("audio mixer is closed")
+		return
+	}
+	mix := m.mixes[exclude]
+	if mix == nil {
+		mix, err = m.newMix(exclude)
+		if err != nil {
+			return
+		}
+		m.mixes[exclude] = mix
+	}
+	mix.listeners++
+	mix.simulcast.Subscribe(f)
+	return
+}
+
+func (m *AudioMixer) Unsubscribe(exclude *GstSession, f *SimulcastForwarder) {
+	m.Lock()
+	defer m.Unlock()
+	mix := m.mixes[exclude]
+	if mix == nil {
+		return
+	}
+	mix.simulcast.Unsubscribe(f)
+	mix.listeners--
+	if mix.listeners <= 0 {
+		mix.close()
+		delete(m.mixes, exclude)
+	}
+}
+
+func (mix *audioMix) closeMixer() {
+	mix.mixerCancel()
+	gst.ElementSetState(mix.mixer.elements.Get("pdecoder").(*gst.GstElement), gst.StateNull)
+}
+
+// close stop the mixing pipeline, then the encoder: the raw audio is sent
+// with blocking writes
+func (mix *audioMix) close() {
+	mix.closeMixer()
+	mix.cancel()
+	gst.ElementSetState(mix.encoder.elements.Get("pencoder").(*gst.GstElement), gst.StateNull)
+}
+
+func (mix *audioMix) forward(ctx context.Context, audioOut chan *srtp.PacketRTP) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-audioOut:
+			mix.simulcast.Forward(0, packet)
+		}
+	}
+}
+
+// Close stop the mixes, the room left the MCU mode or is empty
+func (m *AudioMixer) Close() {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for exclude, mix := range m.mixes {
+		mix.close()
+		delete(m.mixes, exclude)
+	}
+	for _, decoder := range m.decoders {
+		decoder.EncodersMutex.Lock()
+		decoder.audioMixer = nil
+		decoder.EncodersMutex.Unlock()
+	}
+	m.decoders = nil
+}
@@ -0,0 +1,347 @@
+package main
+
+/*
+ * MCU video composition
+ *
+ * the raw frames of the publishers decoders are tiled in a grid by a
+ * compositor pipeline, the tiles have the size requested to the peers by
+ * join (userMediaMaxSize). The grid is encoded once per codec of the
+ * listeners and forwarded to their "mix" listener session.
+ *
+ * the compositor is rebuilt when a publisher comes or goes, it keeps the
+ * clock & base time of the first one: the encoders are moved to the new
+ * compositor without a timestamp discontinuity.
+ */
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/gst"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
+)
+
+const (
+	// listener session receiving the composition of the room
+	mixStreamName       = "mix"
+	videoMixerFramerate = 25
+)
+
+type VideoMixer struct {
+	sync.Mutex
+	ctx context.Context
+	// decoders of the publishers, by tile
+	decoders         []*GstSession
+	compositor       *GstSession
+	compositorCancel context.CancelFunc
+	clock            *gst.GstClock
+	baseTime         gst.GstClockTime
+	// encoders of the grid, by codec of the listeners
+	outputs map[CodecOptions]*videoMixerOutput
+	closed  bool
+}
+
+type videoMixerOutput struct {
+	encoder   *GstSession
+	simulcast *SimulcastPublisher
+	// last remb of each listener, the encoder follows the lowest
+	estimates map[*SimulcastForwarder]int
+	cancel    context.CancelFunc
+}
+
+func NewVideoMixer(ctx context.Context) (m *VideoMixer, err error) {
+	log := plogger.FromContextSafe(ctx).Prefix("MIXER:Video").Tag("gst")
+	m = new(VideoMixer)
+	// the mixer lives as long as the room, not the session creating it
+	m.ctx = plogger.NewContext(context.Background(), log)
+	m.outputs = make(map[CodecOptions]*videoMixerOutput)
+	m.compositor, m.compositorCancel, err = m.newCompositor()
+	return
+}
+
+// videoMixerGrid return the columns & rows of the grid, the tiles are
+// side by side up to 2 publishers
+func videoMixerGrid(tiles int) (columns int, rows int) {
+	if tiles <= 1 {
+		return 1, 1
+	}
+	return 2, (tiles + (tiles % 2)) / 2
+}
+
+/*
+ * newCompositor build the pipeline tiling the decoders frames:
+ *
+ *  videotestsrc (black background) ---------------------------------\
+ *  appsrcrawvideoN ! videoconvert ! videoscale ! tile caps ! compositor.sink_N+1
+ *  compositor ! grid caps ! appsink name=appsinkrawvideo
+ *
+ * the appsrcs timestamp the frames: the decoders pipelines have their
+ * own base time. not thread safe
+ */
+func (m *VideoMixer) newCompositor() (s *GstSession, cancel context.CancelFunc, err error) {
+	log := plogger.FromContextSafe(m.ctx)
+
+	tileWidth, tileHeight := userMediaMaxSize(len(m.decoders))
+	columns, rows := videoMixerGrid(len(m.decoders))
+	width := tileWidth * columns
+	height := tileHeight * rows
+
+	var description bytes.Buffer
+	description.WriteString("compositor name=compositor background=black")
+	for i := range m.decoders {
+		fmt.Fprintf(&description, " sink_%d::xpos=%d sink_%d::ypos=%d", i+1, (i%columns)*tileWidth, i+1, (i/columns)*tileHeight)
+	}
+	fmt.Fprintf(&description, ` !
+		video/x-raw,format=I420,width=%d,height=%d,framerate=%d/1 !
+		queue ! appsink name=appsinkrawvideo
+		videotestsrc is-live=true pattern=black !
+		video/x-raw,format=I420,width=%d,height=%d,framerate=%d/1 ! compositor.sink_0`,
+		width, height, videoMixerFramerate, width, height, videoMixerFramerate)
+	for i := range m.decoders {
+		fmt.Fprintf(&description, `
+		appsrc name=appsrcrawvideo%d is-live=true do-timestamp=true format=3 !
+		queue ! videoconvert ! videoscale !
+		video/x-raw,format=I420,width=%d,height=%d,pixel-aspect-ratio=1/1 ! compositor.sink_%d`,
+			i, tileWidth, tileHeight, i+1)
+	}
+
+	e, err := gst.ParseLaunchFull(description.String(), nil, gst.ParseFlagNone)
+	if log.OnError(err, "Could not create a new GStreamer compositor pipeline") {
+		return
+	}
+	s = NewGstSession(m.ctx, nil, nil, nil, nil, 0, 0, CodecNone, 0)
+	// named like a decoder, the encoders read the raw video from it
+	s.elements.Set("pdecoder", e)
+	s.elements.Set("appsinkrawvideo", gst.ElementGetByName(e, "appsinkrawvideo"))
+	for i := range m.decoders {
+		name := fmt.Sprintf("appsrcrawvideo%d", i)
+		s.elements.Set(name, gst.ElementGetByName(e, name))
+	}
+
+	if m.clock != nil {
+		gst.PipelineUseClock(e, m.clock, m.baseTime)
+	}
+	stateReturn := gst.ElementSetState(e, gst.StatePlaying)
+	log.Infof("State return of compositor pipeline (%d tiles, %dx%d) is %#v", len(m.decoders), width, height, stateReturn)
+	if m.clock == nil {
+		m.clock = gst.ElementGetClock(e)
+		m.baseTime = gst.ElementGetBaseTime(e)
+	}
+
+	var ctx context.Context
+	ctx, cancel = context.WithCancel(m.ctx)
+	go s.handleVideoRawData(ctx)
+
+	return
+}
+
+/*
+ * rebuild replace the compositor after a change of the publishers, the
+ * encoders are moved to the new one. not thread safe
+ */
+func (m *VideoMixer) rebuild() {
+	log := plogger.FromContextSafe(m.ctx)
+
+	compositor, compositorCancel, err := m.newCompositor()
+	if log.OnError(err, "could not rebuild the compositor, keeping the previous layout") {
+		return
+	}
+	previous := m.compositor
+	previous.moveEncoders(compositor)
+
+	m.compositorCancel()
+	gst.ElementSetState(previous.elements.Get("pdecoder").(*gst.GstElement), gst.StateNull)
+	m.compositor = compositor
+	m.compositorCancel = compositorCancel
+}
+
+// AddPublisher add a tile for the decoder, its raw video is only sent to
+// the compositor
+func (m *VideoMixer) AddPublisher(decoder *GstSession) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	for _, d := range m.decoders {
+		if d == decoder {
+			return
+		}
+	}
+	m.decoders = append(m.decoders, decoder)
+	m.rebuild()
+	decoder.EncodersMutex.Lock()
+	decoder.videoMixer = m
+	decoder.EncodersMutex.Unlock()
+}
+
+func (m *VideoMixer) RemovePublisher(decoder *GstSession) {
+	m.Lock()
+	defer m.Unlock()
+	decoder.EncodersMutex.Lock()
+	decoder.videoMixer = nil
+	decoder.EncodersMutex.Unlock()
+	if m.closed {
+		return
+	}
+	for i, d := range m.decoders {
+		if d == decoder {
+			m.decoders = append(m.decoders[:i], m.decoders[i+1:]...)
+			m.rebuild()
+			return
+		}
+	}
+}
+
+// Push send a raw frame of a publisher decoder to its tile
+func (m *VideoMixer) Push(decoder *GstSession, gstSample *gst.GstSample) {
+	log := plogger.FromContextSafe(m.ctx)
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	for i, d := range m.decoders {
+		if d == decoder {
+			e := m.compositor.elements.Get(fmt.Sprintf("appsrcrawvideo%d", i)).(*gst.GstElement)
+			err := gst.AppSrcPushSample(e, gstSample)
+			log.OnError(err, "Could not push raw video data to the compositor")
+			return
+		}
+	}
+}
+
+/*
+ * Subscribe forward the grid to a listener, the grid is encoded once per
+ * codec. A key frame is requested by the forwarder before its first packet.
+ */
+func (m *VideoMixer) Subscribe(codecOption CodecOptions, f *SimulcastForwarder) (err error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		err = fmt.Errorf("video mixer is closed")
+		return
+	}
+	output := m.outputs[codecOption]
+	if output == nil {
+		output, err = m.newOutput(codecOption)
+		if err != nil {
+			return
+		}
+		m.outputs[codecOption] = output
+	}
+	output.estimates[f] = 0
+	output.simulcast.Subscribe(f)
+	return
+}
+
+func (m *VideoMixer) Unsubscribe(codecOption CodecOptions, f *SimulcastForwarder) {
+	m.Lock()
+	defer m.Unlock()
+	output := m.outputs[codecOption]
+	if output == nil {
+		return
+	}
+	output.simulcast.Unsubscribe(f)
+	delete(output.estimates, f)
+	if len(output.estimates) == 0 {
+		m.closeOutput(output)
+		delete(m.outputs, codecOption)
+	}
+}
+
+// SetEstimate save the remb of a listener, the encoder of its codec
+// follows the lowest one
+func (m *VideoMixer) SetEstimate(codecOption CodecOptions, f *SimulcastForwarder, remb int) {
+	m.Lock()
+	defer m.Unlock()
+	output := m.outputs[codecOption]
+	if output == nil {
+		return
+	}
+	output.estimates[f] = remb
+	bitrate := 0
+	for _, estimate := range output.estimates {
+		if estimate != 0 && (bitrate == 0 || estimate < bitrate) {
+			bitrate = estimate
+		}
+	}
+	if bitrate != 0 && bitrate != output.encoder.GetVideoEncodingBitrate() {
+		output.encoder.SetEncodingVideoBitrate(bitrate)
+	}
+}
+
+// newOutput create the encoder of a codec. not thread safe
+func (m *VideoMixer) newOutput(codecOption CodecOptions) (output *videoMixerOutput, err error) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	audioOut := make(chan *srtp.PacketRTP, 1000)
+	videoOut := make(chan *srtp.PacketRTP, 1000)
+	encoder, err := CreateEncoder(ctx, codecOption, nil, audioOut, videoOut, m.compositor, nil, randUint32(), randUint32(), config.Bitrates.Video.Max, FecOptions{}, ModeMCU)
+	if err != nil {
+		cancel()
+		return
+	}
+	output = &videoMixerOutput{
+		encoder:   encoder,
+		estimates: make(map[*SimulcastForwarder]int),
+		cancel:    cancel,
+	}
+	output.simulcast = NewSimulcastPublisher(codecOption, func(layer int) {
+		encoder.ForceKeyFrame()
+	})
+	go output.forward(ctx, audioOut, videoOut)
+	return
+}
+
+// closeOutput stop the encoder, removed from the compositor first: the
+// raw frames are sent with blocking writes. not thread safe
+func (m *VideoMixer) closeOutput(output *videoMixerOutput) {
+	m.compositor.EncodersMutex.Lock()
+	for i, e := range m.compositor.Encoders {
+		if e == output.encoder {
+			m.compositor.Encoders = append(m.compositor.Encoders[:i], m.compositor.Encoders[i+1:]...)
+			break
+		}
+	}
+	m.compositor.EncodersMutex.Unlock()
+	output.cancel()
+}
+
+func (output *videoMixerOutput) forward(ctx context.Context, audioOut chan *srtp.PacketRTP, videoOut chan *srtp.PacketRTP) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-videoOut:
+			output.simulcast.Forward(0, packet)
+		case <-audioOut:
+			// the compositor has no audio
+		}
+	}
+}
+
+// Close stop the compositor & the encoders, the room left the MCU mode
+// or is empty
+func (m *VideoMixer) Close() {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for codecOption, output := range m.outputs {
+		m.closeOutput(output)
+		delete(m.outputs, codecOption)
+	}
+	for _, decoder := range m.decoders {
+		decoder.EncodersMutex.Lock()
+		decoder.videoMixer = nil
+		decoder.EncodersMutex.Unlock()
+	}
+	m.decoders = nil
+	m.compositorCancel()
+	gst.ElementSetState(m.compositor.elements.Get("pdecoder").(*gst.GstElement), gst.StateNull)
+}
@@ -0,0 +1,144 @@
+package main
+
+/*
+ * Transport-wide congestion control (publisher side)
+ *
+ * the publisher numbers every RTP packet of the transport (audio, video,
+ * rtx, simulcast layers) in the transport-wide sequence number header
+ * extension. The jitter buffers record the arrival time of each number, the
+ * video jitter buffer periodically sends them back in a transport-cc
+ * feedback (RTPFB FMT=15), the publisher estimates the bandwidth from it.
+ *
+ * @see https://tools.ietf.org/html/draft-holmer-rmcat-transport-wide-cc-extensions-01
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/heytribe/live-webrtcsignaling/rtcp"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
+)
+
+const (
+	extmapTransportWideCC = "http://www.ietf.org/id/draft-holmer-rmcat-transport-wide-cc-extensions-01"
+	twccFeedbackPeriod    = 100 * time.Millisecond
+	// a feedback reports the last packets only, after a long gap
+	twccMaxPacketsPerFeedback = 1000
+)
+
+/*
+ * TransportWideCC record the arrivals of the transport-wide sequence numbers,
+ * shared by the jitter buffers of a publisher session
+ */
+type TransportWideCC struct {
+	sync.Mutex
+	// reference times are counted from epoch
+	epoch time.Time
+	// unwrapped sequence number => arrival
+	arrivals map[int64]time.Time
+	// next sequence number to report, -1 until the first packet
+	baseSeq    int64
+	highestSeq int64
+	lastSeq    uint16
+	cycles     int64
+	fbPktCount uint8
+}
+
+func NewTransportWideCC() *TransportWideCC {
+	t := new(TransportWideCC)
+	t.epoch = time.Now()
+	t.arrivals = make(map[int64]time.Time)
+	t.baseSeq = -1
+	return t
+}
+
+// Record save the arrival of a transport-wide sequence number
+func (t *TransportWideCC) Record(seq uint16, arrival time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if t.baseSeq < 0 {
+		t.baseSeq = int64(seq)
+		t.highestSeq = int64(seq)
+		t.lastSeq = seq
+	}
+	// unwrap, packets can be reordered around the wrap
+	diff := int16(seq - t.lastSeq)
+	if diff > 0 && seq < t.lastSeq {
+		t.cycles += 1 << 16
+	}
+	unwrapped := t.cycles + int64(seq)
+	if diff < 0 && seq > t.lastSeq {
+		unwrapped -= 1 << 16
+	}
+	if diff > 0 {
+		t.lastSeq = seq
+	}
+	if unwrapped < t.baseSeq {
+		// already reported as lost
+		return
+	}
+	t.arrivals[unwrapped] = arrival
+	if unwrapped > t.highestSeq {
+		t.highestSeq = unwrapped
+	}
+}
+
+// Feedback return the arrivals since the last feedback, nil if none
+func (t *TransportWideCC) Feedback(senderSSRC uint32, mediaSSRC uint32) *rtcp.PacketALFBTW {
+	t.Lock()
+	defer t.Unlock()
+	if t.baseSeq < 0 || len(t.arrivals) == 0 {
+		return nil
+	}
+	if t.highestSeq-t.baseSeq >= twccMaxPacketsPerFeedback {
+		for seq := t.baseSeq; seq <= t.highestSeq-twccMaxPacketsPerFeedback; seq++ {
+			delete(t.arrivals, seq)
+		}
+		t.baseSeq = t.highestSeq - twccMaxPacketsPerFeedback + 1
+	}
+	arrivals := make([]time.Time, t.highestSeq-t.baseSeq+1)
+	for seq, arrival := range t.arrivals {
+		arrivals[seq-t.baseSeq] = arrival
+	}
+	feedback := rtcp.NewPacketALFBTW()
+	feedback.PacketRTPFB.SenderSSRC = senderSSRC
+	feedback.PacketRTPFB.MediaSSRC = mediaSSRC
+	feedback.FbPktCount = t.fbPktCount
+	feedback.SetArrivals(uint16(t.baseSeq), arrivals, t.epoch)
+
+	t.fbPktCount++
+	t.baseSeq = t.highestSeq + 1
+	t.arrivals = make(map[int64]time.Time)
+	return feedback
+}
+
+// getTransportWideSeq read the transport-wide sequence number header extension
+func getTransportWideSeq(extension []byte) (seq uint16, ok bool) {
+	if len(extension) < 2 {
+		return
+	}
+	return binary.BigEndian.Uint16(extension[0:2]), true
+}
+
+// transportWideCCAnswerMedia accept transport-cc for the media if the offer
+// negotiates the transport-wide sequence number
+func transportWideCCAnswerMedia(offer *sdp.SDP, media *sdp.Media) {
+	id := offer.GetExtmapId(media.Type, extmapTransportWideCC)
+	if id == 0 {
+		return
+	}
+	media.Attributes = append(media.Attributes, sdp.Attribute{K: "extmap", V: fmt.Sprintf("%d %s", id, extmapTransportWideCC)})
+	media.RtcpFb = append(media.RtcpFb, "transport-cc")
+}
+
+// transportWideCCExtensionId return the extension id, the same for every
+// media of the BUNDLE
+func transportWideCCExtensionId(offer *sdp.SDP) int {
+	if id := offer.GetExtmapId("video", extmapTransportWideCC); id != 0 {
+		return id
+	}
+	return offer.GetExtmapId("audio", extmapTransportWideCC)
+}
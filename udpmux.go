@@ -0,0 +1,246 @@
+package main
+
+/*
+ * UdpMux
+ * single UDP socket shared by every WebRTC session (config.Network.UdpMuxPort)
+ *
+ * incoming packets are routed to the session endpoint:
+ *  - by the remote address, once learned
+ *  - STUN binding requests by the local ufrag of the USERNAME attribute
+ * a remote address is learned once the session validated the
+ * MESSAGE-INTEGRITY of its connectivity check & on every packet a session
+ * sends, never from the USERNAME alone.
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	plogger "github.com/heytribe/go-plogger"
+	"github.com/heytribe/live-webrtcsignaling/packet"
+)
+
+// socket of a WebRTC session, a dedicated *net.UDPConn or an UdpMux endpoint
+type udpSessionConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// pause after a persistent read error, not to spin on it
+const udpMuxReadErrorDelay = 10 * time.Millisecond
+
+type UdpMux struct {
+	sync.RWMutex
+	conn   *net.UDPConn
+	ufrags map[string]*udpMuxConn
+	rAddrs map[string]*udpMuxConn
+}
+
+func NewUdpMux(ctx context.Context, port int) (m *UdpMux, err error) {
+	m = new(UdpMux)
+	m.conn, err = net.ListenUDP(listenUdpAddr(port))
+	if err != nil {
+		return
+	}
+	m.ufrags = make(map[string]*udpMuxConn)
+	m.rAddrs = make(map[string]*udpMuxConn)
+	return
+}
+
+// NewConn create the endpoint of a new session
+func (m *UdpMux) NewConn() *udpMuxConn {
+	c := new(udpMuxConn)
+	c.mux = m
+	c.in = make(chan *packet.UDP, 1000)
+	c.closed = make(chan struct{})
+	return c
+}
+
+// setUfrag fail if the ufrag already routes to another session
+func (m *UdpMux) setUfrag(ufrag string, c *udpMuxConn) error {
+	m.Lock()
+	defer m.Unlock()
+	if other, ok := m.ufrags[ufrag]; ok && other != c {
+		return errors.New(fmt.Sprintf("ufrag %s is already used by another session", ufrag))
+	}
+	m.ufrags[ufrag] = c
+	return nil
+}
+
+func (m *UdpMux) learnRAddr(rAddr *net.UDPAddr, c *udpMuxConn) {
+	key := rAddr.String()
+	m.RLock()
+	known := m.rAddrs[key] == c
+	m.RUnlock()
+	if known {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.rAddrs[key] = c
+}
+
+func (m *UdpMux) remove(c *udpMuxConn) {
+	m.Lock()
+	defer m.Unlock()
+	for ufrag, conn := range m.ufrags {
+		if conn == c {
+			delete(m.ufrags, ufrag)
+		}
+	}
+	for rAddr, conn := range m.rAddrs {
+		if conn == c {
+			delete(m.rAddrs, rAddr)
+		}
+	}
+}
+
+func (m *UdpMux) route(p *packet.UDP) *udpMuxConn {
+	m.RLock()
+	c := m.rAddrs[p.GetRAddr().String()]
+	m.RUnlock()
+	if c != nil || !p.IsSTUN() {
+		return c
+	}
+	username, ok := stunUsername(p.GetData())
+	if !ok {
+		return nil
+	}
+	// USERNAME is "<receiver ufrag>:<sender ufrag>", we are the receiver.
+	// the address is learned by the session once the check is validated
+	m.RLock()
+	c = m.ufrags[strings.Split(username, ":")[0]]
+	m.RUnlock()
+	return c
+}
+
+func (m *UdpMux) run(ctx context.Context) {
+	log := plogger.FromContextSafe(ctx).Prefix("UdpMux")
+	log.Infof("listening on %s", m.conn.LocalAddr())
+	go func() {
+		<-ctx.Done()
+		m.conn.Close()
+	}()
+	for {
+		p := packet.NewUDP()
+		size, rAddr, err := m.conn.ReadFromUDP(p.GetData())
+		if err != nil {
+			// every session shares the socket, only a shutdown stops it
+			if ctx.Err() != nil || isClosedConnError(err) {
+				log.Infof("socket closed, stop reading")
+				return
+			}
+			log.Errorf("packet read error %s", err.Error())
+			if netErr, ok := err.(net.Error); !ok || !netErr.Temporary() {
+				time.Sleep(udpMuxReadErrorDelay)
+			}
+			continue
+		}
+		p.SetCreatedAt(time.Now())
+		p.SetRAddr(rAddr)
+		p.Slice(0, size)
+		if p.IsEmpty() {
+			continue
+		}
+		c := m.route(p)
+		if c == nil {
+			log.Debugf("no session for packet from %s, dropping", rAddr)
+			continue
+		}
+		select {
+		case <-c.closed:
+		case c.in <- p:
+		default:
+			log.Warnf("session endpoint is full, dropping packet from %s", rAddr)
+		}
+	}
+}
+
+// isClosedConnError is true for the reads of a closed socket (no
+// net.ErrClosed before go 1.16)
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// stunUsername return the USERNAME attribute of a STUN message
+func stunUsername(buf []byte) (username string, ok bool) {
+	if len(buf) < 20 {
+		return
+	}
+	end := 20 + int(bin.Uint16(buf[2:4]))
+	if end > len(buf) {
+		return
+	}
+	for pos := 20; pos+4 <= end; {
+		typ := bin.Uint16(buf[pos : pos+2])
+		length := int(bin.Uint16(buf[pos+2 : pos+4]))
+		if pos+4+length > end {
+			return
+		}
+		if typ == 0x0006 {
+			return string(buf[pos+4 : pos+4+length]), true
+		}
+		// attributes are padded on 32 bits
+		pos += 4 + (length+3)&^3
+	}
+	return
+}
+
+/*
+ * endpoint of a session on the shared socket, implements udpSessionConn
+ */
+type udpMuxConn struct {
+	mux       *UdpMux
+	in        chan *packet.UDP
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// SetUfrag route incoming connectivity checks for ufrag to this endpoint
+func (c *udpMuxConn) SetUfrag(ufrag string) error {
+	return c.mux.setUfrag(ufrag, c)
+}
+
+// LearnRAddr route the packets of a validated remote address to this
+// endpoint
+func (c *udpMuxConn) LearnRAddr(rAddr *net.UDPAddr) {
+	c.mux.learnRAddr(rAddr, c)
+}
+
+func (c *udpMuxConn) ReadFromUDP(b []byte) (n int, rAddr *net.UDPAddr, err error) {
+	select {
+	case <-c.closed:
+		err = errors.New("use of closed udp mux connection")
+	case p := <-c.in:
+		n = copy(b, p.GetData())
+		rAddr = p.GetRAddr()
+	}
+	return
+}
+
+func (c *udpMuxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if rAddr, ok := addr.(*net.UDPAddr); ok {
+		c.mux.learnRAddr(rAddr, c)
+	}
+	return c.mux.conn.WriteTo(b, addr)
+}
+
+func (c *udpMuxConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+// Close unregister the endpoint, the shared socket stays open
+func (c *udpMuxConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mux.remove(c)
+		close(c.closed)
+	})
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/heytribe/live-webrtcsignaling/packet"
+)
+
+func newUdpMuxTest() *UdpMux {
+	return &UdpMux{
+		ufrags: make(map[string]*udpMuxConn),
+		rAddrs: make(map[string]*udpMuxConn),
+	}
+}
+
+// newUdpMuxTestBindingRequest build a binding request with a USERNAME
+func newUdpMuxTestBindingRequest(username string, rAddr *net.UDPAddr) *packet.UDP {
+	m := StunMessage{b: append([]byte{}, stunTestHeader...)}
+	m.b[0], m.b[1] = 0x00, 0x01
+	m.AddUsername(username, "")
+	m.UpdateLength()
+	return packet.NewUDPFromData(m.b, rAddr)
+}
+
+func TestUdpMuxRouteByUfrag(t *testing.T) {
+	m := newUdpMuxTest()
+	c := m.NewConn()
+	if err := c.SetUfrag("localufrag"); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	rAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}
+	if routed := m.route(newUdpMuxTestBindingRequest("localufrag", rAddr)); routed != c {
+		t.Errorf("binding request not routed by ufrag")
+	}
+	if routed := m.route(newUdpMuxTestBindingRequest("otherufrag", rAddr)); routed != nil {
+		t.Errorf("binding request of an unknown ufrag routed")
+	}
+	// the USERNAME alone doesn't route the address
+	dtlsPacket := packet.NewUDPFromData([]byte{22, 254, 253, 0, 0}, rAddr)
+	if routed := m.route(dtlsPacket); routed != nil {
+		t.Errorf("DTLS packet routed before the check is validated")
+	}
+	c.LearnRAddr(rAddr)
+	if routed := m.route(dtlsPacket); routed != c {
+		t.Errorf("DTLS packet not routed once the address is learned")
+	}
+}
+
+func TestUdpMuxSetUfrag(t *testing.T) {
+	m := newUdpMuxTest()
+	c := m.NewConn()
+	other := m.NewConn()
+	if err := c.SetUfrag("localufrag"); err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if err := c.SetUfrag("localufrag"); err != nil {
+		t.Errorf("same session: %s", err.Error())
+	}
+	if err := other.SetUfrag("localufrag"); err == nil {
+		t.Errorf("ufrag of another session overwritten")
+	}
+	c.Close()
+	if err := other.SetUfrag("localufrag"); err != nil {
+		t.Errorf("ufrag of a closed session: %s", err.Error())
+	}
+}
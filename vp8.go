@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// temporal layer ids are 2 bits long
+const vp8TemporalLayerAll uint8 = 3
+
+/*
+ * VP8 payload descriptor (RFC 7741 4.2)
+ *
+ *       0 1 2 3 4 5 6 7
+ *      +-+-+-+-+-+-+-+-+
+ *      |X|R|N|S|R| PID | (REQUIRED)
+ *      +-+-+-+-+-+-+-+-+
+ * X:   |I|L|T|K| RSV   | (OPTIONAL)
+ *      +-+-+-+-+-+-+-+-+
+ * I:   |M| PictureID   | (OPTIONAL)
+ *      +-+-+-+-+-+-+-+-+
+ *      |   PictureID   |
+ *      +-+-+-+-+-+-+-+-+
+ * L:   |   TL0PICIDX   | (OPTIONAL)
+ *      +-+-+-+-+-+-+-+-+
+ * T/K: |TID|Y| KEYIDX  | (OPTIONAL)
+ *      +-+-+-+-+-+-+-+-+
+ */
+type VP8PayloadDescriptor struct {
+	NonReference     bool
+	StartOfPartition bool
+	PartitionId      uint8
+	HasPictureId     bool
+	PictureId        uint16
+	// 15 bits picture id (M=1), 7 bits otherwise
+	PictureIdLong bool
+	HasTL0PicIdx  bool
+	TL0PicIdx     uint8
+	HasTID        bool
+	TID           uint8
+	// Y: the frame only depends on the base layer
+	LayerSync bool
+	HasKeyIdx bool
+	KeyIdx    uint8
+	// descriptor length, the VP8 payload header follows
+	Size int
+	// offsets in the payload, to rewrite the fields
+	pictureIdOffset int
+	tl0PicIdxOffset int
+}
+
+func ParseVP8PayloadDescriptor(payload []byte) (d VP8PayloadDescriptor, err error) {
+	if len(payload) < 1 {
+		err = errors.New("empty VP8 payload")
+		return
+	}
+	d.NonReference = payload[0]&0x20 != 0
+	d.StartOfPartition = payload[0]&0x10 != 0
+	d.PartitionId = payload[0] & 0x07
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			err = errors.New("VP8 payload descriptor truncated after X")
+			return
+		}
+		x := payload[1]
+		i = 2
+		if x&0x80 != 0 {
+			if len(payload) <= i {
+				err = errors.New("VP8 payload descriptor truncated before PictureID")
+				return
+			}
+			d.HasPictureId = true
+			d.pictureIdOffset = i
+			if payload[i]&0x80 != 0 {
+				if len(payload) <= i+1 {
+					err = errors.New("VP8 payload descriptor truncated in PictureID")
+					return
+				}
+				d.PictureIdLong = true
+				d.PictureId = binary.BigEndian.Uint16(payload[i:i+2]) & 0x7fff
+				i += 2
+			} else {
+				d.PictureId = uint16(payload[i] & 0x7f)
+				i++
+			}
+		}
+		if x&0x40 != 0 {
+			if len(payload) <= i {
+				err = errors.New("VP8 payload descriptor truncated before TL0PICIDX")
+				return
+			}
+			d.HasTL0PicIdx = true
+			d.tl0PicIdxOffset = i
+			d.TL0PicIdx = payload[i]
+			i++
+		}
+		if x&0x20 != 0 || x&0x10 != 0 {
+			if len(payload) <= i {
+				err = errors.New("VP8 payload descriptor truncated before TID/KEYIDX")
+				return
+			}
+			d.HasTID = x&0x20 != 0
+			d.HasKeyIdx = x&0x10 != 0
+			if d.HasTID {
+				d.TID = payload[i] >> 6
+				d.LayerSync = payload[i]&0x20 != 0
+			}
+			if d.HasKeyIdx {
+				d.KeyIdx = payload[i] & 0x1f
+			}
+			i++
+		}
+	}
+	d.Size = i
+	return
+}
+
+// IsFrameStart is true on the first packet of a frame
+func (d *VP8PayloadDescriptor) IsFrameStart() bool {
+	return d.StartOfPartition && d.PartitionId == 0
+}
+
+// IsKeyFrameStart check the P bit of the VP8 payload header (RFC 7741 4.3)
+func (d *VP8PayloadDescriptor) IsKeyFrameStart(payload []byte) bool {
+	return d.IsFrameStart() && len(payload) > d.Size && payload[d.Size]&0x01 == 0
+}
+
+// SetPictureId rewrite the picture id, keeping its length
+func (d *VP8PayloadDescriptor) SetPictureId(payload []byte, pictureId uint16) {
+	if !d.HasPictureId {
+		return
+	}
+	if d.PictureIdLong {
+		binary.BigEndian.PutUint16(payload[d.pictureIdOffset:d.pictureIdOffset+2], 0x8000|pictureId&0x7fff)
+	} else {
+		payload[d.pictureIdOffset] = byte(pictureId & 0x7f)
+	}
+	d.PictureId = pictureId & d.pictureIdMask()
+}
+
+func (d *VP8PayloadDescriptor) SetTL0PicIdx(payload []byte, tl0PicIdx uint8) {
+	if !d.HasTL0PicIdx {
+		return
+	}
+	payload[d.tl0PicIdxOffset] = tl0PicIdx
+	d.TL0PicIdx = tl0PicIdx
+}
+
+func (d *VP8PayloadDescriptor) pictureIdMask() uint16 {
+	if d.PictureIdLong {
+		return 0x7fff
+	}
+	return 0x7f
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseVP8PayloadDescriptor(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		d       VP8PayloadDescriptor
+	}{
+		{"no extension", []byte{0x10, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, Size: 1,
+		}},
+		{"non reference partition", []byte{0x23, 0x00}, VP8PayloadDescriptor{
+			NonReference: true, PartitionId: 3, Size: 1,
+		}},
+		{"7 bits picture id", []byte{0x90, 0x80, 0x45, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasPictureId: true, PictureId: 0x45, Size: 3, pictureIdOffset: 2,
+		}},
+		{"15 bits picture id", []byte{0x90, 0x80, 0x81, 0x23, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasPictureId: true, PictureId: 0x123, PictureIdLong: true, Size: 4, pictureIdOffset: 2,
+		}},
+		{"TL0PICIDX", []byte{0x90, 0x40, 0x07, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasTL0PicIdx: true, TL0PicIdx: 7, Size: 3, tl0PicIdxOffset: 2,
+		}},
+		// TID 2, Y
+		{"TID", []byte{0x90, 0x20, 0xA0, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasTID: true, TID: 2, LayerSync: true, Size: 3,
+		}},
+		{"KEYIDX", []byte{0x90, 0x10, 0x1F, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasKeyIdx: true, KeyIdx: 31, Size: 3,
+		}},
+		{"every extension", []byte{0x90, 0xF0, 0x80, 0x01, 0x05, 0x45, 0x00}, VP8PayloadDescriptor{
+			StartOfPartition: true, HasPictureId: true, PictureId: 1, PictureIdLong: true,
+			HasTL0PicIdx: true, TL0PicIdx: 5, HasTID: true, TID: 1, HasKeyIdx: true, KeyIdx: 5,
+			Size: 6, pictureIdOffset: 2, tl0PicIdxOffset: 4,
+		}},
+	}
+	for _, test := range tests {
+		d, err := ParseVP8PayloadDescriptor(test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if d != test.d {
+			t.Errorf("%s: %+v, expected %+v", test.name, d, test.d)
+		}
+	}
+}
+
+func TestParseVP8PayloadDescriptorTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", []byte{}},
+		{"X", []byte{0x90}},
+		{"picture id", []byte{0x90, 0x80}},
+		{"15 bits picture id", []byte{0x90, 0x80, 0x81}},
+		{"TL0PICIDX", []byte{0x90, 0x40}},
+		{"TID", []byte{0x90, 0x20}},
+		{"KEYIDX", []byte{0x90, 0x10}},
+	}
+	for _, test := range tests {
+		if _, err := ParseVP8PayloadDescriptor(test.payload); err == nil {
+			t.Errorf("%s: truncated descriptor parsed", test.name)
+		}
+	}
+}
+
+func TestVP8SetPictureId(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   []byte
+		pictureId uint16
+		rewritten []byte
+		parsed    uint16
+	}{
+		{"15 bits", []byte{0x90, 0x80, 0x81, 0x23, 0x00}, 0x4567, []byte{0x90, 0x80, 0xC5, 0x67, 0x00}, 0x4567},
+		{"15 bits wrap", []byte{0x90, 0x80, 0x81, 0x23, 0x00}, 0x8001, []byte{0x90, 0x80, 0x80, 0x01, 0x00}, 1},
+		{"7 bits", []byte{0x90, 0x80, 0x45, 0x00}, 0x12, []byte{0x90, 0x80, 0x12, 0x00}, 0x12},
+		{"7 bits wrap", []byte{0x90, 0x80, 0x45, 0x00}, 0x80, []byte{0x90, 0x80, 0x00, 0x00}, 0},
+		{"no picture id", []byte{0x10, 0x00}, 0x12, []byte{0x10, 0x00}, 0},
+	}
+	for _, test := range tests {
+		d, err := ParseVP8PayloadDescriptor(test.payload)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		d.SetPictureId(test.payload, test.pictureId)
+		if !bytes.Equal(test.payload, test.rewritten) {
+			t.Errorf("%s: rewritten %X, expected %X", test.name, test.payload, test.rewritten)
+		}
+		if d, _ := ParseVP8PayloadDescriptor(test.payload); d.PictureId != test.parsed {
+			t.Errorf("%s: picture id %d after rewrite, expected %d", test.name, d.PictureId, test.parsed)
+		}
+	}
+}
+
+func TestVP8SetTL0PicIdx(t *testing.T) {
+	payload := []byte{0x90, 0xC0, 0x05, 0x07, 0x00}
+	d, err := ParseVP8PayloadDescriptor(payload)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	d.SetTL0PicIdx(payload, 0xFF)
+	if expected := []byte{0x90, 0xC0, 0x05, 0xFF, 0x00}; !bytes.Equal(payload, expected) {
+		t.Errorf("rewritten %X, expected %X", payload, expected)
+	}
+}
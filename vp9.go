@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+ * VP9 payload descriptor (draft-ietf-payload-vp9 4.2)
+ *
+ *       0 1 2 3 4 5 6 7
+ *      +-+-+-+-+-+-+-+-+
+ *      |I|P|L|F|B|E|V|Z| (REQUIRED)
+ *      +-+-+-+-+-+-+-+-+
+ * I:   |M| PICTURE ID  | (RECOMMENDED)
+ *      +-+-+-+-+-+-+-+-+
+ * M:   | EXTENDED PID  | (RECOMMENDED)
+ *      +-+-+-+-+-+-+-+-+
+ * L:   | TID |U| SID |D| (CONDITIONALLY RECOMMENDED)
+ *      +-+-+-+-+-+-+-+-+
+ *      |   TL0PICIDX   | (CONDITIONALLY REQUIRED, non flexible mode)
+ *      +-+-+-+-+-+-+-+-+
+ * P,F: | P_DIFF      |N| (CONDITIONALLY REQUIRED, up to 3 times)
+ *      +-+-+-+-+-+-+-+-+
+ * V:   | SS            |
+ *      | ..            |
+ *      +-+-+-+-+-+-+-+-+
+ */
+type VP9PayloadDescriptor struct {
+	// P: the picture is predicted from other pictures
+	InterPicture bool
+	// F: flexible mode, the references are in the descriptor
+	Flexible          bool
+	StartOfLayerFrame bool
+	EndOfLayerFrame   bool
+	HasPictureId      bool
+	PictureId         uint16
+	// 15 bits picture id (M=1), 7 bits otherwise
+	PictureIdLong bool
+	HasLayers     bool
+	TID           uint8
+	// U: switching up point
+	SwitchingUp bool
+	SID         uint8
+	// D: inter-layer dependency
+	InterLayer   bool
+	HasTL0PicIdx bool
+	TL0PicIdx    uint8
+	// V: the scalability structure follows the layer indices
+	HasScalabilityStructure bool
+	// descriptor length, the VP9 frame follows
+	Size int
+}
+
+func ParseVP9PayloadDescriptor(payload []byte) (d VP9PayloadDescriptor, err error) {
+	if len(payload) < 1 {
+		err = errors.New("empty VP9 payload")
+		return
+	}
+	d.HasPictureId = payload[0]&0x80 != 0
+	d.InterPicture = payload[0]&0x40 != 0
+	d.HasLayers = payload[0]&0x20 != 0
+	d.Flexible = payload[0]&0x10 != 0
+	d.StartOfLayerFrame = payload[0]&0x08 != 0
+	d.EndOfLayerFrame = payload[0]&0x04 != 0
+	d.HasScalabilityStructure = payload[0]&0x02 != 0
+	i := 1
+	if d.HasPictureId {
+		if len(payload) <= i {
+			err = errors.New("VP9 payload descriptor truncated before PICTURE ID")
+			return
+		}
+		if payload[i]&0x80 != 0 {
+			if len(payload) <= i+1 {
+				err = errors.New("VP9 payload descriptor truncated in PICTURE ID")
+				return
+			}
+			d.PictureIdLong = true
+			d.PictureId = binary.BigEndian.Uint16(payload[i:i+2]) & 0x7fff
+			i += 2
+		} else {
+			d.PictureId = uint16(payload[i] & 0x7f)
+			i++
+		}
+	}
+	if d.HasLayers {
+		if len(payload) <= i {
+			err = errors.New("VP9 payload descriptor truncated before the layer indices")
+			return
+		}
+		d.TID = payload[i] >> 5
+		d.SwitchingUp = payload[i]&0x10 != 0
+		d.SID = (payload[i] >> 1) & 0x07
+		d.InterLayer = payload[i]&0x01 != 0
+		i++
+		if !d.Flexible {
+			if len(payload) <= i {
+				err = errors.New("VP9 payload descriptor truncated before TL0PICIDX")
+				return
+			}
+			d.HasTL0PicIdx = true
+			d.TL0PicIdx = payload[i]
+			i++
+		}
+	}
+	if d.Flexible && d.InterPicture {
+		for n := 0; ; n++ {
+			if len(payload) <= i || n == 3 {
+				err = errors.New("VP9 payload descriptor invalid reference indices")
+				return
+			}
+			pDiff := payload[i]
+			i++
+			// N: another reference follows
+			if pDiff&0x01 == 0 {
+				break
+			}
+		}
+	}
+	if d.HasScalabilityStructure {
+		i, err = skipVP9ScalabilityStructure(payload, i)
+		if err != nil {
+			return
+		}
+	}
+	d.Size = i
+	return
+}
+
+/*
+ * skipVP9ScalabilityStructure return the offset following the SS data
+ *
+ *      +-+-+-+-+-+-+-+-+
+ * V:   | N_S |Y|G|-|-|-|
+ *      +-+-+-+-+-+-+-+-+              -\
+ * Y:   |     WIDTH     | (OPTIONAL)    .
+ *      +               +               .
+ *      |               | (OPTIONAL)    .
+ *      +-+-+-+-+-+-+-+-+               . - N_S + 1 times
+ *      |     HEIGHT    | (OPTIONAL)    .
+ *      +               +               .
+ *      |               | (OPTIONAL)    .
+ *      +-+-+-+-+-+-+-+-+              -/
+ * G:   |      N_G      | (OPTIONAL)
+ *      +-+-+-+-+-+-+-+-+                           -\
+ * N_G: | TID |U| R |-|-| (OPTIONAL)                 .
+ *      +-+-+-+-+-+-+-+-+              -\            . - N_G times
+ *      |    P_DIFF     | (OPTIONAL)    . - R times  .
+ *      +-+-+-+-+-+-+-+-+              -/           -/
+ */
+func skipVP9ScalabilityStructure(payload []byte, i int) (int, error) {
+	if len(payload) <= i {
+		return i, errors.New("VP9 payload descriptor truncated before SS")
+	}
+	spatialLayers := int(payload[i]>>5) + 1
+	hasResolutions := payload[i]&0x10 != 0
+	hasGroup := payload[i]&0x08 != 0
+	i++
+	if hasResolutions {
+		i += spatialLayers * 4
+	}
+	if hasGroup {
+		if len(payload) <= i {
+			return i, errors.New("VP9 payload descriptor truncated before N_G")
+		}
+		pictures := int(payload[i])
+		i++
+		for n := 0; n < pictures; n++ {
+			if len(payload) <= i {
+				return i, errors.New("VP9 payload descriptor truncated in the picture group")
+			}
+			i += 1 + int(payload[i]>>2)&0x03
+		}
+	}
+	if len(payload) < i {
+		return i, errors.New("VP9 payload descriptor truncated in SS")
+	}
+	return i, nil
+}
+
+// IsKeyFrameStart is true on the first packet of the base spatial layer of
+// a picture which is not predicted
+func (d *VP9PayloadDescriptor) IsKeyFrameStart() bool {
+	return d.StartOfLayerFrame && !d.InterPicture && (!d.HasLayers || d.SID == 0)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseVP9PayloadDescriptor(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		d       VP9PayloadDescriptor
+	}{
+		{"no extension", []byte{0x08, 0x00}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, Size: 1,
+		}},
+		{"end of layer frame", []byte{0x44, 0x00}, VP9PayloadDescriptor{
+			InterPicture: true, EndOfLayerFrame: true, Size: 1,
+		}},
+		{"7 bits picture id", []byte{0x88, 0x45, 0x00}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, HasPictureId: true, PictureId: 0x45, Size: 2,
+		}},
+		{"15 bits picture id", []byte{0x88, 0x81, 0x23, 0x00}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, HasPictureId: true, PictureId: 0x123, PictureIdLong: true, Size: 3,
+		}},
+		// TID 2, SID 1, D
+		{"non flexible layers", []byte{0x28, 0x43, 0x07, 0x00}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, HasLayers: true, TID: 2, SID: 1, InterLayer: true,
+			HasTL0PicIdx: true, TL0PicIdx: 7, Size: 3,
+		}},
+		// TID 1 U, 2 references
+		{"flexible references", []byte{0xF8, 0x01, 0x30, 0x03, 0x04, 0x00}, VP9PayloadDescriptor{
+			HasPictureId: true, PictureId: 1, InterPicture: true, HasLayers: true, Flexible: true,
+			StartOfLayerFrame: true, TID: 1, SwitchingUp: true, Size: 5,
+		}},
+		{"flexible without reference", []byte{0x18, 0x00}, VP9PayloadDescriptor{
+			Flexible: true, StartOfLayerFrame: true, Size: 1,
+		}},
+		// 2 spatial layers with resolutions, 1 picture with 1 reference
+		{"scalability structure", []byte{
+			0x0A,
+			0x38, 0x01, 0x40, 0x00, 0xB4, 0x02, 0x80, 0x01, 0x68,
+			0x01, 0x04, 0x01,
+			0x00,
+		}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, HasScalabilityStructure: true, Size: 13,
+		}},
+		{"scalability structure without resolution", []byte{0x0A, 0x00, 0x00}, VP9PayloadDescriptor{
+			StartOfLayerFrame: true, HasScalabilityStructure: true, Size: 2,
+		}},
+	}
+	for _, test := range tests {
+		d, err := ParseVP9PayloadDescriptor(test.payload)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if d != test.d {
+			t.Errorf("%s: %+v, expected %+v", test.name, d, test.d)
+		}
+	}
+}
+
+func TestParseVP9PayloadDescriptorTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", []byte{}},
+		{"I", []byte{0x88}},
+		{"M", []byte{0x88, 0x80}},
+		{"L", []byte{0x28}},
+		{"TL0PICIDX", []byte{0x28, 0x00}},
+		{"P_DIFF", []byte{0x58}},
+		{"4 references", []byte{0x58, 0x03, 0x05, 0x07, 0x08}},
+		{"SS", []byte{0x0A}},
+		{"SS resolutions", []byte{0x0A, 0x10, 0x01, 0x40}},
+		{"N_G", []byte{0x0A, 0x08}},
+		{"SS picture group", []byte{0x0A, 0x08, 0x02, 0x00}},
+	}
+	for _, test := range tests {
+		if _, err := ParseVP9PayloadDescriptor(test.payload); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestIsVP9KeyFrameStart(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  []byte
+		keyFrame bool
+	}{
+		{"key frame", []byte{0x08, 0x00}, true},
+		{"key frame with picture id", []byte{0x88, 0x81, 0x23, 0x00}, true},
+		{"inter picture", []byte{0x48, 0x00}, false},
+		{"not the first packet", []byte{0x04, 0x00}, false},
+		// SID 0, TL0PICIDX 1
+		{"base spatial layer", []byte{0x28, 0x00, 0x01, 0x00}, true},
+		// SID 1
+		{"upper spatial layer", []byte{0x28, 0x02, 0x01, 0x00}, false},
+		{"truncated", []byte{0x88}, false},
+	}
+	for _, test := range tests {
+		if keyFrame := isVP9KeyFrameStart(test.payload); keyFrame != test.keyFrame {
+			t.Errorf("%s: key frame %t, expected %t", test.name, keyFrame, test.keyFrame)
+		}
+	}
+}
@@ -4,15 +4,15 @@ import (
 	"context"
 	"errors"
 	"net"
-	"strconv"
-	"strings"
 	"fmt"
+	"sync"
 
 	"encoding/json"
 
 	plogger "github.com/heytribe/go-plogger"
 	"github.com/heytribe/live-webrtcsignaling/dtls"
 	"github.com/heytribe/live-webrtcsignaling/gst"
+	"github.com/heytribe/live-webrtcsignaling/sdp"
 	"github.com/heytribe/live-webrtcsignaling/srtp"
 	"github.com/kr/pretty"
 )
@@ -44,28 +44,55 @@ func NewWebRTCSessionMap() *WebRTCSessionMap {
 
 type WebRTCSession struct {
 	mode WebRTCMode
+	// SFU or MCU, the mode of the room when the session was created
+	roomMode ModeOptions
 	webRTCSessionPublisher *WebRTCSession
 	// max videoBitrate authorized
 	maxVideoBitrate int
 	//
-	udpConn    *net.UDPConn
+	udpConn    udpSessionConn
 	listenPort int
+	// DTLS certificate of the session, the current one at creation
+	dtlsCtx *dtls.Ctx
 	//
-	sdpCtx   *SdpContext
-	stunCtx  *StunContext
-	stunMode StunMode
-	c        *connectionUdp
-	bus      *gst.GstBus
+	sdpCtx *SdpContext
+	// replaced by an ICE restart under stunCtxMutex, see getStunCtx
+	stunCtxMutex sync.RWMutex
+	stunCtx      *StunContext
+	stunMode     StunMode
+	c            *connectionUdp
+	bus          *gst.GstBus
 	//loop		*gst.GMainLoop
 	videoJitterBuffer *JitterBuffer
 	audioJitterBuffer *JitterBuffer
 	p                 *Pipeline
+	// publisher only: ssrc dependant nodes, rebuilt on renegotiation,
+	// replaced under publisherMediaMutex, see getPublisherMedia
+	publisherMediaMutex sync.RWMutex
+	publisherMedia      *publisherMediaNodes
+	renegotiated        chan struct{}
+	// publisher only: simulcast layers dispatch to the listeners (SFU)
+	simulcast *SimulcastPublisher
+	// listener only: layer forwarded, nil without simulcast
+	simulcastForwarder *SimulcastForwarder
+	// listener only: quality of the subscription, last-N pause. The
+	// forwarder, quality & lastNPaused are changed under subscriptionMutex
+	// by the api & the room
+	subscriptionMutex sync.Mutex
+	quality           SubscriptionQuality
+	lastNPaused       bool
+	// MCU, publisher: its decoder is a tile & is mixed, listener: receives
+	// the composition & the mix of the other peers
+	videoMixer *VideoMixer
+	audioMixer *AudioMixer
 	// listener: last rembs received, publisher: last rembs sent.
 	lastRembs []int
 	// listener only: last encoding bitrate set
 	lastEncodingBitrate []int
 	// publisher: input bandwidth, listener: output bandwidth
 	lastBandwidthEstimates []uint64
+	// publisher only: retransmissions of the video ssrcs
+	rtxStats []*PipelineMessageRtxStats
 	//
 	disconnected bool
 	ctxCancel    context.CancelFunc
@@ -83,13 +110,31 @@ func (w *WebRTCSession) GetMaxVideoBitrate() int {
 	return w.maxVideoBitrate
 }
 
+// remoteFingerprints return the fingerprints announced by the peer: in its
+// offer for a publisher, in its answer for a listener
+func (w *WebRTCSession) remoteFingerprints() []dtls.Fingerprint {
+	offer, answer := w.sdpCtx.Negotiated()
+	if w.mode == WebRTCModePublisher {
+		return getFingerprints(offer)
+	}
+	return getFingerprints(answer)
+}
+
+// srtpMasterKeys concatenate the master keys & salts, as libsrtp expects
+// them. Lengths depend on the negotiated profile.
+func srtpMasterKeys(srtpKeys *dtls.SrtpKeys) (localSrtp []byte, remoteSrtp []byte) {
+	localSrtp = append(append([]byte{}, srtpKeys.LocalKey...), srtpKeys.LocalSalt...)
+	remoteSrtp = append(append([]byte{}, srtpKeys.RemoteKey...), srtpKeys.RemoteSalt...)
+	return
+}
+
 func (w *WebRTCSession) dtlsClientConnect(ctx context.Context) {
 	var err error
 
 	log, _ := plogger.FromContext(ctx)
 	log.Debugf("dtls client connect")
 	// Now DTLS connect
-	w.c.dtlsSession, err = dtlsCtx.NewDTLS(w.c.send, w.stunCtx.RAddr, dtls.DtlsRoleClient)
+	w.c.dtlsSession, err = w.dtlsCtx.NewDTLS(w.c.send, w.getStunCtx().RAddr, dtls.DtlsRoleClient, w.remoteFingerprints())
 	if log.OnError(err, "[ error ] could not DTLS link with channel %#v", w.c.send) {
 		return
 	}
@@ -109,12 +154,7 @@ func (w *WebRTCSession) dtlsClientConnect(ctx context.Context) {
 		w.c.dtlsState = DtlsStateFailed
 		return
 	}
-	localSrtp := make([]byte, 30)
-	remoteSrtp := make([]byte, 30)
-	copy(localSrtp[0:16], srtpKeys.LocalKey)
-	copy(localSrtp[16:30], srtpKeys.LocalSalt)
-	copy(remoteSrtp[0:16], srtpKeys.RemoteKey)
-	copy(remoteSrtp[16:30], srtpKeys.RemoteSalt)
+	localSrtp, remoteSrtp := srtpMasterKeys(srtpKeys)
 	/*logger.Infof("[ WEBRTC ] DTLS SRTP localSrtp concat is %#v", localSrtp)
 	logger.Infof("[ WEBRTC ] DTLS SRTP base64 local key is %s", base64.StdEncoding.EncodeToString(localSrtp))
 	logger.Infof("[ WEBRTC ] DTLS SRTP remoteSrtp concat is %#v", remoteSrtp)
@@ -122,7 +162,7 @@ func (w *WebRTCSession) dtlsClientConnect(ctx context.Context) {
 
 	// create SRTP session with keys
 	log.Infof("[ STUN ] CREATING SRTP SESSION")
-	w.c.srtpSession, err = srtp.Create(localSrtp, remoteSrtp)
+	w.c.srtpSession, err = srtp.Create(srtp.Profile(srtpKeys.Profile), localSrtp, remoteSrtp)
 	if log.OnError(err, "[ STUN ] Could not create SRTP session") {
 		return
 	}
@@ -134,7 +174,7 @@ func (w *WebRTCSession) dtlsServerAccept(ctx context.Context) {
 	var err error
 
 	log, _ := plogger.FromContext(ctx)
-	w.c.dtlsSession, err = dtlsCtx.NewDTLS(w.c.send, w.stunCtx.RAddr, dtls.DtlsRoleServer)
+	w.c.dtlsSession, err = w.dtlsCtx.NewDTLS(w.c.send, w.getStunCtx().RAddr, dtls.DtlsRoleServer, w.remoteFingerprints())
 	if log.OnError(err, "[ error ] could not DTLS link with channel %#v", w.c.send) {
 		return
 	}
@@ -152,19 +192,14 @@ func (w *WebRTCSession) dtlsServerAccept(ctx context.Context) {
 		w.c.dtlsState = DtlsStateFailed
 		return
 	}
-	localSrtp := make([]byte, 30)
-	remoteSrtp := make([]byte, 30)
-	copy(localSrtp[0:16], srtpKeys.LocalKey)
-	copy(localSrtp[16:30], srtpKeys.LocalSalt)
-	copy(remoteSrtp[0:16], srtpKeys.RemoteKey)
-	copy(remoteSrtp[16:30], srtpKeys.RemoteSalt)
+	localSrtp, remoteSrtp := srtpMasterKeys(srtpKeys)
 	log.Infof("[ WEBRTC ] DTLS SRTP localSrtp concat is %#v", localSrtp)
 	//logger.Infof("[ WEBRTC ] DTLS SRTP base64 local key is %s", base64.StdEncoding.EncodeToString(localSrtp))
 	log.Infof("[ WEBRTC ] DTLS SRTP remoteSrtp concat is %#v", remoteSrtp)
 	//logger.Infof("[ WEBRTC ] DTLS SRTP base64 remote key is %s", base64.StdEncoding.EncodeToString(remoteSrtp))*/
 
 	// create SRTP session with keys
-	w.c.srtpSession, err = srtp.Create(remoteSrtp, localSrtp)
+	w.c.srtpSession, err = srtp.Create(srtp.Profile(srtpKeys.Profile), remoteSrtp, localSrtp)
 	if log.OnError(err, "[ STUN ] Could not create SRTP session") {
 		return
 	}
@@ -173,50 +208,88 @@ func (w *WebRTCSession) dtlsServerAccept(ctx context.Context) {
 }
 
 func (w *WebRTCSession) connectListeners(ctx context.Context, ourConn *connection) {
-	log := plogger.FromContextSafe(ctx)
 	room := rooms.Get(ctx, ourConn.roomId)
+	roomMode := room.GetMode(ctx)
+	// MCU: the peers are only received mixed
+	if roomMode == ModeMCU && w.videoMixer != nil {
+		w.connectMixListener(ctx, ourConn)
+		return
+	}
 	// foreach peer in the room excluding ourselves
 	room.Range(ctx, func(i int, peerConn *connection) {
 		if peerConn.socketId == ourConn.socketId {
 			return // exclude ourself
 		}
-		// adding our connection to the listeners list of the peer (we became a listener of the peer)
-		sdpCtx := NewSdpCtx()
-		webRTCSession, err := NewWebRTCSession(ctx, WebRTCModeListener, sdpCtx)
-		if log.OnError(err, "could not create a new WebRTC Session (1)") {
-			return
+		// the peer becomes a listener of us
+		if quality := peerConn.subscription(ourConn.socketId); quality != SubscriptionNone {
+			connectListener(ctx, roomMode, ourConn, peerConn, quality)
+		}
+		// we become a listener of the peer
+		if quality := ourConn.subscription(peerConn.socketId); quality != SubscriptionNone {
+			connectListener(ctx, roomMode, peerConn, ourConn, quality)
 		}
+	})
+}
 
-		peerCodec, _ := peerConn.getPublisherCodec(ctx)
-		sdpCtx.createSdpOffer(ctx, peerCodec, webRTCSession.listenPort)
-		log.Debugf("Setting listener with socketId %s with WebRTCSession %#v on c %s", ourConn.socketId, webRTCSession, peerConn.socketId)
-		cDst := hub.socketIds.Get(ctx, peerConn.socketId)
-		cDst.webRTCSessionListeners.Set(ourConn.socketId, webRTCSession)
-		log.Debugf("------------------------------------")
-		log.Debugf("CONNECT LISTENER SDP OFFER :\n%s", pretty.Formatter(webRTCSession.sdpCtx.offer))
-		log.Debugf("------------------------------------")
+/*
+ * connectListener offer the stream of a publisher to a listener, in the
+ * codec the listener publishes. A previous session is replaced: the peers
+ * publish again after a mode switch.
+ */
+func connectListener(ctx context.Context, roomMode ModeOptions, publisherConn *connection, listenerConn *connection, quality SubscriptionQuality) {
+	log := plogger.FromContextSafe(ctx)
+	sdpCtx := NewSdpCtx(roomMode)
+	webRTCSession, err := NewWebRTCSession(ctx, WebRTCModeListener, sdpCtx)
+	if log.OnError(err, "could not create a new WebRTC Session for %s listening to %s", listenerConn.socketId, publisherConn.socketId) {
+		return
+	}
+	webRTCSession.quality = quality
+
+	listenerCodec, _ := listenerConn.getPublisherCodec(ctx)
+	// SFU: the bitstream forwarded is the one of the publisher
+	sdpCtx.h264ProfileLevelId = publisherConn.getPublisherH264ProfileLevelId()
+	sdpCtx.createSdpOffer(ctx, listenerCodec, webRTCSession.listenPort)
+	log.Debugf("Setting listener with socketId %s with WebRTCSession %#v on c %s", publisherConn.socketId, webRTCSession, listenerConn.socketId)
+	if previous := listenerConn.webRTCSessionListeners.Get(publisherConn.socketId); previous != nil {
+		previous.Disconnect(ctx)
+	}
+	listenerConn.webRTCSessionListeners.Set(publisherConn.socketId, webRTCSession)
 
-		eventExchangeSdp(ctx, ourConn.socketId, ourConn.userId, peerConn.socketId, "offer", webRTCSession.sdpCtx.offer.Write(ctx))
+	log.Debugf("------------------------------------")
+	log.Debugf("CONNECT LISTENER SDP OFFER :\n%s", pretty.Formatter(webRTCSession.sdpCtx.offer))
+	log.Debugf("------------------------------------")
 
-		// adding the peer connection to our peer list (the peer became a listener of us)
-		sdpCtx = NewSdpCtx()
+	eventExchangeSdp(ctx, publisherConn.socketId, publisherConn.userId, listenerConn.socketId, "offer", webRTCSession.sdpCtx.offer.Write(ctx))
+}
 
-		webRTCSession, err = NewWebRTCSession(ctx, WebRTCModeListener, sdpCtx)
-		if logOnError(err, "could not create a new WebRTC Session (2)") {
-			return
-		}
+/*
+ * connectMixListener offer the composition & the audio mix of the other
+ * peers to our connection, sent from the "mix" stream in the codec we
+ * publish
+ */
+func (w *WebRTCSession) connectMixListener(ctx context.Context, ourConn *connection) {
+	log := plogger.FromContextSafe(ctx)
+	sdpCtx := NewSdpCtx(ModeMCU)
+	sdpCtx.mix = true
+	webRTCSession, err := NewWebRTCSession(ctx, WebRTCModeListener, sdpCtx)
+	if log.OnError(err, "could not create a new WebRTC Session (mix)") {
+		return
+	}
+	webRTCSession.videoMixer = w.videoMixer
+	webRTCSession.audioMixer = w.audioMixer
 
-		ourCodec, _ := ourConn.getPublisherCodec(ctx)
-		sdpCtx.createSdpOffer(ctx, ourCodec, webRTCSession.listenPort)
-		log.Debugf("Setting listener with socketId %s with WebRTCSession %#v on c %s", ourConn.socketId, webRTCSession, peerConn.socketId)
-		ourConn.webRTCSessionListeners.Set(peerConn.socketId, webRTCSession)
+	ourCodec, _ := ourConn.getPublisherCodec(ctx)
+	sdpCtx.createSdpOffer(ctx, ourCodec, webRTCSession.listenPort)
+	if previous := ourConn.webRTCSessionListeners.Get(mixStreamName); previous != nil {
+		previous.Disconnect(ctx)
+	}
+	ourConn.webRTCSessionListeners.Set(mixStreamName, webRTCSession)
 
-		log.Debugf("------------------------------------")
-		log.Debugf("CONNECT LISTENER SDP OFFER :\n%s", pretty.Formatter(webRTCSession.sdpCtx.offer))
-		log.Debugf("------------------------------------")
+	log.Debugf("------------------------------------")
+	log.Debugf("CONNECT MIX LISTENER SDP OFFER :\n%s", pretty.Formatter(webRTCSession.sdpCtx.offer))
+	log.Debugf("------------------------------------")
 
-		eventExchangeSdp(ctx, peerConn.socketId, peerConn.userId, ourConn.socketId, "offer", webRTCSession.sdpCtx.offer.Write(ctx))
-	})
+	eventExchangeSdp(ctx, mixStreamName, ``, ourConn.socketId, "offer", webRTCSession.sdpCtx.offer.Write(ctx))
 }
 
 /*
@@ -244,13 +317,26 @@ func (w *WebRTCSession) disconnectListener(ctx context.Context, peerConn *connec
 	}
 }
 
+// listenUdpAddr return a dual-stack address if a public IPv6 is configured,
+// IPv4 clients are then seen with IPv4-mapped IPv6 addresses
+func listenUdpAddr(port int) (string, *net.UDPAddr) {
+	if config.Network.PublicIPV6 != "" {
+		return "udp", &net.UDPAddr{IP: net.IPv6unspecified, Port: port}
+	}
+	return "udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port}
+}
+
 /*
+ * shared: endpoint of the single UDP socket (config.Network.UdpMuxPort)
  * prod: listeUdp on random port
  * dev: listenUdp on port >= DEV_MIN_UDP_PORT && < DEV_MAX_UDP_PORT
  */
-func ListenUdp(ctx context.Context) (*net.UDPConn, error) {
+func ListenUdp(ctx context.Context) (udpSessionConn, error) {
+	if udpMux != nil {
+		return udpMux.NewConn(), nil
+	}
 	if config.StaticPorts == false {
-		return net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+		return net.ListenUDP(listenUdpAddr(0))
 	}
 
 	var udpConn *net.UDPConn
@@ -259,7 +345,7 @@ func ListenUdp(ctx context.Context) (*net.UDPConn, error) {
 
 	for port := DEV_MIN_UDP_PORT; port < DEV_MAX_UDP_PORT; port++ {
 		log.Infof("[ WEBRTC ] try to listen on udp port %d", port)
-		udpConn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: port})
+		udpConn, err = net.ListenUDP(listenUdpAddr(port))
 		if err == nil {
 			return udpConn, nil
 		}
@@ -268,14 +354,14 @@ func ListenUdp(ctx context.Context) (*net.UDPConn, error) {
 }
 
 func NewWebRTCSession(ctx context.Context, webRTCMode WebRTCMode, sdpCtx *SdpContext) (w *WebRTCSession, err error) {
-	var udpConn *net.UDPConn
+	var udpConn udpSessionConn
 
 	udpConn, err = ListenUdp(ctx)
 	if logOnError(err, "[ WEBRTC ] [ error ] could not choose a free UDP port to listen STUN/DTLS/SRTP/RTCP protocols") {
 		err = errors.New("could not listen on UDP with automatic port (0)")
 		return
 	}
-	listenPort, _ := strconv.Atoi(strings.Split(udpConn.LocalAddr().String(), ":")[1])
+	listenPort := udpConn.LocalAddr().(*net.UDPAddr).Port
 
 	var stunMode StunMode
 	if webRTCMode == WebRTCModePublisher {
@@ -286,25 +372,270 @@ func NewWebRTCSession(ctx context.Context, webRTCMode WebRTCMode, sdpCtx *SdpCon
 
 	//loop := gst.MainLoopNew()
 
+	dtlsCtx := dtls.Current()
+	sdpCtx.localFingerprint = dtlsCtx.GetLocalFingerprint()
+
 	w = &WebRTCSession{
 		mode:       webRTCMode,
+		roomMode:   sdpCtx.mode,
 		udpConn:    udpConn,
 		listenPort: listenPort,
+		dtlsCtx:    dtlsCtx,
 		sdpCtx:     sdpCtx,
 		stunCtx:    nil,
 		stunMode:   stunMode,
 		c:          nil,
+		// a single pending renegotiation is enough, the pipeline reads the sdp context
+		renegotiated: make(chan struct{}, 1),
 	}
 
 	return
 }
 
-func (w *WebRTCSession) CreateStunCtx(ctx context.Context) {
-	w.stunCtx = NewStunCtx(ctx, w.udpConn.LocalAddr().String(), w.sdpCtx, w.stunMode)
+func (w *WebRTCSession) CreateStunCtx(ctx context.Context) error {
+	w.setStunCtx(NewStunCtx(ctx, w.udpConn.LocalAddr().String(), w.sdpCtx, w.stunMode))
+	return w.routeUfrag()
+}
+
+// getStunCtx return the current stun context, an ICE restart replaces it
+func (w *WebRTCSession) getStunCtx() *StunContext {
+	w.stunCtxMutex.RLock()
+	defer w.stunCtxMutex.RUnlock()
+	return w.stunCtx
+}
+
+func (w *WebRTCSession) setStunCtx(stunCtx *StunContext) {
+	w.stunCtxMutex.Lock()
+	defer w.stunCtxMutex.Unlock()
+	w.stunCtx = stunCtx
+}
+
+// shared socket: connectivity checks are routed by our local ufrag
+func (w *WebRTCSession) routeUfrag() error {
+	if c, ok := w.udpConn.(*udpMuxConn); ok {
+		return c.SetUfrag(w.getStunCtx().iceUfragLocal)
+	}
+	return nil
+}
+
+/*
+ * Renegotiate answer a new offer on an established publisher session.
+ * UDP socket, DTLS & SRTP are kept, the pipeline is notified to rebuild
+ * the nodes depending on ssrcs & payload types. New remote ICE
+ * credentials in the offer trigger an ICE restart.
+ */
+func (w *WebRTCSession) Renegotiate(ctx context.Context, offer *sdp.SDP) (sdpAnswer string, err error) {
+	log := plogger.FromContextSafe(ctx).Prefix("WebRTC").Tag("webrtc-session")
+
+	if w.mode != WebRTCModePublisher {
+		err = errors.New("only publisher sessions could be renegotiated with a remote offer")
+		return
+	}
+	codec, ok := w.getCodec(ctx)
+	if !ok {
+		err = errors.New("could not find the codec of the current session")
+		return
+	}
+	// the session keeps reading the current exchange while the new offer
+	// is answered
+	next := w.sdpCtx.renegotiationCtx(offer)
+	sdpAnswer, err = next.answerSDP(ctx, codec, w.listenPort)
+	if err != nil {
+		return
+	}
+	if newCodec, _ := answerCodec(ctx, next.answer); newCodec != codec {
+		err = errors.New(fmt.Sprintf("codec change (%d -> %d) is not supported", codec, newCodec))
+		return
+	}
+	w.sdpCtx.setNegotiated(next)
+	log.Infof("publisher renegotiated, session version is now %d", next.answer.Data.Origin.SessionVersion)
+	if w.getStunCtx().credentialsChanged(w.sdpCtx) {
+		w.restartICE(ctx)
+	}
+	select {
+	case w.renegotiated <- struct{}{}:
+	default:
+		log.Infof("a renegotiation is already pending")
+	}
+
+	return
+}
+
+/*
+ * send a new offer to every listener of our publisher stream
+ * (sessions created by connectListeners on the other peers)
+ */
+func (w *WebRTCSession) reofferListeners(ctx context.Context, ourConn *connection) {
+	log := plogger.FromContextSafe(ctx)
+	room := rooms.Get(ctx, ourConn.roomId)
+	if room == nil {
+		return
+	}
+	room.Range(ctx, func(i int, peerConn *connection) {
+		if peerConn.socketId == ourConn.socketId {
+			return // exclude ourself
+		}
+		webRTCSession := peerConn.webRTCSessionListeners.Get(ourConn.socketId)
+		if webRTCSession == nil {
+			return
+		}
+		sdpOffer, err := webRTCSession.sdpCtx.reofferSDP(ctx, false)
+		if log.OnError(err, "could not re-offer listener %s of %s", peerConn.socketId, ourConn.socketId) {
+			return
+		}
+		eventExchangeSdp(ctx, ourConn.socketId, ourConn.userId, peerConn.socketId, "offer", sdpOffer)
+	})
+}
+
+/*
+ * SetAnswer save the answer of a listener to one of our re-offers,
+ * restarting ICE if the credentials changed
+ */
+func (w *WebRTCSession) SetAnswer(ctx context.Context, answer *sdp.SDP) {
+	w.sdpCtx.setAnswer(answer)
+	if w.getStunCtx().credentialsChanged(w.sdpCtx) {
+		w.restartICE(ctx)
+	}
+}
+
+/*
+ * ICE restart: a new stun context replaces the current one, it receives the
+ * connectivity checks of the new credentials while the media keeps flowing
+ * to the previous remote address until a new one is validated.
+ */
+func (w *WebRTCSession) restartICE(ctx context.Context) {
+	log := plogger.FromContextSafe(ctx).Prefix("WebRTC").Tag("webrtc-session")
+
+	previous := w.getStunCtx()
+	stunCtx := NewStunCtxRestart(ctx, w.udpConn.LocalAddr().String(), w.sdpCtx, previous)
+	if w.c != nil {
+		// consent must keep being checked even if the new path never answers
+		stunCtx.monitorStarted = true
+		go stunCtx.monitorRTT(ctx, w.c)
+		go stunCtx.connectivityChecks(ctx, w.c)
+	}
+	w.setStunCtx(stunCtx)
+	log.OnError(w.routeUfrag(), "could not route the connectivity checks of the ICE restart")
+	previous.Close()
+	log.Infof("ICE restart, local ufrag %s, remote ufrag %s", stunCtx.iceUfragLocal, stunCtx.iceUfragRemote)
+}
+
+/*
+ * called by the state managers once the stun context of an ICE restart is
+ * completed: DTLS & media writes are moved to the new remote address
+ */
+func (w *WebRTCSession) iceRestarted(ctx context.Context) {
+	log, _ := plogger.FromContext(ctx)
+
+	rAddr := w.getStunCtx().RAddr
+	w.c.SetRAddr(rAddr)
+	if w.c.dtlsSession != nil {
+		w.c.dtlsSession.SetRAddr(rAddr)
+	}
+	if m := w.getPublisherMedia(); m != nil {
+		m.jitterBufferVideo.SetRaddr(ctx, rAddr)
+		m.jitterBufferAudio.SetRaddr(ctx, rAddr)
+		// packets were lost during the network change
+		m.jitterBufferVideo.SendPLI()
+	}
+	log.Infof("ICE restart completed, media now flowing to %s", rAddr)
+}
+
+/*
+ * name of the stream carried by the session, as seen by its owner:
+ * "publisher" or the socketId of the listened publisher
+ */
+func (w *WebRTCSession) streamName() string {
+	if w.mode == WebRTCModeListener && w.videoMixer != nil {
+		return mixStreamName
+	}
+	if w.mode == WebRTCModePublisher || w.webRTCSessionPublisher == nil {
+		return `publisher`
+	}
+	return w.webRTCSessionPublisher.c.wsConn.socketId
+}
+
+/*
+ * called by the state managers on consent freshness changes, the owner &
+ * the room are notified. A failed media path tears down the session.
+ */
+func (w *WebRTCSession) consentStateChanged(ctx context.Context, stunState StunState) {
+	log, _ := plogger.FromContext(ctx)
+
+	var state string
+	switch stunState {
+	case StunStateConnected:
+		state = "connected"
+	case StunStateDisconnected:
+		state = "disconnected"
+	case StunStateFailed:
+		state = "failed"
+	default:
+		return
+	}
+	ourConn := w.c.wsConn
+	stream := w.streamName()
+	log.Infof("peer connection %s of %s is %s", stream, ourConn.socketId, state)
+	eventPeerConnectionState(ctx, ourConn.socketId, ourConn.userId, ourConn.roomId, stream, state)
+	if stunState != StunStateFailed {
+		return
+	}
+
+	if w.mode == WebRTCModePublisher {
+		// nobody can listen to a dead publisher
+		room := rooms.Get(ctx, ourConn.roomId)
+		if room != nil {
+			room.Range(ctx, func(i int, peerConn *connection) {
+				webRTCSession := peerConn.webRTCSessionListeners.Get(ourConn.socketId)
+				if webRTCSession != nil {
+					peerConn.webRTCSessionListeners.Del(ourConn.socketId)
+					webRTCSession.Disconnect(ctx)
+				}
+			})
+		}
+		// the client could publish again with a new offer
+		ourConn.negoSdpMutex.Lock(ctx)
+		if ourConn.webRTCSessionPublisher == w {
+			ourConn.webRTCSessionPublisher = nil
+		}
+		ourConn.negoSdpMutex.Unlock(ctx)
+	} else if ourConn.webRTCSessionListeners.Get(stream) == w {
+		ourConn.webRTCSessionListeners.Del(stream)
+	}
+	w.Disconnect(ctx)
+}
+
+/*
+ * server initiated ICE restart of the listener sessions of a connection,
+ * the new offers are sent on behalf of each publisher
+ */
+func restartListenersICE(ctx context.Context, ourConn *connection) {
+	log := plogger.FromContextSafe(ctx)
+	room := rooms.Get(ctx, ourConn.roomId)
+	if room == nil {
+		return
+	}
+	room.Range(ctx, func(i int, peerConn *connection) {
+		if peerConn.socketId == ourConn.socketId {
+			return // exclude ourself
+		}
+		webRTCSession := ourConn.webRTCSessionListeners.Get(peerConn.socketId)
+		if webRTCSession == nil || webRTCSession.getStunCtx() == nil {
+			return
+		}
+		sdpOffer, err := webRTCSession.sdpCtx.reofferSDP(ctx, true)
+		if log.OnError(err, "could not restart ICE of listener %s of %s", ourConn.socketId, peerConn.socketId) {
+			return
+		}
+		eventExchangeSdp(ctx, peerConn.socketId, peerConn.userId, ourConn.socketId, "offer", sdpOffer)
+	})
 }
 
 func (w *WebRTCSession) Disconnect(ctx context.Context) {
 	w.disconnected = true
+	if stunCtx := w.getStunCtx(); stunCtx != nil {
+		stunCtx.Close()
+	}
 	if w.ctxCancel != nil {
 		w.ctxCancel()
 		return
@@ -331,11 +662,16 @@ func (w *WebRTCSession) serveWebRTC(ctx context.Context, wsConn *connection, web
 	w.c = connUdp
 
 	go connUdp.writePump(ctx)
+	go w.getStunCtx().connectivityChecks(ctx, connUdp)
 
 	codec, _ := wsConn.getPublisherCodec(ctx)
 	log.Warnf("CODEC IS %d", codec)
 	if w.mode == WebRTCModePublisher {
 		w.serveWebRTCPublisher(ctx, codec)
+		if w.videoMixer != nil && w.c.gstSession != nil {
+			w.videoMixer.RemovePublisher(w.c.gstSession)
+			w.audioMixer.RemovePublisher(w.c.gstSession)
+		}
 	} else {
 		w.serveWebRTCListener(ctx, codec, webRTCSessionPublisher)
 	}
@@ -347,6 +683,13 @@ func (w *WebRTCSession) serveWebRTC(ctx context.Context, wsConn *connection, web
 	return err
 }
 
+// negotiatedAnswer return the answer of the current exchange, a re-offer
+// answer replaces it
+func (w *WebRTCSession) negotiatedAnswer() *sdp.SDP {
+	_, answer := w.sdpCtx.Negotiated()
+	return answer
+}
+
 func (w *WebRTCSession) getCodec(ctx context.Context) (codecOption CodecOptions, ok bool) {
 	codecOption = 0
 	ok = false
@@ -357,10 +700,17 @@ func (w *WebRTCSession) getCodec(ctx context.Context) (codecOption CodecOptions,
 			return CodecVP8, true
 		case "H264":
 			return CodecH264, true
+		case "VP9":
+			return CodecVP9, true
 		}
 	}
 
-	sdpAnswer := w.sdpCtx.answer
+	_, sdpAnswer := w.sdpCtx.Negotiated()
+	return answerCodec(ctx, sdpAnswer)
+}
+
+// answerCodec return the video codec of an answer
+func answerCodec(ctx context.Context, sdpAnswer *sdp.SDP) (codecOption CodecOptions, ok bool) {
 	if sdpAnswer == nil {
 		return
 	}
@@ -372,7 +722,8 @@ func (w *WebRTCSession) getCodec(ctx context.Context) (codecOption CodecOptions,
 	videoRtpMap := firstMediaVideo.RtpMap
 	var codecStr string
 	for _, rtp := range videoRtpMap {
-		if rtp.Codec != "rtx" {
+		// skip the retransmission & redundancy formats
+		if rtp.Codec != "rtx" && rtp.Codec != "red" && rtp.Codec != "ulpfec" {
 			codecStr = rtp.Codec
 			break
 		}
@@ -385,6 +736,9 @@ func (w *WebRTCSession) getCodec(ctx context.Context) (codecOption CodecOptions,
 	case "VP8":
 		codecOption = CodecVP8
 		ok = true
+	case "VP9":
+		codecOption = CodecVP9
+		ok = true
 	default:
 		log := plogger.FromContextSafe(ctx).Prefix("WebRTC").Tag("webrtc-session")
 		log.Errorf("found unknown codec string '%v' in session's SDP answer %#v", codecStr, videoRtpMap)
@@ -395,18 +749,19 @@ func (w *WebRTCSession) getCodec(ctx context.Context) (codecOption CodecOptions,
 
 // JSON marshaling
 type jsonWebRTCSession struct {
-	Mode                   string       `json:"mode"`
-	ListenPort             int          `json:"listenPort"`
-	CodecName              string       `json:"codecName"`
-	SsrcId                 uint32       `json:"ssrcId"`
-	PayloadType            uint16       `json:"payloadType"`
-	RtxPayloadType         uint16       `json:"rtxPayloadType"`
-	ClockRate              uint32       `json:"clockRate"`
-	StunCtx                *StunContext `json:"stunCtx"`
-	SdpCtx                 *SdpContext  `json:"sdpCtx"`
-	LastRembs              []int        `json:"lastRembs"`
-	LastEncodingBitrate    []int        `json:"lastEncodingBitrate"`
-	LastBandwidthEstimates []uint64     `json:"lastBandwidthEstimates"`
+	Mode                   string                     `json:"mode"`
+	ListenPort             int                        `json:"listenPort"`
+	CodecName              string                     `json:"codecName"`
+	SsrcId                 uint32                     `json:"ssrcId"`
+	PayloadType            uint16                     `json:"payloadType"`
+	RtxPayloadType         uint16                     `json:"rtxPayloadType"`
+	ClockRate              uint32                     `json:"clockRate"`
+	StunCtx                *StunContext               `json:"stunCtx"`
+	SdpCtx                 *SdpContext                `json:"sdpCtx"`
+	LastRembs              []int                      `json:"lastRembs"`
+	LastEncodingBitrate    []int                      `json:"lastEncodingBitrate"`
+	LastBandwidthEstimates []uint64                   `json:"lastBandwidthEstimates"`
+	RtxStats               []*PipelineMessageRtxStats `json:"rtxStats"`
 }
 
 func newJsonWebRTCSession(w *WebRTCSession) jsonWebRTCSession {
@@ -425,12 +780,15 @@ func newJsonWebRTCSession(w *WebRTCSession) jsonWebRTCSession {
 			codecName = "VP8"
 		case CodecH264:
 			codecName = "H264"
+		case CodecVP9:
+			codecName = "VP9"
 		}
-		ssrcId = w.sdpCtx.offer.GetVideoSSRC()
-		if w.sdpCtx.answer != nil {
-			payloadType = w.sdpCtx.answer.GetVideoPayloadType(codecName)
-			rtxPayloadType = w.sdpCtx.answer.GetRtxPayloadType(codecName)
-			clockRate = w.sdpCtx.answer.GetVideoClockRate(codecName)
+		offer, answer := w.sdpCtx.Negotiated()
+		ssrcId = offer.GetVideoSSRC()
+		if answer != nil {
+			payloadType = answer.GetVideoPayloadType(codecName)
+			rtxPayloadType = answer.GetRtxPayloadType(codecName)
+			clockRate = answer.GetVideoClockRate(codecName)
 		}
 	}
 
@@ -442,11 +800,12 @@ func newJsonWebRTCSession(w *WebRTCSession) jsonWebRTCSession {
 		payloadType,
 		rtxPayloadType,
 		clockRate,
-		w.stunCtx,
+		w.getStunCtx(),
 		w.sdpCtx,
 		w.lastRembs,
 		w.lastEncodingBitrate,
 		w.lastBandwidthEstimates,
+		w.rtxStats,
 	}
 }
 
@@ -36,17 +36,21 @@ func (w *WebRTCSession) listenerStateManager(ctx context.Context, vSsrcId uint32
 	log := plogger.FromContextSafe(ctx).Prefix("STATE-MANAGER").Tag("webrtcsession-listener")
 	ctx = plogger.NewContext(ctx, log)
 
-	if webRTCSessionPublisher == nil {
+	if webRTCSessionPublisher == nil && w.videoMixer == nil {
 		log.Warnf("webRTCSessionPublisher is nil, session disconnected ?")
 		return
 	}
+	if webRTCSessionPublisher != nil && webRTCSessionPublisher.roomMode != w.roomMode {
+		log.Warnf("publisher session is in %s mode, listener in %s mode, the room is switching ?", webRTCSessionPublisher.roomMode, w.roomMode)
+		return
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Debugf("LISTENER CTX DONE")
 			return
-		case stunState := <-w.stunCtx.ChState:
+		case stunState := <-w.getStunCtx().ChState:
 			log.Debugf("stunState %v", stunState)
 			//
 			if stunState == StunStateCompleted {
@@ -54,15 +58,22 @@ func (w *WebRTCSession) listenerStateManager(ctx context.Context, vSsrcId uint32
 
 				var err error
 				// Create DTLS Server attached to the listen port
-				log.Infof("Running DTLS server connection for video/audio on port %d, waiting for connection from %s:%d", w.listenPort, w.stunCtx.RAddr.IP.String(), w.stunCtx.RAddr.Port)
+				log.Infof("Running DTLS server connection for video/audio on port %d, waiting for connection from %s:%d", w.listenPort, w.getStunCtx().RAddr.IP.String(), w.getStunCtx().RAddr.Port)
 				w.dtlsServerAccept(ctx)
+				w.c.SetRAddr(w.getStunCtx().RAddr)
 
 				// HOOKING
 				log.Infof("listener: PUSHING SRTP SESSION INTO nodeSRTP")
 				nodeSRTP.SetSession(ctx, w.c.srtpSession)
 
+				if w.videoMixer != nil {
+					// the composition & the mix are already encoded
+					log.Infof("connection is up, sending WebRTC up event")
+					eventWebrtcUp(ctx, mixStreamName, ``, w.c.wsConn.socketId)
+					continue
+				}
 				codec, _ := w.c.wsConn.getPublisherCodec(ctx)
-				w.c.gstSession, err = CreateEncoder(ctx, codec, w.c, gstreamerAudioOutput, gstreamerVideoOutput, webRTCSessionPublisher.c.gstSession, w.stunCtx.RAddr, vSsrcId, aSsrcId, w.GetMaxVideoBitrate())
+				w.c.gstSession, err = CreateEncoder(ctx, codec, w.c, gstreamerAudioOutput, gstreamerVideoOutput, webRTCSessionPublisher.c.gstSession, w.getStunCtx().RAddr, vSsrcId, aSsrcId, w.GetMaxVideoBitrate(), getFecOptions(w.negotiatedAnswer()), w.roomMode)
 				if err != nil {
 					log.Errorf("could not create encoder: %#v", err)
 					return
@@ -74,6 +85,10 @@ func (w *WebRTCSession) listenerStateManager(ctx context.Context, vSsrcId uint32
 				eventWebrtcUp(ctx, webRTCSessionPublisher.c.wsConn.socketId, webRTCSessionPublisher.c.wsConn.userId, w.c.wsConn.socketId)
 				log.Infof("running bus message management")
 			}
+			if stunState == StunStateRestarted {
+				w.iceRestarted(ctx)
+			}
+			w.consentStateChanged(ctx, stunState)
 		}
 	}
 }
@@ -84,7 +99,6 @@ func (w *WebRTCSession) listenerStateManager(ctx context.Context, vSsrcId uint32
 func (w *WebRTCSession) listenerBusManager(ctx context.Context, gstInPipeline, gstOutPipeline *Pipeline) {
 	log := plogger.FromContextSafe(ctx).Prefix("BUS").Tag("webrtcsession-listener")
 	ctx = plogger.NewContext(ctx, log)
-	lastFractionPacketLost := uint8(0)
 	log.Infof("start")
 	//pipeleNodeJitterBufferAudio := gstOutPipeline.Get("jitteraudio").(*PipelineNodeJitterListener)
 	pipeleNodeJitterBufferVideo := gstOutPipeline.Get("jittervideo").(*PipelineNodeJitterListener)
@@ -103,64 +117,53 @@ func (w *WebRTCSession) listenerBusManager(ctx context.Context, gstInPipeline, g
 				log.Infof("PipelineMessageStop")
 			case *RtcpContextInfoRemb:
 				log.Infof("[ LISTENER ] REMB %d", e.Remb)
-				// saving remb received
+				// saving bitrate target
 				w.lastRembs = append(w.lastRembs, e.Remb)
 				if len(w.lastRembs) > 50 {
 					w.lastRembs = w.lastRembs[1:51]
 				}
-				// using remb
-				//videoBitrate := e.Remb - w.c.gstSession.GetAudioBitrate()
-				// 1 / 256 * packetLostFraction == packet loss rate (0.00 -> 1.00)
-				packetLossRate := (float64(1) / float64(256)) * float64(lastFractionPacketLost)
-				videoBitrate := w.c.gstSession.GetVideoEncodingBitrate()
-				if packetLossRate < 0.02 {
-					videoBitrate = int(float64(e.Remb) * float64(1.1))
+				if w.simulcastForwarder != nil {
+					w.simulcastForwarder.SetEstimate(e.Remb)
 				}
-				if packetLossRate > 0.1 {
-					videoBitrate = int(float64(e.Remb) * (float64(1) - float64(0.5)*packetLossRate))
+				// the bitrate controller corrected the remb with the packet loss
+				w.lastEncodingBitrate = append(w.lastEncodingBitrate, e.Remb)
+				if len(w.lastEncodingBitrate) > 50 {
+					w.lastEncodingBitrate = w.lastEncodingBitrate[1:51]
 				}
-				if videoBitrate > e.Remb {
-					videoBitrate = e.Remb
-				}
-				log.Warnf("PACKET LOSS RATE IS %f -- REMB IS %d -- REMB CORRECTED VIDEOBITRATE IS %d", packetLossRate, e.Remb, videoBitrate)
-				if videoBitrate >= config.Bitrates.Video.Min && videoBitrate <= config.Bitrates.Video.Max {
-					// changing bitrate
-					w.lastEncodingBitrate = append(w.lastEncodingBitrate, videoBitrate)
-					if len(w.lastEncodingBitrate) > 50 {
-						w.lastEncodingBitrate = w.lastEncodingBitrate[1:51]
-					}
-					/*videoBitrate -= config.Bitrates.Audio.Max
-					if videoBitrate < 32000 {
-						videoBitrate = 32000
-					}*/
-					w.c.gstSession.SetEncodingVideoBitrate(videoBitrate)
-				} else {
-					// keeping bitrate
-					currentEncodingBitrate := int(config.Bitrates.Video.Start)
-					if len(w.lastEncodingBitrate) > 0 {
-						currentEncodingBitrate = w.lastEncodingBitrate[len(w.lastEncodingBitrate)-1]
-					}
-					w.lastEncodingBitrate = append(w.lastEncodingBitrate, currentEncodingBitrate)
-					if len(w.lastEncodingBitrate) > 50 {
-						w.lastEncodingBitrate = w.lastEncodingBitrate[1:51]
-					}
+				if w.videoMixer != nil {
+					codec, _ := w.c.wsConn.getPublisherCodec(ctx)
+					w.videoMixer.SetEstimate(codec, w.simulcastForwarder, e.Remb)
+					break
 				}
+				w.c.gstSession.SetEncodingVideoBitrate(e.Remb)
 			case *RtcpContextInfoFIR:
 				log.Infof("RtcpContextInfoFIR")
-				switch config.Mode {
-				case ModeMCU:
+				switch {
+				case w.videoMixer != nil:
+					w.simulcastForwarder.RequestKeyFrame()
+				case w.roomMode == ModeMCU:
 					w.c.gstSession.ForceKeyFrame()
-				case ModeSFU:
+				case w.roomMode == ModeSFU:
+					if w.simulcastForwarder != nil {
+						w.simulcastForwarder.RequestKeyFrame()
+						break
+					}
 					nodeVideo := w.webRTCSessionPublisher.p.Get("jittervideo").(*PipelineNodeJitterPublisher)
 					nodeVideo.SendFIR()
 					log.Infof("Reforward RTCP FIR with a RTCP PLI to the publisher XXX to be changed by a real FIR")
 				}
 			case *rtcp.PacketPSFBPli:
 				log.Infof("PacketPSFBPli")
-				switch config.Mode {
-				case ModeMCU:
+				switch {
+				case w.videoMixer != nil:
+					w.simulcastForwarder.RequestKeyFrame()
+				case w.roomMode == ModeMCU:
 					w.c.gstSession.ForceKeyFrame()
-				case ModeSFU:
+				case w.roomMode == ModeSFU:
+					if w.simulcastForwarder != nil {
+						w.simulcastForwarder.RequestKeyFrame()
+						break
+					}
 					nodeVideo := w.webRTCSessionPublisher.p.Get("jittervideo").(*PipelineNodeJitterPublisher)
 					nodeVideo.SendPLI()
 					log.Infof("Reforward RTCP PLI to the publisher")
@@ -173,13 +176,8 @@ func (w *WebRTCSession) listenerBusManager(ctx context.Context, gstInPipeline, g
 					go pipeleNodeJitterBufferVideo.SendRTX(n.GetSequences(), ssrc)
 				}
 			case *rtcp.PacketRR:
-				ssrc := w.sdpCtx.offer.GetVideoSSRC()
-				for _, rb := range e.ReportBlocks {
-					if rb.SSRC == ssrc {
-						lastFractionPacketLost = rb.FractionLost
-						//w.c.gstSession.AddJitterStat(rb.Jitter)
-					}
-				}
+				// used by the bitrate controller too
+				w.setEncodingPacketLoss(e)
 			case *PipelineMessageInBps:
 				// skip
 			case *PipelineMessageOutBps:
@@ -202,11 +200,73 @@ func (w *WebRTCSession) listenerBusManager(ctx context.Context, gstInPipeline, g
 	}
 }
 
+// setEncodingPacketLoss adapt the redundancy of the encoder to the losses
+// reported by the listener
+func (w *WebRTCSession) setEncodingPacketLoss(packet *rtcp.PacketRR) {
+	if w.c.gstSession == nil {
+		return
+	}
+	var videoLossRate, audioLossRate float64
+	for _, rb := range packet.ReportBlocks {
+		switch rb.SSRC {
+		case w.sdpCtx.offer.GetVideoSSRC():
+			videoLossRate = float64(rb.FractionLost) / 256
+		case w.sdpCtx.offer.GetAudioSSRC():
+			audioLossRate = float64(rb.FractionLost) / 256
+		}
+	}
+	w.c.gstSession.SetEncodingPacketLoss(videoLossRate, audioLossRate)
+}
+
+// SetVideoForwarded pause or resume the video of the publisher (last-N),
+// the audio continues
+func (w *WebRTCSession) SetVideoForwarded(forwarded bool) {
+	w.subscriptionMutex.Lock()
+	defer w.subscriptionMutex.Unlock()
+	w.lastNPaused = !forwarded
+	w.applySubscription()
+}
+
+// SetQuality change the quality of the subscription to the publisher
+func (w *WebRTCSession) SetQuality(quality SubscriptionQuality) {
+	w.subscriptionMutex.Lock()
+	defer w.subscriptionMutex.Unlock()
+	w.quality = quality
+	w.applySubscription()
+}
+
+// GetQuality return the quality of the subscription & true if it is
+// applied by a forwarder, without renegotiation
+func (w *WebRTCSession) GetQuality() (quality SubscriptionQuality, forwarded bool) {
+	w.subscriptionMutex.Lock()
+	defer w.subscriptionMutex.Unlock()
+	return w.quality, w.simulcastForwarder != nil
+}
+
+// applySubscription configure the forwarder: the video is paused by
+// last-N or an audio only subscription, low keeps the first layer.
+// subscriptionMutex must be held
+func (w *WebRTCSession) applySubscription() {
+	if w.mode != WebRTCModeListener || w.simulcastForwarder == nil || w.videoMixer != nil {
+		return
+	}
+	if w.quality == SubscriptionLow {
+		w.simulcastForwarder.SetMaxLayer(0)
+	} else {
+		w.simulcastForwarder.SetMaxLayer(-1)
+	}
+	if w.lastNPaused || w.quality == SubscriptionAudio {
+		w.simulcastForwarder.Pause()
+	} else {
+		w.simulcastForwarder.Resume()
+	}
+}
+
 func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption CodecOptions, webRTCSessionPublisher *WebRTCSession) {
 	log := plogger.FromContextSafe(ctx).Prefix("LISTENER").Tag("webrtcsession-listener")
 	ctx = plogger.NewContext(ctx, log)
 
-	if webRTCSessionPublisher == nil {
+	if webRTCSessionPublisher == nil && w.videoMixer == nil {
 		log.Warnf("webRTCSessionPublisher is nil, session is disconnected ?")
 		return
 	}
@@ -241,6 +301,13 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 			rtxPayloadType: w.sdpCtx.offer.GetRtxPayloadType("H264"),
 			clockRate:      w.sdpCtx.offer.GetVideoClockRate("H264"),
 		}
+	case CodecVP9:
+		video = RtpInfo{
+			ssrcId:         w.sdpCtx.offer.GetVideoSSRC(),
+			payloadType:    w.sdpCtx.offer.GetVideoPayloadType("VP9"),
+			rtxPayloadType: w.sdpCtx.offer.GetRtxPayloadType("VP9"),
+			clockRate:      w.sdpCtx.offer.GetVideoClockRate("VP9"),
+		}
 	}
 
 	audio = RtpInfo{
@@ -270,6 +337,9 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 	nodeDemux := NewPipelineNodeDemux()
 	nodeSRTP := NewPipelineNodeSRTP()
 	nodeRTCP := NewPipelineNodeRTCP()
+	// the controller name is checked by the config
+	controller, _ := NewBitrateController(config.Bitrates.Controller, config.Bitrates.Video)
+	nodeRTCP.SetBitrateController(controller, video.ssrcId, w.getStunCtx().rtt)
 
 	gstInPipeline.Register("udp", nodeUDP)
 	gstInPipeline.Register("demux", nodeDemux)
@@ -280,8 +350,11 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 	// gstOut pipeline nodes
 	gstOutPipeline := NewPipeline()
 	// XXX FIX FIX FIX rtx payload type is not +1, it depends of the codec, should fix like publisher
-	nodeJitterBufferVideo := NewPipelineNodeJitterListener(ctx, codecOption, video.payloadType, video.payloadType+1, video.clockRate, video.ssrcId, rtx.ssrcId, JitterStreamVideo, config.Bitrates.Video, w.stunCtx.rtt)
-	nodeJitterBufferAudio := NewPipelineNodeJitterListener(ctx, codecOption, audio.payloadType, video.payloadType+1, audio.clockRate, audio.ssrcId, rtx.ssrcId, JitterStreamAudio, config.Bitrates.Audio, w.stunCtx.rtt)
+	nodeJitterBufferVideo := NewPipelineNodeJitterListener(ctx, codecOption, video.payloadType, video.payloadType+1, video.clockRate, video.ssrcId, rtx.ssrcId, JitterStreamVideo, config.Bitrates.Video, w.getStunCtx().rtt)
+	nodeJitterBufferAudio := NewPipelineNodeJitterListener(ctx, codecOption, audio.payloadType, video.payloadType+1, audio.clockRate, audio.ssrcId, rtx.ssrcId, JitterStreamAudio, config.Bitrates.Audio, w.getStunCtx().rtt)
+	if fec := getFecOptions(w.negotiatedAnswer()); w.roomMode == ModeMCU && fec.Enabled() {
+		nodeJitterBufferVideo.SetRed(fec)
+	}
 	nodeUdpSink := NewPipelineNodeUDPSink(w.c)
 	nodeReporterSRVideo := NewPipelineNodeRTCPReporterSR(video.ssrcId, video.clockRate)
 
@@ -294,6 +367,55 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 	gstreamerAudioOutput := make(chan *srtp.PacketRTP, 1000)
 	gstreamerVideoOutput := make(chan *srtp.PacketRTP, 1000)
 
+	// simulcast publisher: the video is forwarded from one of its layers,
+	// instead of the gstreamer output. VP8 temporal layers can only be
+	// dropped if the publisher packets are forwarded too, last-N & the
+	// subscriptions pause the forwarded video.
+	var simulcastVideoOutput chan *srtp.PacketRTP
+	room := rooms.Get(ctx, w.c.wsConn.roomId)
+	quality, _ := w.GetQuality()
+	if w.roomMode == ModeSFU && webRTCSessionPublisher.simulcast != nil &&
+		(webRTCSessionPublisher.simulcast.Enabled() || (config.Sfu.ForwardRTP && codecOption == CodecVP8) ||
+			(room != nil && room.GetLastN(ctx) > 0) || !w.c.wsConn.autoSubscribe || quality != SubscriptionHigh) {
+		forwarder := NewSimulcastForwarder(ctx, codecOption, video.ssrcId, video.payloadType, video.clockRate)
+		webRTCSessionPublisher.simulcast.Subscribe(forwarder)
+		defer webRTCSessionPublisher.simulcast.Unsubscribe(forwarder)
+		simulcastVideoOutput = forwarder.Out
+		forwarded := room == nil || room.IsVideoForwarded(ctx, webRTCSessionPublisher.c.wsConn.socketId)
+		w.subscriptionMutex.Lock()
+		w.simulcastForwarder = forwarder
+		w.lastNPaused = !forwarded
+		w.applySubscription()
+		w.subscriptionMutex.Unlock()
+	}
+	// MCU composition, forwarded from the encoder of our codec
+	if w.videoMixer != nil {
+		w.subscriptionMutex.Lock()
+		w.simulcastForwarder = NewSimulcastForwarder(ctx, codecOption, video.ssrcId, video.payloadType, video.clockRate)
+		w.subscriptionMutex.Unlock()
+		err := w.videoMixer.Subscribe(codecOption, w.simulcastForwarder)
+		if log.OnError(err, "could not subscribe to the composition of the room") {
+			return
+		}
+		defer w.videoMixer.Unsubscribe(codecOption, w.simulcastForwarder)
+		simulcastVideoOutput = w.simulcastForwarder.Out
+	}
+	// MCU mix of the other peers, without our own voice
+	var mixAudioOutput chan *srtp.PacketRTP
+	if w.audioMixer != nil {
+		var exclude *GstSession
+		if publisher := w.c.wsConn.webRTCSessionPublisher; publisher != nil && publisher.c != nil {
+			exclude = publisher.c.gstSession
+		}
+		audioForwarder := NewSimulcastForwarder(ctx, CodecNone, audio.ssrcId, audio.payloadType, audio.clockRate)
+		err := w.audioMixer.Subscribe(exclude, audioForwarder)
+		if log.OnError(err, "could not subscribe to the audio mix of the room") {
+			return
+		}
+		defer w.audioMixer.Unsubscribe(exclude, audioForwarder)
+		mixAudioOutput = audioForwarder.Out
+	}
+
 	go w.listenerStateManager(ctx,
 		video.ssrcId, audio.ssrcId, rtx.ssrcId, nodeSRTP, webRTCSessionPublisher,
 		gstreamerAudioOutput, gstreamerVideoOutput)
@@ -349,10 +471,11 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 			 */
 			case packetSTUN := <-nodeDemux.OutPacketSTUN:
 				log.Debugf("packetSTUN START")
-				if w.stunCtx == nil {
+				stunCtx := w.getStunCtx()
+				if stunCtx == nil {
 					log.Errorf("[ UDP ] could not found stun session for local address %s", w.c.conn.LocalAddr().String())
 				} else {
-					if err := w.stunCtx.handleStunMessage(ctx, w.c, packetSTUN); err != nil {
+					if err := stunCtx.handleStunMessage(ctx, w.c, packetSTUN); err != nil {
 						rAddr := packetSTUN.GetRAddr()
 						log.Errorf("could not handle STUN message for %s:%d : %s", rAddr.IP, rAddr.Port, err.Error())
 						log.Errorf("dropping STUN packet silentely")
@@ -378,9 +501,11 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 	}()
 
 	// Sending FIR to the publisher to start with a key frame
-	nodeVideo := w.webRTCSessionPublisher.p.Get("jittervideo").(*PipelineNodeJitterPublisher)
-	log.Infof("Sending FIR")
-	nodeVideo.SendFIR()
+	if w.webRTCSessionPublisher != nil {
+		nodeVideo := w.webRTCSessionPublisher.p.Get("jittervideo").(*PipelineNodeJitterPublisher)
+		log.Infof("Sending FIR")
+		nodeVideo.SendFIR()
+	}
 
 	func() {
 		log := log.Prefix("Pipeline").Prefix("GSTOUT")
@@ -405,7 +530,17 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 					log.Warnf("nodeJitterBufferAudio.In is full, dropping packet from gstreamerAudioOutput")
 				}
 				log.Debugf("nodeJitterBufferAudio.In FINISHED")
+			case packet := <-mixAudioOutput:
+				select {
+				case nodeJitterBufferAudio.In <- packet:
+				default:
+					log.Warnf("nodeJitterBufferAudio.In is full, dropping packet from mixAudioOutput")
+				}
 			case packet := <-gstreamerVideoOutput:
+				if w.simulcastForwarder != nil {
+					// skip, video comes from simulcastVideoOutput
+					break
+				}
 				log.Debugf("nodeJitterBufferVideo.In START")
 				select {
 				case nodeJitterBufferVideo.In <- packet:
@@ -420,6 +555,19 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 					log.Warnf("nodeReporterSRVideo.In is full, dropping packet from gstreamerVideoOutput")
 				}
 				log.Debugf("nodeReporterSRVideo.In FINISHED")
+			case packet := <-simulcastVideoOutput:
+				log.Debugf("nodeJitterBufferVideo.In START")
+				select {
+				case nodeJitterBufferVideo.In <- packet:
+				default:
+					log.Warnf("nodeJitterBufferVideo.In is full, dropping packet from simulcastVideoOutput")
+				}
+				log.Debugf("nodeJitterBufferVideo.In FINISHED")
+				select {
+				case nodeReporterSRVideo.InRTP <- packet:
+				default:
+					log.Warnf("nodeReporterSRVideo.In is full, dropping packet from simulcastVideoOutput")
+				}
 			case packet := <-nodeJitterBufferAudio.OutRTP:
 				log.Debugf("nodeUdpSink.InRTP START")
 				select {
@@ -455,11 +603,11 @@ func (w *WebRTCSession) serveWebRTCListener(ctx context.Context, codecOption Cod
 			case packet := <-nodeReporterSRVideo.Out:
 				log.Debugf("nodeReporterSRVideo.Out START")
 				// sending rtcp packet
-				if w.stunCtx == nil || w.stunCtx.RAddr == nil {
-					log.Warnf("cannot send RTCP SR, missing w.stunCtx.RAddr")
+				if stunCtx := w.getStunCtx(); stunCtx == nil || stunCtx.RAddr == nil {
+					log.Warnf("cannot send RTCP SR, missing w.getStunCtx().RAddr")
 				} else {
 					rtcpPacketSR := &RtpUdpPacket{
-						RAddr: w.stunCtx.RAddr,
+						RAddr: stunCtx.RAddr,
 						Data:  packet.Bytes(),
 					}
 					log.Infof("ReporterSR sending report SR %s", packet.String())
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"time"
 
 	plogger "github.com/heytribe/go-plogger"
 	"github.com/heytribe/live-webrtcsignaling/rtcp"
@@ -25,6 +27,7 @@ import (
  * Link node nodeSplitRTCPAV.audio => nodeRTCPAudio
  * nodeJitterBufferVideo.Out => decoder GSTREAMER => raw data
  * nodeJitterBufferAudio.Out => decoder GSTREAMER => raw data
+ * simulcast (SFU): nodeSplitRTPAV.video layer N => jittervideoN => listeners forwarders
  * Link node nodeSplitRTCPAV.audio => nodeReporterRRAudio.In
  * Link node nodeSplitRTCPAV.video => nodeReporterRRVideo.In
  */
@@ -39,7 +42,7 @@ import (
 * until DTLS & STUN are in their own object & goroutine
 * Adding them to pipeline output hooks is locking the MCU.
  */
-func (w *WebRTCSession) publisherStateManager(ctx context.Context, decoderAudioIn chan *srtp.PacketRTP, decoderVideoIn chan *srtp.PacketRTP, vSsrcId uint32, vPayloadType uint16, aSsrcId uint32, aPayloadType uint16, nodeSRTP *PipelineNodeSRTP) {
+func (w *WebRTCSession) publisherStateManager(ctx context.Context, decoderAudioIn chan *srtp.PacketRTP, decoderVideoIn chan *srtp.PacketRTP, nodeSRTP *PipelineNodeSRTP) {
 	var err error
 
 	log := plogger.FromContextSafe(ctx).Prefix("STATE-MANAGER").Tag("webrtcsession-publisher")
@@ -49,19 +52,22 @@ func (w *WebRTCSession) publisherStateManager(ctx context.Context, decoderAudioI
 		case <-ctx.Done():
 			log.Debugf("STATE MANAGER CTX DONE")
 			return
-		case stunState := <-w.stunCtx.ChState:
+		case stunState := <-w.getStunCtx().ChState:
 			log.Debugf("FOR LOOP stunState %v", stunState)
 			//
 			if stunState == StunStateCompleted {
 				log.Infof("Stun Session state is now completed for video(and/or audio)")
-				nodeVideo := w.p.Get("jittervideo").(*PipelineNodeJitterPublisher)
-				nodeVideo.SetRaddr(ctx, w.stunCtx.RAddr)
+				m := w.getPublisherMedia()
+				for _, nodeVideo := range m.jitterBufferVideoLayers {
+					nodeVideo.SetRaddr(ctx, w.getStunCtx().RAddr)
+				}
 				nodeAudio := w.p.Get("jitteraudio").(*PipelineNodeJitterPublisher)
-				nodeAudio.SetRaddr(ctx, w.stunCtx.RAddr)
+				nodeAudio.SetRaddr(ctx, w.getStunCtx().RAddr)
+				w.c.SetRAddr(w.getStunCtx().RAddr)
 				// create Decoder
 				log.Debugf("Creating a new session as publisher")
 				codec, _ := w.c.wsConn.getPublisherCodec(ctx)
-				w.c.gstSession, err = NewDecoder(ctx, codec, decoderAudioIn, decoderVideoIn, w.c, w.stunCtx.RAddr, vSsrcId, vPayloadType, aSsrcId, aPayloadType)
+				w.c.gstSession, err = NewDecoder(ctx, codec, decoderAudioIn, decoderVideoIn, w.c, w.getStunCtx().RAddr, m.video.ssrcId, m.video.payloadType, m.audio.ssrcId, m.audio.payloadType, w.roomMode)
 				if err != nil {
 					log.Errorf("could not create decoder: %#v", err)
 					return
@@ -78,9 +84,26 @@ func (w *WebRTCSession) publisherStateManager(ctx context.Context, decoderAudioI
 				<-w.c.gstSession.WebrtcUpCh
 				log.Infof("connection is up, sending WebRTC up event")
 				eventWebrtcUp(ctx, `publisher`, ``, w.c.wsConn.socketId)
+				// MCU: our video is a tile of the composition of the room,
+				// our audio is mixed for the other peers
+				if room := rooms.Get(ctx, w.c.wsConn.roomId); room != nil && w.roomMode == ModeMCU {
+					w.videoMixer, w.audioMixer, err = room.GetMixers(ctx)
+					if !log.OnError(err, "could not create the mixers of the room") {
+						w.videoMixer.AddPublisher(w.c.gstSession)
+						w.audioMixer.AddPublisher(w.c.gstSession)
+					}
+				}
 				log.Infof("connecting all listeners to %s", w.c.wsConn.socketId)
 				w.connectListeners(ctx, w.c.wsConn)
+				// last-N: our video might take a free place
+				if room := rooms.Get(ctx, w.c.wsConn.roomId); room != nil && !room.UpdateLastN(ctx, w.c.wsConn.roomId) {
+					room.SendLastN(ctx, w.c.wsConn.roomId, w.c.wsConn)
+				}
+			}
+			if stunState == StunStateRestarted {
+				w.iceRestarted(ctx)
 			}
+			w.consentStateChanged(ctx, stunState)
 		}
 	}
 }
@@ -121,12 +144,20 @@ func (w *WebRTCSession) publisherBusManager(ctx context.Context) {
 				log.Infof("PipelineMessageJitterSize size=%d", e.size)
 				nodeAudio := w.p.Get("jitteraudio").(*PipelineNodeJitterPublisher)
 				nodeAudio.SetJitterSize(e.size)
-			case *PipelineMessageInBps:
+			case *PipelineMessageRtxStats:
+				log.Debugf("PipelineMessageRtxStats ssrc=%d %#v", e.SSRC, e.RtxStats)
+				w.setRtxStats(e)
+			case *PipelineMessageBandwidthEstimate:
+				log.Infof("PipelineMessageBandwidthEstimate %s", e)
 				// saving bandwidth estimates
 				w.lastBandwidthEstimates = append(w.lastBandwidthEstimates, e.Bps)
 				if len(w.lastBandwidthEstimates) > 50 {
 					w.lastBandwidthEstimates = w.lastBandwidthEstimates[1:51]
 				}
+			case *PipelineMessageAudioLevel:
+				w.observeAudioLevel(ctx, e.Level)
+			case *PipelineMessageInBps:
+				// skip, the estimates come from the jitter buffer
 			case *PipelineMessageOutBps:
 				// skip.
 			default:
@@ -141,50 +172,308 @@ type RtpInfo struct {
 	payloadType    uint16
 	rtxPayloadType uint16
 	clockRate      uint32
+	fec            FecOptions
 }
 
-func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption CodecOptions) {
-	log := plogger.FromContextSafe(ctx).Prefix("PUBLISHER").Tag("webrtcsession-publisher")
-	ctx = plogger.NewContext(ctx, log)
+/*
+ * nodes of the publisher pipeline depending on the negotiated ssrcs &
+ * payload types, they are rebuilt when the publisher renegotiates.
+ */
+type publisherMediaNodes struct {
+	video             RtpInfo
+	audio             RtpInfo
+	rtxSsrcId         uint32
+	layers            []SimulcastLayer
+	splitRTPAV        *PipelineNodeSplitRTPAV
+	splitRTCPAV       *PipelineNodeSplitRTCPAV
+	jitterBufferVideo *PipelineNodeJitterPublisher
+	jitterBufferAudio *PipelineNodeJitterPublisher
+	// simulcast: one jitter buffer per layer, the first one is jitterBufferVideo
+	jitterBufferVideoLayers []*PipelineNodeJitterPublisher
+	reporterRRVideo         *PipelineNodeRTCPReporterRR
+	cancelReporterRRVideo   context.CancelFunc
+	ctx                     context.Context
+	cancel                  context.CancelFunc
+}
 
-	/*
-	 * Publisher pipeline
-	 */
-	var video RtpInfo
-	var audio RtpInfo
+// getPublisherMedia return the media nodes of the current negotiation
+func (w *WebRTCSession) getPublisherMedia() *publisherMediaNodes {
+	w.publisherMediaMutex.RLock()
+	defer w.publisherMediaMutex.RUnlock()
+	return w.publisherMedia
+}
+
+func (w *WebRTCSession) getPublisherRtpInfos(codecOption CodecOptions) (video RtpInfo, audio RtpInfo, rtxSsrcId uint32) {
+	offer, answer := w.sdpCtx.Negotiated()
 	switch codecOption {
 	case CodecVP8:
 		video = RtpInfo{
-			ssrcId:         w.sdpCtx.offer.GetVideoSSRC(),
-			payloadType:    w.sdpCtx.answer.GetVideoPayloadType("VP8"),
-			rtxPayloadType: w.sdpCtx.answer.GetRtxPayloadType("VP8"),
-			clockRate:      w.sdpCtx.offer.GetVideoClockRate("VP8"),
+			ssrcId:         offer.GetVideoSSRC(),
+			payloadType:    answer.GetVideoPayloadType("VP8"),
+			rtxPayloadType: answer.GetRtxPayloadType("VP8"),
+			clockRate:      offer.GetVideoClockRate("VP8"),
 		}
 	case CodecH264:
 		video = RtpInfo{
-			ssrcId:         w.sdpCtx.offer.GetVideoSSRC(),
-			payloadType:    w.sdpCtx.answer.GetVideoPayloadType("H264"),
-			rtxPayloadType: w.sdpCtx.answer.GetRtxPayloadType("H264"),
-			clockRate:      w.sdpCtx.offer.GetVideoClockRate("H264"),
+			ssrcId:         offer.GetVideoSSRC(),
+			payloadType:    answer.GetVideoPayloadType("H264"),
+			rtxPayloadType: answer.GetRtxPayloadType("H264"),
+			clockRate:      offer.GetVideoClockRate("H264"),
+		}
+	case CodecVP9:
+		video = RtpInfo{
+			ssrcId:         offer.GetVideoSSRC(),
+			payloadType:    answer.GetVideoPayloadType("VP9"),
+			rtxPayloadType: answer.GetRtxPayloadType("VP9"),
+			clockRate:      offer.GetVideoClockRate("VP9"),
 		}
 	}
 
+	video.fec = getFecOptions(answer)
+
 	audio = RtpInfo{
-		ssrcId:      w.sdpCtx.offer.GetAudioSSRC(),
-		payloadType: w.sdpCtx.offer.GetAudioPayloadType("opus"),
-		clockRate:   w.sdpCtx.offer.GetAudioClockRate("opus"),
+		ssrcId:      offer.GetAudioSSRC(),
+		payloadType: offer.GetAudioPayloadType("opus"),
+		clockRate:   offer.GetAudioClockRate("opus"),
+	}
+
+	rtxSsrcId = offer.GetRtxSSRC()
+
+	return
+}
+
+// getPublisherSimulcastLayers return the layers to forward, simulcast is
+// only used in SFU mode
+func (w *WebRTCSession) getPublisherSimulcastLayers() []SimulcastLayer {
+	if w.roomMode != ModeSFU {
+		return nil
+	}
+	offer, _ := w.sdpCtx.Negotiated()
+	return getSimulcastLayers(offer)
+}
+
+/*
+ * create & start the ssrc dependant nodes in the running publisher
+ * pipeline, they run with their own context to be stopped on renegotiation
+ */
+func (w *WebRTCSession) startPublisherMediaNodes(ctx context.Context, codecOption CodecOptions, video RtpInfo, audio RtpInfo, rtxSsrcId uint32, layers []SimulcastLayer) *publisherMediaNodes {
+	m := &publisherMediaNodes{
+		video:     video,
+		audio:     audio,
+		rtxSsrcId: rtxSsrcId,
+		layers:    layers,
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.ctx = ctx
+	offer, _ := w.sdpCtx.Negotiated()
+	videoSsrcIds := []uint32{video.ssrcId, rtxSsrcId}
+	for _, layer := range layers {
+		videoSsrcIds = append(videoSsrcIds, layer.ssrcId, layer.rtxSsrcId)
+	}
+	m.splitRTPAV = NewPipelineNodeSplitRTPAV([]uint32{audio.ssrcId}, []uint32{video.ssrcId, rtxSsrcId})
+	m.splitRTCPAV = NewPipelineNodeSplitRTCPAV([]uint32{audio.ssrcId}, videoSsrcIds)
+	m.jitterBufferVideo = NewPipelineNodeJitterPublisher(ctx, codecOption, w.roomMode, video.payloadType, video.rtxPayloadType, video.clockRate, video.ssrcId, rtxSsrcId, JitterStreamVideo, config.Bitrates.Video, w.getStunCtx().rtt)
+	m.jitterBufferVideo.SetFec(video.fec)
+	m.jitterBufferAudio = NewPipelineNodeJitterPublisher(ctx, CodecNone, w.roomMode, audio.payloadType, audio.rtxPayloadType, audio.clockRate, audio.ssrcId, 0, JitterStreamAudio, config.Bitrates.Audio, w.getStunCtx().rtt)
+	m.jitterBufferVideoLayers = []*PipelineNodeJitterPublisher{m.jitterBufferVideo}
+	if len(layers) > 1 {
+		m.splitRTPAV.SetVideoLayers(layers,
+			offer.GetVideoExtmapId(extmapRtpStreamId),
+			offer.GetVideoExtmapId(extmapRepairedRtpStreamId))
+		for i := 1; i < len(layers); i++ {
+			jitter := NewPipelineNodeJitterPublisher(ctx, codecOption, w.roomMode, video.payloadType, video.rtxPayloadType, video.clockRate, layers[i].ssrcId, layers[i].rtxSsrcId, JitterStreamVideo, config.Bitrates.Video, w.getStunCtx().rtt)
+			jitter.SetSimulcastLayer(m.jitterBufferVideo)
+			jitter.SetFec(video.fec)
+			m.jitterBufferVideoLayers = append(m.jitterBufferVideoLayers, jitter)
+		}
+	}
+
+	if twccExtensionId := transportWideCCExtensionId(offer); twccExtensionId != 0 {
+		twcc := NewTransportWideCC()
+		m.jitterBufferAudio.SetTransportWideCC(twcc, twccExtensionId, false)
+		for i, jitter := range m.jitterBufferVideoLayers {
+			jitter.SetTransportWideCC(twcc, twccExtensionId, i == 0)
+		}
+	}
+
+	if audioLevelExtensionId := offer.GetExtmapId("audio", extmapAudioLevel); audioLevelExtensionId != 0 {
+		m.jitterBufferAudio.SetAudioLevel(audioLevelExtensionId)
+	}
+
+	w.p.Replace(ctx, "splitrtpav", m.splitRTPAV)
+	w.p.Replace(ctx, "splitrtcpav", m.splitRTCPAV)
+	w.p.Replace(ctx, "jitteraudio", m.jitterBufferAudio)
+	for i, jitter := range m.jitterBufferVideoLayers {
+		w.p.Replace(ctx, simulcastJitterName(i), jitter)
+		if i > 0 {
+			go w.runPublisherSimulcastLayer(ctx, i, m.splitRTPAV.OutPacketRTPVideoLayers[i], jitter)
+		}
+	}
+	w.startPublisherReporterRRVideo(m, video.ssrcId)
+	w.simulcast.SetLayers(len(m.jitterBufferVideoLayers))
+	w.publisherMediaMutex.Lock()
+	w.publisherMedia = m
+	w.publisherMediaMutex.Unlock()
+
+	return m
+}
+
+// startPublisherReporterRRVideo (re)start the RR reporter of the first
+// video layer, with rid simulcast the ssrc is only known once received
+func (w *WebRTCSession) startPublisherReporterRRVideo(m *publisherMediaNodes, ssrcId uint32) {
+	var ctx context.Context
+
+	if m.cancelReporterRRVideo != nil {
+		m.cancelReporterRRVideo()
+	}
+	ctx, m.cancelReporterRRVideo = context.WithCancel(m.ctx)
+	m.reporterRRVideo = NewPipelineNodeRTCPReporterRR(ssrcId, m.video.clockRate)
+	w.p.Replace(ctx, "reporterRRVideo", m.reporterRRVideo)
+}
+
+/*
+ * link the nodes of a simulcast layer > 0: split => jitter buffer =>
+ * listeners forwarders. The first layer is linked by the pipeline loop,
+ * with the gstreamer decoder.
+ */
+func (w *WebRTCSession) runPublisherSimulcastLayer(ctx context.Context, layer int, in chan *srtp.PacketRTP, jitter *PipelineNodeJitterPublisher) {
+	log := plogger.FromContextSafe(ctx).Prefix(fmt.Sprintf("LAYER%d", layer))
+	nodeUDPSink := w.p.Get("udpsink").(*PipelineNodeUDPSink)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-in:
+			select {
+			case jitter.In <- packet:
+			default:
+				log.Warnf("jitter.In is full, dropping packet from splitRTPAV.OutPacketRTPVideoLayers")
+			}
+		case packet := <-jitter.Out:
+			w.simulcast.Forward(layer, packet)
+		case packet := <-jitter.OutRTCP:
+			select {
+			case nodeUDPSink.InRTCP <- packet:
+			default:
+				log.Warnf("nodeUDPSink.InRTCP is full, dropping packet from jitter.OutRTCP")
+			}
+		}
 	}
+}
 
-	rtx := struct {
-		ssrcId uint32
-	}{w.sdpCtx.offer.GetRtxSSRC()}
+/*
+ * a rid simulcast ssrc has been received for the first time, the jitter
+ * buffer of the layer now knows the ssrc to send NACKs & PLIs.
+ */
+func (w *WebRTCSession) simulcastSSRCLearned(ctx context.Context, m *publisherMediaNodes, learned SimulcastLayerSSRC) {
+	log := plogger.FromContextSafe(ctx)
+	log.Infof("simulcast: layer %d (rid %s) ssrc %d rtx %t", learned.layer, m.layers[learned.layer].rid, learned.ssrcId, learned.rtx)
+	select {
+	case m.splitRTCPAV.InVideoSSRC <- learned.ssrcId:
+	default:
+		log.Warnf("m.splitRTCPAV.InVideoSSRC is full, dropping ssrc %d", learned.ssrcId)
+	}
+	if learned.rtx {
+		m.jitterBufferVideoLayers[learned.layer].SetRtxSSRC(learned.ssrcId)
+		return
+	}
+	m.jitterBufferVideoLayers[learned.layer].SetSSRC(learned.ssrcId)
+	if learned.layer == 0 {
+		w.startPublisherReporterRRVideo(m, learned.ssrcId)
+	}
+	// listeners waiting for this layer need a key frame
+	m.jitterBufferVideoLayers[learned.layer].SendPLI()
+}
 
-	if video.ssrcId == 0 || audio.ssrcId == 0 {
+// observeAudioLevel rank our level in the room, the room is notified of a
+// new active speaker & of the levels
+func (w *WebRTCSession) observeAudioLevel(ctx context.Context, level uint8) {
+	wsConn := w.c.wsConn
+	room := rooms.Get(ctx, wsConn.roomId)
+	if room == nil {
+		return
+	}
+	active, levels := room.speakers.Observe(wsConn.socketId, wsConn.userId, level, time.Now())
+	if active != nil {
+		eventActiveSpeaker(ctx, wsConn.roomId, *active)
+		room.UpdateLastN(ctx, wsConn.roomId)
+	}
+	if levels != nil {
+		eventAudioLevels(ctx, wsConn.roomId, levels)
+	}
+}
+
+// setRtxStats save the last stats of each video ssrc
+func (w *WebRTCSession) setRtxStats(stats *PipelineMessageRtxStats) {
+	rtxStats := []*PipelineMessageRtxStats{stats}
+	for _, s := range w.rtxStats {
+		if s.SSRC != stats.SSRC {
+			rtxStats = append(rtxStats, s)
+		}
+	}
+	w.rtxStats = rtxStats
+}
+
+// sendSimulcastPLI request a key frame on a layer, for the listeners forwarders
+func (w *WebRTCSession) sendSimulcastPLI(layer int) {
+	node, ok := w.p.Get(simulcastJitterName(layer)).(*PipelineNodeJitterPublisher)
+	if ok {
+		node.SendPLI()
+	}
+}
+
+/*
+ * called from the pipeline goroutine once a new offer has been answered,
+ * UDP, DTLS & SRTP are kept, only the ssrc dependant nodes are rebuilt.
+ */
+func (w *WebRTCSession) renegotiatePublisherMediaNodes(ctx context.Context, codecOption CodecOptions, m *publisherMediaNodes) *publisherMediaNodes {
+	log, _ := plogger.FromContext(ctx)
+
+	video, audio, rtxSsrcId := w.getPublisherRtpInfos(codecOption)
+	layers := w.getPublisherSimulcastLayers()
+	if (video.ssrcId == 0 && len(layers) == 0) || audio.ssrcId == 0 {
+		log.Errorf("renegotiation: missing ssrc %d %d, keeping the current pipeline", video.ssrcId, audio.ssrcId)
+		return m
+	}
+	if video == m.video && audio == m.audio && rtxSsrcId == m.rtxSsrcId && reflect.DeepEqual(layers, m.layers) {
+		log.Infof("renegotiation: ssrcs & payload types are unchanged")
+		return m
+	}
+	log.Infof("renegotiation: rebuilding pipeline video %#v audio %#v rtx ssrc %d simulcast %#v", video, audio, rtxSsrcId, layers)
+	m.cancel()
+	m = w.startPublisherMediaNodes(ctx, codecOption, video, audio, rtxSsrcId, layers)
+	if w.getStunCtx().RAddr != nil {
+		for _, jitter := range m.jitterBufferVideoLayers {
+			jitter.SetRaddr(ctx, w.getStunCtx().RAddr)
+		}
+		m.jitterBufferAudio.SetRaddr(ctx, w.getStunCtx().RAddr)
+	}
+	if w.c.gstSession != nil {
+		w.c.gstSession.SetDecoderPayloadTypes(ctx, video.payloadType, audio.payloadType)
+	}
+	// the decoder needs a key frame of the new stream
+	m.jitterBufferVideo.SendPLI()
+
+	return m
+}
+
+func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption CodecOptions) {
+	log := plogger.FromContextSafe(ctx).Prefix("PUBLISHER").Tag("webrtcsession-publisher")
+	ctx = plogger.NewContext(ctx, log)
+
+	/*
+	 * Publisher pipeline
+	 */
+	video, audio, rtxSsrcId := w.getPublisherRtpInfos(codecOption)
+	layers := w.getPublisherSimulcastLayers()
+
+	// rid simulcast: the video ssrcs are learned from the stream
+	if (video.ssrcId == 0 && len(layers) == 0) || audio.ssrcId == 0 {
 		log.Errorf("missing ssrc %d %d", video.ssrcId, audio.ssrcId)
 		return
 	}
 
-	if rtx.ssrcId == 0 {
+	if rtxSsrcId == 0 {
 		log.Infof("missing rtx ssrcId")
 	}
 
@@ -192,31 +481,23 @@ func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption Co
 	nodeUDP := NewPipelineNodeUDP(w.udpConn)
 	nodeDemux := NewPipelineNodeDemux()
 	nodeSRTP := NewPipelineNodeSRTP()
-	nodeSplitRTPAV := NewPipelineNodeSplitRTPAV([]uint32{audio.ssrcId}, []uint32{video.ssrcId, rtx.ssrcId})
 	nodeSanitizerAudio := NewPipelineNodeSanitizer()
 	nodeSanitizerVideo := NewPipelineNodeSanitizer()
-	nodeSplitRTCPAV := NewPipelineNodeSplitRTCPAV([]uint32{audio.ssrcId}, []uint32{video.ssrcId, rtx.ssrcId})
-	nodeJitterBufferVideo := NewPipelineNodeJitterPublisher(ctx, codecOption, video.payloadType, video.rtxPayloadType, video.clockRate, video.ssrcId, 0, JitterStreamVideo, config.Bitrates.Video, w.stunCtx.rtt)
-	nodeJitterBufferAudio := NewPipelineNodeJitterPublisher(ctx, CodecNone, audio.payloadType, audio.rtxPayloadType, audio.clockRate, audio.ssrcId, 0, JitterStreamAudio, config.Bitrates.Audio, w.stunCtx.rtt)
 	nodeRTCPAudio := NewPipelineNodeRTCP()
 	nodeRTCPVideo := NewPipelineNodeRTCP()
-	nodeReporterRRVideo := NewPipelineNodeRTCPReporterRR(video.ssrcId, video.clockRate)
 	nodeUDPSink := NewPipelineNodeUDPSink(w.c)
 
 	w.p.Register("udp", nodeUDP)
 	w.p.Register("demux", nodeDemux)
 	w.p.Register("srtp", nodeSRTP)
-	w.p.Register("splitrtpav", nodeSplitRTPAV)
 	w.p.Register("sanitizerAudio", nodeSanitizerAudio)
 	w.p.Register("sanitizerVideo", nodeSanitizerVideo)
-	w.p.Register("splitrtcpav", nodeSplitRTCPAV)
-	w.p.Register("jitteraudio", nodeJitterBufferAudio)
-	w.p.Register("jittervideo", nodeJitterBufferVideo)
 	w.p.Register("rtcpaudio", nodeRTCPAudio)
 	w.p.Register("rtcpvideo", nodeRTCPVideo)
-	w.p.Register("reporterRRVideo", nodeReporterRRVideo)
 	w.p.Register("udpsink", nodeUDPSink)
 	w.p.Run(ctx)
+	w.simulcast = NewSimulcastPublisher(codecOption, w.sendSimulcastPLI)
+	m := w.startPublisherMediaNodes(ctx, codecOption, video, audio, rtxSsrcId, layers)
 
 	// FIXME: push encoder into a pipeline node
 	var decoderAudioIn chan *srtp.PacketRTP
@@ -227,7 +508,7 @@ func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption Co
 	log = log.Prefix("Pipeline")
 	ctx = plogger.NewContext(ctx, log)
 
-	go w.publisherStateManager(ctx, decoderAudioIn, decoderVideoIn, video.ssrcId, video.payloadType, audio.ssrcId, audio.payloadType, nodeSRTP)
+	go w.publisherStateManager(ctx, decoderAudioIn, decoderVideoIn, nodeSRTP)
 	go w.publisherBusManager(ctx)
 
 	/*
@@ -245,6 +526,10 @@ func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption Co
 		case <-ctx.Done():
 			log.Debugf("CTX DONE")
 			exit = true
+		case <-w.renegotiated:
+			m = w.renegotiatePublisherMediaNodes(ctx, codecOption, m)
+		case learned := <-m.splitRTPAV.OutLearnedSSRC:
+			w.simulcastSSRCLearned(ctx, m, learned)
 		case packet := <-nodeUDP.Out:
 			log.Debugf("nodeDemux.In START")
 			select {
@@ -262,121 +547,124 @@ func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption Co
 			}
 			log.Debugf("nodeSRTP.In FINISHED")
 		case packet := <-nodeSRTP.OutPacketRTP:
-			log.Debugf("nodeSplitRTPAV.In START")
+			log.Debugf("m.splitRTPAV.In START")
 			select {
-			case nodeSplitRTPAV.In <- packet:
+			case m.splitRTPAV.In <- packet:
 			default:
-				log.Warnf("nodeSplitRTPAV.In is full, dropping packet from nodeSRTP.OutPacketRTP")
+				log.Warnf("m.splitRTPAV.In is full, dropping packet from nodeSRTP.OutPacketRTP")
 			}
-			log.Debugf("nodeSplitRTPAV.In FINISHED")
+			log.Debugf("m.splitRTPAV.In FINISHED")
 		case packet := <-nodeSRTP.OutPacketRTCP:
 			log.Debugf("nodeSplitRTCPAV START")
 			select {
-			case nodeSplitRTCPAV.In <- packet:
+			case m.splitRTCPAV.In <- packet:
 			default:
-				log.Warnf("nodeSplitRTCPAV.In is full, dropping packet from nodeSRTP.OutPacketRTP")
+				log.Warnf("m.splitRTCPAV.In is full, dropping packet from nodeSRTP.OutPacketRTP")
 			}
 			log.Debugf("nodeSplitRTCPAV FINISHED")
-		case packet := <-nodeSplitRTPAV.OutPacketRTPAudio:
+		case packet := <-m.splitRTPAV.OutPacketRTPAudio:
 			log.Debugf("nodeSanitizerAudio start")
 			select {
 			case nodeSanitizerAudio.In <- packet:
 			default:
-				log.Warnf("nodeSanitizerAudio.In is full, dropping packet from nodeSplitRTPAV.OutPacketRTPAudio")
+				log.Warnf("nodeSanitizerAudio.In is full, dropping packet from m.splitRTPAV.OutPacketRTPAudio")
 			}
 			log.Debugf("nodeSanitizerAudio finished")
 		case packet := <-nodeSanitizerAudio.Out:
 			log.Debugf("nodeJitterBufferAudio start")
 			select {
-			case nodeJitterBufferAudio.In <- packet:
+			case m.jitterBufferAudio.In <- packet:
 			default:
-				log.Warnf("nodeJitterBufferAudio.In is full, dropping packet from nodeSanitizerAudio.Out")
+				log.Warnf("m.jitterBufferAudio.In is full, dropping packet from nodeSanitizerAudio.Out")
 			}
 			log.Debugf("nodeJitterBufferAudio finished")
-		case packet := <-nodeSplitRTPAV.OutPacketRTPVideo:
+		case packet := <-m.splitRTPAV.OutPacketRTPVideo:
 			log.Debugf("nodeSanitizerVideo start")
 			select {
 			case nodeSanitizerVideo.In <- packet:
 			default:
-				log.Warnf("nodeSanitizerVideo.In is full, dropping packet from nodeSplitRTPAV.OutPacketRTPVideo")
+				log.Warnf("nodeSanitizerVideo.In is full, dropping packet from m.splitRTPAV.OutPacketRTPVideo")
 			}
 			log.Debugf("nodeSanitizerVideo finished")
 		case packet := <-nodeSanitizerVideo.Out:
 			log.Debugf("nodeJitterBufferVideo start")
 			select {
-			case nodeJitterBufferVideo.In <- packet:
+			case m.jitterBufferVideo.In <- packet:
 			default:
-				log.Warnf("nodeJitterBufferVideo.In is full, dropping packet from nodeSanitizerVideo.Out")
+				log.Warnf("m.jitterBufferVideo.In is full, dropping packet from nodeSanitizerVideo.Out")
 			}
 			log.Debugf("nodeJitterBufferVideo finished")
-		case packet := <-nodeSplitRTCPAV.OutPacketRTCPAudio:
+		case packet := <-m.splitRTCPAV.OutPacketRTCPAudio:
 			log.Debugf("nodeRTCPAudio start")
 			select {
 			case nodeRTCPAudio.In <- packet:
 			default:
-				log.Warnf("nodeRTCPAudio.In is full, dropping packet from nodeSplitRTCPAV.OutPacketRTPAudio")
+				log.Warnf("nodeRTCPAudio.In is full, dropping packet from m.splitRTCPAV.OutPacketRTPAudio")
 			}
 			log.Debugf("nodeRTCPAudio finished")
-		case packet := <-nodeSplitRTCPAV.OutPacketRTCPVideo:
+		case packet := <-m.splitRTCPAV.OutPacketRTCPVideo:
 			log.Debugf("nodeRTCPVideo start")
 			select {
 			case nodeRTCPVideo.In <- packet:
 			default:
-				log.Warnf("nodeRTCPVideo.In is full, dropping packet from nodeSplitRTPAV.OutPacketRTPVideo")
+				log.Warnf("nodeRTCPVideo.In is full, dropping packet from m.splitRTPAV.OutPacketRTPVideo")
 			}
 			log.Debugf("nodeRTCPVideo finished")
-			log.Debugf("nodeReporterRRVideo.InRTCP start")
+			log.Debugf("m.reporterRRVideo.InRTCP start")
 			select {
-			case nodeReporterRRVideo.InRTCP <- packet:
+			case m.reporterRRVideo.InRTCP <- packet:
 			default:
-				log.Warnf("nodeReporterRRVideo.InRTCP is full, dropping packet from nodeJitterBufferVideo.Out")
+				log.Warnf("m.reporterRRVideo.InRTCP is full, dropping packet from m.jitterBufferVideo.Out")
 			}
-			log.Debugf("nodeReporterRRVideo.InRTCP finished")
-		case packet := <-nodeJitterBufferAudio.Out:
+			log.Debugf("m.reporterRRVideo.InRTCP finished")
+		case packet := <-m.jitterBufferAudio.Out:
 			log.Debugf("decoderAudioIn start")
 			select {
 			case decoderAudioIn <- packet:
 			default:
-				log.Warnf("decoderAudioIn is full, dropping packet from nodeJitterBufferAudio.Out")
+				log.Warnf("decoderAudioIn is full, dropping packet from m.jitterBufferAudio.Out")
 			}
 			log.Debugf("decoderAudioIn finished")
-		case packet := <-nodeJitterBufferVideo.Out:
+		case packet := <-m.jitterBufferVideo.Out:
 			log.Debugf("decoderVideoIn start")
-			select {
-			case decoderVideoIn <- packet:
-			default:
-				log.Warnf("decoderVideoIn is full, dropping packet from nodeJitterBufferVideo.Out")
+			if !isFecSeqPlaceholder(packet) {
+				select {
+				case decoderVideoIn <- packet:
+				default:
+					log.Warnf("decoderVideoIn is full, dropping packet from m.jitterBufferVideo.Out")
+				}
 			}
 			log.Debugf("decoderVideoIn finished")
-			log.Debugf("nodeReporterRRVideo.InRTP start")
+			w.simulcast.Forward(0, packet)
+			log.Debugf("m.reporterRRVideo.InRTP start")
 			select {
-			case nodeReporterRRVideo.InRTP <- packet:
+			case m.reporterRRVideo.InRTP <- packet:
 			default:
-				log.Warnf("nodeReporterRRVideo.InRTP is full, dropping packet from nodeJitterBufferVideo.Out")
+				log.Warnf("m.reporterRRVideo.InRTP is full, dropping packet from m.jitterBufferVideo.Out")
 			}
-			log.Debugf("nodeReporterRRVideo.InRTP finished")
-		case rctpRR := <-nodeReporterRRVideo.Out:
-			log.Debugf("nodeReporterRRVideo.Out start")
+			log.Debugf("m.reporterRRVideo.InRTP finished")
+		case rctpRR := <-m.reporterRRVideo.Out:
+			log.Debugf("m.reporterRRVideo.Out start")
 			w.c.writeSrtpRtcpTo(ctx, &RtpUdpPacket{
-				RAddr: w.stunCtx.RAddr,
+				RAddr: w.getStunCtx().RAddr,
 				Data:  rctpRR.Bytes(),
 			})
 			log.Infof("ReporterRR Video sending report RR %s", rctpRR.String())
-			log.Debugf("nodeReporterRRVideo.Out finished")
-		case packet := <-nodeJitterBufferAudio.OutRTCP:
+			log.Debugf("m.reporterRRVideo.Out finished")
+		case packet := <-m.jitterBufferAudio.OutRTCP:
 			log.Debugf("nodeUDPSink.InRTCP start")
 			select {
 			case nodeUDPSink.InRTCP <- packet:
 			default:
-				log.Warnf("nodeUDPSink.InRTCP is full, dropping packet from nodeJitterBufferAudio.OutRTCP")
+				log.Warnf("nodeUDPSink.InRTCP is full, dropping packet from m.jitterBufferAudio.OutRTCP")
 			}
 			log.Debugf("nodeUDPSink.InRTCP finished")
-		case packet := <-nodeJitterBufferVideo.OutRTCP:
+		case packet := <-m.jitterBufferVideo.OutRTCP:
 			log.Debugf("nodeUDPSink.InRTCP start")
 			select {
 			case nodeUDPSink.InRTCP <- packet:
 			default:
-				log.Warnf("nodeUDPSink.InRTCP is full, dropping packet from nodeJitterBufferVideo.OutRTCP")
+				log.Warnf("nodeUDPSink.InRTCP is full, dropping packet from m.jitterBufferVideo.OutRTCP")
 			}
 			log.Debugf("nodeUDPSink.InRTCP finished")
 		/*
@@ -384,10 +672,11 @@ func (w *WebRTCSession) serveWebRTCPublisher(ctx context.Context, codecOption Co
 		 */
 		case packetSTUN := <-nodeDemux.OutPacketSTUN:
 			log.Debugf("packetSTUN START")
-			if w.stunCtx == nil {
+			stunCtx := w.getStunCtx()
+			if stunCtx == nil {
 				log.Errorf("[ UDP ] could not found stun session for local address %s", w.c.conn.LocalAddr().String())
 			} else {
-				if err := w.stunCtx.handleStunMessage(ctx, w.c, packetSTUN); err != nil {
+				if err := stunCtx.handleStunMessage(ctx, w.c, packetSTUN); err != nil {
 					rAddr := packetSTUN.GetRAddr()
 					log.Errorf("could not handle STUN message for %s:%d : %s", rAddr.IP, rAddr.Port, err.Error())
 					log.Errorf("dropping STUN packet silentely")
@@ -18,6 +18,7 @@ import (
 	"github.com/heytribe/live-webrtcsignaling/dtls"
 	"github.com/heytribe/live-webrtcsignaling/gst"
 	"github.com/heytribe/live-webrtcsignaling/my"
+	"github.com/heytribe/live-webrtcsignaling/srtp"
 
 	_ "net/http/pprof"
 )
@@ -28,7 +29,7 @@ var hub *Hub
 var rmq liverabbitmq.Rmq
 var udpStats net.Conn
 var stunTransactions *StunTransactionsMap
-var dtlsCtx *dtls.Ctx
+var udpMux *UdpMux // nil: one UDP socket per session
 var gWsId uint64 = 0
 var upgrader = websocket.Upgrader{
 	CheckOrigin:     checkWsOrigin,
@@ -112,6 +113,23 @@ func serveApi(w http.ResponseWriter, r *http.Request) {
 	c.joinMutex.Unlock(ctx)
 }
 
+// rotateDtlsCertificate generate a new DTLS certificate every period,
+// running sessions keep the one of their offer/answer
+func rotateDtlsCertificate(ctx context.Context, period time.Duration) {
+	log := plogger.FromContextSafe(ctx).Prefix("DTLS")
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := dtls.Rotate()
+			log.OnError(err, "could not rotate the DTLS certificate")
+		}
+	}
+}
+
 func main() {
 	var err error
 
@@ -140,14 +158,29 @@ func main() {
 	features = NewFeatures()
 
 	// init features
-	features.Register(ctx, "forcecodec", "VP8")      // val=VP8,H264
+	features.Register(ctx, "forcecodec", "VP8")      // val=VP8,VP9,H264
 	features.Register(ctx, "facedetect", "false") // val=true,false
 
 	// Initialize DTLS package
-	dtlsCtx, err = dtls.Init(config.Cert.FilePath, config.Cert.KeyFilePath)
+	srtpProfiles, err := dtls.FilterSrtpProfiles(config.Dtls.SrtpProfiles, func(profile dtls.SrtpProfile) bool {
+		return srtp.Profile(profile).Supported()
+	})
+	if log.OnError(err, "invalid env SRTP_PROFILES") {
+		os.Exit(1)
+	}
+	_, err = dtls.Init(srtpProfiles)
 	if log.OnError(err, "could not initialize OpenSSL in DTLS mode") {
 		os.Exit(1)
 	}
+	go rotateDtlsCertificate(ctx, config.Cert.DtlsRotationPeriod)
+	// Shared UDP socket
+	if config.Network.UdpMuxPort != 0 {
+		udpMux, err = NewUdpMux(ctx, config.Network.UdpMuxPort)
+		if log.OnError(err, "could not listen on shared UDP port %d", config.Network.UdpMuxPort) {
+			os.Exit(1)
+		}
+		go udpMux.run(ctx)
+	}
 	// Opening statsd connection
 	raddr, err := net.ResolveUDPAddr("udp", config.GraphiteIPV4+":8125")
 	log.OnError(err, "could not resolve UDP address")
@@ -217,7 +250,7 @@ hub.socketIds.Data: %#v
 
 stunTransactions.Data: %#v
 `,
-			config, udpStats, dtlsCtx, rooms.Data, hub.socketIds.Data, stunTransactions.Data)
+			config, udpStats, dtls.Current(), rooms.Data, hub.socketIds.Data, stunTransactions.Data)
 	})
 
 	http.HandleFunc("/state", httpStateController)